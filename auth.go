@@ -0,0 +1,213 @@
+package lungo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
+)
+
+// privilege describes a class of actions that is granted by roles.
+type privilege int
+
+const (
+	// commands that may be run without authentication
+	privNone privilege = iota
+
+	// commands that may be run by any authenticated user
+	privAuthenticated
+
+	// reading documents
+	privRead
+
+	// listing and inspecting namespaces
+	privList
+
+	// writing documents
+	privWrite
+
+	// creating and dropping collections and indexes
+	privSchema
+
+	// validating and dropping databases
+	privAdmin
+
+	// managing users and the server
+	privRoot
+)
+
+// the privileges granted by the built-in roles
+var rolePrivileges = map[string][]privilege{
+	"read":      {privRead, privList},
+	"readWrite": {privRead, privList, privWrite, privSchema},
+	"dbAdmin":   {privList, privSchema, privAdmin},
+}
+
+// the privileges required by commands, unlisted commands require root
+var commandPrivileges = map[string]privilege{
+	"hello":            privNone,
+	"isMaster":         privNone,
+	"ismaster":         privNone,
+	"buildInfo":        privNone,
+	"buildinfo":        privNone,
+	"ping":             privNone,
+	"listCommands":     privNone,
+	"connectionStatus": privNone,
+	"listDatabases":    privAuthenticated,
+	"find":             privRead,
+	"getMore":          privRead,
+	"killCursors":      privRead,
+	"count":            privRead,
+	"distinct":         privRead,
+	"aggregate":        privRead,
+	"listCollections":  privList,
+	"listIndexes":      privList,
+	"collStats":        privList,
+	"dbStats":          privList,
+	"insert":           privWrite,
+	"update":           privWrite,
+	"delete":           privWrite,
+	"findAndModify":    privWrite,
+	"findandmodify":    privWrite,
+	"create":           privSchema,
+	"drop":             privSchema,
+	"createIndexes":    privSchema,
+	"dropIndexes":      privSchema,
+	"deleteIndexes":    privSchema,
+	"renameCollection": privSchema,
+	"validate":         privAdmin,
+	"dropDatabase":     privAdmin,
+}
+
+// validateRole will check whether the role exists and may be granted on the
+// database.
+func validateRole(role Role) error {
+	// check root
+	if role.Role == "root" {
+		if role.DB != "admin" {
+			return fmt.Errorf("role root may only be granted on the admin database")
+		}
+		return nil
+	}
+
+	// check other roles
+	if rolePrivileges[role.Role] == nil {
+		return fmt.Errorf("role %s@%s does not exist", role.Role, role.DB)
+	}
+
+	return nil
+}
+
+// granted returns whether the user has been granted the privilege on the
+// database.
+func granted(user *User, db string, priv privilege) bool {
+	// check none and authenticated
+	if priv == privNone {
+		return true
+	} else if user == nil {
+		return false
+	} else if priv == privAuthenticated {
+		return true
+	}
+
+	// check roles
+	for _, role := range user.Roles {
+		if role.Role == "root" && role.DB == "admin" {
+			return true
+		} else if role.DB != db {
+			continue
+		}
+		for _, p := range rolePrivileges[role.Role] {
+			if p == priv {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authorize will check whether the context may run the specified command.
+func (c *CommandContext) authorize(name string, cmd bsonkit.Doc) error {
+	// skip if not enforced
+	if !c.Authorize {
+		return nil
+	}
+
+	// get privilege
+	priv, ok := commandPrivileges[name]
+	if !ok {
+		priv = privRoot
+	}
+
+	// get collection
+	coll, _ := (*cmd)[0].Value.(string)
+	if name == "getMore" {
+		coll, _ = bsonkit.Get(cmd, "collection").(string)
+	}
+
+	// collect required privileges
+	type requirement struct {
+		db   string
+		coll string
+		priv privilege
+	}
+	required := []requirement{{c.Database, coll, priv}}
+	switch name {
+	case "aggregate":
+		// cluster wide change streams require root
+		pipeline, _ := getList(cmd, "pipeline")
+		if len(pipeline) > 0 && len(*pipeline[0]) > 0 && (*pipeline[0])[0].Key == "$changeStream" {
+			if cluster, _ := bsonkit.Get(pipeline[0], "$changeStream.allChangesForCluster").(bool); cluster {
+				required = append(required, requirement{Users[0], "", privRoot})
+			}
+		}
+
+		// pipelines may read and write collections of other databases
+		for _, ref := range mongokit.References(pipeline) {
+			db := ref.DB
+			if db == "" {
+				db = c.Database
+			}
+			if ref.Write {
+				required = append(required, requirement{db, ref.Coll, privWrite})
+			} else {
+				required = append(required, requirement{db, ref.Coll, privRead})
+			}
+		}
+	case "renameCollection":
+		// renames require privileges on the source and target namespace
+		from, _ := bsonkit.Get(cmd, "renameCollection").(string)
+		to, _ := bsonkit.Get(cmd, "to").(string)
+		fromDB, fromColl, _ := strings.Cut(from, ".")
+		toDB, toColl, _ := strings.Cut(to, ".")
+		required = []requirement{
+			{fromDB, fromColl, privSchema},
+			{toDB, toColl, privSchema},
+		}
+	case "dropDatabase":
+		// dropping the admin database removes all users
+		if c.Database == Users[0] {
+			required[0].priv = privRoot
+		}
+	}
+
+	// check privileges
+	for _, req := range required {
+		// system namespaces may only be accessed by root
+		if strings.HasPrefix(req.coll, "system.") {
+			req.priv = privRoot
+		}
+
+		// check privilege
+		if !granted(c.User, req.db, req.priv) {
+			if c.User == nil {
+				return fmt.Errorf("%w: command %s requires authentication", ErrUnauthorized, name)
+			}
+			return fmt.Errorf("%w: not authorized on %s to execute command %s", ErrUnauthorized, req.db, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,302 @@
+package bsonkit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MarshalExtJSON will encode the document as canonical or relaxed Extended
+// JSON. The canonical mode preserves all types while the relaxed mode encodes
+// numbers as plain JSON numbers that may decode to a different integer type.
+func MarshalExtJSON(doc Doc, canonical bool) ([]byte, error) {
+	// handle nil
+	if doc == nil {
+		doc = NewDoc()
+	}
+
+	return bson.MarshalExtJSON(*doc, canonical, false)
+}
+
+// MarshalExtJSONValue will encode the value as canonical or relaxed Extended
+// JSON.
+func MarshalExtJSONValue(value interface{}, canonical bool) ([]byte, error) {
+	// encode wrapped value
+	buf, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, canonical, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// unwrap value
+	buf = bytes.TrimPrefix(buf, []byte(`{"v":`))
+	buf = bytes.TrimSuffix(buf, []byte(`}`))
+
+	return buf, nil
+}
+
+// UnmarshalExtJSON will decode a canonical or relaxed Extended JSON document.
+// The order of the fields is preserved and plain JSON numbers decode to an
+// int32, int64 or float64 depending on their size and format.
+func UnmarshalExtJSON(data []byte) (Doc, error) {
+	// decode document
+	var doc bson.D
+	err := bson.UnmarshalExtJSON(data, false, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// ensure document
+	if doc == nil {
+		doc = bson.D{}
+	}
+
+	return &doc, nil
+}
+
+// UnmarshalExtJSONValue will decode a canonical or relaxed Extended JSON
+// document, array or value.
+func UnmarshalExtJSONValue(data []byte) (interface{}, error) {
+	// decode wrapped value
+	doc, err := UnmarshalExtJSON(append(append([]byte(`{"v":`), data...), '}'))
+	if err != nil {
+		return nil, err
+	} else if len(*doc) != 1 {
+		return nil, fmt.Errorf("invalid value")
+	}
+
+	return (*doc)[0].Value, nil
+}
+
+// ExtJSONError is returned by the ExtJSONReader if the stream contains invalid
+// Extended JSON.
+type ExtJSONError struct {
+	Line int
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ExtJSONError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *ExtJSONError) Unwrap() error {
+	return e.Err
+}
+
+// ExtJSONReader reads Extended JSON documents from a stream. The stream may
+// either contain a single array of documents or a sequence of documents that
+// are separated by whitespace e.g. one document per line.
+type ExtJSONReader struct {
+	reader      *bufio.Reader
+	started     bool
+	array       bool
+	done        bool
+	line        int
+	start       int
+	failed      []byte
+	complete    bool
+	recoverable bool
+}
+
+// NewExtJSONReader creates and returns a new reader.
+func NewExtJSONReader(r io.Reader) *ExtJSONReader {
+	return &ExtJSONReader{
+		reader: bufio.NewReader(r),
+		line:   1,
+	}
+}
+
+// Next will read and return the next document. It returns io.EOF when the
+// stream has been read completely.
+func (r *ExtJSONReader) Next() (Doc, error) {
+	// check state
+	if r.done {
+		return nil, io.EOF
+	}
+
+	// reset failure
+	r.failed = nil
+	r.recoverable = false
+
+	// get next character
+	c, err := r.skip()
+	if errors.Is(err, io.EOF) && r.array {
+		return nil, r.errorf("unexpected end of input")
+	} else if errors.Is(err, io.EOF) {
+		r.done = true
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	// detect array
+	if !r.started {
+		r.started = true
+		if c == '[' {
+			r.array = true
+			c, err = r.skip()
+			if errors.Is(err, io.EOF) {
+				return nil, r.errorf("unexpected end of input")
+			} else if err != nil {
+				return nil, err
+			}
+			if c == ']' {
+				return nil, r.finish()
+			}
+			return r.document(c)
+		}
+	}
+
+	// handle separator or end of array
+	if r.array {
+		if c == ']' {
+			return nil, r.finish()
+		} else if c != ',' {
+			return nil, r.errorf("expected ',' or ']', got %q", c)
+		}
+		c, err = r.skip()
+		if errors.Is(err, io.EOF) {
+			return nil, r.errorf("unexpected end of input")
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return r.document(c)
+}
+
+// Line returns the line on which the last returned document started.
+func (r *ExtJSONReader) Line() int {
+	return r.start
+}
+
+// Skip will skip the invalid document reported by the last call to Next so
+// that reading can continue with the next document. Incomplete documents are
+// skipped to the end of the line on which they started. It returns false if
+// reading cannot continue e.g. if the error occurred within an array.
+func (r *ExtJSONReader) Skip() bool {
+	// check state
+	if !r.recoverable {
+		return false
+	}
+	r.recoverable = false
+
+	// complete documents have already been consumed
+	if r.complete {
+		return true
+	}
+
+	// continue after the first line of the consumed input
+	if i := bytes.IndexByte(r.failed, '\n'); i >= 0 {
+		r.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(r.failed[i+1:]), r.reader))
+		r.line = r.start + 1
+		return true
+	}
+
+	// otherwise, skip the remainder of the line
+	for {
+		c, err := r.reader.ReadByte()
+		if err != nil {
+			return true
+		} else if c == '\n' {
+			r.line++
+			return true
+		}
+	}
+}
+
+func (r *ExtJSONReader) document(c byte) (Doc, error) {
+	// check start
+	r.start = r.line
+	if c != '{' {
+		r.fail([]byte{c}, false)
+		return nil, r.errorf("expected document, got %q", c)
+	}
+
+	// read until the matching brace
+	buf := []byte{c}
+	depth := 1
+	str := false
+	escaped := false
+	for depth > 0 {
+		c, err := r.reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			r.fail(buf, false)
+			return nil, &ExtJSONError{Line: r.start, Err: errors.New("unexpected end of input")}
+		} else if err != nil {
+			return nil, err
+		}
+		buf = append(buf, c)
+		switch {
+		case c == '\n':
+			r.line++
+		case escaped:
+			escaped = false
+		case str && c == '\\':
+			escaped = true
+		case c == '"':
+			str = !str
+		case !str && (c == '{' || c == '['):
+			depth++
+		case !str && (c == '}' || c == ']'):
+			depth--
+		}
+	}
+
+	// decode document
+	doc, err := UnmarshalExtJSON(buf)
+	if err != nil {
+		r.fail(nil, true)
+		return nil, &ExtJSONError{Line: r.start, Err: err}
+	}
+
+	return doc, nil
+}
+
+// finish will ensure that only whitespace follows the end of the array.
+func (r *ExtJSONReader) finish() error {
+	// check remainder
+	c, err := r.skip()
+	if errors.Is(err, io.EOF) {
+		r.done = true
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+
+	return r.errorf("unexpected %q after end of array", c)
+}
+
+// skip will skip whitespace and return the next character.
+func (r *ExtJSONReader) skip() (byte, error) {
+	for {
+		c, err := r.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case '\n':
+			r.line++
+		case ' ', '\t', '\r':
+		default:
+			return c, nil
+		}
+	}
+}
+
+// fail will remember the consumed input of an invalid document. Documents
+// within an array cannot be skipped.
+func (r *ExtJSONReader) fail(consumed []byte, complete bool) {
+	r.failed = consumed
+	r.complete = complete
+	r.recoverable = !r.array
+}
+
+func (r *ExtJSONReader) errorf(format string, args ...interface{}) error {
+	return &ExtJSONError{Line: r.line, Err: fmt.Errorf(format, args...)}
+}
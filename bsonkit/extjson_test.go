@@ -0,0 +1,208 @@
+package bsonkit
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExtJSON(t *testing.T) {
+	id := primitive.NewObjectID()
+	dec, err := primitive.ParseDecimal128("1.5")
+	assert.NoError(t, err)
+
+	doc := &bson.D{
+		{Key: "z", Value: int32(1)},
+		{Key: "a", Value: int64(2)},
+		{Key: "m", Value: 3.0},
+		{Key: "big", Value: int64(math.MaxInt64)},
+		{Key: "id", Value: id},
+		{Key: "dec", Value: dec},
+		{Key: "date", Value: primitive.DateTime(1577934245000)},
+		{Key: "ts", Value: primitive.Timestamp{T: 1, I: 2}},
+		{Key: "re", Value: primitive.Regex{Pattern: "a+", Options: "i"}},
+		{Key: "bin", Value: primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}},
+		{Key: "null", Value: nil},
+		{Key: "sub", Value: bson.D{
+			{Key: "y", Value: "x"},
+			{Key: "b", Value: bson.A{int32(1), "2", bson.D{{Key: "c", Value: true}}}},
+		}},
+	}
+
+	buf, err := MarshalExtJSON(doc, true)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), `{"z":{"$numberInt":"1"},"a":{"$numberLong":"2"},"m":{"$numberDouble":"3.0"}`))
+
+	res, err := UnmarshalExtJSON(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, doc, res)
+
+	buf, err = MarshalExtJSON(doc, false)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), `{"z":1,"a":2,"m":3.0,"big":9223372036854775807`))
+
+	res, err = UnmarshalExtJSON(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), Get(res, "a"))
+	assert.Equal(t, 3.0, Get(res, "m"))
+	assert.Equal(t, int64(math.MaxInt64), Get(res, "big"))
+	Put(res, "a", int64(2), false)
+	assert.Equal(t, doc, res)
+
+	buf, err = MarshalExtJSON(nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(buf))
+
+	res, err = UnmarshalExtJSON([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &bson.D{}, res)
+
+	res, err = UnmarshalExtJSON([]byte(`[1]`))
+	assert.Error(t, err)
+	assert.Nil(t, res)
+}
+
+func TestExtJSONValue(t *testing.T) {
+	for _, item := range []struct {
+		value     interface{}
+		canonical string
+		relaxed   string
+	}{
+		{
+			value:     int32(1),
+			canonical: `{"$numberInt":"1"}`,
+			relaxed:   `1`,
+		},
+		{
+			value:     "foo",
+			canonical: `"foo"`,
+			relaxed:   `"foo"`,
+		},
+		{
+			value:     bson.A{int64(1), nil},
+			canonical: `[{"$numberLong":"1"},null]`,
+			relaxed:   `[1,null]`,
+		},
+		{
+			value:     bson.D{{Key: "a", Value: 1.5}},
+			canonical: `{"a":{"$numberDouble":"1.5"}}`,
+			relaxed:   `{"a":1.5}`,
+		},
+	} {
+		buf, err := MarshalExtJSONValue(item.value, true)
+		assert.NoError(t, err)
+		assert.Equal(t, item.canonical, string(buf))
+
+		buf, err = MarshalExtJSONValue(item.value, false)
+		assert.NoError(t, err)
+		assert.Equal(t, item.relaxed, string(buf))
+
+		value, err := UnmarshalExtJSONValue([]byte(item.canonical))
+		assert.NoError(t, err)
+		assert.Equal(t, item.value, value)
+	}
+
+	_, err := UnmarshalExtJSONValue([]byte(`1, "x": 2`))
+	assert.Error(t, err)
+
+	_, err = UnmarshalExtJSONValue([]byte(`{`))
+	assert.Error(t, err)
+}
+
+func TestExtJSONReader(t *testing.T) {
+	read := func(input string) ([]interface{}, []int, error) {
+		reader := NewExtJSONReader(strings.NewReader(input))
+		var values []interface{}
+		var lines []int
+		for {
+			doc, err := reader.Next()
+			if err == io.EOF {
+				return values, lines, nil
+			} else if err != nil {
+				return values, lines, err
+			}
+			values = append(values, Get(doc, "a"))
+			lines = append(lines, reader.Line())
+		}
+	}
+
+	values, lines, err := read("")
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	values, lines, err = read("{\"a\":1}\n\n{\"a\": \"}{\\\"\"}\r\n  {\"a\":{\"$numberLong\":\"3\"}}{\"a\":\n[4]}\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int32(1), "}{\"", int64(3), bson.A{int32(4)}}, values)
+	assert.Equal(t, []int{1, 3, 4, 4}, lines)
+
+	values, lines, err = read(" [\n{\"a\":1},\n  {\"a\":{\"b\":[]}}\n]\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int32(1), bson.D{{Key: "b", Value: bson.A{}}}}, values)
+	assert.Equal(t, []int{2, 3}, lines)
+
+	values, _, err = read("[]")
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	values, _, err = read("{\"a\":1}\n{\"a\":2")
+	assert.EqualError(t, err, "line 2: unexpected end of input")
+	assert.Equal(t, []interface{}{int32(1)}, values)
+
+	values, _, err = read("{\"a\":1}\n\n[1]")
+	assert.EqualError(t, err, "line 3: expected document, got '['")
+	assert.Equal(t, []interface{}{int32(1)}, values)
+
+	_, _, err = read("[{\"a\":1}\n{\"a\":2}]")
+	assert.EqualError(t, err, "line 2: expected ',' or ']', got '{'")
+
+	_, _, err = read("[{\"a\":1},")
+	assert.EqualError(t, err, "line 1: unexpected end of input")
+
+	_, _, err = read("[{\"a\":1}] {}")
+	assert.EqualError(t, err, "line 1: unexpected '{' after end of array")
+
+	_, _, err = read("{\"a\":1}\n{\"a\":x}")
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "line 2: "))
+
+	var jsonErr *ExtJSONError
+	assert.True(t, errors.As(err, &jsonErr))
+	assert.Equal(t, 2, jsonErr.Line)
+}
+
+func TestExtJSONReaderSkip(t *testing.T) {
+	reader := NewExtJSONReader(strings.NewReader("{\"a\":1}\n{\"a\":x}\nfoo {\"a\":2}\n{\"a\":3,\n{\"a\":\n4}\n{\"a\":5"))
+
+	var values []interface{}
+	var failed []int
+	for {
+		doc, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			var jsonErr *ExtJSONError
+			assert.True(t, errors.As(err, &jsonErr))
+			assert.True(t, reader.Skip())
+			assert.False(t, reader.Skip())
+			failed = append(failed, jsonErr.Line)
+			continue
+		}
+		values = append(values, Get(doc, "a"))
+	}
+	assert.Equal(t, []interface{}{int32(1), int32(4)}, values)
+	assert.Equal(t, []int{2, 3, 4, 7}, failed)
+
+	reader = NewExtJSONReader(strings.NewReader("[{\"a\":1},\n{\"a\":x}, {\"a\":2}]"))
+	_, err := reader.Next()
+	assert.NoError(t, err)
+	_, err = reader.Next()
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "line 2: "))
+	assert.False(t, reader.Skip())
+}
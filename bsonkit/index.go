@@ -1,6 +1,7 @@
 package bsonkit
 
 import (
+	"fmt"
 	"unsafe"
 
 	"github.com/tidwall/btree"
@@ -148,6 +149,101 @@ func (i *Index) List() List {
 	return list
 }
 
+// Lookup will return all documents whose value for the first column equals
+// the specified value. The documents are returned in index order.
+func (i *Index) Lookup(value interface{}) List {
+	// prepare list and dedup set
+	seen := map[Doc]struct{}{}
+	var list List
+
+	// prepare visitor
+	visit := func(e indexEntry) bool {
+		if Compare(e.keys[0], value) == 0 {
+			if _, ok := seen[e.doc]; !ok {
+				seen[e.doc] = struct{}{}
+				list = append(list, e.doc)
+			}
+		}
+		return true
+	}
+
+	// scan the whole index if a later column is reversed as the null probe
+	// would not sort before the matching entries
+	for _, col := range i.columns[1:] {
+		if col.Reverse {
+			i.btree.Scan(visit)
+			return list
+		}
+	}
+
+	// probe ascending from the smallest entry with the specified value (null
+	// sorts first and the nil document has the lowest identity)
+	probe := indexEntry{keys: make([]interface{}, len(i.columns))}
+	probe.keys[0] = value
+	i.btree.Ascend(probe, func(e indexEntry) bool {
+		if Compare(e.keys[0], value) != 0 {
+			return false
+		}
+		return visit(e)
+	})
+
+	return list
+}
+
+// Validate will verify that the entries of the index match the current keys of
+// the indexed documents and, for unique indexes, that no two documents share
+// the same key.
+func (i *Index) Validate() error {
+	// collect entries
+	entries := map[Doc]int{}
+	var prev *indexEntry
+	var err error
+	i.btree.Scan(func(e indexEntry) bool {
+		// count entry
+		entries[e.doc]++
+
+		// check uniqueness
+		if i.unique && prev != nil && prev.doc != e.doc {
+			equal := true
+			for j := range i.columns {
+				if Compare(prev.keys[j], e.keys[j]) != 0 {
+					equal = false
+					break
+				}
+			}
+			if equal {
+				err = fmt.Errorf("duplicate key %v", e.keys)
+				return false
+			}
+		}
+		prev = &e
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// check entries
+	for doc, num := range entries {
+		// check tuples
+		var keys int
+		for _, t := range i.tuples(doc) {
+			if _, ok := i.btree.Get(indexEntry{keys: t, doc: doc}); !ok {
+				return fmt.Errorf("missing entry for key %v", t)
+			}
+			keys++
+		}
+
+		// check count (equal array elements share an entry)
+		if num > keys {
+			return fmt.Errorf("document has %d entries but %d keys", num, keys)
+		}
+	}
+
+	return nil
+}
+
 // Clone will clone the index. Mutating the new index will not mutate the original
 // index.
 func (i *Index) Clone() *Index {
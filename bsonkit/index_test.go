@@ -385,3 +385,39 @@ func TestIndexMultiKeyUnique(t *testing.T) {
 	ok = index.Add(d2)
 	assert.True(t, ok)
 }
+
+func TestIndexLookup(t *testing.T) {
+	d1 := MustConvert(bson.M{"a": int32(1), "b": "x"})
+	d2 := MustConvert(bson.M{"a": 1.0, "b": "y"})
+	d3 := MustConvert(bson.M{"a": bson.A{int32(1), int32(2)}, "b": "z"})
+	d4 := MustConvert(bson.M{"b": "w"})
+	d5 := MustConvert(bson.M{"a": nil, "b": "v"})
+
+	for _, columns := range [][]Column{
+		{{Path: "a"}},
+		{{Path: "a"}, {Path: "b"}},
+		{{Path: "a", Reverse: true}, {Path: "b", Reverse: true}},
+	} {
+		index := NewIndex(false, columns)
+		assert.True(t, index.Build(List{d1, d2, d3, d4, d5}))
+
+		assert.ElementsMatch(t, List{d1, d2, d3}, index.Lookup(int64(1)))
+		assert.Equal(t, List{d3}, index.Lookup(int32(2)))
+		assert.ElementsMatch(t, List{d4, d5}, index.Lookup(nil))
+		assert.Empty(t, index.Lookup("1"))
+	}
+}
+
+func TestIndexValidate(t *testing.T) {
+	d1 := MustConvert(bson.M{"a": "1"})
+	d2 := MustConvert(bson.M{"a": bson.A{"2", "3", "3"}})
+
+	index := NewIndex(true, []Column{
+		{Path: "a"},
+	})
+	assert.True(t, index.Build(List{d1, d2}))
+	assert.NoError(t, index.Validate())
+
+	*d1 = bson.D{{Key: "a", Value: "3"}}
+	assert.Error(t, index.Validate())
+}
@@ -1,5 +1,7 @@
 package bsonkit
 
+import "fmt"
+
 // Set is set of unique documents. The set is not safe from concurrent access.
 type Set struct {
 	List  List
@@ -100,3 +102,26 @@ func (s *Set) Clone() *Set {
 
 	return clone
 }
+
+// Validate will verify that the list and index of the set are consistent.
+func (s *Set) Validate() error {
+	// check length
+	if len(s.List) != len(s.Index) {
+		return fmt.Errorf("list has %d documents but index has %d", len(s.List), len(s.Index))
+	}
+
+	// check positions
+	for i, doc := range s.List {
+		if doc == nil {
+			return fmt.Errorf("document at position %d is nil", i)
+		}
+		index, ok := s.Index[doc]
+		if !ok {
+			return fmt.Errorf("document at position %d is missing from index", i)
+		} else if index != i {
+			return fmt.Errorf("document at position %d is indexed at position %d", i, index)
+		}
+	}
+
+	return nil
+}
@@ -125,3 +125,17 @@ func TestSetReplace(t *testing.T) {
 		},
 	}, set)
 }
+
+func TestSetValidate(t *testing.T) {
+	d1 := &bson.D{}
+	d2 := &bson.D{}
+
+	set := NewSet(List{d1, d2})
+	assert.NoError(t, set.Validate())
+
+	set.Index[d2] = 0
+	assert.Error(t, set.Validate())
+
+	delete(set.Index, d2)
+	assert.Error(t, set.Validate())
+}
@@ -38,3 +38,17 @@ func Now() primitive.Timestamp {
 		I: tsCounter,
 	}
 }
+
+// Advance will ensure that timestamps generated by Now are ordered after the
+// specified timestamp.
+func Advance(ts primitive.Timestamp) {
+	// acquire mutex
+	tsMutex.Lock()
+	defer tsMutex.Unlock()
+
+	// advance clock
+	if ts.T > tsSeconds || (ts.T == tsSeconds && ts.I > tsCounter) {
+		tsSeconds = ts.T
+		tsCounter = ts.I
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestGenerate(t *testing.T) {
@@ -13,3 +14,15 @@ func TestGenerate(t *testing.T) {
 	assert.Equal(t, ts1.T, ts1.T)
 	assert.Equal(t, ts2.I, ts1.I+1)
 }
+
+func TestAdvance(t *testing.T) {
+	ts1 := Now()
+
+	Advance(primitive.Timestamp{T: ts1.T, I: ts1.I + 10})
+	ts2 := Now()
+	assert.Equal(t, primitive.Timestamp{T: ts1.T, I: ts1.I + 11}, ts2)
+
+	Advance(ts1)
+	ts3 := Now()
+	assert.Equal(t, primitive.Timestamp{T: ts2.T, I: ts2.I + 1}, ts3)
+}
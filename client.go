@@ -151,9 +151,7 @@ func (c *Client) StartSession(opts ...*options.SessionOptions) (ISession, error)
 		"DefaultMaxCommitTime":  ignored,
 	})
 
-	return &Session{
-		engine: c.engine,
-	}, nil
+	return newSession(c.engine), nil
 }
 
 // Timeout implements the IClient.Timeout method.
@@ -178,9 +176,7 @@ func (c *Client) UseSessionWithOptions(ctx context.Context, opt *options.Session
 	})
 
 	// create session
-	session := &Session{
-		engine: c.engine,
-	}
+	session := newSession(c.engine)
 
 	// ensure ending
 	defer session.EndSession(nil)
@@ -222,11 +218,6 @@ func (c *Client) Watch(_ context.Context, pipeline interface{}, opts ...*options
 		return nil, err
 	}
 
-	// reject non-empty pipelines
-	if len(filter) > 0 {
-		panic("lungo: change stream pipelines are not supported")
-	}
-
 	// get resume after
 	var resumeAfter bsonkit.Doc
 	if opt.ResumeAfter != nil {
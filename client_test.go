@@ -77,5 +77,6 @@ func TestClientListDatabasesAndNames(t *testing.T) {
 			},
 			TotalSize: res.TotalSize,
 		}, res)
+		assert.True(t, res.Databases[0].SizeOnDisk > 0)
 	})
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register admin commands
+	commands["stats"] = command{
+		usage: "<file>",
+		help:  "Print the size of the file and the statistics of all namespaces.",
+		run:   runStats,
+	}
+	commands["ls"] = command{
+		usage: "<file> [db[.coll]]",
+		help:  "List the databases, the collections of a database or the indexes of a collection.",
+		run:   runList,
+	}
+	commands["compact"] = command{
+		usage: "[flags] <file>",
+		help:  "Remove expired documents and oplog events and rewrite the file.",
+		run:   runCompact,
+	}
+	commands["validate"] = command{
+		usage: "[flags] <file> [db.coll]",
+		help:  "Validate all or the specified namespace and print the reports.",
+		run:   runValidate,
+	}
+	commands["oplog"] = command{
+		usage: "tail [flags] <file>",
+		help:  "Print the latest oplog events and optionally follow the file.",
+		run:   runOplog,
+	}
+}
+
+func runStats(env *env, args []string) error {
+	// parse flags
+	args, err := env.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	// get file size
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	// open database
+	_, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// print file size
+	_, err = fmt.Fprintf(env.stdout, "file: %s (%d bytes)\n\n", args[0], info.Size())
+	if err != nil {
+		return err
+	}
+
+	// print namespaces
+	w := tabwriter.NewWriter(env.stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAMESPACE\tDOCUMENTS\tSIZE\tINDEXES\tINDEX SIZE")
+	for _, handle := range namespaces(engine) {
+		namespace := engine.Catalog().Namespaces[handle]
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", handle.String(), len(namespace.Documents.List),
+			namespace.Size(), len(namespace.Indexes), namespace.IndexSize())
+	}
+
+	return w.Flush()
+}
+
+func runList(env *env, args []string) error {
+	// parse flags
+	args, err := env.parse(args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// list databases
+	if len(args) == 1 {
+		names, err := client.ListDatabaseNames(env.ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(env.stdout, lines(names))
+		return err
+	}
+
+	// list collections
+	if !strings.Contains(args[1], ".") {
+		names, err := client.Database(args[1]).ListCollectionNames(env.ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(env.stdout, lines(names))
+		return err
+	}
+
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// check collection
+	if engine.Catalog().Namespaces[handle] == nil {
+		return fmt.Errorf("ns not found: %s", handle.String())
+	}
+
+	// list indexes
+	csr, err := collection(client, handle).Indexes().List(env.ctx)
+	if err != nil {
+		return err
+	}
+	var specs []bson.D
+	err = csr.All(env.ctx, &specs)
+	if err != nil {
+		return err
+	}
+
+	// print indexes
+	for _, spec := range specs {
+		err = env.print(spec, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runCompact(env *env, args []string) error {
+	// parse flags
+	oplogFlag := env.flags.Bool("oplog", true, "remove all oplog events")
+	args, err := env.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	// get size
+	before, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	// open database
+	_, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// count documents and events
+	documents, events := count(engine.Catalog())
+
+	// begin transaction
+	txn, err := engine.Begin(env.ctx, true)
+	if err != nil {
+		return err
+	}
+	defer engine.Abort(txn)
+
+	// remove expired documents
+	err = txn.Expire()
+	if err != nil {
+		return err
+	}
+
+	// remove oplog events
+	if *oplogFlag {
+		txn.Clean(0, 0, 0, 0)
+	}
+
+	// commit transaction
+	err = engine.Commit(txn)
+	if err != nil {
+		return err
+	}
+
+	// get size
+	after, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	// get removed
+	remainingDocuments, remainingEvents := count(engine.Catalog())
+
+	// print result
+	_, err = fmt.Fprintf(env.stdout, "removed %d expired documents and %d oplog events, size %d -> %d bytes\n",
+		documents-remainingDocuments, events-remainingEvents, before.Size(), after.Size())
+
+	return err
+}
+
+func runValidate(env *env, args []string) error {
+	// parse flags
+	fullFlag := env.flags.Bool("full", false, "verify documents, index keys and sizes")
+	args, err := env.parse(args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	// check file
+	_, err = os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	// read file without building the catalog to report all violations
+	file, err := lungo.NewFileStore(args[0], 0666).ReadFile()
+	if err != nil {
+		return err
+	}
+
+	// get handles
+	var handles []lungo.Handle
+	if len(args) > 1 {
+		handle, err := parseNamespace(args[1])
+		if err != nil {
+			return err
+		}
+		handles = []lungo.Handle{handle}
+	} else {
+		for name := range file.Namespaces {
+			handle, err := parseNamespace(name)
+			if err != nil {
+				return err
+			}
+			handles = append(handles, handle)
+		}
+		sort.Slice(handles, func(i, j int) bool {
+			return handles[i].String() < handles[j].String()
+		})
+	}
+
+	// validate namespaces
+	var invalid []string
+	for _, handle := range handles {
+		res, err := file.Validate(handle, *fullFlag)
+		if err != nil {
+			return err
+		}
+		if valid, _ := bsonkit.Get(res, "valid").(bool); !valid {
+			invalid = append(invalid, handle.String())
+		}
+		err = env.print(*res, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check result
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid namespaces: %s", strings.Join(invalid, ", "))
+	}
+
+	return nil
+}
+
+func runOplog(env *env, args []string) error {
+	// define flags
+	numFlag := env.flags.Int("n", 10, "the number of events to print (all if negative)")
+	followFlag := env.flags.Bool("f", false, "follow the file and print new events")
+	intervalFlag := env.flags.Duration("interval", time.Second, "the interval to check the file when following")
+
+	// check subcommand
+	if len(args) == 0 || args[0] != "tail" {
+		return errUsage
+	}
+
+	// parse flags
+	args, err := env.parse(args[1:], 1, 1)
+	if err != nil {
+		return err
+	}
+
+	// check file
+	_, err = os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	// prepare store
+	store := lungo.NewFileStore(args[0], 0666)
+
+	// load catalog
+	catalog, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	// print latest events
+	events := catalog.Namespaces[lungo.Oplog].Documents.List
+	if *numFlag >= 0 && len(events) > *numFlag {
+		events = events[len(events)-*numFlag:]
+	}
+	for _, event := range events {
+		err = env.print(*event, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check follow
+	if !*followFlag {
+		return nil
+	}
+
+	// get last timestamp
+	var last interface{}
+	if list := catalog.Namespaces[lungo.Oplog].Documents.List; len(list) > 0 {
+		last = bsonkit.Get(list[len(list)-1], "clusterTime")
+	}
+
+	// get modification time
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	modified := info.ModTime()
+
+	// poll file
+	ticker := time.NewTicker(*intervalFlag)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-env.ctx.Done():
+			return nil
+		}
+
+		// check modification time
+		info, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		} else if info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		// load catalog
+		catalog, err := store.Load()
+		if err != nil {
+			return err
+		}
+
+		// print new events
+		for _, event := range catalog.Namespaces[lungo.Oplog].Documents.List {
+			ts := bsonkit.Get(event, "clusterTime")
+			if bsonkit.Compare(ts, last) <= 0 {
+				continue
+			}
+			last = ts
+			err = env.print(*event, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// count will return the number of documents and oplog events in the catalog.
+func count(catalog *lungo.Catalog) (int, int) {
+	var documents int
+	for handle, namespace := range catalog.Namespaces {
+		if handle != lungo.Oplog {
+			documents += len(namespace.Documents.List)
+		}
+	}
+
+	return documents, len(catalog.Namespaces[lungo.Oplog].Documents.List)
+}
+
+// lines will join the strings with newlines.
+func lines(list []string) string {
+	var str string
+	for _, item := range list {
+		str += item + "\n"
+	}
+	return str
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register data commands
+	commands["find"] = command{
+		usage: "[flags] <file> <db.coll> [filter]",
+		help:  "Print the documents matching the filter as Extended JSON.",
+		run:   runFind,
+	}
+	commands["count"] = command{
+		usage: "<file> <db.coll> [filter]",
+		help:  "Print the number of documents matching the filter.",
+		run:   runCount,
+	}
+	commands["insert"] = command{
+		usage: "<file> <db.coll> [doc...]",
+		help:  "Insert the documents from the arguments or JSON lines on stdin.",
+		run:   runInsert,
+	}
+	commands["update"] = command{
+		usage: "[flags] <file> <db.coll> <filter> <update>",
+		help:  "Update the documents matching the filter.",
+		run:   runUpdate,
+	}
+	commands["delete"] = command{
+		usage: "[flags] <file> <db.coll> <filter>",
+		help:  "Delete the documents matching the filter.",
+		run:   runDelete,
+	}
+	commands["export"] = command{
+		usage: "[flags] <file> <db.coll> [filter]",
+		help:  "Export the documents matching the filter as JSON lines or CSV.",
+		run:   runExport,
+	}
+	commands["import"] = command{
+		usage: "[flags] <file> <db.coll> [input]",
+		help:  "Import documents from a JSON, CSV or TSV file or stdin.",
+		run:   runImport,
+	}
+}
+
+func runFind(env *env, args []string) error {
+	// parse flags
+	sortFlag := env.flags.String("sort", "", "the sort document")
+	projFlag := env.flags.String("projection", "", "the projection document")
+	skipFlag := env.flags.Int64("skip", 0, "the number of documents to skip")
+	limitFlag := env.flags.Int64("limit", 0, "the maximum number of documents")
+	canonicalFlag := env.flags.Bool("canonical", false, "print canonical Extended JSON")
+	args, err := env.parse(args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	// prepare options
+	opts := options.Find().SetSkip(*skipFlag).SetLimit(*limitFlag)
+	if *sortFlag != "" {
+		sort, err := parseDoc(*sortFlag)
+		if err != nil {
+			return err
+		}
+		opts.SetSort(sort)
+	}
+	if *projFlag != "" {
+		projection, err := parseDoc(*projFlag)
+		if err != nil {
+			return err
+		}
+		opts.SetProjection(projection)
+	}
+
+	return find(env, args, opts, func(doc bson.D) error {
+		return env.print(doc, *canonicalFlag)
+	})
+}
+
+func runCount(env *env, args []string) error {
+	// parse flags
+	args, err := env.parse(args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// get filter
+	filter, err := parseDoc(optional(args, 2))
+	if err != nil {
+		return err
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// count documents
+	count, err := collection(client, handle).CountDocuments(env.ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	// print count
+	_, err = fmt.Fprintf(env.stdout, "%d\n", count)
+
+	return err
+}
+
+func runInsert(env *env, args []string) error {
+	// parse flags
+	args, err := env.parse(args, 2, -1)
+	if err != nil {
+		return err
+	}
+
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// collect documents
+	var docs []interface{}
+	if len(args) > 2 {
+		for _, arg := range args[2:] {
+			doc, err := parseDoc(arg)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+		}
+	} else {
+		docs, err = readLines(env.stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check documents
+	if len(docs) == 0 {
+		return fmt.Errorf("no documents to insert")
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// insert documents
+	res, err := collection(client, handle).InsertMany(env.ctx, docs)
+	if err != nil {
+		return err
+	}
+
+	return env.print(bson.D{
+		{Key: "inserted", Value: len(res.InsertedIDs)},
+	}, false)
+}
+
+func runUpdate(env *env, args []string) error {
+	// parse flags
+	multiFlag := env.flags.Bool("multi", false, "update all matching documents")
+	upsertFlag := env.flags.Bool("upsert", false, "insert a document if none matches")
+	args, err := env.parse(args, 4, 4)
+	if err != nil {
+		return err
+	}
+
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// get filter
+	filter, err := parseDoc(args[2])
+	if err != nil {
+		return err
+	}
+
+	// get update
+	update, err := parseJSON(args[3])
+	if err != nil {
+		return err
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// update documents
+	coll := collection(client, handle)
+	opts := options.Update().SetUpsert(*upsertFlag)
+	if *multiFlag {
+		res, err := coll.UpdateMany(env.ctx, filter, update, opts)
+		if err != nil {
+			return err
+		}
+		return printUpdate(env, res.MatchedCount, res.ModifiedCount, res.UpsertedID)
+	}
+	res, err := coll.UpdateOne(env.ctx, filter, update, opts)
+	if err != nil {
+		return err
+	}
+
+	return printUpdate(env, res.MatchedCount, res.ModifiedCount, res.UpsertedID)
+}
+
+func runDelete(env *env, args []string) error {
+	// parse flags
+	multiFlag := env.flags.Bool("multi", false, "delete all matching documents")
+	args, err := env.parse(args, 3, 3)
+	if err != nil {
+		return err
+	}
+
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// get filter
+	filter, err := parseDoc(args[2])
+	if err != nil {
+		return err
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// delete documents
+	coll := collection(client, handle)
+	var deleted int64
+	if *multiFlag {
+		res, err := coll.DeleteMany(env.ctx, filter)
+		if err != nil {
+			return err
+		}
+		deleted = res.DeletedCount
+	} else {
+		res, err := coll.DeleteOne(env.ctx, filter)
+		if err != nil {
+			return err
+		}
+		deleted = res.DeletedCount
+	}
+
+	return env.print(bson.D{
+		{Key: "deleted", Value: deleted},
+	}, false)
+}
+
+func runExport(env *env, args []string) error {
+	// parse flags
+	formatFlag := env.flags.String("format", "json", "the output format (json or csv)")
+	fieldsFlag := env.flags.String("fields", "", "the comma separated fields (required for csv)")
+	outFlag := env.flags.String("out", "", "the output file (stdout if empty)")
+	canonicalFlag := env.flags.Bool("canonical", false, "write canonical Extended JSON")
+	args, err := env.parse(args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	// get fields
+	var fields []string
+	if *fieldsFlag != "" {
+		fields = strings.Split(*fieldsFlag, ",")
+	}
+
+	// check format
+	switch *formatFlag {
+	case "json":
+	case "csv":
+		if len(fields) == 0 {
+			return fmt.Errorf("export: csv format requires fields")
+		}
+	default:
+		return fmt.Errorf("export: unsupported format %q", *formatFlag)
+	}
+
+	// prepare options
+	opts := options.Find()
+	if len(fields) > 0 {
+		projection := bson.D{}
+		for _, field := range fields {
+			projection = append(projection, bson.E{Key: field, Value: 1})
+		}
+		opts.SetProjection(projection)
+	}
+
+	// open output
+	if *outFlag != "" {
+		file, err := os.Create(*outFlag)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		env.stdout = file
+	}
+
+	// export json
+	if *formatFlag == "json" {
+		return find(env, args, opts, func(doc bson.D) error {
+			return env.print(doc, *canonicalFlag)
+		})
+	}
+
+	// write header
+	writer := csv.NewWriter(env.stdout)
+	err = writer.Write(fields)
+	if err != nil {
+		return err
+	}
+
+	// write records
+	record := make([]string, len(fields))
+	err = find(env, args, opts, func(doc bson.D) error {
+		for i, field := range fields {
+			record[i], err = formatCSV(bsonkit.Get(&doc, field))
+			if err != nil {
+				return err
+			}
+		}
+		return writer.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	// flush writer
+	writer.Flush()
+
+	return writer.Error()
+}
+
+func runImport(env *env, args []string) error {
+	// parse flags
+	typeFlag := env.flags.String("type", "json", "the input format (json, csv or tsv)")
+	fieldsFlag := env.flags.String("fields", "", "the comma separated fields (header row if empty)")
+	typesFlag := env.flags.Bool("columnsHaveTypes", false, "the fields specify their types e.g. age.int32()")
+	blanksFlag := env.flags.Bool("ignoreBlanks", false, "omit empty csv and tsv values")
+	modeFlag := env.flags.String("mode", "insert", "the write mode (insert, upsert, merge or delete)")
+	upsertFlag := env.flags.String("upsertFields", "", "the comma separated fields to match documents (_id if empty)")
+	batchFlag := env.flags.Int("batchSize", 0, "the number of documents per batch")
+	stopFlag := env.flags.Bool("stopOnError", false, "stop at the first failed line")
+	args, err := env.parse(args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// prepare options
+	opts := lungo.ImportOptions{
+		Format:           lungo.ImportFormat(*typeFlag),
+		ColumnsHaveTypes: *typesFlag,
+		IgnoreBlanks:     *blanksFlag,
+		Mode:             lungo.ImportMode(*modeFlag),
+		BatchSize:        *batchFlag,
+		StopOnError:      *stopFlag,
+	}
+	if *fieldsFlag != "" {
+		opts.Fields = strings.Split(*fieldsFlag, ",")
+	}
+	if *upsertFlag != "" {
+		opts.UpsertFields = strings.Split(*upsertFlag, ",")
+	}
+
+	// open input
+	input := env.stdin
+	if len(args) > 2 && args[2] != "-" {
+		file, err := os.Open(args[2])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// import documents
+	res, err := lungo.Import(env.ctx, collection(client, handle), input, opts)
+
+	// print failed lines
+	for _, lineErr := range res.Errors {
+		if error(lineErr) != err {
+			_, _ = fmt.Fprintf(env.stderr, "%s\n", lineErr.Error())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return env.print(bson.D{
+		{Key: "inserted", Value: res.Inserted},
+		{Key: "matched", Value: res.Matched},
+		{Key: "modified", Value: res.Modified},
+		{Key: "upserted", Value: res.Upserted},
+		{Key: "deleted", Value: res.Deleted},
+		{Key: "failed", Value: len(res.Errors)},
+	}, false)
+}
+
+// find will open the database and yield the documents of the namespace in the
+// second argument that match the filter in the optional third argument.
+func find(env *env, args []string, opts *options.FindOptions, fn func(bson.D) error) error {
+	// get handle
+	handle, err := parseNamespace(args[1])
+	if err != nil {
+		return err
+	}
+
+	// get filter
+	filter, err := parseDoc(optional(args, 2))
+	if err != nil {
+		return err
+	}
+
+	// open database
+	client, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// find documents
+	csr, err := collection(client, handle).Find(env.ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer csr.Close(env.ctx)
+
+	// yield documents
+	for csr.Next(env.ctx) {
+		var doc bson.D
+		err = csr.Decode(&doc)
+		if err != nil {
+			return err
+		}
+		err = fn(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return csr.Err()
+}
+
+// readLines will read Extended JSON documents that are either given one per
+// line or as a single array.
+func readLines(r io.Reader) ([]interface{}, error) {
+	// read documents
+	var docs []interface{}
+	reader := bsonkit.NewExtJSONReader(r)
+	for {
+		doc, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		docs = append(docs, *doc)
+	}
+}
+
+func printUpdate(env *env, matched, modified int64, upserted interface{}) error {
+	// prepare result
+	res := bson.D{
+		{Key: "matched", Value: matched},
+		{Key: "modified", Value: modified},
+	}
+	if upserted != nil {
+		res = append(res, bson.E{Key: "upserted", Value: upserted})
+	}
+
+	return env.print(res, false)
+}
+
+// formatCSV will format the value for a CSV field like mongoexport does.
+func formatCSV(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case bsonkit.MissingType, nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int32, int64:
+		return fmt.Sprintf("%d", value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	case primitive.ObjectID:
+		return "ObjectId(" + value.Hex() + ")", nil
+	case primitive.DateTime:
+		return value.Time().UTC().Format(time.RFC3339Nano), nil
+	}
+
+	// marshal other values
+	buf, err := bsonkit.MarshalExtJSONValue(value, false)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// optional will return the argument at the index or an empty string.
+func optional(args []string, i int) string {
+	if len(args) > i {
+		return args[i]
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/256dpi/lungo"
+)
+
+func init() {
+	// register dump commands
+	commands["dump"] = command{
+		usage: "[flags] <file> <dir|archive>",
+		help:  "Write the collections to a directory or archive in the mongodump format.",
+		run:   runDump,
+	}
+	commands["restore"] = command{
+		usage: "[flags] <file> <dir|archive>",
+		help:  "Restore the collections from a directory or archive in the mongodump format.",
+		run:   runRestore,
+	}
+}
+
+func runDump(env *env, args []string) error {
+	// parse flags
+	dbFlag := env.flags.String("db", "", "the database to dump (all if empty)")
+	archiveFlag := env.flags.Bool("archive", false, "write an archive file instead of a directory (- for stdout)")
+	gzipFlag := env.flags.Bool("gzip", false, "compress the files or archive with gzip")
+	args, err := env.parse(args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	// open database
+	_, engine, err := env.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// prepare options
+	opts := lungo.DumpOptions{
+		Database: *dbFlag,
+		Gzip:     *gzipFlag,
+	}
+
+	// write directory
+	if !*archiveFlag {
+		counts, err := lungo.DumpDirectory(engine.Catalog(), args[1], opts)
+		if err != nil {
+			return err
+		}
+		return report(env.stdout, "dumped", counts)
+	}
+
+	// write archive to stdout
+	if args[1] == "-" {
+		counts, err := lungo.DumpArchive(engine.Catalog(), env.stdout, opts)
+		if err != nil {
+			return err
+		}
+		return report(env.stderr, "dumped", counts)
+	}
+
+	// create archive
+	file, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// write archive
+	counts, err := lungo.DumpArchive(engine.Catalog(), file, opts)
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return report(env.stdout, "dumped", counts)
+}
+
+func runRestore(env *env, args []string) error {
+	// parse flags
+	dbFlag := env.flags.String("db", "", "the database to restore (all if empty)")
+	dropFlag := env.flags.Bool("drop", false, "drop existing collections before restoring")
+	archiveFlag := env.flags.Bool("archive", false, "read an archive file instead of a directory (- for stdin)")
+	args, err := env.parse(args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	// open archive
+	var archive io.Reader
+	if *archiveFlag && args[1] == "-" {
+		archive = env.stdin
+	} else if *archiveFlag {
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		archive = file
+	}
+
+	// open database
+	_, engine, err := env.open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// prepare options
+	opts := lungo.RestoreOptions{
+		Database: *dbFlag,
+		Drop:     *dropFlag,
+	}
+
+	// restore directory or archive
+	var counts map[lungo.Handle]int
+	if archive != nil {
+		counts, err = lungo.RestoreArchive(env.ctx, engine, archive, opts)
+	} else {
+		counts, err = lungo.RestoreDirectory(env.ctx, engine, args[1], opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	return report(env.stdout, "restored", counts)
+}
+
+// report will print the number of documents per namespace.
+func report(w io.Writer, verb string, counts map[lungo.Handle]int) error {
+	// sort handles
+	handles := make([]lungo.Handle, 0, len(counts))
+	for handle := range counts {
+		handles = append(handles, handle)
+	}
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i].String() < handles[j].String()
+	})
+
+	// print counts
+	for _, handle := range handles {
+		_, err := fmt.Fprintf(w, "%s %s (%d documents)\n", verb, handle.String(), counts[handle])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+// Command lungo inspects and maintains lungo database files.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// errUsage is returned if the arguments are invalid.
+var errUsage = errors.New("invalid usage")
+
+// command describes a subcommand.
+type command struct {
+	usage string
+	help  string
+	run   func(env *env, args []string) error
+}
+
+// commands holds all available subcommands.
+var commands = map[string]command{}
+
+// env is the environment of a subcommand.
+type env struct {
+	ctx    context.Context
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	flags  *flag.FlagSet
+}
+
+func main() {
+	// cancel context on signal
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// run command
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		cancel()
+		os.Exit(2)
+	} else if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "lungo: %s\n", err.Error())
+		cancel()
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	// check arguments
+	if len(args) == 0 {
+		usage(stderr)
+		return errUsage
+	}
+
+	// get command
+	cmd, ok := commands[args[0]]
+	if !ok {
+		_, _ = fmt.Fprintf(stderr, "lungo: unknown command %q\n", args[0])
+		usage(stderr)
+		return errUsage
+	}
+
+	// prepare flags
+	flags := flag.NewFlagSet("lungo "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: lungo %s %s\n\n%s\n", args[0], cmd.usage, cmd.help)
+		flags.PrintDefaults()
+	}
+
+	// run command
+	err := cmd.run(&env{
+		ctx:    ctx,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		flags:  flags,
+	}, args[1:])
+	if errors.Is(err, errUsage) {
+		flags.Usage()
+	}
+
+	return err
+}
+
+func usage(w io.Writer) {
+	// sort names
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// print commands
+	_, _ = fmt.Fprintf(w, "Usage: lungo <command> [flags] <file> [args]\n\nCommands:\n")
+	for _, name := range names {
+		_, _ = fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].help)
+	}
+}
+
+// parse will parse the flags and check the number of positional arguments.
+// The first positional argument is always the database file.
+func (e *env) parse(args []string, min, max int) ([]string, error) {
+	// parse flags
+	err := e.flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// check arguments
+	args = e.flags.Args()
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return nil, errUsage
+	}
+
+	return args, nil
+}
+
+// open will open the database file. If the file must exist and is missing an
+// error is returned.
+func (e *env) open(file string, mustExist bool) (lungo.IClient, *lungo.Engine, error) {
+	// check file
+	if mustExist {
+		_, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// open database
+	client, engine, err := lungo.Open(e.ctx, lungo.Options{
+		Store: lungo.NewFileStore(file, 0666),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, engine, nil
+}
+
+// print will write the value as relaxed or canonical Extended JSON followed
+// by a newline.
+func (e *env) print(value interface{}, canonical bool) error {
+	// marshal value
+	buf, err := bsonkit.MarshalExtJSONValue(value, canonical)
+	if err != nil {
+		return err
+	}
+
+	// write line
+	_, err = fmt.Fprintf(e.stdout, "%s\n", buf)
+
+	return err
+}
+
+// parseJSON will parse the Extended JSON document, array or value.
+func parseJSON(str string) (interface{}, error) {
+	// decode value
+	value, err := bsonkit.UnmarshalExtJSONValue([]byte(str))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON %q: %w", str, err)
+	}
+
+	return value, nil
+}
+
+// parseDoc will parse the Extended JSON document. An empty string yields an
+// empty document.
+func parseDoc(str string) (bson.D, error) {
+	// handle empty
+	if strings.TrimSpace(str) == "" {
+		return bson.D{}, nil
+	}
+
+	// parse value
+	value, err := parseJSON(str)
+	if err != nil {
+		return nil, err
+	}
+
+	// check document
+	doc, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("expected JSON document, got %q", str)
+	}
+
+	return doc, nil
+}
+
+// parseNamespace will parse the "db.coll" namespace.
+func parseNamespace(ns string) (lungo.Handle, error) {
+	// split namespace
+	handle := lungo.Handle{ns}
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		handle = lungo.Handle{ns[:i], ns[i+1:]}
+	}
+
+	// validate handle
+	err := handle.Validate(true)
+	if err != nil {
+		return handle, fmt.Errorf("invalid namespace %q", ns)
+	}
+
+	return handle, nil
+}
+
+// namespaces will return the sorted handles of all namespaces.
+func namespaces(engine *lungo.Engine) []lungo.Handle {
+	// collect handles
+	var list []lungo.Handle
+	for handle := range engine.Catalog().Namespaces {
+		list = append(list, handle)
+	}
+
+	// sort handles
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+
+	return list
+}
+
+// collection will return the collection for the handle.
+func collection(client lungo.IClient, handle lungo.Handle) lungo.ICollection {
+	return client.Database(handle[0]).Collection(handle[1])
+}
+
+// runCommand will run the command on the database and return the reply.
+func runCommand(env *env, engine *lungo.Engine, db string, cmd bson.D) (bson.D, error) {
+	reply, err := engine.RunCommand(env.ctx, db, &cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return *reply, nil
+}
+
+// get will return the value at the path of the document.
+func get(doc bson.D, path string) interface{} {
+	return bsonkit.Get(&doc, path)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func invoke(t *testing.T, stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestCLI(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "db.bson")
+
+	out, err := invoke(t, "", "find", file, "app.users")
+	assert.Error(t, err)
+	assert.Empty(t, out)
+
+	out, err = invoke(t, "", "insert", file, "app.users", `{"_id":1,"name":"a","age":31}`, `{"_id":2,"name":"b","age":25}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"inserted\":2}\n", out)
+
+	out, err = invoke(t, "{\"_id\":3,\"name\":\"c\",\"age\":{\"$numberLong\":\"40\"}}\n\n", "insert", file, "app.users")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"inserted\":1}\n", out)
+
+	out, err = invoke(t, "", "find", "-sort", `{"age":-1}`, "-limit", "2", file, "app.users", `{"age":{"$gt":20}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"_id\":3,\"name\":\"c\",\"age\":40}\n{\"_id\":1,\"name\":\"a\",\"age\":31}\n", out)
+
+	out, err = invoke(t, "", "find", "-canonical", "-projection", `{"age":1}`, file, "app.users", `{"_id":3}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"_id\":{\"$numberInt\":\"3\"},\"age\":{\"$numberLong\":\"40\"}}\n", out)
+
+	out, err = invoke(t, "", "count", file, "app.users", `{"age":{"$lt":35}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "2\n", out)
+
+	out, err = invoke(t, "", "update", "-multi", file, "app.users", `{}`, `{"$inc":{"age":1}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"matched\":3,\"modified\":3}\n", out)
+
+	out, err = invoke(t, "", "update", "-upsert", file, "app.users", `{"_id":4}`, `[{"$set":{"name":"d"}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"matched\":0,\"modified\":0,\"upserted\":4}\n", out)
+
+	out, err = invoke(t, "", "delete", file, "app.users", `{"_id":4}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"deleted\":1}\n", out)
+
+	out, err = invoke(t, "", "export", "-format", "csv", "-fields", "_id,name,age", file, "app.users", `{"_id":{"$lte":2}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "_id,name,age\n1,a,32\n2,b,26\n", out)
+
+	out, err = invoke(t, "", "export", "-format", "csv", file, "app.users")
+	assert.Error(t, err)
+	assert.Empty(t, out)
+
+	out, err = invoke(t, "", "ls", file)
+	assert.NoError(t, err)
+	assert.Equal(t, "app\nlocal\n", out)
+
+	out, err = invoke(t, "", "ls", file, "app")
+	assert.NoError(t, err)
+	assert.Equal(t, "users\n", out)
+
+	out, err = invoke(t, "", "ls", file, "app.users")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"v\":2,\"key\":{\"_id\":1},\"name\":\"_id_\"}\n", out)
+
+	out, err = invoke(t, "", "stats", file)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "app.users    3")
+
+	out, err = invoke(t, "", "validate", "-full", file)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(out, `"errors":[]`))
+
+	out, err = invoke(t, "", "oplog", "tail", "-n", "1", file)
+	assert.NoError(t, err)
+	assert.Contains(t, out, `"operationType":"delete"`)
+
+	out, err = invoke(t, "", "dump", file, filepath.Join(dir, "dump"))
+	assert.NoError(t, err)
+	assert.Equal(t, "dumped app.users (3 documents)\n", out)
+
+	restored := filepath.Join(dir, "restored.bson")
+	out, err = invoke(t, "", "restore", restored, filepath.Join(dir, "dump"))
+	assert.NoError(t, err)
+	assert.Equal(t, "restored app.users (3 documents)\n", out)
+
+	out, err = invoke(t, "", "find", "-canonical", restored, "app.users", `{"_id":3}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"_id\":{\"$numberInt\":\"3\"},\"name\":\"c\",\"age\":{\"$numberLong\":\"41\"}}\n", out)
+
+	out, err = invoke(t, "", "restore", restored, filepath.Join(dir, "dump"))
+	assert.Error(t, err)
+	assert.Empty(t, out)
+
+	out, err = invoke(t, "", "restore", "-drop", restored, filepath.Join(dir, "dump"))
+	assert.NoError(t, err)
+	assert.Equal(t, "restored app.users (3 documents)\n", out)
+	assert.FileExists(t, filepath.Join(dir, "dump", "app", "users.bson"))
+
+	archive, err := invoke(t, "", "dump", "-archive", "-gzip", file, "-")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(archive, "\x1f\x8b"))
+
+	out, err = invoke(t, archive, "restore", "-archive", filepath.Join(dir, "archived.bson"), "-")
+	assert.NoError(t, err)
+	assert.Equal(t, "restored app.users (3 documents)\n", out)
+
+	out, err = invoke(t, "", "count", filepath.Join(dir, "archived.bson"), "app.users")
+	assert.NoError(t, err)
+	assert.Equal(t, "3\n", out)
+
+	out, err = invoke(t, "", "compact", file)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "removed 0 expired documents and 8 oplog events")
+
+	out, err = invoke(t, "", "oplog", "tail", file)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	out, err = invoke(t, "[\n  {\"_id\": 1},\n  {\"_id\": 2}\n]\n", "insert", file, "app.items")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"inserted\":2}\n", out)
+
+	out, err = invoke(t, "{\"_id\": 3}\n{\"_id\": }\n", "insert", file, "app.items")
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "line 2: "))
+	assert.Empty(t, out)
+
+	out, err = invoke(t, "_id,name,age\n10,j,20\n11,k,x\n10,l,30\n", "import", "-type", "csv", file, "app.imported")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"inserted\":2,\"matched\":0,\"modified\":0,\"upserted\":0,\"deleted\":0,\"failed\":1}\n", out)
+
+	input := filepath.Join(dir, "input.json")
+	assert.NoError(t, os.WriteFile(input, []byte(`[{"_id":10,"age":21},{"_id":12,"age":22}]`), 0644))
+
+	out, err = invoke(t, "", "import", "-mode", "merge", file, "app.imported", input)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"inserted\":0,\"matched\":1,\"modified\":1,\"upserted\":1,\"deleted\":0,\"failed\":0}\n", out)
+
+	out, err = invoke(t, "", "find", file, "app.imported", `{"_id":10}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"_id\":10,\"name\":\"j\",\"age\":21}\n", out)
+
+	out, err = invoke(t, "", "import", "-mode", "foo", file, "app.imported", input)
+	assert.Error(t, err)
+	assert.Empty(t, out)
+
+	corrupt := filepath.Join(dir, "corrupt.bson")
+	buf, err := bson.Marshal(lungo.File{
+		Namespaces: map[string]lungo.FileNamespace{
+			"app.users": {
+				Documents: bsonkit.List{
+					bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+					bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+				},
+				Indexes: map[string]lungo.FileIndex{
+					"_id_": {Key: bsonkit.MustConvert(bson.M{"_id": int32(1)}), Unique: true},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(corrupt, buf, 0644))
+
+	out, err = invoke(t, "", "validate", "-full", corrupt)
+	assert.EqualError(t, err, "invalid namespaces: app.users")
+	assert.Contains(t, out, `"nrecords":2`)
+	assert.Contains(t, out, `index \"_id_\": duplicate key for document 1`)
+
+	_, err = invoke(t, "", "unknown")
+	assert.ErrorIs(t, err, errUsage)
+
+	_, err = invoke(t, "", "count", file)
+	assert.ErrorIs(t, err, errUsage)
+
+	_, err = invoke(t, "", "oplog")
+	assert.ErrorIs(t, err, errUsage)
+
+	_, err = invoke(t, "", "oplog", "head", file)
+	assert.ErrorIs(t, err, errUsage)
+}
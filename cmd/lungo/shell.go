@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/peterh/liner"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// the number of documents printed per batch
+const shellBatchSize = 20
+
+func init() {
+	// register shell command
+	commands["shell"] = command{
+		usage: "[flags] [file]",
+		help:  "Start an interactive shell on the database file or a server.",
+		run:   runShell,
+	}
+}
+
+// shell holds the state of an interactive session.
+type shell struct {
+	env       *env
+	eval      *evaluator
+	cursor    lungo.ICursor
+	pending   bson.D
+	canonical bool
+}
+
+func runShell(env *env, args []string) error {
+	// parse flags
+	uriFlag := env.flags.String("uri", "", "the connection string of a server to use instead of a file")
+	dbFlag := env.flags.String("db", "test", "the initial database")
+	evalFlag := env.flags.String("eval", "", "evaluate the expression and exit")
+	canonicalFlag := env.flags.Bool("canonical", false, "print canonical Extended JSON")
+	args, err := env.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	// check arguments
+	if (*uriFlag == "") == (len(args) == 0) {
+		return errUsage
+	}
+
+	// open database or connect to server
+	var client lungo.IClient
+	if *uriFlag != "" {
+		client, err = lungo.Connect(env.ctx, options.Client().ApplyURI(*uriFlag))
+		if err != nil {
+			return err
+		}
+		defer client.Disconnect(env.ctx)
+		err = client.Ping(env.ctx, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		var engine *lungo.Engine
+		client, engine, err = env.open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer engine.Close()
+	}
+
+	// prepare shell
+	sh := &shell{
+		env: env,
+		eval: &evaluator{
+			ctx:    env.ctx,
+			client: client,
+			db:     *dbFlag,
+		},
+		canonical: *canonicalFlag,
+	}
+	defer sh.close()
+
+	// evaluate expression
+	if *evalFlag != "" {
+		_, err = sh.execute(*evalFlag)
+		return err
+	}
+
+	// read from non-terminal input
+	if !terminal(env.stdin) {
+		return sh.script(env.stdin)
+	}
+
+	return sh.interactive()
+}
+
+// interactive will run the read-eval-print loop on the terminal.
+func (s *shell) interactive() error {
+	// prepare line editor
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetTabCompletionStyle(liner.TabPrints)
+	line.SetCompleter(s.complete)
+
+	// load history
+	history := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		history = filepath.Join(home, ".lungo_history")
+		if file, err := os.Open(history); err == nil {
+			_, _ = line.ReadHistory(file)
+			_ = file.Close()
+		}
+	}
+
+	// save history
+	defer func() {
+		if history != "" {
+			if file, err := os.Create(history); err == nil {
+				_, _ = line.WriteHistory(file)
+				_ = file.Close()
+			}
+		}
+	}()
+
+	for {
+		// read input
+		input, err := line.Prompt(s.eval.db + "> ")
+		if errors.Is(err, liner.ErrPromptAborted) {
+			continue
+		} else if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// check input
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		line.AppendHistory(input)
+
+		// execute input
+		exit, err := s.execute(input)
+		if err != nil {
+			_, _ = fmt.Fprintln(s.env.stdout, err.Error())
+		} else if exit {
+			return nil
+		}
+	}
+}
+
+// script will execute each line of the reader and stop at the first error.
+func (s *shell) script(r io.Reader) error {
+	// prepare scanner
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	// execute lines
+	var num int
+	for scanner.Scan() {
+		num++
+		input := strings.TrimSpace(scanner.Text())
+		if input == "" || strings.HasPrefix(input, "//") {
+			continue
+		}
+		exit, err := s.execute(input)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", num, err)
+		} else if exit {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// execute will run the semicolon separated statements of the input. It returns
+// whether the shell should exit.
+func (s *shell) execute(input string) (bool, error) {
+	// run statements
+	for _, stmt := range statements(input) {
+		exit, err := s.run(stmt)
+		if err != nil || exit {
+			return exit, err
+		}
+	}
+
+	return false, nil
+}
+
+// run will run the shell helper or evaluate the expression and print the
+// result. It returns whether the shell should exit.
+func (s *shell) run(input string) (bool, error) {
+	// handle helpers
+	fields := strings.Fields(input)
+	switch fields[0] {
+	case "exit", "quit", "exit()", "quit()":
+		return true, nil
+	case "help":
+		return false, s.printHelp()
+	case "use":
+		if len(fields) != 2 {
+			return false, fmt.Errorf("usage: use <db>")
+		}
+		s.eval.db = fields[1]
+		_, err := fmt.Fprintf(s.env.stdout, "switched to db %s\n", fields[1])
+		return false, err
+	case "show":
+		if len(fields) != 2 {
+			return false, fmt.Errorf("usage: show dbs|collections")
+		}
+		return false, s.show(fields[1])
+	case "it":
+		if s.cursor == nil {
+			return false, fmt.Errorf("no cursor")
+		}
+		return false, s.iterate()
+	}
+
+	// parse expression
+	expr, err := parse(input)
+	if err != nil {
+		return false, err
+	}
+
+	// evaluate expression
+	value, err := s.eval.eval(expr)
+	if err != nil {
+		return false, err
+	}
+
+	return false, s.print(value)
+}
+
+func (s *shell) show(what string) error {
+	var names []string
+	var err error
+	switch what {
+	case "dbs", "databases":
+		names, err = s.eval.client.ListDatabaseNames(s.env.ctx, bson.D{})
+	case "collections", "tables":
+		names, err = s.eval.client.Database(s.eval.db).ListCollectionNames(s.env.ctx, bson.D{})
+	default:
+		return fmt.Errorf("unknown show target %q", what)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprint(s.env.stdout, lines(sorted(names)))
+
+	return err
+}
+
+func (s *shell) print(value interface{}) error {
+	switch value := value.(type) {
+	case *cursorValue:
+		// open cursor
+		s.close()
+		csr, err := s.eval.open(value)
+		if err != nil {
+			return err
+		}
+		s.cursor = csr
+		return s.iterate()
+	case dbValue:
+		_, err := fmt.Fprintln(s.env.stdout, value.name)
+		return err
+	case collValue:
+		_, err := fmt.Fprintln(s.env.stdout, value.db+"."+value.name)
+		return err
+	case string:
+		_, err := fmt.Fprintln(s.env.stdout, value)
+		return err
+	case bson.D:
+		return s.env.print(value, s.canonical)
+	}
+
+	// print other values
+	buf, err := bsonkit.MarshalExtJSONValue(value, s.canonical)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.env.stdout, "%s\n", buf)
+
+	return err
+}
+
+// iterate will print the next batch of the current cursor.
+func (s *shell) iterate() error {
+	// print batch
+	for i := 0; i < shellBatchSize; i++ {
+		doc, err := s.next()
+		if err != nil || doc == nil {
+			s.close()
+			return err
+		}
+		err = s.env.print(doc, s.canonical)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check for more
+	doc, err := s.next()
+	if err != nil || doc == nil {
+		s.close()
+		return err
+	}
+	s.pending = doc
+
+	_, err = fmt.Fprintln(s.env.stdout, `Type "it" for more`)
+
+	return err
+}
+
+// next will return the pending or next document of the current cursor.
+func (s *shell) next() (bson.D, error) {
+	// return pending document
+	if s.pending != nil {
+		doc := s.pending
+		s.pending = nil
+		return doc, nil
+	}
+
+	// get next document
+	if !s.cursor.Next(s.env.ctx) {
+		return nil, s.cursor.Err()
+	}
+	var doc bson.D
+	err := s.cursor.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func (s *shell) close() {
+	if s.cursor != nil {
+		_ = s.cursor.Close(s.env.ctx)
+		s.cursor = nil
+		s.pending = nil
+	}
+}
+
+func (s *shell) printHelp() error {
+	_, err := fmt.Fprint(s.env.stdout, `Shell helpers:
+  use <db>                   switch the current database
+  show dbs                   list the databases
+  show collections           list the collections of the current database
+  it                         print the next batch of the last cursor
+  exit                       exit the shell
+
+Database methods:
+  db.`+strings.Join(dbMethods, "(), db.")+`()
+
+Collection methods:
+  db.coll.`+strings.Join(collMethods, "(), db.coll.")+`()
+
+Cursor methods:
+  find().`+strings.Join(cursorMethods, "(), find().")+`()
+
+Values may use ObjectId(), ISODate(), NumberInt(), NumberLong(), NumberDecimal(),
+Timestamp(), UUID(), BinData(), MinKey(), MaxKey() and /regex/ literals.
+Multiple statements may be separated by semicolons.
+`)
+	return err
+}
+
+// complete will return the completions for the line.
+func (s *shell) complete(line string) []string {
+	// complete helpers
+	if strings.HasPrefix(line, "use ") {
+		names, _ := s.eval.client.ListDatabaseNames(s.env.ctx, bson.D{})
+		return prefixed("use ", line[4:], names)
+	} else if strings.HasPrefix(line, "show ") {
+		return prefixed("show ", line[5:], []string{"dbs", "collections"})
+	}
+
+	// split off the trailing expression
+	start := expressionStart(line)
+	head, expr := line[:start], line[start:]
+
+	// complete database members
+	if strings.HasPrefix(expr, "db.") {
+		rest := expr[3:]
+		if dot := strings.LastIndexByte(rest, '.'); dot >= 0 {
+			// complete collection or cursor methods
+			methods := collMethods
+			if strings.Contains(rest[:dot], "(") {
+				methods = cursorMethods
+			}
+			return prefixed(head+"db."+rest[:dot+1], rest[dot+1:], methods)
+		}
+
+		// complete collections and database methods
+		names, _ := s.eval.client.Database(s.eval.db).ListCollectionNames(s.env.ctx, bson.D{})
+		return prefixed(head+"db.", rest, append(names, dbMethods...))
+	}
+
+	return prefixed(head, expr, []string{"db", "use", "show", "help", "exit"})
+}
+
+// terminal will return whether the reader is an interactive terminal.
+func terminal(r io.Reader) bool {
+	// check file
+	file, ok := r.(*os.File)
+	if !ok || !liner.TerminalSupported() {
+		return false
+	}
+
+	// check mode
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// expressionStart will return the offset of the trailing expression by
+// skipping over balanced parentheses.
+func expressionStart(line string) int {
+	var depth int
+	for i := len(line) - 1; i >= 0; i-- {
+		switch line[i] {
+		case ')':
+			depth++
+		case '(':
+			if depth == 0 {
+				return i + 1
+			}
+			depth--
+		case ' ', ',', '{', '[', ':', '=':
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// prefixed will return the candidates that start with the prefix joined with
+// the head.
+func prefixed(head, prefix string, candidates []string) []string {
+	var list []string
+	for _, candidate := range sorted(candidates) {
+		if strings.HasPrefix(candidate, prefix) {
+			list = append(list, head+candidate)
+		}
+	}
+	return list
+}
+
+// sorted will return a sorted copy of the list.
+func sorted(list []string) []string {
+	list = append([]string{}, list...)
+	sort.Strings(list)
+	return list
+}
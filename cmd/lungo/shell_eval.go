@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// dbValue is the value of "db" or a sibling database.
+type dbValue struct {
+	name string
+}
+
+// collValue is the value of a collection like "db.users".
+type collValue struct {
+	db   string
+	name string
+}
+
+// cursorValue is a lazily executed find or aggregate.
+type cursorValue struct {
+	coll      collValue
+	filter    bson.D
+	pipeline  bson.A
+	aggregate bool
+	opts      *options.FindOptions
+}
+
+// the methods available on databases, collections and cursors
+var (
+	dbMethods = []string{
+		"adminCommand", "createCollection", "dropDatabase", "getCollection",
+		"getCollectionNames", "getName", "getSiblingDB", "runCommand", "stats",
+	}
+	collMethods = []string{
+		"aggregate", "count", "countDocuments", "createIndex", "deleteMany",
+		"deleteOne", "distinct", "drop", "dropIndex", "estimatedDocumentCount",
+		"find", "findOne", "getIndexes", "insertMany", "insertOne", "replaceOne",
+		"stats", "updateMany", "updateOne",
+	}
+	cursorMethods = []string{
+		"batchSize", "count", "limit", "pretty", "projection", "skip", "sort",
+		"toArray",
+	}
+)
+
+// evaluator evaluates parsed shell expressions against a client.
+type evaluator struct {
+	ctx    context.Context
+	client lungo.IClient
+	db     string
+}
+
+func (e *evaluator) eval(n node) (interface{}, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.value, nil
+	case *regexNode:
+		return primitive.Regex{Pattern: n.pattern, Options: n.options}, nil
+	case *identNode:
+		switch n.name {
+		case "db":
+			return dbValue{name: e.db}, nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "NaN":
+			return math.NaN(), nil
+		}
+		return nil, fmt.Errorf("ReferenceError: %s is not defined", n.name)
+	case *objectNode:
+		doc := make(bson.D, 0, len(n.keys))
+		for i, key := range n.keys {
+			value, err := e.value(n.values[i])
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: key, Value: value})
+		}
+		return doc, nil
+	case *arrayNode:
+		array := make(bson.A, 0, len(n.items))
+		for _, item := range n.items {
+			value, err := e.value(item)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case *memberNode:
+		return e.member(n)
+	case *newNode:
+		return e.construct(n.name, n.args)
+	case *callNode:
+		return e.call(n)
+	}
+
+	return nil, fmt.Errorf("unsupported expression %T", n)
+}
+
+// value will evaluate the node and ensure it yields a BSON value.
+func (e *evaluator) value(n node) (interface{}, error) {
+	// evaluate node
+	value, err := e.eval(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// check value
+	switch value.(type) {
+	case dbValue, collValue, *cursorValue:
+		return nil, fmt.Errorf("TypeError: %s is not a value", describe(value))
+	}
+
+	return value, nil
+}
+
+func (e *evaluator) values(nodes []node) ([]interface{}, error) {
+	list := make([]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		value, err := e.value(n)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+func (e *evaluator) member(n *memberNode) (interface{}, error) {
+	// evaluate object
+	object, err := e.eval(n.object)
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate name
+	name, err := e.value(n.name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch object := object.(type) {
+	case dbValue:
+		if name, ok := name.(string); ok {
+			return collValue{db: object.name, name: name}, nil
+		}
+	case collValue:
+		if name, ok := name.(string); ok {
+			return collValue{db: object.db, name: object.name + "." + name}, nil
+		}
+	case bson.D:
+		if name, ok := name.(string); ok {
+			value := bsonkit.Get(&object, name)
+			if value == bsonkit.Missing {
+				return nil, nil
+			}
+			return value, nil
+		}
+	case bson.A:
+		if index, ok := toInt(name); ok {
+			if index < 0 || index >= len(object) {
+				return nil, nil
+			}
+			return object[index], nil
+		} else if name == "length" {
+			return int32(len(object)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("TypeError: cannot read property %v of %s", name, describe(object))
+}
+
+func (e *evaluator) call(n *callNode) (interface{}, error) {
+	// handle functions
+	if ident, ok := n.fn.(*identNode); ok {
+		return e.construct(ident.name, n.args)
+	}
+
+	// check method
+	member, ok := n.fn.(*memberNode)
+	if !ok {
+		return nil, fmt.Errorf("TypeError: expression is not a function")
+	}
+	var name string
+	if lit, ok := member.name.(*literalNode); ok {
+		name, _ = lit.value.(string)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("TypeError: expression is not a function")
+	}
+
+	// evaluate object
+	object, err := e.eval(member.object)
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate arguments
+	args, err := e.values(n.args)
+	if err != nil {
+		return nil, err
+	}
+
+	// call method
+	switch object := object.(type) {
+	case dbValue:
+		return e.dbMethod(object, name, args)
+	case collValue:
+		return e.collMethod(object, name, args)
+	case *cursorValue:
+		return e.cursorMethod(object, name, args)
+	}
+
+	return nil, fmt.Errorf("TypeError: %s.%s is not a function", describe(object), name)
+}
+
+func (e *evaluator) construct(name string, nodes []node) (interface{}, error) {
+	// evaluate arguments
+	args, err := e.values(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	// get string argument
+	str, _ := arg(args, 0).(string)
+
+	switch name {
+	case "ObjectId":
+		if len(args) == 0 {
+			return primitive.NewObjectID(), nil
+		}
+		return primitive.ObjectIDFromHex(str)
+	case "ISODate", "Date":
+		if len(args) == 0 {
+			return primitive.NewDateTimeFromTime(time.Now()), nil
+		} else if ms, ok := toFloat(args[0]); ok {
+			return primitive.DateTime(int64(ms)), nil
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			t, err := time.Parse(layout, str)
+			if err == nil {
+				return primitive.NewDateTimeFromTime(t), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q", str)
+	case "NumberInt", "NumberLong":
+		var n int64
+		if f, ok := toFloat(arg(args, 0)); ok {
+			n = int64(f)
+		} else if _, err := fmt.Sscan(str, &n); err != nil {
+			return nil, fmt.Errorf("%s: invalid number %q", name, str)
+		}
+		if name == "NumberInt" {
+			return int32(n), nil
+		}
+		return n, nil
+	case "NumberDecimal", "Decimal128":
+		if f, ok := toFloat(arg(args, 0)); ok {
+			str = fmt.Sprint(f)
+		}
+		return primitive.ParseDecimal128(str)
+	case "Timestamp":
+		t, _ := toInt(arg(args, 0))
+		i, _ := toInt(arg(args, 1))
+		return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+	case "UUID":
+		data, err := hex.DecodeString(strings.ReplaceAll(str, "-", ""))
+		if err != nil || len(data) != 16 {
+			return nil, fmt.Errorf("invalid UUID %q", str)
+		}
+		return primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: data}, nil
+	case "BinData":
+		subtype, _ := toInt(arg(args, 0))
+		data, err := base64.StdEncoding.DecodeString(fmt.Sprint(arg(args, 1)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 data")
+		}
+		return primitive.Binary{Subtype: byte(subtype), Data: data}, nil
+	case "RegExp":
+		options, _ := arg(args, 1).(string)
+		return primitive.Regex{Pattern: str, Options: options}, nil
+	case "MinKey":
+		return primitive.MinKey{}, nil
+	case "MaxKey":
+		return primitive.MaxKey{}, nil
+	}
+
+	return nil, fmt.Errorf("ReferenceError: %s is not defined", name)
+}
+
+func (e *evaluator) dbMethod(db dbValue, name string, args []interface{}) (interface{}, error) {
+	database := e.client.Database(db.name)
+	switch name {
+	case "getName":
+		return db.name, nil
+	case "getCollectionNames":
+		names, err := database.ListCollectionNames(e.ctx, bson.D{})
+		if err != nil {
+			return nil, err
+		}
+		list := bson.A{}
+		for _, name := range sorted(names) {
+			list = append(list, name)
+		}
+		return list, nil
+	case "getCollection":
+		name, err := stringArg(args, 0, "name")
+		if err != nil {
+			return nil, err
+		}
+		return collValue{db: db.name, name: name}, nil
+	case "getSiblingDB":
+		name, err := stringArg(args, 0, "name")
+		if err != nil {
+			return nil, err
+		}
+		return dbValue{name: name}, nil
+	case "createCollection":
+		name, err := stringArg(args, 0, "name")
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "ok", Value: 1}}, database.CreateCollection(e.ctx, name)
+	case "dropDatabase":
+		return bson.D{{Key: "ok", Value: 1}, {Key: "dropped", Value: db.name}}, database.Drop(e.ctx)
+	case "runCommand", "adminCommand":
+		if name == "adminCommand" {
+			database = e.client.Database("admin")
+		}
+		cmd := arg(args, 0)
+		if str, ok := cmd.(string); ok {
+			cmd = bson.D{{Key: str, Value: 1}}
+		}
+		if _, ok := cmd.(bson.D); !ok {
+			return nil, fmt.Errorf("%s: command must be a document or string", name)
+		}
+		return decode(database.RunCommand(e.ctx, cmd))
+	case "stats":
+		return decode(database.RunCommand(e.ctx, bson.D{{Key: "dbStats", Value: 1}}))
+	}
+
+	return nil, fmt.Errorf("TypeError: db.%s is not a function", name)
+}
+
+func (e *evaluator) collMethod(coll collValue, name string, args []interface{}) (interface{}, error) {
+	c := e.client.Database(coll.db).Collection(coll.name)
+	switch name {
+	case "find":
+		filter, err := docArg(args, 0, "filter")
+		if err != nil {
+			return nil, err
+		}
+		projection, err := docArg(args, 1, "projection")
+		if err != nil {
+			return nil, err
+		}
+		opts := options.Find()
+		if len(args) > 1 {
+			opts.SetProjection(projection)
+		}
+		return &cursorValue{coll: coll, filter: filter, opts: opts}, nil
+	case "findOne":
+		filter, err := docArg(args, 0, "filter")
+		if err != nil {
+			return nil, err
+		}
+		projection, err := docArg(args, 1, "projection")
+		if err != nil {
+			return nil, err
+		}
+		opts := options.FindOne()
+		if len(args) > 1 {
+			opts.SetProjection(projection)
+		}
+		doc, err := decode(c.FindOne(e.ctx, filter, opts))
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return doc, err
+	case "aggregate":
+		pipeline, ok := arg(args, 0).(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("aggregate: pipeline must be an array")
+		}
+		return &cursorValue{coll: coll, pipeline: pipeline, aggregate: true}, nil
+	case "count", "countDocuments":
+		filter, err := docArg(args, 0, "filter")
+		if err != nil {
+			return nil, err
+		}
+		return c.CountDocuments(e.ctx, filter)
+	case "estimatedDocumentCount":
+		return c.EstimatedDocumentCount(e.ctx)
+	case "distinct":
+		field, err := stringArg(args, 0, "field")
+		if err != nil {
+			return nil, err
+		}
+		filter, err := docArg(args, 1, "filter")
+		if err != nil {
+			return nil, err
+		}
+		values, err := c.Distinct(e.ctx, field, filter)
+		if err != nil {
+			return nil, err
+		}
+		return bson.A(values), nil
+	case "insertOne":
+		doc, err := docArg(args, 0, "document")
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.InsertOne(e.ctx, doc)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "insertedId", Value: res.InsertedID},
+		}, nil
+	case "insertMany":
+		list, ok := arg(args, 0).(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("insertMany: documents must be an array")
+		}
+		res, err := c.InsertMany(e.ctx, list)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "insertedIds", Value: bson.A(res.InsertedIDs)},
+		}, nil
+	case "updateOne", "updateMany", "replaceOne":
+		filter, err := docArg(args, 0, "filter")
+		if err != nil {
+			return nil, err
+		}
+		opts, err := docArg(args, 2, "options")
+		if err != nil {
+			return nil, err
+		}
+		upsert, _ := bsonkit.Get(&opts, "upsert").(bool)
+		var res *mongo.UpdateResult
+		switch name {
+		case "updateOne":
+			res, err = c.UpdateOne(e.ctx, filter, arg(args, 1), options.Update().SetUpsert(upsert))
+		case "updateMany":
+			res, err = c.UpdateMany(e.ctx, filter, arg(args, 1), options.Update().SetUpsert(upsert))
+		case "replaceOne":
+			res, err = c.ReplaceOne(e.ctx, filter, arg(args, 1), options.Replace().SetUpsert(upsert))
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply := bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "matchedCount", Value: res.MatchedCount},
+			{Key: "modifiedCount", Value: res.ModifiedCount},
+			{Key: "upsertedCount", Value: res.UpsertedCount},
+		}
+		if res.UpsertedID != nil {
+			reply = append(reply, bson.E{Key: "upsertedId", Value: res.UpsertedID})
+		}
+		return reply, nil
+	case "deleteOne", "deleteMany":
+		filter, err := docArg(args, 0, "filter")
+		if err != nil {
+			return nil, err
+		}
+		var res *mongo.DeleteResult
+		if name == "deleteOne" {
+			res, err = c.DeleteOne(e.ctx, filter)
+		} else {
+			res, err = c.DeleteMany(e.ctx, filter)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{
+			{Key: "acknowledged", Value: true},
+			{Key: "deletedCount", Value: res.DeletedCount},
+		}, nil
+	case "createIndex":
+		keys, err := docArg(args, 0, "keys")
+		if err != nil {
+			return nil, err
+		}
+		opts, err := docArg(args, 1, "options")
+		if err != nil {
+			return nil, err
+		}
+		index := options.Index()
+		if name, ok := bsonkit.Get(&opts, "name").(string); ok {
+			index.SetName(name)
+		}
+		if unique, ok := bsonkit.Get(&opts, "unique").(bool); ok {
+			index.SetUnique(unique)
+		}
+		if partial, ok := bsonkit.Get(&opts, "partialFilterExpression").(bson.D); ok {
+			index.SetPartialFilterExpression(partial)
+		}
+		if seconds, ok := toInt(bsonkit.Get(&opts, "expireAfterSeconds")); ok {
+			index.SetExpireAfterSeconds(int32(seconds))
+		}
+		return c.Indexes().CreateOne(e.ctx, mongo.IndexModel{Keys: keys, Options: index})
+	case "getIndexes":
+		csr, err := c.Indexes().List(e.ctx)
+		if err != nil {
+			return nil, err
+		}
+		var list []bson.D
+		err = csr.All(e.ctx, &list)
+		if err != nil {
+			return nil, err
+		}
+		array := bson.A{}
+		for _, spec := range list {
+			array = append(array, spec)
+		}
+		return array, nil
+	case "dropIndex":
+		name, err := stringArg(args, 0, "name")
+		if err != nil {
+			return nil, err
+		}
+		_, err = c.Indexes().DropOne(e.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "ok", Value: 1}}, nil
+	case "drop":
+		return true, c.Drop(e.ctx)
+	case "stats":
+		return decode(e.client.Database(coll.db).RunCommand(e.ctx, bson.D{{Key: "collStats", Value: coll.name}}))
+	}
+
+	return nil, fmt.Errorf("TypeError: db.%s.%s is not a function", coll.name, name)
+}
+
+func (e *evaluator) cursorMethod(csr *cursorValue, name string, args []interface{}) (interface{}, error) {
+	// check aggregate
+	if csr.aggregate && name != "toArray" && name != "pretty" && name != "batchSize" {
+		return nil, fmt.Errorf("TypeError: cursor.%s is not supported for aggregations", name)
+	}
+
+	switch name {
+	case "sort", "projection":
+		doc, err := docArg(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "sort" {
+			csr.opts.SetSort(doc)
+		} else {
+			csr.opts.SetProjection(doc)
+		}
+		return csr, nil
+	case "limit", "skip":
+		n, ok := toInt(arg(args, 0))
+		if !ok {
+			return nil, fmt.Errorf("cursor.%s: argument must be a number", name)
+		}
+		if name == "limit" {
+			csr.opts.SetLimit(int64(n))
+		} else {
+			csr.opts.SetSkip(int64(n))
+		}
+		return csr, nil
+	case "batchSize", "pretty":
+		return csr, nil
+	case "count":
+		return e.client.Database(csr.coll.db).Collection(csr.coll.name).CountDocuments(e.ctx, csr.filter)
+	case "toArray":
+		cursor, err := e.open(csr)
+		if err != nil {
+			return nil, err
+		}
+		var list []bson.D
+		err = cursor.All(e.ctx, &list)
+		if err != nil {
+			return nil, err
+		}
+		array := bson.A{}
+		for _, doc := range list {
+			array = append(array, doc)
+		}
+		return array, nil
+	}
+
+	return nil, fmt.Errorf("TypeError: cursor.%s is not a function", name)
+}
+
+// open will execute the find or aggregate of the cursor value.
+func (e *evaluator) open(csr *cursorValue) (lungo.ICursor, error) {
+	coll := e.client.Database(csr.coll.db).Collection(csr.coll.name)
+	if csr.aggregate {
+		return coll.Aggregate(e.ctx, csr.pipeline)
+	}
+	return coll.Find(e.ctx, csr.filter, csr.opts)
+}
+
+func decode(res lungo.ISingleResult) (interface{}, error) {
+	var doc bson.D
+	err := res.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func describe(value interface{}) string {
+	switch value := value.(type) {
+	case dbValue:
+		return value.name
+	case collValue:
+		return value.db + "." + value.name
+	case *cursorValue:
+		return "cursor"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func arg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func docArg(args []interface{}, i int, name string) (bson.D, error) {
+	switch value := arg(args, i).(type) {
+	case nil:
+		return bson.D{}, nil
+	case bson.D:
+		return value, nil
+	}
+	return nil, fmt.Errorf("%s must be a document", name)
+}
+
+func stringArg(args []interface{}, i int, name string) (string, error) {
+	str, ok := arg(args, i).(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	return str, nil
+}
+
+func toInt(value interface{}) (int, bool) {
+	f, ok := toFloat(value)
+	return int(f), ok && f == math.Trunc(f)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// node is a parsed shell expression.
+type node interface{}
+
+// literalNode is a constant value.
+type literalNode struct {
+	value interface{}
+}
+
+// identNode is a plain identifier like "db" or "ObjectId".
+type identNode struct {
+	name string
+}
+
+// memberNode is a property access like "db.users" or "db['users']".
+type memberNode struct {
+	object node
+	name   node
+}
+
+// callNode is a function or method call.
+type callNode struct {
+	fn   node
+	args []node
+}
+
+// newNode is a constructor call like "new Date()".
+type newNode struct {
+	name string
+	args []node
+}
+
+// objectNode is an object literal.
+type objectNode struct {
+	keys   []string
+	values []node
+}
+
+// arrayNode is an array literal.
+type arrayNode struct {
+	items []node
+}
+
+// regexNode is a regular expression literal.
+type regexNode struct {
+	pattern string
+	options string
+}
+
+// parser is a recursive descent parser for the subset of JavaScript that is
+// used to write shell expressions.
+type parser struct {
+	src string
+	pos int
+}
+
+// parse will parse the expression. A trailing semicolon is ignored.
+func parse(src string) (node, error) {
+	// parse expression
+	p := &parser{src: src}
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	// check end
+	p.skip()
+	if p.pos < len(p.src) && p.src[p.pos] == ';' {
+		p.pos++
+		p.skip()
+	}
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+
+	return expr, nil
+}
+
+// statements will split the source into the statements separated by
+// semicolons outside of strings, regular expressions and brackets. Empty
+// statements are omitted.
+func statements(src string) []string {
+	// prepare list
+	var list []string
+	add := func(stmt string) {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" {
+			list = append(list, stmt)
+		}
+	}
+
+	// split source
+	var depth, start int
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"', '\'':
+			// skip string
+			for i++; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case '/':
+			// skip regular expression
+			for i++; i < len(src) && src[i] != '/'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ';':
+			if depth == 0 {
+				add(src[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(src[start:])
+
+	return list
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) skip() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) expect(c byte) error {
+	if p.peek() != c {
+		if p.pos >= len(p.src) {
+			return p.errorf("expected %q, got end of input", c)
+		}
+		return p.errorf("expected %q, got %q", c, p.src[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) expression() (node, error) {
+	// parse primary
+	expr, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	// parse member accesses and calls
+	for {
+		switch p.peek() {
+		case '.':
+			p.pos++
+			p.skip()
+			name := p.ident()
+			if name == "" {
+				return nil, p.errorf("expected property name")
+			}
+			expr = &memberNode{object: expr, name: &literalNode{value: name}}
+		case '[':
+			p.pos++
+			key, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			err = p.expect(']')
+			if err != nil {
+				return nil, err
+			}
+			expr = &memberNode{object: expr, name: key}
+		case '(':
+			p.pos++
+			args, err := p.list(')')
+			if err != nil {
+				return nil, err
+			}
+			expr = &callNode{fn: expr, args: args}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	// check end
+	c := p.peek()
+	if c == 0 {
+		return nil, p.errorf("unexpected end of input")
+	}
+
+	switch {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		p.pos++
+		items, err := p.list(']')
+		if err != nil {
+			return nil, err
+		}
+		return &arrayNode{items: items}, nil
+	case c == '"' || c == '\'':
+		str, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return &literalNode{value: str}, nil
+	case c == '/':
+		return p.regex()
+	case c == '-' || c == '+' || c == '.' || isDigit(c):
+		return p.number()
+	case c == '(':
+		p.pos++
+		expr, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(')')
+	case isIdentStart(c):
+		name := p.ident()
+		switch name {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null", "undefined":
+			return &literalNode{value: nil}, nil
+		case "new":
+			p.skip()
+			name = p.ident()
+			if name == "" {
+				return nil, p.errorf("expected constructor name")
+			}
+			var args []node
+			if p.peek() == '(' {
+				p.pos++
+				var err error
+				args, err = p.list(')')
+				if err != nil {
+					return nil, err
+				}
+			}
+			return &newNode{name: name, args: args}, nil
+		}
+		return &identNode{name: name}, nil
+	}
+
+	return nil, p.errorf("unexpected %q", c)
+}
+
+// list will parse a comma separated list of expressions until the closing
+// character. A trailing comma is allowed.
+func (p *parser) list(end byte) ([]node, error) {
+	var items []node
+	for {
+		// check end
+		if p.peek() == end {
+			p.pos++
+			return items, nil
+		}
+
+		// parse item
+		item, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		// check separator
+		if p.peek() == ',' {
+			p.pos++
+		} else if p.peek() != end {
+			return nil, p.expect(end)
+		}
+	}
+}
+
+func (p *parser) object() (node, error) {
+	// skip brace
+	p.pos++
+
+	obj := &objectNode{}
+	for {
+		// check end
+		c := p.peek()
+		if c == 0 {
+			return nil, p.errorf("unexpected end of input")
+		} else if c == '}' {
+			p.pos++
+			return obj, nil
+		}
+
+		// parse key
+		var key string
+		switch {
+		case c == '"' || c == '\'':
+			var err error
+			key, err = p.string()
+			if err != nil {
+				return nil, err
+			}
+		case isIdentStart(c) || isDigit(c):
+			start := p.pos
+			for p.pos < len(p.src) && (isIdentPart(p.src[p.pos]) || p.src[p.pos] == '.') {
+				p.pos++
+			}
+			key = p.src[start:p.pos]
+		default:
+			return nil, p.errorf("expected object key, got %q", c)
+		}
+
+		// parse value
+		err := p.expect(':')
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		obj.keys = append(obj.keys, key)
+		obj.values = append(obj.values, value)
+
+		// check separator
+		if p.peek() == ',' {
+			p.pos++
+		} else if p.peek() != '}' {
+			return nil, p.expect('}')
+		}
+	}
+}
+
+func (p *parser) ident() string {
+	start := p.pos
+	if p.pos < len(p.src) && isIdentStart(p.src[p.pos]) {
+		p.pos++
+		for p.pos < len(p.src) && isIdentPart(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *parser) string() (string, error) {
+	// get quote
+	quote := p.src[p.pos]
+	p.pos++
+
+	// read characters
+	var buf strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case quote:
+			return buf.String(), nil
+		case '\\':
+			if p.pos >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			c = p.src[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'r':
+				buf.WriteByte('\r')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				buf.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				buf.WriteByte(c)
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
+
+func (p *parser) regex() (node, error) {
+	// skip slash
+	p.pos++
+
+	// read pattern
+	var buf strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated regular expression")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		if c == '/' {
+			break
+		} else if c == '\\' && p.pos < len(p.src) {
+			buf.WriteByte(c)
+			c = p.src[p.pos]
+			p.pos++
+		}
+		buf.WriteByte(c)
+	}
+
+	// read options
+	start := p.pos
+	for p.pos < len(p.src) && unicode.IsLetter(rune(p.src[p.pos])) {
+		p.pos++
+	}
+
+	return &regexNode{pattern: buf.String(), options: p.src[start:p.pos]}, nil
+}
+
+func (p *parser) number() (node, error) {
+	// read number
+	start := p.pos
+	if p.src[p.pos] == '-' || p.src[p.pos] == '+' {
+		p.pos++
+	}
+	integer := true
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '.' || c == 'e' || c == 'E' {
+			integer = false
+		} else if (c == '-' || c == '+') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E') {
+			// exponent sign
+		} else if !isDigit(c) && !isIdentPart(c) {
+			break
+		}
+		p.pos++
+	}
+	str := p.src[start:p.pos]
+
+	// handle special values
+	switch strings.TrimLeft(str, "+-") {
+	case "Infinity", "NaN":
+		f, _ := strconv.ParseFloat(str, 64)
+		return &literalNode{value: f}, nil
+	}
+
+	// parse integer
+	if integer {
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err == nil {
+			if n >= -1<<31 && n < 1<<31 {
+				return &literalNode{value: int32(n)}, nil
+			}
+			return &literalNode{value: n}, nil
+		}
+	}
+
+	// parse float
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid number %q", str)
+	}
+
+	return &literalNode{value: f}, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/server"
+)
+
+func TestShellParse(t *testing.T) {
+	for _, item := range []struct {
+		src string
+		val interface{}
+		err string
+	}{
+		{
+			src: `{a: 1, 'b': "x\"y", $gt: -2.5, "c.d": [true, null, 3000000000]};`,
+			val: bson.D{
+				{Key: "a", Value: int32(1)},
+				{Key: "b", Value: `x"y`},
+				{Key: "$gt", Value: -2.5},
+				{Key: "c.d", Value: bson.A{true, nil, int64(3000000000)}},
+			},
+		},
+		{
+			src: `{re: /a\/b+/i, id: ObjectId("5f5f5f5f5f5f5f5f5f5f5f5f"), n: NumberLong("7"), i: NumberInt(2)}`,
+			val: bson.D{
+				{Key: "re", Value: primitive.Regex{Pattern: `a\/b+`, Options: "i"}},
+				{Key: "id", Value: primitive.ObjectID{0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f, 0x5f}},
+				{Key: "n", Value: int64(7)},
+				{Key: "i", Value: int32(2)},
+			},
+		},
+		{
+			src: `{d: ISODate("2020-01-02T03:04:05Z"), e: new Date(0), t: Timestamp(1, 2), trailing: [1,],}`,
+			val: bson.D{
+				{Key: "d", Value: primitive.DateTime(1577934245000)},
+				{Key: "e", Value: primitive.DateTime(0)},
+				{Key: "t", Value: primitive.Timestamp{T: 1, I: 2}},
+				{Key: "trailing", Value: bson.A{int32(1)}},
+			},
+		},
+		{
+			src: `{a: {b: [10, 20]}}.a.b[1]`,
+			val: int32(20),
+		},
+		{
+			src: `{a: 1`,
+			err: "syntax error at position 6: expected '}', got end of input",
+		},
+		{
+			src: `{a: 1} x`,
+			err: `syntax error at position 8: unexpected "x"`,
+		},
+		{
+			src: `'abc`,
+			err: "syntax error at position 5: unterminated string",
+		},
+		{
+			src: `foo(1)`,
+			err: "ReferenceError: foo is not defined",
+		},
+		{
+			src: `{a: db}`,
+			err: "TypeError: test is not a value",
+		},
+	} {
+		expr, err := parse(item.src)
+		if err == nil {
+			var val interface{}
+			val, err = (&evaluator{db: "test"}).eval(expr)
+			if err == nil {
+				assert.Equal(t, item.val, val, item.src)
+			}
+		}
+		if item.err != "" {
+			assert.EqualError(t, err, item.err, item.src)
+		} else {
+			assert.NoError(t, err, item.src)
+		}
+	}
+}
+
+func TestShell(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.bson")
+
+	out, err := invoke(t, strings.Join([]string{
+		`db.users.insertMany([{_id: 1, name: "a", age: 31}, {_id: 2, name: "b", age: 25}, {_id: 3, name: "c", age: NumberLong(40)}])`,
+		`db.users.find({age: {$gt: 30}}).sort({name: -1}).limit(5)`,
+		`db.users.find({}, {name: 1}).skip(2)`,
+		`db.users.findOne({name: "b"}).age`,
+		`db.users.findOne({name: "x"})`,
+		`db.users.findOne({name: /^B/i}).name; db.users.countDocuments({name: {$in: [/^a/, "c;"]}});`,
+		`db.users.countDocuments({name: {$regex: "^[ab]", $options: "i"}})`,
+		`db.users.find().count()`,
+		`db.users.distinct("name", {age: {$lt: 40}})`,
+		`db.users.updateOne({_id: 1}, {$inc: {age: 1}})`,
+		`db.users.updateMany({_id: 4}, {$set: {age: 1}}, {upsert: true})`,
+		`db.users.deleteOne({_id: 4})`,
+		`db.users.aggregate([{$group: {_id: null, total: {$sum: "$age"}}}])`,
+		`db.users.createIndex({name: 1}, {unique: true})`,
+		`db.users.getIndexes().length`,
+		`show collections`,
+		`use other`,
+		`db.getName()`,
+		`db.getSiblingDB("test").getCollection("users").estimatedDocumentCount()`,
+		`db.runCommand("ping")`,
+		`exit`,
+		`db.ignored.insertOne({})`,
+	}, "\n"), "shell", file)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		`{"acknowledged":true,"insertedIds":[1,2,3]}`,
+		`{"_id":3,"name":"c","age":40}`,
+		`{"_id":1,"name":"a","age":31}`,
+		`{"_id":3,"name":"c"}`,
+		`25`,
+		`null`,
+		`b`,
+		`1`,
+		`2`,
+		`3`,
+		`["a","b"]`,
+		`{"acknowledged":true,"matchedCount":1,"modifiedCount":1,"upsertedCount":0}`,
+		`{"acknowledged":true,"matchedCount":0,"modifiedCount":0,"upsertedCount":1,"upsertedId":4}`,
+		`{"acknowledged":true,"deletedCount":1}`,
+		`{"_id":null,"total":97}`,
+		`name_1`,
+		`2`,
+		`users`,
+		`switched to db other`,
+		`other`,
+		`3`,
+		`{"ok":1.0}`,
+		``,
+	}, "\n"), out)
+
+	out, err = invoke(t, "", "shell", "-eval", `db.users.find({_id: 3}, {_id: 0})`, "-canonical", file)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"name\":\"c\",\"age\":{\"$numberLong\":\"40\"}}\n", out)
+
+	out, err = invoke(t, "db.users.find()\nit\nit\n", "shell", file)
+	assert.EqualError(t, err, "line 2: no cursor")
+	assert.Equal(t, 3, strings.Count(out, "\n"))
+
+	out, err = invoke(t, "", "shell", "-eval", `db.users.fnord()`, file)
+	assert.EqualError(t, err, "TypeError: db.users.fnord is not a function")
+	assert.Empty(t, out)
+
+	_, err = invoke(t, "", "shell")
+	assert.ErrorIs(t, err, errUsage)
+}
+
+func TestShellStatements(t *testing.T) {
+	for _, item := range []struct {
+		src  string
+		list []string
+	}{
+		{src: ``, list: nil},
+		{src: ` ; ;`, list: nil},
+		{src: `db.foo.find()`, list: []string{`db.foo.find()`}},
+		{src: `use test; show collections;`, list: []string{`use test`, `show collections`}},
+		{src: `db.foo.find({a: "x;y", 'b': '\';'}); it`, list: []string{`db.foo.find({a: "x;y", 'b': '\';'})`, `it`}},
+		{src: `db.foo.find({a: /;\/;/}) ;db.bar.find()`, list: []string{`db.foo.find({a: /;\/;/})`, `db.bar.find()`}},
+		{src: `db.foo.find({a: 1};)`, list: []string{`db.foo.find({a: 1};)`}},
+	} {
+		assert.Equal(t, item.list, statements(item.src), item.src)
+	}
+}
+
+func TestShellPaging(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.bson")
+
+	docs := make([]string, 0, 45)
+	for i := 0; i < 45; i++ {
+		docs = append(docs, "{}")
+	}
+	_, err := invoke(t, "", "shell", "-eval", "db.items.insertMany(["+strings.Join(docs, ",")+"])", file)
+	assert.NoError(t, err)
+
+	out, err := invoke(t, "db.items.find()\nit\nit\n", "shell", file)
+	assert.NoError(t, err)
+	assert.Equal(t, 45, strings.Count(out, "$oid"))
+	assert.Equal(t, 2, strings.Count(out, `Type "it" for more`))
+}
+
+func TestShellServer(t *testing.T) {
+	engine, err := lungo.CreateEngine(lungo.Options{
+		Store: lungo.NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := server.NewServer(server.Options{
+		Engine: engine,
+	})
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	defer srv.Close()
+
+	uri := "mongodb://" + listener.Addr().String() + "/?directConnection=true"
+
+	out, err := invoke(t, "db.users.insertOne({_id: 1, name: 'a'})\ndb.users.find()\n", "shell", "-uri", uri, "-db", "app")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"acknowledged\":true,\"insertedId\":1}\n{\"_id\":1,\"name\":\"a\"}\n", out)
+
+	n, err := lungo.NewClient(engine).Database("app").Collection("users").CountDocuments(nil, bson.M{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestShellComplete(t *testing.T) {
+	client, engine, err := lungo.Open(nil, lungo.Options{
+		Store: lungo.NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	_, err = client.Database("test").Collection("users").InsertOne(nil, bson.M{})
+	assert.NoError(t, err)
+	_, err = client.Database("test").Collection("uploads").InsertOne(nil, bson.M{})
+	assert.NoError(t, err)
+
+	sh := &shell{
+		env:  &env{ctx: context.Background()},
+		eval: &evaluator{ctx: context.Background(), client: client, db: "test"},
+	}
+
+	assert.Equal(t, []string{"db.uploads", "db.users"}, sh.complete("db.u"))
+	assert.Equal(t, []string{"db.getCollection", "db.getCollectionNames"}, sh.complete("db.getC"))
+	assert.Equal(t, []string{"db.users.find", "db.users.findOne"}, sh.complete("db.users.fi"))
+	assert.Equal(t, []string{"db.users.find().skip", "db.users.find().sort"}, sh.complete("db.users.find().s"))
+	assert.Equal(t, []string{"x = db.users"}, sh.complete("x = db.use"))
+	assert.Equal(t, []string{"use test"}, sh.complete("use t"))
+	assert.Equal(t, []string{"show collections"}, sh.complete("show c"))
+}
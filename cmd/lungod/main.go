@@ -0,0 +1,88 @@
+// Command lungod serves a lungo database using the MongoDB wire protocol.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/server"
+)
+
+var file = flag.String("file", "", "the database file (in-memory if empty)")
+var addr = flag.String("addr", "localhost:27017", "the TCP address to listen on")
+var socket = flag.String("socket", "", "the Unix socket to listen on instead of the TCP address")
+var version = flag.String("version", "", "the reported server version")
+var auth = flag.Bool("auth", false, "whether clients must authenticate")
+
+func main() {
+	// parse flags
+	flag.Parse()
+
+	// prepare store
+	var store lungo.Store = lungo.NewMemoryStore()
+	if *file != "" {
+		store = lungo.NewFileStore(*file, 0666)
+	}
+
+	// create engine
+	engine, err := lungo.CreateEngine(lungo.Options{
+		Store:   store,
+		Version: *version,
+		ExpireErrors: func(err error) {
+			log.Printf("expire error: %s", err.Error())
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// create listener
+	var listener net.Listener
+	address := *addr
+	if *socket != "" {
+		_ = os.Remove(*socket)
+		listener, err = net.Listen("unix", *socket)
+		address = *socket
+	} else {
+		listener, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		engine.Close()
+		log.Fatal(err)
+	}
+
+	// create server
+	srv := server.NewServer(server.Options{
+		Engine:  engine,
+		Address: address,
+		Auth:    *auth,
+		Errors: func(err error) {
+			log.Printf("connection error: %s", err.Error())
+		},
+	})
+
+	// close server on signal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		srv.Close()
+	}()
+
+	// serve connections
+	fmt.Printf("lungod listening on %s\n", listener.Addr().String())
+	err = srv.Serve(listener)
+	if err != nil && err != server.ErrServerClosed {
+		log.Print(err)
+	}
+
+	// close server and engine
+	srv.Close()
+	engine.Close()
+}
@@ -3,6 +3,7 @@ package lungo
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -21,8 +22,33 @@ type Collection struct {
 }
 
 // Aggregate implements the ICollection.Aggregate method.
-func (c *Collection) Aggregate(context.Context, interface{}, ...*options.AggregateOptions) (ICursor, error) {
-	panic("lungo: not implemented")
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (ICursor, error) {
+	// prepare pipeline
+	stages, let, err := prepareAggregate(pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// open change stream
+	stream, ok, err := openChangeStream(c.engine, c.handle, stages, true)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return stream, nil
+	}
+
+	// count operation
+	c.engine.count("command", 1)
+
+	// run pipeline (pipelines with output stages need a write transaction)
+	res, err := c.use(ctx, mongokit.HasOutputStage(stages), func(txn *Transaction) (interface{}, error) {
+		return txn.Aggregate(c.handle, stages, let)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{list: res.(bsonkit.List)}, nil
 }
 
 // BulkWrite implements the ICollection.BulkWrite method.
@@ -33,6 +59,7 @@ func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, o
 	// assert supported options
 	assertOptions(opt, map[string]string{
 		"Comment": ignored,
+		"Let":     supported,
 		"Ordered": supported,
 	})
 
@@ -42,6 +69,12 @@ func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, o
 		ordered = *opt.Ordered
 	}
 
+	// get let (the driver stores a pointer to the value)
+	let := opt.Let
+	if ptr, ok := let.(*interface{}); ok {
+		let = *ptr
+	}
+
 	// prepare operations
 	ops := make([]Operation, 0, len(models))
 
@@ -101,8 +134,19 @@ func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, o
 			Limit:  limit,
 		}
 
-		// transform document
-		if document != nil {
+		// transform document or update
+		if document != nil && opcode == Update {
+			upd, err := transformUpdate(document, let)
+			if err != nil {
+				return nil, err
+			}
+			switch upd := upd.(type) {
+			case bsonkit.Doc:
+				op.Document = upd
+			case *mongokit.UpdatePipeline:
+				op.Pipeline = upd
+			}
+		} else if document != nil {
 			doc, err := bsonkit.Transform(document)
 			if err != nil {
 				return nil, err
@@ -119,7 +163,7 @@ func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, o
 
 		// transform filter
 		if filter != nil {
-			flt, err := bsonkit.Transform(filter)
+			flt, err := transformFilter(filter, let)
 			if err != nil {
 				return nil, err
 			}
@@ -144,8 +188,11 @@ func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, o
 		ops = append(ops, op)
 	}
 
+	// count operations
+	c.engine.countOperations(ops)
+
 	// run bulk
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Bulk(c.handle, ops, ordered)
 	})
 	if err != nil {
@@ -172,9 +219,10 @@ func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, o
 	for i, res := range results {
 		// check error
 		if res.Error != nil {
+			code, _ := ErrorCode(res.Error)
 			errors = append(errors, mongo.WriteError{
 				Index:   i,
-				Code:    0,
+				Code:    int(code),
 				Message: res.Error.Error(),
 			})
 			continue
@@ -267,8 +315,11 @@ func (c *Collection) CountDocuments(ctx context.Context, filter interface{}, opt
 		limit = int(*opt.Limit)
 	}
 
+	// count operation
+	c.engine.count("command", 1)
+
 	// find documents
-	res, err := useTransaction(ctx, c.engine, false, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, false, func(txn *Transaction) (interface{}, error) {
 		return txn.Find(c.handle, query, nil, skip, limit)
 	})
 	if err != nil {
@@ -311,8 +362,11 @@ func (c *Collection) DeleteMany(ctx context.Context, filter interface{}, opts ..
 		return nil, err
 	}
 
+	// count operation
+	c.engine.count("delete", 1)
+
 	// delete documents
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Delete(c.handle, query, nil, 0, 0)
 	})
 	if err != nil {
@@ -349,8 +403,11 @@ func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...
 		return nil, err
 	}
 
+	// count operation
+	c.engine.count("delete", 1)
+
 	// delete document
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Delete(c.handle, query, nil, 0, 1)
 	})
 	if err != nil {
@@ -392,8 +449,11 @@ func (c *Collection) Distinct(ctx context.Context, field string, filter interfac
 		return nil, err
 	}
 
+	// count operation
+	c.engine.count("command", 1)
+
 	// find documents
-	res, err := useTransaction(ctx, c.engine, false, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, false, func(txn *Transaction) (interface{}, error) {
 		return txn.Find(c.handle, query, nil, 0, 0)
 	})
 	if err != nil {
@@ -411,6 +471,9 @@ func (c *Collection) Distinct(ctx context.Context, field string, filter interfac
 
 // Drop implements the ICollection.Drop method.
 func (c *Collection) Drop(ctx context.Context) error {
+	// count operation
+	c.engine.count("command", 1)
+
 	// begin transaction
 	txn, err := c.engine.Begin(ctx, true)
 	if err != nil {
@@ -446,8 +509,11 @@ func (c *Collection) EstimatedDocumentCount(ctx context.Context, opts ...*option
 		"MaxTime": ignored,
 	})
 
+	// count operation
+	c.engine.count("command", 1)
+
 	// count documents
-	res, err := useTransaction(ctx, c.engine, false, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, false, func(txn *Transaction) (interface{}, error) {
 		return txn.CountDocuments(c.handle)
 	})
 	if err != nil {
@@ -520,8 +586,11 @@ func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*opti
 		limit = int(*opt.Limit)
 	}
 
+	// count operation
+	c.engine.count("query", 1)
+
 	// find documents
-	res, err := useTransaction(ctx, c.engine, false, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, false, func(txn *Transaction) (interface{}, error) {
 		return txn.Find(c.handle, query, sort, skip, limit)
 	})
 	if err != nil {
@@ -597,8 +666,11 @@ func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*o
 		}
 	}
 
+	// count operation
+	c.engine.count("query", 1)
+
 	// find documents
-	res, err := useTransaction(ctx, c.engine, false, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, false, func(txn *Transaction) (interface{}, error) {
 		return txn.Find(c.handle, query, sort, skip, 1)
 	})
 	if err != nil {
@@ -667,8 +739,11 @@ func (c *Collection) FindOneAndDelete(ctx context.Context, filter interface{}, o
 		}
 	}
 
+	// count operation
+	c.engine.count("command", 1)
+
 	// delete documents
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Delete(c.handle, query, sort, 0, 1)
 	})
 	if err != nil {
@@ -767,8 +842,11 @@ func (c *Collection) FindOneAndReplace(ctx context.Context, filter, replacement
 		returnAfter = *opt.ReturnDocument == options.After
 	}
 
+	// count operation
+	c.engine.count("command", 1)
+
 	// insert document
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Replace(c.handle, query, sort, repl, upsert)
 	})
 	if err != nil {
@@ -812,6 +890,7 @@ func (c *Collection) FindOneAndUpdate(ctx context.Context, filter, update interf
 		"ArrayFilters":   supported,
 		"Comment":        ignored,
 		"Hint":           ignored,
+		"Let":            supported,
 		"MaxTime":        ignored,
 		"Projection":     supported,
 		"ReturnDocument": supported,
@@ -830,7 +909,7 @@ func (c *Collection) FindOneAndUpdate(ctx context.Context, filter, update interf
 	}
 
 	// transform filter
-	query, err := bsonkit.Transform(filter)
+	query, err := transformFilter(filter, opt.Let)
 	if err != nil {
 		return &SingleResult{err: err}
 	}
@@ -853,8 +932,8 @@ func (c *Collection) FindOneAndUpdate(ctx context.Context, filter, update interf
 		}
 	}
 
-	// transform document
-	upd, err := bsonkit.Transform(update)
+	// transform update
+	upd, err := transformUpdate(update, opt.Let)
 	if err != nil {
 		return &SingleResult{err: err}
 	}
@@ -880,8 +959,11 @@ func (c *Collection) FindOneAndUpdate(ctx context.Context, filter, update interf
 		}
 	}
 
+	// count operation
+	c.engine.count("command", 1)
+
 	// update documents
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Update(c.handle, query, sort, upd, 0, 1, upsert, arrayFilters)
 	})
 	if err != nil {
@@ -960,8 +1042,11 @@ func (c *Collection) InsertMany(ctx context.Context, documents []interface{}, op
 		ordered = *opt.Ordered
 	}
 
+	// count operation
+	c.engine.count("insert", len(list))
+
 	// insert documents
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Insert(c.handle, list, ordered)
 	})
 	if err != nil {
@@ -997,8 +1082,11 @@ func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts .
 		return nil, err
 	}
 
+	// count operation
+	c.engine.count("insert", 1)
+
 	// insert document
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Insert(c.handle, bsonkit.List{doc}, true)
 	})
 	if err != nil {
@@ -1074,8 +1162,11 @@ func (c *Collection) ReplaceOne(ctx context.Context, filter, replacement interfa
 		upsert = *opt.Upsert
 	}
 
+	// count operation
+	c.engine.count("update", 1)
+
 	// insert document
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Replace(c.handle, query, nil, doc, upsert)
 	})
 	if err != nil {
@@ -1124,6 +1215,7 @@ func (c *Collection) UpdateMany(ctx context.Context, filter, update interface{},
 		"ArrayFilters": supported,
 		"Comment":      ignored,
 		"Hint":         ignored,
+		"Let":          supported,
 		"Upsert":       supported,
 	})
 
@@ -1138,13 +1230,13 @@ func (c *Collection) UpdateMany(ctx context.Context, filter, update interface{},
 	}
 
 	// transform filter
-	query, err := bsonkit.Transform(filter)
+	query, err := transformFilter(filter, opt.Let)
 	if err != nil {
 		return nil, err
 	}
 
-	// transform document
-	doc, err := bsonkit.Transform(update)
+	// transform update
+	doc, err := transformUpdate(update, opt.Let)
 	if err != nil {
 		return nil, err
 	}
@@ -1164,8 +1256,11 @@ func (c *Collection) UpdateMany(ctx context.Context, filter, update interface{},
 		}
 	}
 
+	// count operation
+	c.engine.count("update", 1)
+
 	// update documents
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Update(c.handle, query, nil, doc, 0, 0, upsert, arrayFilters)
 	})
 	if err != nil {
@@ -1199,6 +1294,7 @@ func (c *Collection) UpdateOne(ctx context.Context, filter, update interface{},
 		"ArrayFilters": supported,
 		"Comment":      ignored,
 		"Hint":         ignored,
+		"Let":          supported,
 		"Upsert":       supported,
 	})
 
@@ -1213,13 +1309,13 @@ func (c *Collection) UpdateOne(ctx context.Context, filter, update interface{},
 	}
 
 	// transform filter
-	query, err := bsonkit.Transform(filter)
+	query, err := transformFilter(filter, opt.Let)
 	if err != nil {
 		return nil, err
 	}
 
-	// transform document
-	doc, err := bsonkit.Transform(update)
+	// transform update
+	doc, err := transformUpdate(update, opt.Let)
 	if err != nil {
 		return nil, err
 	}
@@ -1239,8 +1335,11 @@ func (c *Collection) UpdateOne(ctx context.Context, filter, update interface{},
 		}
 	}
 
+	// count operation
+	c.engine.count("update", 1)
+
 	// update documents
-	res, err := useTransaction(ctx, c.engine, true, func(txn *Transaction) (interface{}, error) {
+	res, err := c.use(ctx, true, func(txn *Transaction) (interface{}, error) {
 		return txn.Update(c.handle, query, nil, doc, 0, 1, upsert, arrayFilters)
 	})
 	if err != nil {
@@ -1264,6 +1363,18 @@ func (c *Collection) UpdateOne(ctx context.Context, filter, update interface{},
 	}, nil
 }
 
+// use will run the function in a transaction and track the latency of the
+// operation.
+func (c *Collection) use(ctx context.Context, lock bool, fn func(*Transaction) (interface{}, error)) (interface{}, error) {
+	// track latency
+	start := time.Now()
+	defer func() {
+		c.engine.track(c.handle, lock, time.Since(start))
+	}()
+
+	return useTransaction(ctx, c.engine, lock, fn)
+}
+
 // Watch implements the ICollection.Watch method.
 func (c *Collection) Watch(_ context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (IChangeStream, error) {
 	// merge options
@@ -1286,13 +1397,6 @@ func (c *Collection) Watch(_ context.Context, pipeline interface{}, opts ...*opt
 		return nil, err
 	}
 
-	// reject non-empty pipelines: lungo's change streams do not apply the
-	// pipeline, so silently accepting it would yield events that MongoDB
-	// would have filtered out
-	if len(filter) > 0 {
-		panic("lungo: change stream pipelines are not supported")
-	}
-
 	// get resume after
 	var resumeAfter bsonkit.Doc
 	if opt.ResumeAfter != nil {
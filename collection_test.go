@@ -11,6 +11,257 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+func TestCollectionAggregate(t *testing.T) {
+	// missing collection
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		csr, err := d.Collection("not-existing").Aggregate(nil, bson.A{})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{}, readAll(csr))
+	})
+
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := c.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "foo": "bar", "num": int32(1)},
+			bson.M{"_id": int32(2), "foo": "baz", "num": int32(2)},
+			bson.M{"_id": int32(3), "foo": "bar", "num": int32(3)},
+		})
+		assert.NoError(t, err)
+
+		// pipeline
+		csr, err := c.Aggregate(nil, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"foo": "bar"}}},
+			{{Key: "$sort", Value: bson.M{"num": -1}}},
+			{{Key: "$project", Value: bson.M{"_id": 0, "num": 1}}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"num": int32(3)},
+			{"num": int32(1)},
+		}, readAll(csr))
+
+		// variables
+		csr, err = c.Aggregate(nil, bson.A{
+			bson.M{"$match": bson.M{"$expr": bson.M{"$gt": bson.A{"$num", "$$min"}}}},
+			bson.M{"$count": "count"},
+		}, options.Aggregate().SetLet(bson.M{"min": int32(1)}))
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"count": int32(2)},
+		}, readAll(csr))
+
+		// invalid stage
+		_, err = c.Aggregate(nil, bson.A{
+			bson.M{"$foo": bson.M{}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestCollectionAggregateLookup(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		c1 := d.Collection(collectionName())
+		c2 := d.Collection(collectionName())
+
+		_, err := c1.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "ref": "a"},
+			bson.M{"_id": int32(2), "ref": "b"},
+		})
+		assert.NoError(t, err)
+
+		_, err = c2.Indexes().CreateOne(nil, mongo.IndexModel{
+			Keys: bson.M{"key": 1},
+		})
+		assert.NoError(t, err)
+
+		_, err = c2.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "key": "a", "next": "b"},
+			bson.M{"_id": int32(2), "key": "b", "next": "c"},
+			bson.M{"_id": int32(3), "key": "a"},
+		})
+		assert.NoError(t, err)
+
+		// lookup
+		csr, err := c1.Aggregate(nil, bson.A{
+			bson.M{"$lookup": bson.M{
+				"from":         c2.Name(),
+				"localField":   "ref",
+				"foreignField": "key",
+				"as":           "docs",
+			}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "ref": "a", "docs": bson.A{
+				bson.M{"_id": int32(1), "key": "a", "next": "b"},
+				bson.M{"_id": int32(3), "key": "a"},
+			}},
+			{"_id": int32(2), "ref": "b", "docs": bson.A{
+				bson.M{"_id": int32(2), "key": "b", "next": "c"},
+			}},
+		}, readAll(csr))
+
+		// graph lookup
+		csr, err = c1.Aggregate(nil, bson.A{
+			bson.M{"$match": bson.M{"_id": int32(1)}},
+			bson.M{"$graphLookup": bson.M{
+				"from":             c2.Name(),
+				"startWith":        "$ref",
+				"connectFromField": "next",
+				"connectToField":   "key",
+				"as":               "docs",
+			}},
+			bson.M{"$project": bson.M{"ids": "$docs._id"}},
+		})
+		assert.NoError(t, err)
+		res := readAll(csr)
+		assert.Len(t, res, 1)
+		assert.ElementsMatch(t, bson.A{int32(1), int32(2), int32(3)}, res[0]["ids"])
+	})
+}
+
+func TestCollectionAggregateOut(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		c1 := d.Collection(collectionName())
+		c2 := d.Collection(collectionName())
+
+		_, err := c1.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "num": int32(1)},
+			bson.M{"_id": int32(2), "num": int32(2)},
+		})
+		assert.NoError(t, err)
+
+		_, err = c2.InsertOne(nil, bson.M{"_id": int32(3), "num": int32(3)})
+		assert.NoError(t, err)
+
+		// out
+		csr, err := c1.Aggregate(nil, bson.A{
+			bson.M{"$match": bson.M{"num": bson.M{"$gt": int32(1)}}},
+			bson.M{"$out": c2.Name()},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{}, readAll(csr))
+
+		csr, err = c2.Find(nil, bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(2), "num": int32(2)},
+		}, readAll(csr))
+
+		// not final stage
+		_, err = c1.Aggregate(nil, bson.A{
+			bson.M{"$out": c2.Name()},
+			bson.M{"$match": bson.M{}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestCollectionAggregateMerge(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		c1 := d.Collection(collectionName())
+		c2 := d.Collection(collectionName())
+
+		_, err := c1.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "foo": "bar"},
+			bson.M{"_id": int32(2), "foo": "baz"},
+		})
+		assert.NoError(t, err)
+
+		_, err = c2.InsertOne(nil, bson.M{"_id": int32(1), "num": int32(1)})
+		assert.NoError(t, err)
+
+		stream, err := c2.Watch(nil, bson.A{})
+		assert.NoError(t, err)
+
+		// merge
+		csr, err := c1.Aggregate(nil, bson.A{
+			bson.M{"$merge": bson.M{
+				"into":        c2.Name(),
+				"whenMatched": "keepExisting",
+			}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{}, readAll(csr))
+
+		csr, err = c2.Find(nil, bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "num": int32(1)},
+			{"_id": int32(2), "foo": "baz"},
+		}, readAll(csr))
+
+		// change stream
+		assert.True(t, stream.Next(nil))
+		var event bson.M
+		err = stream.Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, "insert", event["operationType"])
+		assert.Equal(t, bson.M{"_id": int32(2)}, event["documentKey"])
+		assert.NoError(t, stream.Close(nil))
+
+		// fail
+		_, err = c1.Aggregate(nil, bson.A{
+			bson.M{"$merge": bson.M{
+				"into":        c2.Name(),
+				"whenMatched": "fail",
+			}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestCollectionAggregateStats(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := c.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "foo": "bar"},
+			bson.M{"_id": int32(2), "foo": "baz"},
+		})
+		assert.NoError(t, err)
+
+		_, err = c.Indexes().CreateOne(nil, mongo.IndexModel{
+			Keys: bson.M{"foo": 1},
+		})
+		assert.NoError(t, err)
+
+		// collection stats
+		csr, err := c.Aggregate(nil, bson.A{
+			bson.M{"$collStats": bson.M{
+				"count":        bson.M{},
+				"storageStats": bson.M{},
+			}},
+			bson.M{"$project": bson.M{
+				"_id":      0,
+				"count":    1,
+				"nindexes": "$storageStats.nindexes",
+			}},
+		})
+		assert.NoError(t, err)
+		res := readAll(csr)
+		assert.Len(t, res, 1)
+		assert.EqualValues(t, 2, res[0]["count"])
+		assert.EqualValues(t, 2, res[0]["nindexes"])
+
+		// index stats
+		csr, err = c.Aggregate(nil, bson.A{
+			bson.M{"$indexStats": bson.M{}},
+			bson.M{"$project": bson.M{"_id": 0, "name": 1, "key": 1}},
+			bson.M{"$sort": bson.M{"name": 1}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"name": "_id_", "key": bson.M{"_id": int32(1)}},
+			{"name": "foo_1", "key": bson.M{"foo": int32(1)}},
+		}, readAll(csr))
+
+		// first stage
+		_, err = c.Aggregate(nil, bson.A{
+			bson.M{"$match": bson.M{}},
+			bson.M{"$collStats": bson.M{}},
+		})
+		assert.Error(t, err)
+	})
+}
+
 func TestCollectionBulkWrite(t *testing.T) {
 	collectionTest(t, func(t *testing.T, c ICollection) {
 		id1 := primitive.NewObjectID()
@@ -580,6 +831,57 @@ func TestCollectionFind(t *testing.T) {
 	})
 }
 
+func TestCollectionRegex(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := c.InsertMany(nil, bson.A{
+			bson.M{"_id": int32(1), "name": "Alice"},
+			bson.M{"_id": int32(2), "name": "bob"},
+			bson.M{"_id": int32(3), "name": "Carol"},
+		})
+		assert.NoError(t, err)
+
+		// find
+		csr, err := c.Find(nil, bson.M{"name": primitive.Regex{Pattern: "^b", Options: "i"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(2), "name": "bob"},
+		}, readAll(csr))
+
+		csr, err = c.Find(nil, bson.M{"name": bson.M{"$regex": "^[ab]", "$options": "i"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "name": "Alice"},
+			{"_id": int32(2), "name": "bob"},
+		}, readAll(csr))
+
+		csr, err = c.Find(nil, bson.M{"name": bson.M{"$in": bson.A{
+			primitive.Regex{Pattern: "ol$"}, "bob",
+		}}})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(2), "name": "bob"},
+			{"_id": int32(3), "name": "Carol"},
+		}, readAll(csr))
+
+		// update
+		res, err := c.UpdateMany(nil, bson.M{"name": bson.M{"$regex": "^[A-Z]"}}, bson.M{
+			"$set": bson.M{"upper": true},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), res.ModifiedCount)
+
+		// delete
+		res2, err := c.DeleteMany(nil, bson.M{"name": bson.M{"$not": primitive.Regex{Pattern: "^[A-Z]"}}})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res2.DeletedCount)
+
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "name": "Alice", "upper": true},
+			{"_id": int32(3), "name": "Carol", "upper": true},
+		}, dumpCollection(c, false))
+	})
+}
+
 func TestCollectionFindSortArrayValuedField(t *testing.T) {
 	collectionTest(t, func(t *testing.T, c ICollection) {
 		_, err := c.InsertMany(nil, bson.A{
@@ -1933,6 +2235,213 @@ func TestCollectionUpdateOneUpsert(t *testing.T) {
 	})
 }
 
+func TestCollectionUpdatePipeline(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		id1 := primitive.NewObjectID()
+		id2 := primitive.NewObjectID()
+
+		_, err := c.InsertMany(nil, bson.A{
+			bson.M{
+				"_id": id1,
+				"foo": int32(1),
+			},
+			bson.M{
+				"_id": id2,
+				"foo": int32(2),
+			},
+		})
+		assert.NoError(t, err)
+
+		// update one
+		res1, err := c.UpdateOne(nil, bson.M{
+			"_id": id1,
+		}, bson.A{
+			bson.M{"$set": bson.M{
+				"bar": bson.M{"$add": bson.A{"$foo", "$$inc"}},
+			}},
+		}, options.Update().SetLet(bson.M{
+			"inc": int32(10),
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res1.MatchedCount)
+		assert.Equal(t, int64(1), res1.ModifiedCount)
+		assert.Equal(t, []bson.M{
+			{
+				"_id": id1,
+				"foo": int32(1),
+				"bar": int32(11),
+			},
+			{
+				"_id": id2,
+				"foo": int32(2),
+			},
+		}, dumpCollection(c, false))
+
+		// update many
+		res1, err = c.UpdateMany(nil, bson.M{}, bson.A{
+			bson.M{"$set": bson.M{
+				"foo": bson.M{"$multiply": bson.A{"$foo", int32(2)}},
+			}},
+			bson.M{"$unset": "bar"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), res1.MatchedCount)
+		assert.Equal(t, int64(2), res1.ModifiedCount)
+		assert.Equal(t, []bson.M{
+			{
+				"_id": id1,
+				"foo": int32(2),
+			},
+			{
+				"_id": id2,
+				"foo": int32(4),
+			},
+		}, dumpCollection(c, false))
+
+		// find one and update
+		var doc bson.M
+		err = c.FindOneAndUpdate(nil, bson.M{
+			"_id": id2,
+		}, bson.A{
+			bson.M{"$replaceWith": bson.M{
+				"baz": "$foo",
+			}},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{
+			"_id": id2,
+			"baz": int32(4),
+		}, doc)
+
+		// bulk write
+		res2, err := c.BulkWrite(nil, []mongo.WriteModel{
+			mongo.NewUpdateOneModel().SetFilter(bson.M{
+				"_id": id1,
+			}).SetUpdate(bson.A{
+				bson.M{"$set": bson.M{
+					"foo": "$$val",
+				}},
+			}),
+		}, options.BulkWrite().SetLet(bson.M{
+			"val": "bar",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res2.ModifiedCount)
+		assert.Equal(t, []bson.M{
+			{
+				"_id": id1,
+				"foo": "bar",
+			},
+			{
+				"_id": id2,
+				"baz": int32(4),
+			},
+		}, dumpCollection(c, false))
+
+		// upsert
+		id3 := primitive.NewObjectID()
+		res1, err = c.UpdateOne(nil, bson.M{
+			"_id": id3,
+		}, bson.A{
+			bson.M{"$set": bson.M{
+				"foo": bson.M{"$literal": "$qux"},
+			}},
+		}, options.Update().SetUpsert(true))
+		assert.NoError(t, err)
+		assert.Equal(t, id3, res1.UpsertedID)
+		assert.Equal(t, []bson.M{
+			{
+				"_id": id1,
+				"foo": "bar",
+			},
+			{
+				"_id": id2,
+				"baz": int32(4),
+			},
+			{
+				"_id": id3,
+				"foo": "$qux",
+			},
+		}, dumpCollection(c, false))
+
+		// invalid stage
+		_, err = c.UpdateOne(nil, bson.M{
+			"_id": id1,
+		}, bson.A{
+			bson.M{"$match": bson.M{}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestCollectionUpdateLet(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := c.InsertMany(nil, bson.A{
+			bson.M{"_id": int32(1), "foo": int32(1)},
+			bson.M{"_id": int32(2), "foo": int32(2)},
+		})
+		assert.NoError(t, err)
+
+		// update one
+		res1, err := c.UpdateOne(nil, bson.M{
+			"$expr": bson.M{"$eq": bson.A{"$foo", "$$x"}},
+		}, bson.M{
+			"$set": bson.M{"bar": "a"},
+		}, options.Update().SetLet(bson.M{
+			"x": int32(2),
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res1.MatchedCount)
+
+		// update many
+		res1, err = c.UpdateMany(nil, bson.M{
+			"$or": bson.A{
+				bson.M{"$expr": bson.M{"$lt": bson.A{"$foo", "$$x"}}},
+				bson.M{"bar": "a"},
+			},
+		}, bson.M{
+			"$inc": bson.M{"foo": int32(10)},
+		}, options.Update().SetLet(bson.M{
+			"x": int32(2),
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), res1.MatchedCount)
+
+		// find one and update
+		var doc bson.M
+		err = c.FindOneAndUpdate(nil, bson.M{
+			"$expr": bson.M{"$eq": bson.A{"$foo", "$$x"}},
+		}, bson.M{
+			"$set": bson.M{"baz": true},
+		}, options.FindOneAndUpdate().SetLet(bson.M{
+			"x": int32(11),
+		}).SetReturnDocument(options.After)).Decode(&doc)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{"_id": int32(1), "foo": int32(11), "baz": true}, doc)
+
+		// bulk write
+		res2, err := c.BulkWrite(nil, []mongo.WriteModel{
+			mongo.NewUpdateOneModel().SetFilter(bson.M{
+				"$expr": bson.M{"$eq": bson.A{"$foo", "$$x"}},
+			}).SetUpdate(bson.M{
+				"$unset": bson.M{"bar": ""},
+			}),
+			mongo.NewDeleteOneModel().SetFilter(bson.M{
+				"$expr": bson.M{"$eq": bson.A{"$foo", "$$y"}},
+			}),
+		}, options.BulkWrite().SetLet(bson.M{
+			"x": int32(12),
+			"y": int32(11),
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res2.ModifiedCount)
+		assert.Equal(t, int64(1), res2.DeletedCount)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(2), "foo": int32(12)},
+		}, dumpCollection(c, false))
+	})
+}
+
 func TestCollectionUpdateOneUpsertNoOpMatch(t *testing.T) {
 	collectionTest(t, func(t *testing.T, c ICollection) {
 		id := primitive.NewObjectID()
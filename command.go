@@ -0,0 +1,1648 @@
+package lungo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
+)
+
+// Command is a function that executes a database command. The returned reply
+// should not contain the "ok" field as it is added by the dispatcher.
+type Command func(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error)
+
+// CommandContext holds the state passed to a command.
+type CommandContext struct {
+	// The context that may carry a session.
+	Context context.Context
+
+	// The engine.
+	Engine *Engine
+
+	// The database the command is run against.
+	Database string
+
+	// The address of the server the client is connected to, if any.
+	Address string
+
+	// Whether the privileges of the user are enforced.
+	Authorize bool
+
+	// The authenticated user, if any.
+	User *User
+}
+
+// Commands defines the available commands that are dispatched by
+// Engine.RunCommand. Additional commands may be registered by adding them to
+// the map.
+var Commands = map[string]Command{}
+
+func init() {
+	// register core commands
+	Commands["find"] = commandFind
+	Commands["getMore"] = commandGetMore
+	Commands["killCursors"] = commandKillCursors
+	Commands["insert"] = commandInsert
+	Commands["update"] = commandUpdate
+	Commands["delete"] = commandDelete
+	Commands["findAndModify"] = commandFindAndModify
+	Commands["findandmodify"] = commandFindAndModify
+	Commands["count"] = commandCount
+	Commands["distinct"] = commandDistinct
+	Commands["aggregate"] = commandAggregate
+	Commands["create"] = commandCreate
+	Commands["drop"] = commandDrop
+	Commands["createIndexes"] = commandCreateIndexes
+	Commands["dropIndexes"] = commandDropIndexes
+	Commands["deleteIndexes"] = commandDropIndexes
+	Commands["listCollections"] = commandListCollections
+	Commands["listIndexes"] = commandListIndexes
+	Commands["listDatabases"] = commandListDatabases
+	Commands["dropDatabase"] = commandDropDatabase
+	Commands["renameCollection"] = commandRenameCollection
+}
+
+// the default number of documents in the first batch of a cursor
+const defaultBatchSize = 101
+
+// the default duration a getMore on a change stream cursor waits for events
+const defaultAwaitTime = time.Second
+
+// genericFields are the fields that drivers may add to any command. They do
+// not carry command specific arguments and should be skipped by commands that
+// interpret arbitrary fields.
+var genericFields = map[string]bool{
+	"comment":              true,
+	"lsid":                 true,
+	"txnNumber":            true,
+	"autocommit":           true,
+	"startTransaction":     true,
+	"readConcern":          true,
+	"writeConcern":         true,
+	"maxTimeMS":            true,
+	"apiVersion":           true,
+	"apiStrict":            true,
+	"apiDeprecationErrors": true,
+}
+
+// isGenericField returns whether the named field is a generic command field.
+// Fields prefixed with "$" (e.g. "$db") are always considered generic.
+func isGenericField(name string) bool {
+	return genericFields[name] || strings.HasPrefix(name, "$")
+}
+
+// commandCursor holds the remaining documents of a command cursor or the
+// stream of a change stream cursor. Cursors may only be used in the namespace
+// and by the user (owner) they have been opened with.
+type commandCursor struct {
+	ns     string
+	owner  string
+	list   bsonkit.List
+	stream *Stream
+	used   time.Time
+}
+
+// RunCommand will run the specified command against the database and return
+// the reply. Commands are looked up using the name of the first field in the
+// command document.
+func (e *Engine) RunCommand(ctx context.Context, database string, cmd bsonkit.Doc) (bsonkit.Doc, error) {
+	return (&CommandContext{
+		Context:  ctx,
+		Engine:   e,
+		Database: database,
+	}).Run(cmd)
+}
+
+// Run will run the specified command using the context and return the reply.
+func (c *CommandContext) Run(cmd bsonkit.Doc) (bsonkit.Doc, error) {
+	// check command
+	if cmd == nil || len(*cmd) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	// get command
+	name := (*cmd)[0].Key
+	fn, ok := Commands[name]
+	if !ok {
+		return nil, fmt.Errorf("no such command: '%s'", name)
+	}
+
+	// authorize command
+	err := c.authorize(name, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// count command
+	c.Engine.countCommand(name, cmd)
+
+	// ensure context
+	ctx := *c
+	ctx.Context = ensureContext(ctx.Context)
+
+	// run command
+	reply, err := fn(&ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// add status
+	reply = append(reply, bson.E{Key: "ok", Value: 1.0})
+
+	return &reply, nil
+}
+
+// openCursor will store the documents that exceed the batch size and return
+// the cursor id and first batch. A zero id is returned if all documents fit
+// into the batch. A negative batch size returns all documents.
+func (e *Engine) openCursor(ns, owner string, list bsonkit.List, size int) (int64, bsonkit.List) {
+	// check size
+	if size < 0 || len(list) <= size {
+		return 0, list
+	}
+
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// store cursor
+	e.cursorID++
+	e.cursors[e.cursorID] = &commandCursor{
+		ns:    ns,
+		owner: owner,
+		list:  list[size:],
+		used:  time.Now(),
+	}
+
+	return e.cursorID, list[:size]
+}
+
+// openStream will store the stream and return the cursor id.
+func (e *Engine) openStream(ns, owner string, stream *Stream) int64 {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// store cursor
+	e.cursorID++
+	e.cursors[e.cursorID] = &commandCursor{
+		ns:     ns,
+		owner:  owner,
+		stream: stream,
+		used:   time.Now(),
+	}
+
+	return e.cursorID
+}
+
+// cursorStream will return the stream of the specified cursor or nil if the
+// cursor does not exist or is not a change stream cursor. If detach is set, the
+// cursor is removed without closing the stream.
+func (e *Engine) cursorStream(id int64, ns, owner string, detach bool) *Stream {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// get cursor
+	cursor, ok := e.cursors[id]
+	if !ok || cursor.ns != ns || cursor.owner != owner || cursor.stream == nil {
+		return nil
+	}
+
+	// detach cursor or update usage
+	if detach {
+		delete(e.cursors, id)
+	} else {
+		cursor.used = time.Now()
+	}
+
+	return cursor.stream
+}
+
+// nextBatch will return the next batch of the specified cursor. A zero id is
+// returned if the cursor has been exhausted.
+func (e *Engine) nextBatch(id int64, ns, owner string, size int) (int64, bsonkit.List, error) {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// get cursor
+	cursor, ok := e.cursors[id]
+	if !ok || cursor.owner != owner {
+		return 0, nil, mongokit.CursorNotFound.Errorf("cursor id %d not found", id)
+	} else if cursor.ns != ns {
+		return 0, nil, fmt.Errorf("cursor id %d belongs to a different namespace", id)
+	}
+
+	// return all documents
+	if size <= 0 || len(cursor.list) <= size {
+		delete(e.cursors, id)
+		return 0, cursor.list, nil
+	}
+
+	// return batch
+	batch := cursor.list[:size]
+	cursor.list = cursor.list[size:]
+	cursor.used = time.Now()
+
+	return id, batch, nil
+}
+
+// killCursor will remove the specified cursor and return whether it existed.
+// Cursors of other namespaces or owners are not removed.
+func (e *Engine) killCursor(id int64, ns, owner string) bool {
+	// get cursor
+	e.mutex.Lock()
+	cursor, ok := e.cursors[id]
+	if ok && (cursor.ns != ns || cursor.owner != owner) {
+		ok = false
+	}
+
+	// remove cursor
+	if ok {
+		delete(e.cursors, id)
+	}
+	e.mutex.Unlock()
+
+	// close stream (without the engine lock as the stream acquires it)
+	if ok && cursor.stream != nil {
+		_ = cursor.stream.Close(nil)
+	}
+
+	return ok
+}
+
+// owner returns the identifier of the user that owns the cursors opened by the
+// command.
+func (c *CommandContext) owner() string {
+	if c.User == nil {
+		return ""
+	}
+
+	return c.User.ID
+}
+
+func (c *CommandContext) use(lock bool, fn func(*Transaction) (interface{}, error)) (interface{}, error) {
+	return useTransaction(c.Context, c.Engine, lock, fn)
+}
+
+func (c *CommandContext) collection(cmd bsonkit.Doc) (Handle, error) {
+	// get name
+	name, ok := (*cmd)[0].Value.(string)
+	if !ok || name == "" {
+		return Handle{}, fmt.Errorf("%s: collection name must be a non-empty string", (*cmd)[0].Key)
+	}
+
+	return Handle{c.Database, name}, nil
+}
+
+func (c *CommandContext) cursor(ns string, list bsonkit.List, size int, single bool) bson.D {
+	// get first batch
+	var id int64
+	batch := list
+	if single {
+		if size >= 0 && len(list) > size {
+			batch = list[:size]
+		}
+	} else {
+		id, batch = c.Engine.openCursor(ns, c.owner(), list, size)
+	}
+
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: toArray(batch)},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+	}
+}
+
+func toArray(list bsonkit.List) bson.A {
+	array := make(bson.A, 0, len(list))
+	for _, doc := range list {
+		array = append(array, *doc)
+	}
+	return array
+}
+
+func toInteger(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		if value == math.Trunc(value) && !math.IsInf(value, 0) {
+			return int64(value), true
+		}
+	}
+	return 0, false
+}
+
+func getDoc(cmd bsonkit.Doc, field string, required bool) (bsonkit.Doc, error) {
+	// get value
+	value := bsonkit.Get(cmd, field)
+	if value == bsonkit.Missing || value == nil {
+		if required {
+			return nil, fmt.Errorf("%s: missing required field '%s'", (*cmd)[0].Key, field)
+		}
+		return nil, nil
+	}
+
+	// check document
+	doc, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: '%s' must be a document", (*cmd)[0].Key, field)
+	}
+
+	return &doc, nil
+}
+
+func getList(cmd bsonkit.Doc, field string) (bsonkit.List, error) {
+	// get value
+	value := bsonkit.Get(cmd, field)
+	if value == bsonkit.Missing {
+		return nil, fmt.Errorf("%s: missing required field '%s'", (*cmd)[0].Key, field)
+	}
+
+	// check array
+	array, ok := value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: '%s' must be an array of documents", (*cmd)[0].Key, field)
+	}
+
+	// collect documents
+	list := make(bsonkit.List, 0, len(array))
+	for _, item := range array {
+		doc, ok := item.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: '%s' must be an array of documents", (*cmd)[0].Key, field)
+		}
+		list = append(list, &doc)
+	}
+
+	return list, nil
+}
+
+func getInt(cmd bsonkit.Doc, field string, def int) (int, error) {
+	// get value
+	value := bsonkit.Get(cmd, field)
+	if value == bsonkit.Missing || value == nil {
+		return def, nil
+	}
+
+	// convert value
+	num, ok := toInteger(value)
+	if !ok {
+		return 0, fmt.Errorf("%s: '%s' must be an integer", (*cmd)[0].Key, field)
+	}
+
+	return int(num), nil
+}
+
+func getBool(cmd bsonkit.Doc, field string, def bool) (bool, error) {
+	// get value
+	value := bsonkit.Get(cmd, field)
+	if value == bsonkit.Missing || value == nil {
+		return def, nil
+	}
+
+	// check numbers
+	if num, ok := toInteger(value); ok {
+		return num != 0, nil
+	}
+
+	// check boolean
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: '%s' must be a boolean", (*cmd)[0].Key, field)
+	}
+
+	return b, nil
+}
+
+func getBatchSize(cmd bsonkit.Doc, def int) (int, error) {
+	// get size
+	size, err := getInt(cmd, "cursor.batchSize", def)
+	if err != nil {
+		return 0, err
+	}
+	size, err = getInt(cmd, "batchSize", size)
+	if err != nil {
+		return 0, err
+	} else if size < 0 {
+		return 0, fmt.Errorf("%s: batch size must be non-negative", (*cmd)[0].Key)
+	}
+
+	return size, nil
+}
+
+func getUpdate(cmd bsonkit.Doc, value interface{}, let bsonkit.Doc) (interface{}, bool, error) {
+	switch value := value.(type) {
+	case bson.D:
+		// check replacement
+		if len(value) == 0 || !strings.HasPrefix(value[0].Key, "$") {
+			return &value, true, nil
+		}
+		return &value, false, nil
+	case bson.A:
+		// transform pipeline
+		stages, err := bsonkit.TransformList(value)
+		if err != nil {
+			return nil, false, err
+		}
+		return &mongokit.UpdatePipeline{
+			Stages:    stages,
+			Variables: let,
+		}, false, nil
+	default:
+		return nil, false, fmt.Errorf("%s: the update must be a document or a pipeline", (*cmd)[0].Key)
+	}
+}
+
+func writeErrors(results []Result) (bson.A, int) {
+	// collect errors
+	var errs bson.A
+	for i, res := range results {
+		if res.Error != nil {
+			code, name := ErrorCode(res.Error)
+			errs = append(errs, bson.D{
+				{Key: "index", Value: int32(i)},
+				{Key: "code", Value: code},
+				{Key: "codeName", Value: name},
+				{Key: "errmsg", Value: res.Error.Error()},
+			})
+		}
+	}
+
+	return errs, len(errs)
+}
+
+func commandFind(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get filter, sort and projection
+	filter, err := getDoc(cmd, "filter", false)
+	if err != nil {
+		return nil, err
+	} else if filter == nil {
+		filter = &bson.D{}
+	}
+	sort, err := getDoc(cmd, "sort", false)
+	if err != nil {
+		return nil, err
+	}
+	projection, err := getDoc(cmd, "projection", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get skip and limit
+	skip, err := getInt(cmd, "skip", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := getInt(cmd, "limit", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// get batch size
+	batchSize, err := getBatchSize(cmd, defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	single, err := getBool(cmd, "singleBatch", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle negative limit
+	if limit < 0 {
+		limit = -limit
+		single = true
+	}
+
+	// find documents
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		return txn.Find(handle, filter, sort, skip, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get list
+	list := res.(*Result).Matched
+
+	// apply projection
+	if projection != nil {
+		list, err = mongokit.ProjectList(list, projection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ctx.cursor(handle.String(), list, batchSize, single), nil
+}
+
+func commandGetMore(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get id
+	id, ok := toInteger((*cmd)[0].Value)
+	if !ok {
+		return nil, fmt.Errorf("getMore: cursor id must be an integer")
+	}
+
+	// get collection
+	coll, ok := bsonkit.Get(cmd, "collection").(string)
+	if !ok {
+		return nil, fmt.Errorf("getMore: collection must be a string")
+	}
+
+	// get batch size
+	batchSize, err := getInt(cmd, "batchSize", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// get namespace
+	ns := Handle{ctx.Database, coll}.String()
+
+	// handle change streams
+	stream := ctx.Engine.cursorStream(id, ns, ctx.owner(), false)
+	if stream != nil {
+		return streamBatch(ctx, cmd, id, ns, stream, "nextBatch", batchSize)
+	}
+
+	// get batch
+	id, batch, err := ctx.Engine.nextBatch(id, ns, ctx.owner(), batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "nextBatch", Value: toArray(batch)},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+	}, nil
+}
+
+// streamBatch will return the available events of a change stream cursor. The
+// first batch is always empty, subsequent batches wait for events up to the
+// "maxTimeMS" of the command.
+func streamBatch(ctx *CommandContext, cmd bsonkit.Doc, id int64, ns string, stream *Stream, field string, size int) (bson.D, error) {
+	// get events
+	var events bsonkit.List
+	if size >= 0 {
+		// get wait time
+		maxTime, err := getInt(cmd, "maxTimeMS", 0)
+		if err != nil {
+			return nil, err
+		}
+		wait := defaultAwaitTime
+		if maxTime > 0 {
+			wait = time.Duration(maxTime) * time.Millisecond
+		}
+
+		// await events
+		events, err = stream.batch(ctx.Context, size, wait)
+		if err != nil {
+			ctx.Engine.killCursor(id, ns, ctx.owner())
+			return nil, err
+		}
+	}
+
+	// remove exhausted cursor
+	if !stream.alive() {
+		ctx.Engine.killCursor(id, ns, ctx.owner())
+		id = 0
+	}
+
+	// prepare cursor
+	cursor := bson.D{
+		{Key: field, Value: toArray(events)},
+		{Key: "id", Value: id},
+		{Key: "ns", Value: ns},
+	}
+
+	// add resume token
+	if token := stream.ResumeToken(); token != nil {
+		var doc bson.D
+		err := bson.Unmarshal(token, &doc)
+		if err != nil {
+			return nil, err
+		}
+		cursor = append(cursor, bson.E{Key: "postBatchResumeToken", Value: doc})
+	}
+
+	return bson.D{
+		{Key: "cursor", Value: cursor},
+	}, nil
+}
+
+func commandKillCursors(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get cursors
+	ids, ok := bsonkit.Get(cmd, "cursors").(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("killCursors: cursors must be an array")
+	}
+
+	// kill cursors
+	killed := bson.A{}
+	notFound := bson.A{}
+	for _, value := range ids {
+		id, ok := toInteger(value)
+		if !ok {
+			return nil, fmt.Errorf("killCursors: cursor ids must be integers")
+		}
+		if ctx.Engine.killCursor(id, handle.String(), ctx.owner()) {
+			killed = append(killed, id)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+
+	return bson.D{
+		{Key: "cursorsKilled", Value: killed},
+		{Key: "cursorsNotFound", Value: notFound},
+		{Key: "cursorsAlive", Value: bson.A{}},
+		{Key: "cursorsUnknown", Value: bson.A{}},
+	}, nil
+}
+
+func commandInsert(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get documents
+	list, err := getList(cmd, "documents")
+	if err != nil {
+		return nil, err
+	} else if len(list) == 0 {
+		return nil, fmt.Errorf("insert: documents must not be empty")
+	}
+
+	// get ordered
+	ordered, err := getBool(cmd, "ordered", true)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare operations
+	ops := make([]Operation, 0, len(list))
+	for _, doc := range list {
+		ops = append(ops, Operation{
+			Opcode:   Insert,
+			Document: doc,
+		})
+	}
+
+	// insert documents
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		return txn.Bulk(handle, ops, ordered)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get results
+	results := res.([]Result)
+	errs, failed := writeErrors(results)
+
+	// prepare reply
+	reply := bson.D{
+		{Key: "n", Value: int32(len(results) - failed)},
+	}
+	if failed > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: errs})
+	}
+
+	return reply, nil
+}
+
+func commandUpdate(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get updates
+	updates, err := getList(cmd, "updates")
+	if err != nil {
+		return nil, err
+	}
+
+	// get ordered
+	ordered, err := getBool(cmd, "ordered", true)
+	if err != nil {
+		return nil, err
+	}
+
+	// get variables
+	let, err := getDoc(cmd, "let", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare operations
+	ops := make([]Operation, 0, len(updates))
+	for _, stmt := range updates {
+		// get filter
+		filter, err := getDoc(stmt, "q", true)
+		if err != nil {
+			return nil, err
+		}
+		filter, err = mongokit.BindVariables(filter, let)
+		if err != nil {
+			return nil, err
+		}
+
+		// get update
+		upd, replace, err := getUpdate(cmd, bsonkit.Get(stmt, "u"), let)
+		if err != nil {
+			return nil, err
+		}
+
+		// get flags
+		upsert, err := getBool(stmt, "upsert", false)
+		if err != nil {
+			return nil, err
+		}
+		multi, err := getBool(stmt, "multi", false)
+		if err != nil {
+			return nil, err
+		}
+
+		// get array filters
+		var arrayFilters bsonkit.List
+		if bsonkit.Get(stmt, "arrayFilters") != bsonkit.Missing {
+			arrayFilters, err = getList(stmt, "arrayFilters")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// prepare operation
+		op := Operation{
+			Filter:       filter,
+			Upsert:       upsert,
+			Limit:        1,
+			ArrayFilters: arrayFilters,
+		}
+		if multi {
+			op.Limit = 0
+		}
+
+		// set update
+		switch upd := upd.(type) {
+		case *mongokit.UpdatePipeline:
+			op.Opcode = Update
+			op.Pipeline = upd
+		case bsonkit.Doc:
+			if replace {
+				if multi {
+					return nil, fmt.Errorf("update: multi update is not supported for replacement-style update")
+				}
+				op.Opcode = Replace
+			} else {
+				op.Opcode = Update
+			}
+			op.Document = upd
+		}
+
+		// add operation
+		ops = append(ops, op)
+	}
+
+	// update documents
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		return txn.Bulk(handle, ops, ordered)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get results
+	results := res.([]Result)
+	errs, failed := writeErrors(results)
+
+	// count documents
+	var n, modified int
+	var upserted bson.A
+	for i, res := range results {
+		if res.Upserted != nil {
+			n++
+			upserted = append(upserted, bson.D{
+				{Key: "index", Value: int32(i)},
+				{Key: "_id", Value: bsonkit.Get(res.Upserted, "_id")},
+			})
+		} else {
+			n += len(res.Matched)
+			modified += len(res.Modified)
+		}
+	}
+
+	// prepare reply
+	reply := bson.D{
+		{Key: "n", Value: int32(n)},
+		{Key: "nModified", Value: int32(modified)},
+	}
+	if len(upserted) > 0 {
+		reply = append(reply, bson.E{Key: "upserted", Value: upserted})
+	}
+	if failed > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: errs})
+	}
+
+	return reply, nil
+}
+
+func commandDelete(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get deletes
+	deletes, err := getList(cmd, "deletes")
+	if err != nil {
+		return nil, err
+	}
+
+	// get ordered
+	ordered, err := getBool(cmd, "ordered", true)
+	if err != nil {
+		return nil, err
+	}
+
+	// get variables
+	let, err := getDoc(cmd, "let", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare operations
+	ops := make([]Operation, 0, len(deletes))
+	for _, stmt := range deletes {
+		// get filter
+		filter, err := getDoc(stmt, "q", true)
+		if err != nil {
+			return nil, err
+		}
+		filter, err = mongokit.BindVariables(filter, let)
+		if err != nil {
+			return nil, err
+		}
+
+		// get limit
+		limit, err := getInt(stmt, "limit", 0)
+		if err != nil {
+			return nil, err
+		} else if limit != 0 && limit != 1 {
+			return nil, fmt.Errorf("delete: the limit must be 0 or 1")
+		}
+
+		// add operation
+		ops = append(ops, Operation{
+			Opcode: Delete,
+			Filter: filter,
+			Limit:  limit,
+		})
+	}
+
+	// delete documents
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		return txn.Bulk(handle, ops, ordered)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get results
+	results := res.([]Result)
+	errs, failed := writeErrors(results)
+
+	// count documents
+	var n int
+	for _, res := range results {
+		n += len(res.Matched)
+	}
+
+	// prepare reply
+	reply := bson.D{
+		{Key: "n", Value: int32(n)},
+	}
+	if failed > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: errs})
+	}
+
+	return reply, nil
+}
+
+func commandFindAndModify(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get query, sort and fields
+	query, err := getDoc(cmd, "query", false)
+	if err != nil {
+		return nil, err
+	} else if query == nil {
+		query = &bson.D{}
+	}
+	sort, err := getDoc(cmd, "sort", false)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := getDoc(cmd, "fields", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get flags
+	remove, err := getBool(cmd, "remove", false)
+	if err != nil {
+		return nil, err
+	}
+	returnNew, err := getBool(cmd, "new", false)
+	if err != nil {
+		return nil, err
+	}
+	upsert, err := getBool(cmd, "upsert", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get variables
+	let, err := getDoc(cmd, "let", false)
+	if err != nil {
+		return nil, err
+	}
+	query, err = mongokit.BindVariables(query, let)
+	if err != nil {
+		return nil, err
+	}
+
+	// get update
+	var upd interface{}
+	var replace bool
+	update := bsonkit.Get(cmd, "update")
+	if remove && update != bsonkit.Missing {
+		return nil, fmt.Errorf("findAndModify: cannot specify both an update and remove=true")
+	} else if remove && (returnNew || upsert) {
+		return nil, fmt.Errorf("findAndModify: cannot specify new=true or upsert=true with remove=true")
+	} else if !remove {
+		if update == bsonkit.Missing {
+			return nil, fmt.Errorf("findAndModify: either an update or remove=true must be specified")
+		}
+		upd, replace, err = getUpdate(cmd, update, let)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get array filters
+	var arrayFilters bsonkit.List
+	if bsonkit.Get(cmd, "arrayFilters") != bsonkit.Missing {
+		arrayFilters, err = getList(cmd, "arrayFilters")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// modify document
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		if remove {
+			return txn.Delete(handle, query, sort, 0, 1)
+		} else if replace {
+			return txn.Replace(handle, query, sort, upd.(bsonkit.Doc), upsert)
+		}
+		return txn.Update(handle, query, sort, upd, 0, 1, upsert, arrayFilters)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get result
+	result := res.(*Result)
+
+	// get document
+	var doc bsonkit.Doc
+	if result.Upserted != nil {
+		if returnNew {
+			doc = result.Upserted
+		}
+	} else if len(result.Matched) > 0 {
+		doc = result.Matched[0]
+		if returnNew && len(result.Modified) > 0 {
+			doc = result.Modified[0]
+		}
+	}
+
+	// apply projection
+	if doc != nil && fields != nil {
+		doc, err = mongokit.Project(doc, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// prepare last error object
+	lastError := bson.D{
+		{Key: "n", Value: int32(len(result.Matched))},
+	}
+	if !remove {
+		lastError = append(lastError, bson.E{Key: "updatedExisting", Value: len(result.Matched) > 0})
+	}
+	if result.Upserted != nil {
+		lastError[0].Value = int32(1)
+		lastError = append(lastError, bson.E{Key: "upserted", Value: bsonkit.Get(result.Upserted, "_id")})
+	}
+
+	// get value
+	var value interface{}
+	if doc != nil {
+		value = *doc
+	}
+
+	return bson.D{
+		{Key: "lastErrorObject", Value: lastError},
+		{Key: "value", Value: value},
+	}, nil
+}
+
+func commandCount(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get query
+	query, err := getDoc(cmd, "query", false)
+	if err != nil {
+		return nil, err
+	} else if query == nil {
+		query = &bson.D{}
+	}
+
+	// get skip and limit
+	skip, err := getInt(cmd, "skip", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := getInt(cmd, "limit", 0)
+	if err != nil {
+		return nil, err
+	} else if limit < 0 {
+		limit = -limit
+	}
+
+	// find documents
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		return txn.Find(handle, query, nil, skip, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{
+		{Key: "n", Value: int32(len(res.(*Result).Matched))},
+	}, nil
+}
+
+func commandDistinct(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get key
+	key, ok := bsonkit.Get(cmd, "key").(string)
+	if !ok || key == "" {
+		return nil, fmt.Errorf("distinct: key must be a non-empty string")
+	}
+
+	// get query
+	query, err := getDoc(cmd, "query", false)
+	if err != nil {
+		return nil, err
+	} else if query == nil {
+		query = &bson.D{}
+	}
+
+	// find documents
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		return txn.Find(handle, query, nil, 0, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// collect values
+	values := mongokit.Distinct(res.(*Result).Matched, key)
+
+	return bson.D{
+		{Key: "values", Value: bson.A(values)},
+	}, nil
+}
+
+func commandAggregate(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle := Handle{ctx.Database}
+	ns := ctx.Database + ".$cmd.aggregate"
+	if num, ok := toInteger((*cmd)[0].Value); !ok || num != 1 {
+		var err error
+		handle, err = ctx.collection(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate: the argument must be a collection name or 1")
+		}
+		ns = handle.String()
+	}
+
+	// get pipeline
+	pipeline, err := getList(cmd, "pipeline")
+	if err != nil {
+		return nil, err
+	}
+
+	// open change stream
+	system := !ctx.Authorize || granted(ctx.User, Users[0], privRoot)
+	stream, ok, err := openChangeStream(ctx.Engine, handle, pipeline, system)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		id := ctx.Engine.openStream(ns, ctx.owner(), stream)
+		return streamBatch(ctx, cmd, id, ns, stream, "firstBatch", -1)
+	}
+
+	// get variables
+	let, err := getDoc(cmd, "let", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get batch size
+	batchSize, err := getBatchSize(cmd, defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// run pipeline
+	res, err := ctx.use(mongokit.HasOutputStage(pipeline), func(txn *Transaction) (interface{}, error) {
+		return txn.Aggregate(handle, pipeline, let)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ctx.cursor(ns, res.(bsonkit.List), batchSize, false), nil
+}
+
+func commandCreate(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// create collection
+	_, err = ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		if txn.Catalog().Namespaces[handle] != nil {
+			return nil, mongokit.NamespaceExists.Errorf("collection already exists. NS: %s", handle.String())
+		}
+		return nil, txn.Create(handle)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{}, nil
+}
+
+func commandDrop(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop collection
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		// get index count
+		namespace := txn.Catalog().Namespaces[handle]
+		if namespace == nil {
+			return -1, nil
+		}
+		count := len(namespace.Indexes)
+
+		// drop namespace
+		err := txn.Drop(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		return count, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// check existence
+	if res.(int) < 0 {
+		return bson.D{}, nil
+	}
+
+	return bson.D{
+		{Key: "nIndexesWas", Value: int32(res.(int))},
+		{Key: "ns", Value: handle.String()},
+	}, nil
+}
+
+func commandCreateIndexes(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get indexes
+	indexes, err := getList(cmd, "indexes")
+	if err != nil {
+		return nil, err
+	} else if len(indexes) == 0 {
+		return nil, fmt.Errorf("createIndexes: must specify at least one index")
+	}
+
+	// prepare configs
+	names := make([]string, 0, len(indexes))
+	configs := make([]mongokit.IndexConfig, 0, len(indexes))
+	for _, index := range indexes {
+		name, config, err := parseIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		configs = append(configs, config)
+	}
+
+	// create indexes
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		// get count
+		var before int
+		namespace := txn.Catalog().Namespaces[handle]
+		if namespace != nil {
+			before = len(namespace.Indexes)
+		}
+
+		// create indexes
+		for i, config := range configs {
+			_, err := txn.CreateIndex(handle, names[i], config)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// get count
+		after := len(txn.Catalog().Namespaces[handle].Indexes)
+
+		return bson.D{
+			{Key: "numIndexesBefore", Value: int32(before)},
+			{Key: "numIndexesAfter", Value: int32(after)},
+			{Key: "createdCollectionAutomatically", Value: namespace == nil},
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(bson.D), nil
+}
+
+// parseIndex will parse the name and configuration of the index specification.
+func parseIndex(spec bsonkit.Doc) (string, mongokit.IndexConfig, error) {
+	// get key
+	key, err := getDoc(spec, "key", true)
+	if err != nil {
+		return "", mongokit.IndexConfig{}, err
+	}
+
+	// get name
+	name, _ := bsonkit.Get(spec, "name").(string)
+
+	// get unique
+	unique, err := getBool(spec, "unique", false)
+	if err != nil {
+		return "", mongokit.IndexConfig{}, err
+	}
+
+	// get partial
+	partial, err := getDoc(spec, "partialFilterExpression", false)
+	if err != nil {
+		return "", mongokit.IndexConfig{}, err
+	}
+
+	// get expiry
+	var expiry time.Duration
+	if bsonkit.Get(spec, "expireAfterSeconds") != bsonkit.Missing {
+		seconds, err := getInt(spec, "expireAfterSeconds", 0)
+		if err != nil {
+			return "", mongokit.IndexConfig{}, err
+		} else if seconds == 0 {
+			expiry = time.Nanosecond
+		} else {
+			expiry = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return name, mongokit.IndexConfig{
+		Key:     key,
+		Unique:  unique,
+		Partial: partial,
+		Expiry:  expiry,
+	}, nil
+}
+
+func commandDropIndexes(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get index
+	index := bsonkit.Get(cmd, "index")
+
+	// drop indexes
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		// get count
+		namespace := txn.Catalog().Namespaces[handle]
+		if namespace == nil {
+			return nil, mongokit.NamespaceNotFound.Errorf("ns not found %s", handle.String())
+		}
+		count := len(namespace.Indexes)
+
+		// drop indexes
+		switch index := index.(type) {
+		case string:
+			if index == "*" {
+				index = ""
+			}
+			err = txn.DropIndex(handle, index)
+		case bson.D:
+			err = txn.DropIndexByKey(handle, &index)
+		case bson.A:
+			for _, item := range index {
+				name, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("dropIndexes: index names must be strings")
+				}
+				err = txn.DropIndex(handle, name)
+				if err != nil {
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("dropIndexes: index must be a name, key or list of names")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return count, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{
+		{Key: "nIndexesWas", Value: int32(res.(int))},
+	}, nil
+}
+
+func commandListCollections(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get filter
+	filter, err := getDoc(cmd, "filter", false)
+	if err != nil {
+		return nil, err
+	} else if filter == nil {
+		filter = &bson.D{}
+	}
+
+	// get name only
+	nameOnly, err := getBool(cmd, "nameOnly", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get batch size
+	batchSize, err := getBatchSize(cmd, defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// list collections
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		return txn.ListCollections(Handle{ctx.Database}, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get list
+	list := res.(bsonkit.List)
+
+	// apply name only
+	if nameOnly {
+		list, err = mongokit.ProjectList(list, &bson.D{
+			{Key: "_id", Value: int32(0)},
+			{Key: "name", Value: int32(1)},
+			{Key: "type", Value: int32(1)},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ctx.cursor(ctx.Database+".$cmd.listCollections", list, batchSize, false), nil
+}
+
+func commandListIndexes(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get batch size
+	batchSize, err := getBatchSize(cmd, defaultBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// list indexes
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		return txn.ListIndexes(handle)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get list
+	list := res.(bsonkit.List)
+	if list == nil {
+		return nil, mongokit.NamespaceNotFound.Errorf("ns does not exist: %s", handle.String())
+	}
+
+	return ctx.cursor(handle.String(), list, batchSize, false), nil
+}
+
+func commandListDatabases(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// check database
+	if ctx.Database != "admin" {
+		return nil, fmt.Errorf("listDatabases may only be run against the admin database")
+	}
+
+	// get filter
+	filter, err := getDoc(cmd, "filter", false)
+	if err != nil {
+		return nil, err
+	} else if filter == nil {
+		filter = &bson.D{}
+	}
+
+	// get name only
+	nameOnly, err := getBool(cmd, "nameOnly", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// list databases
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		return txn.ListDatabases(filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get list
+	list := res.(bsonkit.List)
+
+	// filter unauthorized databases
+	if ctx.Authorize {
+		var authorized bsonkit.List
+		for _, doc := range list {
+			name, _ := bsonkit.Get(doc, "name").(string)
+			if granted(ctx.User, name, privList) {
+				authorized = append(authorized, doc)
+			}
+		}
+		list = authorized
+	}
+
+	// handle name only
+	if nameOnly {
+		list, err = mongokit.ProjectList(list, &bson.D{
+			{Key: "name", Value: int32(1)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return bson.D{
+			{Key: "databases", Value: toArray(list)},
+		}, nil
+	}
+
+	// sum size
+	var totalSize int64
+	for _, doc := range list {
+		size, _ := toInteger(bsonkit.Get(doc, "sizeOnDisk"))
+		totalSize += size
+	}
+
+	return bson.D{
+		{Key: "databases", Value: toArray(list)},
+		{Key: "totalSize", Value: totalSize},
+		{Key: "totalSizeMb", Value: totalSize / 1024 / 1024},
+	}, nil
+}
+
+func commandDropDatabase(ctx *CommandContext, _ bsonkit.Doc) (bson.D, error) {
+	// drop database
+	_, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		return nil, txn.Drop(Handle{ctx.Database})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{
+		{Key: "dropped", Value: ctx.Database},
+	}, nil
+}
+
+func commandRenameCollection(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// check database
+	if ctx.Database != "admin" {
+		return nil, fmt.Errorf("renameCollection may only be run against the admin database")
+	}
+
+	// get namespaces
+	var handles [2]Handle
+	for i, value := range []interface{}{(*cmd)[0].Value, bsonkit.Get(cmd, "to")} {
+		ns, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("renameCollection: namespaces must be strings")
+		}
+		segments := strings.SplitN(ns, ".", 2)
+		if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+			return nil, fmt.Errorf("renameCollection: invalid namespace '%s'", ns)
+		}
+		handles[i] = Handle{segments[0], segments[1]}
+	}
+
+	// get drop target
+	dropTarget, err := getBool(cmd, "dropTarget", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// rename collection
+	_, err = ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		return nil, txn.Rename(handles[0], handles[1], dropTarget)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{}, nil
+}
@@ -0,0 +1,369 @@
+package lungo
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
+)
+
+func init() {
+	// register handshake commands
+	Commands["hello"] = commandHello
+	Commands["isMaster"] = commandHello
+	Commands["ismaster"] = commandHello
+	Commands["buildInfo"] = commandBuildInfo
+	Commands["buildinfo"] = commandBuildInfo
+	Commands["ping"] = commandPing
+	Commands["hostInfo"] = commandHostInfo
+	Commands["getParameter"] = commandGetParameter
+	Commands["listCommands"] = commandListCommands
+	Commands["connectionStatus"] = commandConnectionStatus
+}
+
+// the name of the reported replica set
+const replicaSetName = "lungo"
+
+// the address reported if the command context does not specify one
+const defaultAddress = "localhost:27017"
+
+// the maximum wire versions of the server versions
+var wireVersions = map[[2]int32]int32{
+	{3, 6}: 6,
+	{4, 0}: 7,
+	{4, 2}: 8,
+	{4, 4}: 9,
+	{5, 0}: 13,
+	{5, 1}: 14,
+	{5, 2}: 15,
+	{5, 3}: 16,
+	{6, 0}: 17,
+	{6, 1}: 18,
+	{6, 2}: 19,
+	{6, 3}: 20,
+	{7, 0}: 21,
+	{7, 1}: 22,
+	{7, 2}: 23,
+	{7, 3}: 24,
+	{8, 0}: 25,
+}
+
+// parseVersion will parse a "major.minor.patch" version.
+func parseVersion(version string) ([3]int32, bool) {
+	// split version
+	segments := strings.Split(version, ".")
+	if len(segments) != 3 {
+		return [3]int32{}, false
+	}
+
+	// parse segments
+	var parsed [3]int32
+	for i, segment := range segments {
+		num, err := strconv.ParseInt(segment, 10, 32)
+		if err != nil || num < 0 {
+			return [3]int32{}, false
+		}
+		parsed[i] = int32(num)
+	}
+
+	return parsed, true
+}
+
+// wireVersion returns the maximum wire version of the specified version. Newer
+// versions report the latest known wire version.
+func wireVersion(version [3]int32) int32 {
+	// check known versions
+	if wire, ok := wireVersions[[2]int32{version[0], version[1]}]; ok {
+		return wire
+	}
+
+	// find closest older version
+	var best [2]int32
+	var wire int32 = 6
+	for known, num := range wireVersions {
+		if known[0] < version[0] || (known[0] == version[0] && known[1] < version[1]) {
+			if known[0] > best[0] || (known[0] == best[0] && known[1] > best[1]) {
+				best = known
+				wire = num
+			}
+		}
+	}
+
+	return wire
+}
+
+// hostname returns the name of the host or "localhost" if unavailable.
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return host
+}
+
+// hostMemory returns the total memory of the host in megabytes. It is only
+// available on systems that provide "/proc/meminfo".
+func hostMemory() (int64, bool) {
+	// read info
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+
+	// find total
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return kb / 1024, true
+		}
+	}
+
+	return 0, false
+}
+
+func commandHello(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get version
+	version, _ := parseVersion(ctx.Engine.opts.Version)
+
+	// get address
+	address := ctx.Address
+	if address == "" {
+		address = defaultAddress
+	}
+
+	// prepare reply
+	var reply bson.D
+	if (*cmd)[0].Key == "hello" {
+		reply = append(reply, bson.E{Key: "isWritablePrimary", Value: true})
+	} else {
+		reply = append(reply, bson.E{Key: "ismaster", Value: true})
+	}
+
+	// acknowledge hello support
+	helloOk, err := getBool(cmd, "helloOk", false)
+	if err != nil {
+		return nil, err
+	} else if helloOk {
+		reply = append(reply, bson.E{Key: "helloOk", Value: true})
+	}
+
+	// report mechanisms of the requested user
+	if value, ok := bsonkit.Get(cmd, "saslSupportedMechs").(string); ok {
+		segments := strings.SplitN(value, ".", 2)
+		if len(segments) == 2 {
+			user, err := ctx.Engine.User(segments[0], segments[1])
+			if err != nil {
+				return nil, err
+			} else if user != nil {
+				mechanisms := bson.A{}
+				for _, mechanism := range user.Credentials.Mechanisms() {
+					mechanisms = append(mechanisms, mechanism)
+				}
+				reply = append(reply, bson.E{Key: "saslSupportedMechs", Value: mechanisms})
+			}
+		}
+	}
+
+	// get last write
+	now := time.Now()
+	last := bsonkit.Now()
+
+	return append(reply, bson.D{
+		{Key: "topologyVersion", Value: bson.D{
+			{Key: "processId", Value: ctx.Engine.process},
+			{Key: "counter", Value: int64(0)},
+		}},
+		{Key: "hosts", Value: bson.A{address}},
+		{Key: "setName", Value: replicaSetName},
+		{Key: "setVersion", Value: int32(1)},
+		{Key: "secondary", Value: false},
+		{Key: "primary", Value: address},
+		{Key: "me", Value: address},
+		{Key: "electionId", Value: primitive.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{Key: "lastWrite", Value: bson.D{
+			{Key: "opTime", Value: bson.D{
+				{Key: "ts", Value: last},
+				{Key: "t", Value: int64(1)},
+			}},
+			{Key: "lastWriteDate", Value: primitive.NewDateTimeFromTime(now)},
+			{Key: "majorityOpTime", Value: bson.D{
+				{Key: "ts", Value: last},
+				{Key: "t", Value: int64(1)},
+			}},
+			{Key: "majorityWriteDate", Value: primitive.NewDateTimeFromTime(now)},
+		}},
+		{Key: "maxBsonObjectSize", Value: int32(mongokit.MaxDocumentSize)},
+		{Key: "maxMessageSizeBytes", Value: int32(48000000)},
+		{Key: "maxWriteBatchSize", Value: int32(100000)},
+		{Key: "localTime", Value: primitive.NewDateTimeFromTime(now)},
+		{Key: "logicalSessionTimeoutMinutes", Value: int32(30)},
+		{Key: "connectionId", Value: int32(1)},
+		{Key: "minWireVersion", Value: int32(0)},
+		{Key: "maxWireVersion", Value: wireVersion(version)},
+		{Key: "readOnly", Value: false},
+	}...), nil
+}
+
+func commandBuildInfo(ctx *CommandContext, _ bsonkit.Doc) (bson.D, error) {
+	// get version
+	version, _ := parseVersion(ctx.Engine.opts.Version)
+
+	return bson.D{
+		{Key: "version", Value: ctx.Engine.opts.Version},
+		{Key: "gitVersion", Value: ""},
+		{Key: "modules", Value: bson.A{}},
+		{Key: "allocator", Value: "system"},
+		{Key: "javascriptEngine", Value: "none"},
+		{Key: "sysInfo", Value: "deprecated"},
+		{Key: "versionArray", Value: bson.A{version[0], version[1], version[2], int32(0)}},
+		{Key: "buildEnvironment", Value: bson.D{
+			{Key: "target_os", Value: runtime.GOOS},
+			{Key: "target_arch", Value: runtime.GOARCH},
+			{Key: "compiler", Value: runtime.Version()},
+		}},
+		{Key: "bits", Value: int32(strconv.IntSize)},
+		{Key: "debug", Value: false},
+		{Key: "maxBsonObjectSize", Value: int32(mongokit.MaxDocumentSize)},
+		{Key: "storageEngines", Value: bson.A{"lungo"}},
+	}, nil
+}
+
+func commandPing(*CommandContext, bsonkit.Doc) (bson.D, error) {
+	return bson.D{}, nil
+}
+
+func commandHostInfo(*CommandContext, bsonkit.Doc) (bson.D, error) {
+	// prepare system
+	system := bson.D{
+		{Key: "currentTime", Value: primitive.NewDateTimeFromTime(time.Now())},
+		{Key: "hostname", Value: hostname()},
+		{Key: "cpuAddrSize", Value: int32(strconv.IntSize)},
+	}
+
+	// add memory if available
+	if memSize, ok := hostMemory(); ok {
+		system = append(system, bson.E{Key: "memSizeMB", Value: memSize})
+	}
+
+	// add cpu
+	system = append(system,
+		bson.E{Key: "numCores", Value: int32(runtime.NumCPU())},
+		bson.E{Key: "cpuArch", Value: runtime.GOARCH},
+		bson.E{Key: "numaEnabled", Value: false},
+	)
+
+	return bson.D{
+		{Key: "system", Value: system},
+		{Key: "os", Value: bson.D{
+			{Key: "type", Value: runtime.GOOS},
+			{Key: "name", Value: runtime.GOOS},
+			{Key: "version", Value: ""},
+		}},
+		{Key: "extra", Value: bson.D{}},
+	}, nil
+}
+
+func commandGetParameter(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get version
+	version, _ := parseVersion(ctx.Engine.opts.Version)
+
+	// prepare parameters
+	params := bson.D{
+		{Key: "featureCompatibilityVersion", Value: bson.D{
+			{Key: "version", Value: fmt.Sprintf("%d.%d", version[0], version[1])},
+		}},
+		{Key: "logLevel", Value: int32(0)},
+		{Key: "quiet", Value: false},
+		{Key: "transactionLifetimeLimitSeconds", Value: int32(60)},
+	}
+
+	// return all parameters
+	if (*cmd)[0].Value == "*" {
+		return params, nil
+	}
+	all, err := getBool(cmd, "allParameters", false)
+	if err != nil {
+		return nil, err
+	} else if all {
+		return params, nil
+	}
+
+	// collect requested parameters
+	var reply bson.D
+	for _, field := range (*cmd)[1:] {
+		if field.Key == "allParameters" || isGenericField(field.Key) {
+			continue
+		}
+		value := bsonkit.Get(&params, field.Key)
+		if value == bsonkit.Missing {
+			return nil, fmt.Errorf("getParameter: no option found to get: %s", field.Key)
+		}
+		reply = append(reply, bson.E{Key: field.Key, Value: value})
+	}
+
+	// check reply
+	if len(reply) == 0 {
+		return nil, fmt.Errorf("getParameter: no option found to get")
+	}
+
+	return reply, nil
+}
+
+func commandListCommands(*CommandContext, bsonkit.Doc) (bson.D, error) {
+	// sort names
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// prepare commands
+	commands := make(bson.D, 0, len(names))
+	for _, name := range names {
+		commands = append(commands, bson.E{Key: name, Value: bson.D{
+			{Key: "help", Value: ""},
+		}})
+	}
+
+	return bson.D{
+		{Key: "commands", Value: commands},
+	}, nil
+}
+
+func commandConnectionStatus(ctx *CommandContext, _ bsonkit.Doc) (bson.D, error) {
+	// collect user and roles
+	users := bson.A{}
+	roles := bson.A{}
+	if ctx.User != nil {
+		users = append(users, bson.D{
+			{Key: "user", Value: ctx.User.Name},
+			{Key: "db", Value: ctx.User.DB},
+		})
+		for _, role := range ctx.User.Roles {
+			roles = append(roles, bson.D{
+				{Key: "role", Value: role.Role},
+				{Key: "db", Value: role.DB},
+			})
+		}
+	}
+
+	return bson.D{
+		{Key: "authInfo", Value: bson.D{
+			{Key: "authenticatedUsers", Value: users},
+			{Key: "authenticatedUserRoles", Value: roles},
+		}},
+	}, nil
+}
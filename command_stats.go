@@ -0,0 +1,278 @@
+package lungo
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
+)
+
+func init() {
+	// register stats commands
+	Commands["collStats"] = commandCollStats
+	Commands["dbStats"] = commandDBStats
+	Commands["serverStatus"] = commandServerStatus
+	Commands["validate"] = commandValidate
+}
+
+// countCommand will record the operations performed by the command.
+func (e *Engine) countCommand(name string, cmd bsonkit.Doc) {
+	switch name {
+	case "find":
+		e.count("query", 1)
+	case "getMore":
+		e.count("getmore", 1)
+	case "insert", "update", "delete":
+		field := map[string]string{
+			"insert": "documents",
+			"update": "updates",
+			"delete": "deletes",
+		}[name]
+		array, _ := bsonkit.Get(cmd, field).(bson.A)
+		e.count(name, len(array))
+	default:
+		e.count("command", 1)
+	}
+}
+
+// countOperations will record the specified bulk operations.
+func (e *Engine) countOperations(ops []Operation) {
+	for _, op := range ops {
+		switch op.Opcode {
+		case Insert:
+			e.count("insert", 1)
+		case Replace, Update:
+			e.count("update", 1)
+		case Delete:
+			e.count("delete", 1)
+		}
+	}
+}
+
+// serverStatus will return the operation counters, transaction counters and
+// the oplog window of the engine.
+func (e *Engine) serverStatus() bson.D {
+	// get state
+	e.mutex.Lock()
+	catalog := e.catalog
+	started := e.started
+	active := e.txn != nil
+	txns := e.txns
+	opcounters := bson.D{}
+	for _, op := range []string{"insert", "query", "update", "delete", "getmore", "command"} {
+		opcounters = append(opcounters, bson.E{Key: op, Value: e.ops[op]})
+	}
+	sessions := e.activeSessions()
+	e.mutex.Unlock()
+
+	// count open transactions (checked without the engine lock as sessions
+	// call into the engine while holding their own lock)
+	var open int64
+	for _, session := range sessions {
+		if session.Transaction() != nil {
+			open++
+		}
+	}
+
+	// prepare transactions
+	var currentActive int64
+	if active {
+		currentActive = 1
+	}
+	transactions := bson.D{
+		{Key: "currentActive", Value: currentActive},
+		{Key: "currentOpen", Value: open},
+		{Key: "totalStarted", Value: txns.started},
+		{Key: "totalCommitted", Value: txns.committed},
+		{Key: "totalAborted", Value: txns.aborted},
+	}
+
+	// prepare oplog
+	oplog := catalog.Namespaces[Oplog]
+	oplogStats := bson.D{
+		{Key: "count", Value: int64(len(oplog.Documents.List))},
+		{Key: "size", Value: oplog.Size()},
+	}
+	if len(oplog.Documents.List) > 0 {
+		first, _ := bsonkit.Get(oplog.Documents.List[0], "clusterTime").(primitive.Timestamp)
+		last, _ := bsonkit.Get(oplog.Documents.List[len(oplog.Documents.List)-1], "clusterTime").(primitive.Timestamp)
+		oplogStats = append(oplogStats, bson.D{
+			{Key: "earliest", Value: first},
+			{Key: "latest", Value: last},
+			{Key: "windowSecs", Value: int64(last.T) - int64(first.T)},
+		}...)
+	}
+
+	// get memory
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// get uptime
+	uptime := time.Since(started)
+
+	return bson.D{
+		{Key: "host", Value: hostname()},
+		{Key: "version", Value: e.opts.Version},
+		{Key: "process", Value: "lungo"},
+		{Key: "pid", Value: int64(os.Getpid())},
+		{Key: "uptime", Value: uptime.Seconds()},
+		{Key: "uptimeMillis", Value: uptime.Milliseconds()},
+		{Key: "uptimeEstimate", Value: int64(uptime / time.Second)},
+		{Key: "localTime", Value: primitive.NewDateTimeFromTime(time.Now())},
+		{Key: "opcounters", Value: opcounters},
+		{Key: "transactions", Value: transactions},
+		{Key: "oplog", Value: oplogStats},
+		{Key: "mem", Value: bson.D{
+			{Key: "bits", Value: int32(strconv.IntSize)},
+			{Key: "resident", Value: int64(mem.Sys / 1024 / 1024)},
+			{Key: "virtual", Value: int64(mem.Sys / 1024 / 1024)},
+			{Key: "supported", Value: true},
+			{Key: "heapAlloc", Value: int64(mem.HeapAlloc)},
+			{Key: "heapSys", Value: int64(mem.HeapSys)},
+		}},
+	}
+}
+
+func getScale(cmd bsonkit.Doc) (int64, error) {
+	// get scale
+	scale, err := getInt(cmd, "scale", 1)
+	if err != nil {
+		return 0, err
+	} else if scale < 1 {
+		return 0, fmt.Errorf("%s: scale has to be > 0", (*cmd)[0].Key)
+	}
+
+	return int64(scale), nil
+}
+
+func commandCollStats(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get scale
+	scale, err := getScale(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get storage stats
+	res, err := ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		// check collection
+		if txn.Catalog().Namespaces[handle] == nil {
+			return nil, mongokit.NamespaceNotFound.Errorf("collStats: ns not found: %s", handle.String())
+		}
+
+		return txn.Aggregate(handle, bsonkit.List{
+			{{Key: "$collStats", Value: bson.D{
+				{Key: "storageStats", Value: bson.D{
+					{Key: "scale", Value: scale},
+				}},
+			}}},
+		}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// get stats
+	stats := bsonkit.Get(res.(bsonkit.List)[0], "storageStats").(bson.D)
+
+	// prepare reply
+	reply := bson.D{
+		{Key: "ns", Value: handle.String()},
+		{Key: "capped", Value: false},
+	}
+	reply = append(reply, stats...)
+
+	return reply, nil
+}
+
+func commandDBStats(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get scale
+	scale, err := getScale(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// sum namespaces
+	var collections, objects, dataSize, indexes, indexSize int64
+	_, err = ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		for handle, namespace := range txn.Catalog().Namespaces {
+			if handle[0] == ctx.Database {
+				collections++
+				objects += int64(len(namespace.Documents.List))
+				dataSize += namespace.Size()
+				indexes += int64(len(namespace.Indexes))
+				indexSize += namespace.IndexSize()
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// compute average
+	var avgObjSize float64
+	if objects > 0 {
+		avgObjSize = float64(dataSize) / float64(objects)
+	}
+
+	return bson.D{
+		{Key: "db", Value: ctx.Database},
+		{Key: "collections", Value: collections},
+		{Key: "views", Value: int64(0)},
+		{Key: "objects", Value: objects},
+		{Key: "avgObjSize", Value: avgObjSize},
+		{Key: "dataSize", Value: float64(dataSize / scale)},
+		{Key: "storageSize", Value: float64(dataSize / scale)},
+		{Key: "indexes", Value: indexes},
+		{Key: "indexSize", Value: float64(indexSize / scale)},
+		{Key: "totalSize", Value: float64((dataSize + indexSize) / scale)},
+		{Key: "scaleFactor", Value: scale},
+	}, nil
+}
+
+func commandServerStatus(ctx *CommandContext, _ bsonkit.Doc) (bson.D, error) {
+	return ctx.Engine.serverStatus(), nil
+}
+
+func commandValidate(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get handle
+	handle, err := ctx.collection(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get full
+	full, err := getBool(cmd, "full", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// check repair
+	repair, err := getBool(cmd, "repair", false)
+	if err != nil {
+		return nil, err
+	} else if repair {
+		return nil, fmt.Errorf("validate: repair is not supported")
+	}
+
+	// validate namespace
+	res, err := ctx.Engine.Validate(handle, full)
+	if err != nil {
+		return nil, err
+	}
+
+	return *res, nil
+}
@@ -0,0 +1,1011 @@
+package lungo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
+)
+
+func runCommand(t *testing.T, d IDatabase, cmd bson.D) bson.M {
+	var reply bson.M
+	err := d.RunCommand(nil, cmd).Decode(&reply)
+	assert.NoError(t, err)
+	return reply
+}
+
+func runWriteCommand(t *testing.T, d IDatabase, cmd bson.D) mongo.WriteErrors {
+	err := d.RunCommand(nil, cmd).Err()
+	var we mongo.WriteException
+	if !assert.True(t, errors.As(err, &we), err) {
+		return nil
+	}
+	return we.WriteErrors
+}
+
+func TestCommandCRUD(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		d := c.Database()
+
+		// insert
+		errs := runWriteCommand(t, d, bson.D{
+			{Key: "insert", Value: c.Name()},
+			{Key: "documents", Value: bson.A{
+				bson.D{{Key: "_id", Value: int32(1)}, {Key: "foo", Value: "bar"}},
+				bson.D{{Key: "_id", Value: int32(2)}, {Key: "foo", Value: "baz"}},
+				bson.D{{Key: "_id", Value: int32(1)}, {Key: "foo", Value: "qux"}},
+			}},
+		})
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, 2, errs[0].Index)
+			assert.Equal(t, 11000, errs[0].Code)
+		}
+
+		// update
+		reply := runCommand(t, d, bson.D{
+			{Key: "update", Value: c.Name()},
+			{Key: "updates", Value: bson.A{
+				bson.M{"q": bson.M{"_id": int32(1)}, "u": bson.M{"$set": bson.M{"foo": "quz"}}},
+				bson.M{"q": bson.M{"_id": int32(2)}, "u": bson.M{"foo": "baz"}},
+				bson.M{"q": bson.M{"_id": int32(3)}, "u": bson.M{"foo": "new"}, "upsert": true},
+			}},
+		})
+		assert.Equal(t, int32(3), reply["n"])
+		assert.Equal(t, int32(1), reply["nModified"])
+		assert.Equal(t, bson.A{
+			bson.M{"index": int32(2), "_id": int32(3)},
+		}, reply["upserted"])
+
+		// find
+		reply = runCommand(t, d, bson.D{
+			{Key: "find", Value: c.Name()},
+			{Key: "filter", Value: bson.M{"foo": bson.M{"$ne": "baz"}}},
+			{Key: "sort", Value: bson.M{"_id": -1}},
+			{Key: "projection", Value: bson.M{"_id": 0}},
+		})
+		assert.Equal(t, bson.A{
+			bson.M{"foo": "new"},
+			bson.M{"foo": "quz"},
+		}, reply["cursor"].(bson.M)["firstBatch"])
+		assert.Equal(t, int64(0), reply["cursor"].(bson.M)["id"])
+
+		// count
+		reply = runCommand(t, d, bson.D{
+			{Key: "count", Value: c.Name()},
+			{Key: "query", Value: bson.M{"_id": bson.M{"$gt": int32(1)}}},
+		})
+		assert.Equal(t, int32(2), reply["n"])
+
+		// distinct
+		reply = runCommand(t, d, bson.D{
+			{Key: "distinct", Value: c.Name()},
+			{Key: "key", Value: "foo"},
+		})
+		assert.Equal(t, bson.A{"baz", "new", "quz"}, reply["values"])
+
+		// find and modify
+		reply = runCommand(t, d, bson.D{
+			{Key: "findAndModify", Value: c.Name()},
+			{Key: "query", Value: bson.M{"_id": int32(1)}},
+			{Key: "update", Value: bson.M{"$set": bson.M{"foo": "bar"}}},
+			{Key: "new", Value: true},
+		})
+		assert.Equal(t, bson.M{"_id": int32(1), "foo": "bar"}, reply["value"])
+		assert.Equal(t, int32(1), reply["lastErrorObject"].(bson.M)["n"])
+		assert.Equal(t, true, reply["lastErrorObject"].(bson.M)["updatedExisting"])
+
+		reply = runCommand(t, d, bson.D{
+			{Key: "findAndModify", Value: c.Name()},
+			{Key: "query", Value: bson.M{"_id": int32(2)}},
+			{Key: "remove", Value: true},
+		})
+		assert.Equal(t, bson.M{"_id": int32(2), "foo": "baz"}, reply["value"])
+
+		reply = runCommand(t, d, bson.D{
+			{Key: "findAndModify", Value: c.Name()},
+			{Key: "query", Value: bson.M{"_id": int32(4)}},
+			{Key: "update", Value: bson.M{"foo": "qux"}},
+			{Key: "upsert", Value: true},
+		})
+		assert.Nil(t, reply["value"])
+		assert.Equal(t, int32(4), reply["lastErrorObject"].(bson.M)["upserted"])
+
+		// variables
+		reply = runCommand(t, d, bson.D{
+			{Key: "update", Value: c.Name()},
+			{Key: "updates", Value: bson.A{
+				bson.M{"q": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$id"}}}, "u": bson.M{"$set": bson.M{"foo": "let"}}},
+			}},
+			{Key: "let", Value: bson.M{"id": int32(3)}},
+		})
+		assert.Equal(t, int32(1), reply["nModified"])
+
+		reply = runCommand(t, d, bson.D{
+			{Key: "findAndModify", Value: c.Name()},
+			{Key: "query", Value: bson.M{"$expr": bson.M{"$eq": bson.A{"$foo", "$$foo"}}}},
+			{Key: "update", Value: bson.M{"$set": bson.M{"foo": "new"}}},
+			{Key: "let", Value: bson.M{"foo": "let"}},
+		})
+		assert.Equal(t, bson.M{"_id": int32(3), "foo": "let"}, reply["value"])
+
+		reply = runCommand(t, d, bson.D{
+			{Key: "delete", Value: c.Name()},
+			{Key: "deletes", Value: bson.A{
+				bson.M{"q": bson.M{"$expr": bson.M{"$eq": bson.A{"$foo", "$$foo"}}}, "limit": int32(0)},
+			}},
+			{Key: "let", Value: bson.M{"foo": "qux"}},
+		})
+		assert.Equal(t, int32(1), reply["n"])
+
+		// delete
+		reply = runCommand(t, d, bson.D{
+			{Key: "delete", Value: c.Name()},
+			{Key: "deletes", Value: bson.A{
+				bson.M{"q": bson.M{"_id": int32(1)}, "limit": int32(1)},
+				bson.M{"q": bson.M{}, "limit": int32(0)},
+			}},
+		})
+		assert.Equal(t, int32(2), reply["n"])
+
+		// aggregate
+		reply = runCommand(t, d, bson.D{
+			{Key: "aggregate", Value: c.Name()},
+			{Key: "pipeline", Value: bson.A{
+				bson.M{"$count": "n"},
+			}},
+			{Key: "cursor", Value: bson.M{}},
+		})
+		assert.Equal(t, bson.A{}, reply["cursor"].(bson.M)["firstBatch"])
+
+		// unknown command
+		err := d.RunCommand(nil, bson.D{
+			{Key: "fooBar", Value: 1},
+		}).Err()
+		assert.Error(t, err)
+	})
+}
+
+func TestCommandCursor(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		d := c.Database()
+
+		_, err := c.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1)},
+			bson.M{"_id": int32(2)},
+			bson.M{"_id": int32(3)},
+			bson.M{"_id": int32(4)},
+			bson.M{"_id": int32(5)},
+		})
+		assert.NoError(t, err)
+
+		// first batch
+		reply := runCommand(t, d, bson.D{
+			{Key: "find", Value: c.Name()},
+			{Key: "sort", Value: bson.M{"_id": 1}},
+			{Key: "batchSize", Value: int32(2)},
+		})
+		cursor := reply["cursor"].(bson.M)
+		assert.Equal(t, bson.A{
+			bson.M{"_id": int32(1)},
+			bson.M{"_id": int32(2)},
+		}, cursor["firstBatch"])
+		assert.NotZero(t, cursor["id"])
+
+		// next batch
+		reply = runCommand(t, d, bson.D{
+			{Key: "getMore", Value: cursor["id"]},
+			{Key: "collection", Value: c.Name()},
+			{Key: "batchSize", Value: int32(2)},
+		})
+		cursor = reply["cursor"].(bson.M)
+		assert.Equal(t, bson.A{
+			bson.M{"_id": int32(3)},
+			bson.M{"_id": int32(4)},
+		}, cursor["nextBatch"])
+		assert.NotZero(t, cursor["id"])
+
+		// kill cursor
+		reply = runCommand(t, d, bson.D{
+			{Key: "killCursors", Value: c.Name()},
+			{Key: "cursors", Value: bson.A{cursor["id"]}},
+		})
+		assert.Equal(t, bson.A{cursor["id"]}, reply["cursorsKilled"])
+
+		// missing cursor
+		err = d.RunCommand(nil, bson.D{
+			{Key: "getMore", Value: cursor["id"]},
+			{Key: "collection", Value: c.Name()},
+		}).Err()
+		assert.Error(t, err)
+
+		// cursor command
+		csr, err := d.RunCommandCursor(nil, bson.D{
+			{Key: "find", Value: c.Name()},
+			{Key: "sort", Value: bson.M{"_id": -1}},
+			{Key: "batchSize", Value: int32(2)},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(5)},
+			{"_id": int32(4)},
+			{"_id": int32(3)},
+			{"_id": int32(2)},
+			{"_id": int32(1)},
+		}, readAll(csr))
+	})
+}
+
+func TestCommandChangeStream(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		d := c.Database()
+
+		// open stream
+		reply := runCommand(t, d, bson.D{
+			{Key: "aggregate", Value: c.Name()},
+			{Key: "pipeline", Value: bson.A{
+				bson.M{"$changeStream": bson.M{}},
+			}},
+			{Key: "cursor", Value: bson.M{}},
+		})
+		cursor := reply["cursor"].(bson.M)
+		assert.Equal(t, bson.A{}, cursor["firstBatch"])
+		assert.NotZero(t, cursor["id"])
+
+		_, err := c.InsertOne(nil, bson.M{"_id": int32(1)})
+		assert.NoError(t, err)
+
+		// next batch
+		reply = runCommand(t, d, bson.D{
+			{Key: "getMore", Value: cursor["id"]},
+			{Key: "collection", Value: c.Name()},
+			{Key: "maxTimeMS", Value: int32(1000)},
+		})
+		cursor = reply["cursor"].(bson.M)
+		batch := cursor["nextBatch"].(bson.A)
+		assert.Len(t, batch, 1)
+		assert.Equal(t, "insert", batch[0].(bson.M)["operationType"])
+		assert.Equal(t, bson.M{"_id": int32(1)}, batch[0].(bson.M)["fullDocument"])
+		assert.Equal(t, batch[0].(bson.M)["_id"], cursor["postBatchResumeToken"])
+		assert.NotZero(t, cursor["id"])
+
+		// empty batch
+		reply = runCommand(t, d, bson.D{
+			{Key: "getMore", Value: cursor["id"]},
+			{Key: "collection", Value: c.Name()},
+			{Key: "maxTimeMS", Value: int32(10)},
+		})
+		assert.Equal(t, bson.A{}, reply["cursor"].(bson.M)["nextBatch"])
+
+		// kill cursor
+		reply = runCommand(t, d, bson.D{
+			{Key: "killCursors", Value: c.Name()},
+			{Key: "cursors", Value: bson.A{cursor["id"]}},
+		})
+		assert.Equal(t, bson.A{cursor["id"]}, reply["cursorsKilled"])
+
+		// cursor command
+		csr, err := d.RunCommandCursor(nil, bson.D{
+			{Key: "aggregate", Value: c.Name()},
+			{Key: "pipeline", Value: bson.A{
+				bson.M{"$changeStream": bson.M{}},
+			}},
+			{Key: "cursor", Value: bson.M{}},
+		})
+		assert.NoError(t, err)
+
+		_, err = c.InsertOne(nil, bson.M{"_id": int32(2)})
+		assert.NoError(t, err)
+
+		var event bson.M
+		assert.True(t, csr.Next(nil))
+		assert.NoError(t, csr.Decode(&event))
+		assert.Equal(t, "insert", event["operationType"])
+		assert.NoError(t, csr.Close(nil))
+	})
+}
+
+func TestCommandNamespaces(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		name := collectionName()
+
+		// create
+		runCommand(t, d, bson.D{
+			{Key: "create", Value: name},
+		})
+
+		// create indexes
+		reply := runCommand(t, d, bson.D{
+			{Key: "createIndexes", Value: name},
+			{Key: "indexes", Value: bson.A{
+				bson.M{"key": bson.M{"foo": int32(1)}, "name": "foo_1", "unique": true},
+			}},
+		})
+		assert.Equal(t, int32(1), reply["numIndexesBefore"])
+		assert.Equal(t, int32(2), reply["numIndexesAfter"])
+
+		// list indexes
+		csr, err := d.RunCommandCursor(nil, bson.D{
+			{Key: "listIndexes", Value: name},
+		})
+		assert.NoError(t, err)
+		names := make([]string, 0)
+		for _, index := range readAll(csr) {
+			names = append(names, index["name"].(string))
+		}
+		assert.Equal(t, []string{"_id_", "foo_1"}, names)
+
+		// drop indexes
+		reply = runCommand(t, d, bson.D{
+			{Key: "dropIndexes", Value: name},
+			{Key: "index", Value: "foo_1"},
+		})
+		assert.Equal(t, int32(2), reply["nIndexesWas"])
+
+		// list collections
+		reply = runCommand(t, d, bson.D{
+			{Key: "listCollections", Value: 1},
+			{Key: "filter", Value: bson.M{"name": name}},
+			{Key: "nameOnly", Value: true},
+		})
+		assert.Equal(t, bson.A{
+			bson.M{"name": name, "type": "collection"},
+		}, reply["cursor"].(bson.M)["firstBatch"])
+
+		// list databases
+		reply = runCommand(t, d.Client().Database("admin"), bson.D{
+			{Key: "listDatabases", Value: 1},
+			{Key: "filter", Value: bson.M{"name": d.Name()}},
+			{Key: "nameOnly", Value: true},
+		})
+		assert.Equal(t, bson.A{
+			bson.M{"name": d.Name()},
+		}, reply["databases"])
+
+		// drop
+		reply = runCommand(t, d, bson.D{
+			{Key: "drop", Value: name},
+		})
+		assert.Equal(t, d.Name()+"."+name, reply["ns"])
+
+		csr, err = d.RunCommandCursor(nil, bson.D{
+			{Key: "listCollections", Value: 1},
+			{Key: "filter", Value: bson.M{"name": name}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{}, readAll(csr))
+	})
+}
+
+func TestCommandRenameCollection(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		admin := d.Client().Database("admin")
+
+		c1 := d.Collection(collectionName())
+		c2 := d.Collection(collectionName())
+
+		_, err := c1.InsertOne(nil, bson.M{"_id": int32(1), "foo": "bar"})
+		assert.NoError(t, err)
+
+		_, err = c1.Indexes().CreateOne(nil, mongo.IndexModel{
+			Keys: bson.M{"foo": 1},
+		})
+		assert.NoError(t, err)
+
+		_, err = c2.InsertOne(nil, bson.M{"_id": int32(2), "foo": "baz"})
+		assert.NoError(t, err)
+
+		// existing target
+		err = admin.RunCommand(nil, bson.D{
+			{Key: "renameCollection", Value: d.Name() + "." + c1.Name()},
+			{Key: "to", Value: d.Name() + "." + c2.Name()},
+		}).Err()
+		assert.Equal(t, int32(48), errorCode(err))
+
+		// drop target
+		err = admin.RunCommand(nil, bson.D{
+			{Key: "renameCollection", Value: d.Name() + "." + c1.Name()},
+			{Key: "to", Value: d.Name() + "." + c2.Name()},
+			{Key: "dropTarget", Value: true},
+		}).Err()
+		assert.NoError(t, err)
+
+		assert.Equal(t, []bson.M{}, dumpCollection(c1, false))
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "foo": "bar"},
+		}, dumpCollection(c2, false))
+
+		csr, err := c2.Indexes().List(nil)
+		assert.NoError(t, err)
+		assert.Len(t, readAll(csr), 2)
+
+		// missing source
+		err = admin.RunCommand(nil, bson.D{
+			{Key: "renameCollection", Value: d.Name() + "." + c1.Name()},
+			{Key: "to", Value: d.Name() + "." + collectionName()},
+		}).Err()
+		assert.Equal(t, int32(26), errorCode(err))
+
+		// wrong database
+		err = d.RunCommand(nil, bson.D{
+			{Key: "renameCollection", Value: d.Name() + "." + c2.Name()},
+			{Key: "to", Value: d.Name() + "." + c1.Name()},
+		}).Err()
+		assert.Error(t, err)
+	})
+}
+
+func TestCommandErrorCodes(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		d := c.Database()
+
+		// create existing
+		runCommand(t, d, bson.D{
+			{Key: "create", Value: c.Name()},
+		})
+		err := d.RunCommand(nil, bson.D{
+			{Key: "create", Value: c.Name()},
+		}).Err()
+		assert.Equal(t, int32(48), errorCode(err))
+
+		// write errors
+		errs := runWriteCommand(t, d, bson.D{
+			{Key: "insert", Value: c.Name()},
+			{Key: "documents", Value: bson.A{
+				bson.M{"_id": int32(1), "foo": int32(1)},
+				bson.M{"_id": int32(1)},
+			}},
+		})
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, 11000, errs[0].Code)
+		}
+
+		errs = runWriteCommand(t, d, bson.D{
+			{Key: "update", Value: c.Name()},
+			{Key: "updates", Value: bson.A{
+				bson.M{"q": bson.M{"_id": int32(1)}, "u": bson.M{"$set": bson.M{"_id": int32(2)}}},
+			}},
+		})
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, 66, errs[0].Code)
+			if _, ok := d.(*Database); ok {
+				assert.Equal(t, "ImmutableField", errs[0].Raw.Lookup("codeName").StringValue())
+			}
+		}
+
+		errs = runWriteCommand(t, d, bson.D{
+			{Key: "update", Value: c.Name()},
+			{Key: "updates", Value: bson.A{
+				bson.M{"q": bson.M{"_id": int32(1)}, "u": bson.M{
+					"$set": bson.M{"foo": int32(2)},
+					"$inc": bson.M{"foo": int32(1)},
+				}},
+			}},
+		})
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, 40, errs[0].Code)
+		}
+
+		// bulk write
+		_, err = c.BulkWrite(nil, []mongo.WriteModel{
+			mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": int32(1)}).SetUpdate(bson.M{
+				"$set": bson.M{"_id": int32(2)},
+			}),
+		})
+		var bulkErr mongo.BulkWriteException
+		var writeErrs mongo.WriteErrors
+		if errors.As(err, &bulkErr) {
+			assert.Equal(t, 66, bulkErr.WriteErrors[0].Code)
+		} else if assert.True(t, errors.As(err, &writeErrs)) {
+			assert.Equal(t, 66, writeErrs[0].Code)
+		}
+
+		// missing index
+		err = d.RunCommand(nil, bson.D{
+			{Key: "dropIndexes", Value: c.Name()},
+			{Key: "index", Value: "foo_1"},
+		}).Err()
+		assert.Equal(t, int32(27), errorCode(err))
+
+		// missing namespace
+		err = d.RunCommand(nil, bson.D{
+			{Key: "dropIndexes", Value: collectionName()},
+			{Key: "index", Value: "foo_1"},
+		}).Err()
+		assert.Equal(t, int32(26), errorCode(err))
+
+		// missing cursor
+		err = d.RunCommand(nil, bson.D{
+			{Key: "getMore", Value: int64(42)},
+			{Key: "collection", Value: c.Name()},
+		}).Err()
+		assert.Equal(t, int32(43), errorCode(err))
+	})
+}
+
+func errorCode(err error) int32 {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code
+	}
+	code, _ := ErrorCode(err)
+	return code
+}
+
+func TestCommandStats(t *testing.T) {
+	clientTest(t, func(t *testing.T, client IClient) {
+		d := client.Database(testDB + "-stats")
+		err := d.Drop(nil)
+		assert.NoError(t, err)
+
+		c := d.Collection(collectionName())
+		_, err = c.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "foo": "bar"},
+			bson.M{"_id": int32(2), "foo": "baz"},
+		})
+		assert.NoError(t, err)
+
+		// collection stats
+		reply := runCommand(t, d, bson.D{
+			{Key: "collStats", Value: c.Name()},
+		})
+		assert.Equal(t, d.Name()+"."+c.Name(), reply["ns"])
+		count, _ := toInteger(reply["count"])
+		assert.Equal(t, int64(2), count)
+		size, _ := toInteger(reply["size"])
+		assert.Equal(t, int64(54), size)
+		nindexes, _ := toInteger(reply["nindexes"])
+		assert.Equal(t, int64(1), nindexes)
+
+		// missing collection
+		err = d.RunCommand(nil, bson.D{
+			{Key: "collStats", Value: "missing"},
+		}).Err()
+		assert.Error(t, err)
+
+		// database stats
+		reply = runCommand(t, d, bson.D{
+			{Key: "dbStats", Value: 1},
+		})
+		assert.Equal(t, d.Name(), reply["db"])
+		objects, _ := toInteger(reply["objects"])
+		assert.Equal(t, int64(2), objects)
+		dataSize, _ := toInteger(reply["dataSize"])
+		assert.Equal(t, int64(54), dataSize)
+
+		// server status
+		reply = runCommand(t, d, bson.D{
+			{Key: "serverStatus", Value: 1},
+		})
+		assert.NotEmpty(t, reply["host"])
+		inserts, _ := toInteger(reply["opcounters"].(bson.M)["insert"])
+		assert.True(t, inserts >= 2)
+		assert.NotNil(t, reply["transactions"])
+		assert.NotNil(t, reply["mem"])
+	})
+}
+
+func TestCommandValidate(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		d := c.Database()
+
+		_, err := c.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "foo": "bar"},
+			bson.M{"_id": int32(2), "foo": "baz"},
+		})
+		assert.NoError(t, err)
+
+		_, err = c.Indexes().CreateOne(nil, mongo.IndexModel{
+			Keys: bson.M{"foo": 1},
+		})
+		assert.NoError(t, err)
+
+		reply := runCommand(t, d, bson.D{
+			{Key: "validate", Value: c.Name()},
+			{Key: "full", Value: true},
+		})
+		assert.Equal(t, d.Name()+"."+c.Name(), reply["ns"])
+		assert.Equal(t, true, reply["valid"])
+		assert.Equal(t, bson.A{}, reply["errors"])
+		records, _ := toInteger(reply["nrecords"])
+		assert.Equal(t, int64(2), records)
+		keys, _ := toInteger(reply["keysPerIndex"].(bson.M)["foo_1"])
+		assert.Equal(t, int64(2), keys)
+
+		// missing collection
+		err = d.RunCommand(nil, bson.D{
+			{Key: "validate", Value: "missing"},
+		}).Err()
+		assert.Error(t, err)
+	})
+}
+
+func TestCommandHandshake(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		admin := d.Client().Database("admin")
+
+		// hello
+		reply := runCommand(t, admin, bson.D{
+			{Key: "hello", Value: 1},
+		})
+		assert.Equal(t, true, reply["isWritablePrimary"])
+		wire, _ := toInteger(reply["maxWireVersion"])
+		assert.True(t, wire >= 17)
+
+		// is master
+		reply = runCommand(t, admin, bson.D{
+			{Key: "isMaster", Value: 1},
+		})
+		assert.Equal(t, true, reply["ismaster"])
+
+		// build info
+		reply = runCommand(t, admin, bson.D{
+			{Key: "buildInfo", Value: 1},
+		})
+		assert.NotEmpty(t, reply["version"])
+		assert.Len(t, reply["versionArray"], 4)
+
+		// ping
+		runCommand(t, admin, bson.D{
+			{Key: "ping", Value: 1},
+		})
+
+		// host info
+		reply = runCommand(t, admin, bson.D{
+			{Key: "hostInfo", Value: 1},
+		})
+		assert.NotEmpty(t, reply["system"].(bson.M)["hostname"])
+		if _, ok := hostMemory(); ok {
+			assert.NotZero(t, reply["system"].(bson.M)["memSizeMB"])
+		}
+
+		// get parameter
+		reply = runCommand(t, admin, bson.D{
+			{Key: "getParameter", Value: 1},
+			{Key: "featureCompatibilityVersion", Value: 1},
+		})
+		assert.NotEmpty(t, reply["featureCompatibilityVersion"].(bson.M)["version"])
+
+		reply = runCommand(t, admin, bson.D{
+			{Key: "getParameter", Value: 1},
+			{Key: "logLevel", Value: 1},
+			{Key: "comment", Value: "foo"},
+			{Key: "maxTimeMS", Value: int32(1000)},
+		})
+		assert.Equal(t, int32(0), reply["logLevel"])
+		assert.NotContains(t, reply, "maxTimeMS")
+
+		err := admin.RunCommand(nil, bson.D{
+			{Key: "getParameter", Value: 1},
+			{Key: "fooBar", Value: 1},
+		}).Err()
+		assert.Error(t, err)
+
+		// list commands
+		reply = runCommand(t, admin, bson.D{
+			{Key: "listCommands", Value: 1},
+		})
+		assert.NotNil(t, reply["commands"].(bson.M)["find"])
+
+		// connection status
+		reply = runCommand(t, admin, bson.D{
+			{Key: "connectionStatus", Value: 1},
+		})
+		assert.NotNil(t, reply["authInfo"])
+	})
+}
+
+func TestCommandVersion(t *testing.T) {
+	_, err := CreateEngine(Options{
+		Store:   NewMemoryStore(),
+		Version: "6.0",
+	})
+	assert.Error(t, err)
+
+	for version, wire := range map[string]int32{
+		"3.0.0": 6,
+		"6.0.4": 17,
+		"7.1.0": 22,
+		"9.0.0": 25,
+	} {
+		engine, err := CreateEngine(Options{
+			Store:   NewMemoryStore(),
+			Version: version,
+		})
+		assert.NoError(t, err)
+
+		reply, err := engine.RunCommand(nil, "admin", &bson.D{
+			{Key: "hello", Value: 1},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, wire, bsonkit.Get(reply, "maxWireVersion"))
+
+		reply, err = engine.RunCommand(nil, "admin", &bson.D{
+			{Key: "buildInfo", Value: 1},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, version, bsonkit.Get(reply, "version"))
+
+		engine.Close()
+	}
+}
+
+func TestCommandUsers(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		_ = d.RunCommand(nil, bson.D{{Key: "dropUser", Value: "alice"}}).Err()
+
+		// create
+		runCommand(t, d, bson.D{
+			{Key: "createUser", Value: "alice"},
+			{Key: "pwd", Value: "secret"},
+			{Key: "roles", Value: bson.A{"read"}},
+			{Key: "customData", Value: bson.M{"foo": "bar"}},
+		})
+
+		// duplicate
+		err := d.RunCommand(nil, bson.D{
+			{Key: "createUser", Value: "alice"},
+			{Key: "pwd", Value: "secret"},
+			{Key: "roles", Value: bson.A{}},
+		}).Err()
+		assert.Error(t, err)
+
+		// invalid role
+		err = d.RunCommand(nil, bson.D{
+			{Key: "createUser", Value: "bob"},
+			{Key: "pwd", Value: "secret"},
+			{Key: "roles", Value: bson.A{"foo"}},
+		}).Err()
+		assert.Error(t, err)
+
+		// info
+		reply := runCommand(t, d, bson.D{
+			{Key: "usersInfo", Value: "alice"},
+		})
+		users := reply["users"].(bson.A)
+		assert.Len(t, users, 1)
+		user := users[0].(bson.M)
+		assert.Equal(t, d.Name()+".alice", user["_id"])
+		assert.Equal(t, "alice", user["user"])
+		assert.Equal(t, d.Name(), user["db"])
+		assert.Equal(t, bson.A{bson.M{"role": "read", "db": d.Name()}}, user["roles"])
+		assert.Equal(t, bson.A{"SCRAM-SHA-1", "SCRAM-SHA-256"}, user["mechanisms"])
+		assert.Equal(t, bson.M{"foo": "bar"}, user["customData"])
+		assert.Nil(t, user["credentials"])
+
+		// update
+		runCommand(t, d, bson.D{
+			{Key: "updateUser", Value: "alice"},
+			{Key: "roles", Value: bson.A{"readWrite", "dbAdmin"}},
+		})
+		reply = runCommand(t, d, bson.D{
+			{Key: "usersInfo", Value: bson.M{"user": "alice", "db": d.Name()}},
+		})
+		users = reply["users"].(bson.A)
+		assert.Len(t, users, 1)
+		assert.Equal(t, bson.A{
+			bson.M{"role": "readWrite", "db": d.Name()},
+			bson.M{"role": "dbAdmin", "db": d.Name()},
+		}, users[0].(bson.M)["roles"])
+
+		// drop
+		runCommand(t, d, bson.D{
+			{Key: "dropUser", Value: "alice"},
+		})
+		reply = runCommand(t, d, bson.D{
+			{Key: "usersInfo", Value: "alice"},
+		})
+		assert.Equal(t, bson.A{}, reply["users"])
+
+		// missing
+		err = d.RunCommand(nil, bson.D{
+			{Key: "dropUser", Value: "alice"},
+		}).Err()
+		assert.Error(t, err)
+	})
+}
+
+func TestCommandAuthorization(t *testing.T) {
+	engine, err := CreateEngine(Options{
+		Store: NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	// create users
+	for _, cmd := range []bson.D{
+		{{Key: "createUser", Value: "reader"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"read"}}},
+		{{Key: "createUser", Value: "writer"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"readWrite"}}},
+		{{Key: "createUser", Value: "admin"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"dbAdmin"}}},
+	} {
+		_, err = engine.RunCommand(nil, "test", &cmd)
+		assert.NoError(t, err)
+	}
+	for _, cmd := range []bson.D{
+		{{Key: "createUser", Value: "root"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"root"}}},
+		{{Key: "createUser", Value: "reader"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"read"}}},
+		{{Key: "createUser", Value: "writer"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"readWrite"}}},
+		{{Key: "createUser", Value: "admin"}, {Key: "pwd", Value: "secret"}, {Key: "roles", Value: bson.A{"dbAdmin"}}},
+	} {
+		_, err = engine.RunCommand(nil, "admin", &cmd)
+		assert.NoError(t, err)
+	}
+
+	// root on other database
+	_, err = engine.RunCommand(nil, "test", &bson.D{
+		{Key: "createUser", Value: "other"},
+		{Key: "pwd", Value: "secret"},
+		{Key: "roles", Value: bson.A{"root"}},
+	})
+	assert.Error(t, err)
+
+	run := func(user, db string, cmd bson.D) error {
+		var u *User
+		if user != "" {
+			name, source, ok := strings.Cut(user, "@")
+			if !ok {
+				source = "test"
+			}
+			u, err = engine.User(source, name)
+			assert.NoError(t, err)
+			assert.NotNil(t, u)
+		}
+		_, err := (&CommandContext{
+			Engine:    engine,
+			Database:  db,
+			Authorize: true,
+			User:      u,
+		}).Run(bsonkit.MustConvert(cmd))
+		return err
+	}
+
+	find := bson.D{{Key: "find", Value: "foo"}}
+	insert := bson.D{{Key: "insert", Value: "foo"}, {Key: "documents", Value: bson.A{bson.D{}}}}
+	validate := bson.D{{Key: "validate", Value: "foo"}}
+	status := bson.D{{Key: "serverStatus", Value: 1}}
+	aggregate := func(stage bson.M) bson.D {
+		return bson.D{{Key: "aggregate", Value: "foo"}, {Key: "pipeline", Value: bson.A{stage}}, {Key: "cursor", Value: bson.M{}}}
+	}
+	watch := func(spec bson.M) bson.D {
+		return bson.D{{Key: "aggregate", Value: 1}, {Key: "pipeline", Value: bson.A{bson.M{"$changeStream": spec}}}, {Key: "cursor", Value: bson.M{}}}
+	}
+	findUsers := bson.D{{Key: "find", Value: "system.users"}}
+	insertUsers := bson.D{{Key: "insert", Value: "system.users"}, {Key: "documents", Value: bson.A{bson.D{}}}}
+	renameUsers := bson.D{{Key: "renameCollection", Value: "admin.foo"}, {Key: "to", Value: "admin.system.users"}}
+
+	for _, item := range []struct {
+		user string
+		db   string
+		cmd  bson.D
+		ok   bool
+	}{
+		{"", "test", bson.D{{Key: "hello", Value: 1}}, true},
+		{"", "test", find, false},
+		{"reader", "test", find, true},
+		{"reader", "other", find, false},
+		{"reader", "test", insert, false},
+		{"writer", "test", insert, true},
+		{"writer", "test", validate, false},
+		{"admin", "test", validate, true},
+		{"admin", "test", find, false},
+		{"writer", "admin", status, false},
+		{"root@admin", "admin", status, true},
+		{"root@admin", "other", insert, true},
+
+		// cross-database stages
+		{"reader", "test", aggregate(bson.M{"$lookup": bson.M{"from": "bar", "localField": "a", "foreignField": "b", "as": "c"}}), true},
+		{"reader", "test", aggregate(bson.M{"$lookup": bson.M{"from": bson.M{"db": "admin", "coll": "system.users"}, "localField": "a", "foreignField": "b", "as": "c"}}), false},
+		{"reader", "test", aggregate(bson.M{"$graphLookup": bson.M{"from": bson.M{"db": "other", "coll": "bar"}}}), false},
+		{"reader", "test", aggregate(bson.M{"$unionWith": bson.M{"coll": "bar", "pipeline": bson.A{bson.M{"$unionWith": bson.M{"coll": bson.M{"db": "other", "coll": "bar"}}}}}}), false},
+		{"reader", "test", aggregate(bson.M{"$out": "bar"}), false},
+		{"writer", "test", aggregate(bson.M{"$out": "bar"}), true},
+		{"writer", "test", aggregate(bson.M{"$out": bson.M{"db": "secret", "coll": "bar"}}), false},
+		{"writer", "test", aggregate(bson.M{"$merge": bson.M{"into": bson.M{"db": "secret", "coll": "bar"}}}), false},
+
+		// system namespaces
+		{"reader@admin", "admin", find, true},
+		{"reader@admin", "admin", findUsers, false},
+		{"writer@admin", "admin", findUsers, false},
+		{"writer@admin", "admin", insertUsers, false},
+		{"writer@admin", "admin", renameUsers, false},
+		{"admin@admin", "admin", bson.D{{Key: "dropDatabase", Value: 1}}, false},
+		{"root@admin", "admin", findUsers, true},
+
+		// change streams
+		{"reader", "test", watch(bson.M{}), true},
+		{"reader", "other", watch(bson.M{}), false},
+		{"reader@admin", "admin", watch(bson.M{"allChangesForCluster": true}), false},
+		{"admin@admin", "admin", watch(bson.M{"allChangesForCluster": true}), false},
+		{"root@admin", "admin", watch(bson.M{"allChangesForCluster": true}), true},
+	} {
+		err := run(item.user, item.db, item.cmd)
+		if item.ok {
+			assert.NoError(t, err, item)
+		} else {
+			assert.ErrorIs(t, err, ErrUnauthorized, item)
+		}
+	}
+
+	// filtered databases
+	u, err := engine.User("test", "reader")
+	assert.NoError(t, err)
+	reply, err := (&CommandContext{
+		Engine:    engine,
+		Database:  "admin",
+		Authorize: true,
+		User:      u,
+	}).Run(&bson.D{{Key: "listDatabases", Value: 1}, {Key: "nameOnly", Value: true}})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.A{bson.D{{Key: "name", Value: "test"}}}, bsonkit.Get(reply, "databases"))
+
+	// cursor owners
+	_, err = engine.RunCommand(nil, "test", &bson.D{
+		{Key: "insert", Value: "foo"},
+		{Key: "documents", Value: bson.A{bson.D{}, bson.D{}}},
+	})
+	assert.NoError(t, err)
+	users := map[string]*User{}
+	for _, name := range []string{"reader", "writer"} {
+		users[name], err = engine.User("test", name)
+		assert.NoError(t, err)
+	}
+	runAs := func(user string, cmd bson.D) (bsonkit.Doc, error) {
+		return (&CommandContext{
+			Engine:    engine,
+			Database:  "test",
+			Authorize: true,
+			User:      users[user],
+		}).Run(bsonkit.MustConvert(cmd))
+	}
+	reply, err = runAs("reader", bson.D{{Key: "find", Value: "foo"}, {Key: "batchSize", Value: int32(1)}})
+	assert.NoError(t, err)
+	id := bsonkit.Get(reply, "cursor.id").(int64)
+	assert.NotZero(t, id)
+
+	_, err = runAs("writer", bson.D{{Key: "getMore", Value: id}, {Key: "collection", Value: "foo"}, {Key: "batchSize", Value: int32(1)}})
+	assert.Equal(t, mongokit.CursorNotFound, mongokit.GetErrorCode(err))
+
+	for _, item := range []struct {
+		user string
+		coll string
+	}{
+		{"writer", "foo"},
+		{"reader", "bar"},
+	} {
+		reply, err = runAs(item.user, bson.D{{Key: "killCursors", Value: item.coll}, {Key: "cursors", Value: bson.A{id}}})
+		assert.NoError(t, err)
+		assert.Equal(t, bson.A{}, bsonkit.Get(reply, "cursorsKilled"))
+		assert.Equal(t, bson.A{id}, bsonkit.Get(reply, "cursorsNotFound"))
+	}
+
+	reply, err = runAs("reader", bson.D{{Key: "killCursors", Value: "foo"}, {Key: "cursors", Value: bson.A{id}}})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.A{id}, bsonkit.Get(reply, "cursorsKilled"))
+
+	// system namespace events
+	reply, err = runAs("reader", watch(bson.M{}))
+	assert.NoError(t, err)
+	id = bsonkit.Get(reply, "cursor.id").(int64)
+	assert.NotZero(t, id)
+
+	for _, coll := range []string{"system.foo", "foo"} {
+		_, err = engine.RunCommand(nil, "test", &bson.D{
+			{Key: "insert", Value: coll},
+			{Key: "documents", Value: bson.A{bson.D{}}},
+		})
+		assert.NoError(t, err)
+	}
+
+	reply, err = runAs("reader", bson.D{{Key: "getMore", Value: id}, {Key: "collection", Value: "$cmd.aggregate"}, {Key: "maxTimeMS", Value: int32(100)}})
+	assert.NoError(t, err)
+	events := bsonkit.Get(reply, "cursor.nextBatch").(bson.A)
+	if assert.Len(t, events, 1) {
+		event := events[0].(bson.D)
+		assert.Equal(t, "foo", bsonkit.Get(&event, "ns.coll"))
+	}
+}
@@ -0,0 +1,397 @@
+package lungo
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register user commands
+	Commands["createUser"] = commandCreateUser
+	Commands["updateUser"] = commandUpdateUser
+	Commands["dropUser"] = commandDropUser
+	Commands["usersInfo"] = commandUsersInfo
+}
+
+func getUserName(cmd bsonkit.Doc) (string, error) {
+	// get name
+	name, ok := (*cmd)[0].Value.(string)
+	if !ok || name == "" {
+		return "", fmt.Errorf("%s: user name must be a non-empty string", (*cmd)[0].Key)
+	}
+
+	return name, nil
+}
+
+func getRoles(cmd bsonkit.Doc, db string, required bool) ([]Role, bool, error) {
+	// get value
+	value := bsonkit.Get(cmd, "roles")
+	if value == bsonkit.Missing {
+		if required {
+			return nil, false, fmt.Errorf("%s: missing required field 'roles'", (*cmd)[0].Key)
+		}
+		return nil, false, nil
+	}
+
+	// check array
+	array, ok := value.(bson.A)
+	if !ok {
+		return nil, false, fmt.Errorf("%s: 'roles' must be an array", (*cmd)[0].Key)
+	}
+
+	// parse roles
+	roles := make([]Role, 0, len(array))
+	for _, item := range array {
+		var role Role
+		switch item := item.(type) {
+		case string:
+			role = Role{Role: item, DB: db}
+		case bson.D:
+			name, _ := bsonkit.Get(&item, "role").(string)
+			db, _ := bsonkit.Get(&item, "db").(string)
+			role = Role{Role: name, DB: db}
+		default:
+			return nil, false, fmt.Errorf("%s: roles must be strings or documents", (*cmd)[0].Key)
+		}
+
+		// validate role
+		err := validateRole(role)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %w", (*cmd)[0].Key, err)
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, true, nil
+}
+
+func getMechanisms(cmd bsonkit.Doc, def []string) ([]string, error) {
+	// get value
+	value := bsonkit.Get(cmd, "mechanisms")
+	if value == bsonkit.Missing {
+		return def, nil
+	}
+
+	// check array
+	array, ok := value.(bson.A)
+	if !ok || len(array) == 0 {
+		return nil, fmt.Errorf("%s: 'mechanisms' must be a non-empty array", (*cmd)[0].Key)
+	}
+
+	// collect mechanisms
+	mechanisms := make([]string, 0, len(array))
+	for _, item := range array {
+		mechanism, _ := item.(string)
+		if _, ok := scramParams[mechanism]; !ok {
+			return nil, fmt.Errorf("%s: unsupported mechanism '%v'", (*cmd)[0].Key, item)
+		}
+		mechanisms = append(mechanisms, mechanism)
+	}
+
+	return mechanisms, nil
+}
+
+func makeCredentials(cmd bsonkit.Doc, user, password string, mechanisms []string) (Credentials, error) {
+	// check password
+	if password == "" {
+		return Credentials{}, fmt.Errorf("%s: password must be a non-empty string", (*cmd)[0].Key)
+	}
+
+	// create credentials
+	var creds Credentials
+	for _, mechanism := range mechanisms {
+		cred, err := NewCredential(mechanism, user, password)
+		if err != nil {
+			return Credentials{}, err
+		}
+		switch mechanism {
+		case ScramSHA1:
+			creds.SHA1 = cred
+		case ScramSHA256:
+			creds.SHA256 = cred
+		}
+	}
+
+	return creds, nil
+}
+
+func commandCreateUser(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get name
+	name, err := getUserName(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get password
+	password, ok := bsonkit.Get(cmd, "pwd").(string)
+	if !ok {
+		return nil, fmt.Errorf("createUser: 'pwd' must be a string")
+	}
+
+	// get roles
+	roles, _, err := getRoles(cmd, ctx.Database, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// get custom data
+	customData, err := getDoc(cmd, "customData", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get mechanisms
+	mechanisms, err := getMechanisms(cmd, []string{ScramSHA1, ScramSHA256})
+	if err != nil {
+		return nil, err
+	}
+
+	// create credentials
+	creds, err := makeCredentials(cmd, name, password, mechanisms)
+	if err != nil {
+		return nil, err
+	}
+
+	// generate user id
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+
+	// prepare user
+	user := User{
+		ID:          ctx.Database + "." + name,
+		UserID:      primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: id},
+		Name:        name,
+		DB:          ctx.Database,
+		Credentials: creds,
+		Roles:       roles,
+	}
+	if customData != nil {
+		user.CustomData = *customData
+	}
+
+	// transform user
+	doc, err := bsonkit.Transform(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// insert user
+	_, err = ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		// check existing
+		existing, err := findUser(txn.Catalog(), ctx.Database, name)
+		if err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, fmt.Errorf("createUser: user \"%s@%s\" already exists", name, ctx.Database)
+		}
+
+		return txn.Insert(Users, bsonkit.List{doc}, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{}, nil
+}
+
+func commandUpdateUser(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get name
+	name, err := getUserName(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// get password
+	password, hasPassword := bsonkit.Get(cmd, "pwd").(string)
+
+	// get roles
+	roles, hasRoles, err := getRoles(cmd, ctx.Database, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// get custom data
+	customData, err := getDoc(cmd, "customData", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// update user
+	_, err = ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		// get user
+		user, err := findUser(txn.Catalog(), ctx.Database, name)
+		if err != nil {
+			return nil, err
+		} else if user == nil {
+			return nil, fmt.Errorf("updateUser: user %s@%s not found", name, ctx.Database)
+		}
+
+		// update credentials
+		if hasPassword {
+			mechanisms, err := getMechanisms(cmd, user.Credentials.Mechanisms())
+			if err != nil {
+				return nil, err
+			}
+			user.Credentials, err = makeCredentials(cmd, name, password, mechanisms)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// update roles and custom data
+		if hasRoles {
+			user.Roles = roles
+		}
+		if customData != nil {
+			user.CustomData = *customData
+		}
+
+		// transform user
+		doc, err := bsonkit.Transform(user)
+		if err != nil {
+			return nil, err
+		}
+
+		return txn.Replace(Users, bsonkit.MustConvert(bson.M{"_id": user.ID}), nil, doc, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.D{}, nil
+}
+
+func commandDropUser(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get name
+	name, err := getUserName(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// delete user
+	res, err := ctx.use(true, func(txn *Transaction) (interface{}, error) {
+		return txn.Delete(Users, bsonkit.MustConvert(bson.M{"_id": ctx.Database + "." + name}), nil, 0, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// check result
+	if len(res.(*Result).Matched) == 0 {
+		return nil, fmt.Errorf("dropUser: user %s@%s not found", name, ctx.Database)
+	}
+
+	return bson.D{}, nil
+}
+
+func commandUsersInfo(ctx *CommandContext, cmd bsonkit.Doc) (bson.D, error) {
+	// get flags
+	showCredentials, err := getBool(cmd, "showCredentials", false)
+	if err != nil {
+		return nil, err
+	}
+	forAllDBs, _ := bsonkit.Get(cmd, "usersInfo.forAllDBs").(bool)
+
+	// get users
+	var users []User
+	_, err = ctx.use(false, func(txn *Transaction) (interface{}, error) {
+		// handle all users
+		if forAllDBs {
+			users, err = listUsers(txn.Catalog(), "")
+			return nil, err
+		}
+
+		// handle database users
+		if num, ok := toInteger((*cmd)[0].Value); ok && num == 1 {
+			users, err = listUsers(txn.Catalog(), ctx.Database)
+			return nil, err
+		}
+
+		// get requested users
+		requested := bson.A{(*cmd)[0].Value}
+		if array, ok := (*cmd)[0].Value.(bson.A); ok {
+			requested = array
+		}
+
+		// find users
+		for _, item := range requested {
+			var db, name string
+			switch item := item.(type) {
+			case string:
+				db, name = ctx.Database, item
+			case bson.D:
+				name, _ = bsonkit.Get(&item, "user").(string)
+				db, _ = bsonkit.Get(&item, "db").(string)
+			default:
+				return nil, fmt.Errorf("usersInfo: users must be strings or documents")
+			}
+			user, err := findUser(txn.Catalog(), db, name)
+			if err != nil {
+				return nil, err
+			} else if user != nil {
+				users = append(users, *user)
+			}
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare list
+	list := bson.A{}
+	for _, user := range users {
+		// prepare roles
+		roles := bson.A{}
+		for _, role := range user.Roles {
+			roles = append(roles, bson.D{
+				{Key: "role", Value: role.Role},
+				{Key: "db", Value: role.DB},
+			})
+		}
+
+		// prepare mechanisms
+		mechanisms := bson.A{}
+		for _, mechanism := range user.Credentials.Mechanisms() {
+			mechanisms = append(mechanisms, mechanism)
+		}
+
+		// prepare info
+		info := bson.D{
+			{Key: "_id", Value: user.ID},
+			{Key: "userId", Value: user.UserID},
+			{Key: "user", Value: user.Name},
+			{Key: "db", Value: user.DB},
+			{Key: "roles", Value: roles},
+			{Key: "mechanisms", Value: mechanisms},
+		}
+		if user.CustomData != nil {
+			info = append(info, bson.E{Key: "customData", Value: user.CustomData})
+		}
+		if showCredentials {
+			creds, err := bsonkit.Transform(user.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			info = append(info, bson.E{Key: "credentials", Value: *creds})
+		}
+
+		list = append(list, info)
+	}
+
+	return bson.D{
+		{Key: "users", Value: list},
+	}, nil
+}
@@ -2,7 +2,9 @@ package lungo
 
 import (
 	"context"
+	"fmt"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
@@ -10,6 +12,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 
 	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
 )
 
 var _ IDatabase = &Database{}
@@ -21,8 +24,30 @@ type Database struct {
 }
 
 // Aggregate implements the IDatabase.Aggregate method.
-func (d *Database) Aggregate(context.Context, interface{}, ...*options.AggregateOptions) (ICursor, error) {
-	panic("lungo: not implemented")
+func (d *Database) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (ICursor, error) {
+	// prepare pipeline
+	stages, let, err := prepareAggregate(pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// open change stream
+	stream, ok, err := openChangeStream(d.engine, Handle{d.name}, stages, true)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return stream, nil
+	}
+
+	// run pipeline (pipelines with output stages need a write transaction)
+	res, err := useTransaction(ctx, d.engine, mongokit.HasOutputStage(stages), func(txn *Transaction) (interface{}, error) {
+		return txn.Aggregate(Handle{d.name}, stages, let)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{list: res.(bsonkit.List)}, nil
 }
 
 // Client implements the IDatabase.Client method.
@@ -67,8 +92,14 @@ func (d *Database) CreateCollection(ctx context.Context, name string, opts ...*o
 	// ensure abortion
 	defer d.engine.Abort(txn)
 
+	// check collection
+	handle := Handle{d.name, name}
+	if txn.Catalog().Namespaces[handle] != nil {
+		return mongokit.NamespaceExists.Errorf("collection already exists. NS: %s", handle.String())
+	}
+
 	// create collection
-	err = txn.Create(Handle{d.name, name})
+	err = txn.Create(handle)
 	if err != nil {
 		return err
 	}
@@ -181,13 +212,83 @@ func (d *Database) ReadPreference() *readpref.ReadPref {
 }
 
 // RunCommand implements the IDatabase.RunCommand method.
-func (d *Database) RunCommand(context.Context, interface{}, ...*options.RunCmdOptions) ISingleResult {
-	panic("lungo: not implemented")
+func (d *Database) RunCommand(ctx context.Context, command interface{}, opts ...*options.RunCmdOptions) ISingleResult {
+	// run command
+	reply, err := d.runCommand(ctx, command, opts)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+
+	// check write errors
+	err = writeException(reply)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+
+	return &SingleResult{doc: reply}
 }
 
 // RunCommandCursor implements the IDatabase.RunCommandCursor method.
-func (d *Database) RunCommandCursor(context.Context, interface{}, ...*options.RunCmdOptions) (ICursor, error) {
-	panic("lungo: not implemented")
+func (d *Database) RunCommandCursor(ctx context.Context, command interface{}, opts ...*options.RunCmdOptions) (ICursor, error) {
+	// run command
+	reply, err := d.runCommand(ctx, command, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// get first batch
+	batch, ok := bsonkit.Get(reply, "cursor.firstBatch").(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("the command did not return a cursor")
+	}
+
+	// collect documents
+	list := make(bsonkit.List, 0, len(batch))
+	for _, item := range batch {
+		doc := item.(bson.D)
+		list = append(list, &doc)
+	}
+
+	// get remaining documents
+	id, _ := bsonkit.Get(reply, "cursor.id").(int64)
+	if id != 0 {
+		// return change streams directly
+		ns, _ := bsonkit.Get(reply, "cursor.ns").(string)
+		if stream := d.engine.cursorStream(id, ns, "", true); stream != nil {
+			return stream, nil
+		}
+
+		_, rest, err := d.engine.nextBatch(id, ns, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rest...)
+	}
+
+	return &Cursor{list: list}, nil
+}
+
+func (d *Database) runCommand(ctx context.Context, command interface{}, opts []*options.RunCmdOptions) (bsonkit.Doc, error) {
+	// merge options
+	opt := options.MergeRunCmdOptions(opts...)
+
+	// assert supported options
+	assertOptions(opt, map[string]string{
+		"ReadPreference": ignored,
+	})
+
+	// check command
+	if command == nil {
+		panic("lungo: missing command")
+	}
+
+	// transform command
+	cmd, err := bsonkit.Transform(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.engine.RunCommand(ctx, d.name, cmd)
 }
 
 // Watch implements the IDatabase.Watch method.
@@ -212,11 +313,6 @@ func (d *Database) Watch(_ context.Context, pipeline interface{}, opts ...*optio
 		return nil, err
 	}
 
-	// reject non-empty pipelines
-	if len(filter) > 0 {
-		panic("lungo: change stream pipelines are not supported")
-	}
-
 	// get resume after
 	var resumeAfter bsonkit.Doc
 	if opt.ResumeAfter != nil {
@@ -248,3 +344,43 @@ func (d *Database) Watch(_ context.Context, pipeline interface{}, opts ...*optio
 func (d *Database) WriteConcern() *writeconcern.WriteConcern {
 	return nil
 }
+
+// writeException will return a write exception for the write errors in the
+// reply, like the driver does for commands run with RunCommand.
+func writeException(reply bsonkit.Doc) error {
+	// get write errors
+	list, _ := bsonkit.Get(reply, "writeErrors").(bson.A)
+	if len(list) == 0 {
+		return nil
+	}
+
+	// convert errors
+	errs := make(mongo.WriteErrors, 0, len(list))
+	for _, item := range list {
+		doc, _ := item.(bson.D)
+		index, _ := bsonkit.Get(&doc, "index").(int32)
+		code, _ := bsonkit.Get(&doc, "code").(int32)
+		msg, _ := bsonkit.Get(&doc, "errmsg").(string)
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		errs = append(errs, mongo.WriteError{
+			Index:   int(index),
+			Code:    int(code),
+			Message: msg,
+			Raw:     raw,
+		})
+	}
+
+	// encode reply
+	raw, err := bson.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	return mongo.WriteException{
+		WriteErrors: errs,
+		Raw:         raw,
+	}
+}
@@ -9,6 +9,32 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+func TestDatabaseAggregate(t *testing.T) {
+	databaseTest(t, func(t *testing.T, d IDatabase) {
+		// documents
+		csr, err := d.Aggregate(nil, bson.A{
+			bson.M{"$documents": bson.A{
+				bson.M{"num": int32(1)},
+				bson.M{"num": int32(2)},
+				bson.M{"num": int32(3)},
+			}},
+			bson.M{"$match": bson.M{"num": bson.M{"$gte": int32(2)}}},
+			bson.M{"$sort": bson.M{"num": -1}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{"num": int32(3)},
+			{"num": int32(2)},
+		}, readAll(csr))
+
+		// collection required
+		_, err = d.Aggregate(nil, bson.A{
+			bson.M{"$match": bson.M{}},
+		})
+		assert.Error(t, err)
+	})
+}
+
 func TestDatabaseClient(t *testing.T) {
 	clientTest(t, func(t *testing.T, c IClient) {
 		assert.Equal(t, c, c.Database("").Client())
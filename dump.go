@@ -0,0 +1,787 @@
+package lungo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// the magic number that starts a mongodump archive
+const archiveMagic = 0x8199e26d
+
+// the marker that ends a block of documents in a mongodump archive
+var archiveTerminator = []byte{0xff, 0xff, 0xff, 0xff}
+
+// the table used to compute the checksums of a mongodump archive
+var archiveTable = crc64.MakeTable(crc64.ECMA)
+
+// DumpOptions is used to configure a dump.
+type DumpOptions struct {
+	// The database to dump. All databases except "local" are dumped if empty.
+	Database string
+
+	// Whether the files or the archive should be compressed with gzip.
+	Gzip bool
+}
+
+// RestoreOptions is used to configure a restore.
+type RestoreOptions struct {
+	// The database to restore. All databases are restored if empty.
+	Database string
+
+	// Whether existing collections should be dropped before restoring.
+	Drop bool
+}
+
+// dumpNamespace is a single collection of a dump.
+type dumpNamespace struct {
+	handle   Handle
+	metadata bson.D
+	size     int64
+	docs     bsonkit.List
+}
+
+// archiveHeader is the header of a mongodump archive.
+type archiveHeader struct {
+	ConcurrentCollections int32  `bson:"concurrent_collections"`
+	Version               string `bson:"version"`
+	ServerVersion         string `bson:"server_version"`
+	ToolVersion           string `bson:"tool_version"`
+}
+
+// archiveCollection describes a collection in the prelude of a mongodump
+// archive.
+type archiveCollection struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	Metadata   string `bson:"metadata"`
+	Size       int64  `bson:"size"`
+	Type       string `bson:"type"`
+}
+
+// archiveBlock is the header of a block of documents in a mongodump archive.
+type archiveBlock struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	EOF        bool   `bson:"EOF"`
+	CRC        int64  `bson:"CRC"`
+}
+
+// DumpDirectory will write the collections of the catalog to the directory
+// using the mongodump layout. The documents of a collection are written to a
+// "<db>/<coll>.bson" file and the index specifications to a
+// "<db>/<coll>.metadata.json" file. If gzip is enabled, both files get an
+// additional ".gz" extension. The number of dumped documents per namespace is
+// returned.
+func DumpDirectory(catalog *Catalog, dir string, opts DumpOptions) (map[Handle]int, error) {
+	// collect namespaces
+	namespaces, err := dumpNamespaces(catalog, opts.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	// write namespaces
+	counts := map[Handle]int{}
+	for _, ns := range namespaces {
+		// create directory
+		err = os.MkdirAll(filepath.Join(dir, ns.handle[0]), 0777)
+		if err != nil {
+			return nil, err
+		}
+
+		// encode metadata
+		metadata, err := bsonkit.MarshalExtJSON(&ns.metadata, true)
+		if err != nil {
+			return nil, err
+		}
+
+		// write metadata
+		base := filepath.Join(dir, ns.handle[0], ns.handle[1])
+		err = writeDumpFile(base+".metadata.json", opts.Gzip, func(w io.Writer) error {
+			_, err := w.Write(metadata)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// write documents
+		err = writeDumpFile(base+".bson", opts.Gzip, func(w io.Writer) error {
+			return writeDocuments(w, ns.docs, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// set count
+		counts[ns.handle] = len(ns.docs)
+	}
+
+	return counts, nil
+}
+
+// DumpArchive will write the collections of the catalog to the writer using
+// the archive format of "mongodump --archive". If gzip is enabled, the whole
+// archive is compressed like with "mongodump --archive --gzip". The number of
+// dumped documents per namespace is returned.
+func DumpArchive(catalog *Catalog, w io.Writer, opts DumpOptions) (map[Handle]int, error) {
+	// collect namespaces
+	namespaces, err := dumpNamespaces(catalog, opts.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare writer
+	bw := bufio.NewWriter(w)
+	out := io.Writer(bw)
+	var zw *gzip.Writer
+	if opts.Gzip {
+		zw = gzip.NewWriter(bw)
+		out = zw
+	}
+
+	// write magic number
+	err = binary.Write(out, binary.LittleEndian, uint32(archiveMagic))
+	if err != nil {
+		return nil, err
+	}
+
+	// write header
+	err = writeValue(out, archiveHeader{
+		ConcurrentCollections: 1,
+		Version:               "0.1",
+		ServerVersion:         defaultVersion,
+		ToolVersion:           "lungo",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// write prelude
+	for _, ns := range namespaces {
+		// encode metadata
+		metadata, err := bsonkit.MarshalExtJSON(&ns.metadata, true)
+		if err != nil {
+			return nil, err
+		}
+
+		// write collection
+		err = writeValue(out, archiveCollection{
+			Database:   ns.handle[0],
+			Collection: ns.handle[1],
+			Metadata:   string(metadata),
+			Size:       ns.size,
+			Type:       "collection",
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = out.Write(archiveTerminator)
+	if err != nil {
+		return nil, err
+	}
+
+	// write namespaces
+	counts := map[Handle]int{}
+	for _, ns := range namespaces {
+		// write documents
+		checksum := crc64.New(archiveTable)
+		if len(ns.docs) > 0 {
+			err = writeValue(out, archiveBlock{
+				Database:   ns.handle[0],
+				Collection: ns.handle[1],
+			})
+			if err != nil {
+				return nil, err
+			}
+			err = writeDocuments(out, ns.docs, checksum)
+			if err != nil {
+				return nil, err
+			}
+			_, err = out.Write(archiveTerminator)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// write end of namespace
+		err = writeValue(out, archiveBlock{
+			Database:   ns.handle[0],
+			Collection: ns.handle[1],
+			EOF:        true,
+			CRC:        int64(checksum.Sum64()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = out.Write(archiveTerminator)
+		if err != nil {
+			return nil, err
+		}
+
+		// set count
+		counts[ns.handle] = len(ns.docs)
+	}
+
+	// close compressor
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// flush writer
+	err = bw.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// RestoreDirectory will restore the collections from a directory written by
+// DumpDirectory or mongodump. Compressed files are detected by their ".gz"
+// extension. The collections are restored in a single transaction and the
+// number of restored documents per namespace is returned.
+func RestoreDirectory(ctx context.Context, engine *Engine, dir string, opts RestoreOptions) (map[Handle]int, error) {
+	// find files
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	// read files
+	index := map[Handle]*dumpNamespace{}
+	var namespaces []*dumpNamespace
+	for _, file := range files {
+		// parse name
+		name := strings.TrimSuffix(filepath.Base(file), ".gz")
+		metadata := strings.HasSuffix(name, ".metadata.json")
+		if !metadata && !strings.HasSuffix(name, ".bson") {
+			continue
+		}
+
+		// get handle
+		handle := Handle{
+			filepath.Base(filepath.Dir(file)),
+			strings.TrimSuffix(strings.TrimSuffix(name, ".metadata.json"), ".bson"),
+		}
+		if opts.Database != "" && handle[0] != opts.Database {
+			continue
+		}
+
+		// get namespace
+		ns := index[handle]
+		if ns == nil {
+			ns = &dumpNamespace{handle: handle}
+			index[handle] = ns
+			namespaces = append(namespaces, ns)
+		}
+
+		// read file
+		buf, err := readDumpFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// decode file
+		if metadata {
+			ns.metadata, err = decodeMetadata(buf)
+		} else {
+			ns.docs, err = readDocuments(bytes.NewReader(buf))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	// check namespaces
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("no collections found in %s", dir)
+	}
+
+	return restoreNamespaces(ctx, engine, namespaces, opts.Drop)
+}
+
+// RestoreArchive will restore the collections from an archive written by
+// DumpArchive or "mongodump --archive". A compressed archive is detected
+// automatically. The collections are restored in a single transaction and the
+// number of restored documents per namespace is returned.
+func RestoreArchive(ctx context.Context, engine *Engine, r io.Reader, opts RestoreOptions) (map[Handle]int, error) {
+	// prepare reader
+	br := bufio.NewReader(r)
+	in := io.Reader(br)
+
+	// detect compression
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	// read magic number
+	var magic uint32
+	err := binary.Read(in, binary.LittleEndian, &magic)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	} else if magic != archiveMagic {
+		return nil, fmt.Errorf("not a mongodump archive")
+	}
+
+	// read header
+	var header archiveHeader
+	err = readValue(in, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	// read prelude
+	index := map[Handle]*dumpNamespace{}
+	var namespaces []*dumpNamespace
+	for {
+		// read collection
+		var coll archiveCollection
+		err = readValue(in, &coll)
+		if errors.Is(err, errTerminator) {
+			break
+		} else if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		// skip empty databases
+		if coll.Database == "" || coll.Collection == "" {
+			continue
+		}
+
+		// add namespace
+		ns := &dumpNamespace{handle: Handle{coll.Database, coll.Collection}}
+		if coll.Metadata != "" {
+			ns.metadata, err = decodeMetadata([]byte(coll.Metadata))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", ns.handle.String(), err)
+			}
+		}
+		index[ns.handle] = ns
+		namespaces = append(namespaces, ns)
+	}
+
+	// read blocks
+	checksums := map[Handle]hash.Hash64{}
+	for {
+		// read block
+		var block archiveBlock
+		err = readValue(in, &block)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// get namespace
+		handle := Handle{block.Database, block.Collection}
+		ns := index[handle]
+		if ns == nil {
+			return nil, fmt.Errorf("%s: namespace missing in prelude", handle.String())
+		}
+
+		// get checksum
+		checksum := checksums[handle]
+		if checksum == nil {
+			checksum = crc64.New(archiveTable)
+			checksums[handle] = checksum
+		}
+
+		// check checksum
+		if block.EOF {
+			if block.CRC != 0 && block.CRC != int64(checksum.Sum64()) {
+				return nil, fmt.Errorf("%s: checksum mismatch", handle.String())
+			}
+			_, err = readDocument(in)
+			if !errors.Is(err, errTerminator) {
+				return nil, fmt.Errorf("%s: missing terminator", handle.String())
+			}
+			continue
+		}
+
+		// read documents
+		for {
+			buf, err := readDocument(in)
+			if errors.Is(err, errTerminator) {
+				break
+			} else if errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return nil, err
+			}
+			_, _ = checksum.Write(buf)
+			doc, err := decodeDocument(buf)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", handle.String(), err)
+			}
+			ns.docs = append(ns.docs, doc)
+		}
+	}
+
+	// filter namespaces
+	if opts.Database != "" {
+		var list []*dumpNamespace
+		for _, ns := range namespaces {
+			if ns.handle[0] == opts.Database {
+				list = append(list, ns)
+			}
+		}
+		namespaces = list
+	}
+
+	return restoreNamespaces(ctx, engine, namespaces, opts.Drop)
+}
+
+// dumpNamespaces will collect the sorted namespaces of the catalog except the
+// local database.
+func dumpNamespaces(catalog *Catalog, db string) ([]*dumpNamespace, error) {
+	// collect handles
+	var handles []Handle
+	for handle := range catalog.Namespaces {
+		if handle[0] != Local && (db == "" || handle[0] == db) {
+			handles = append(handles, handle)
+		}
+	}
+
+	// sort handles
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i].String() < handles[j].String()
+	})
+
+	// collect namespaces
+	txn := NewTransaction(catalog)
+	namespaces := make([]*dumpNamespace, 0, len(handles))
+	for _, handle := range handles {
+		// get indexes
+		indexes, err := txn.ListIndexes(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		// collect specs
+		specs := bson.A{}
+		for _, spec := range indexes {
+			specs = append(specs, *spec)
+		}
+
+		// add namespace
+		namespace := catalog.Namespaces[handle]
+		namespaces = append(namespaces, &dumpNamespace{
+			handle: handle,
+			metadata: bson.D{
+				{Key: "options", Value: bson.D{}},
+				{Key: "indexes", Value: specs},
+				{Key: "collectionName", Value: handle[1]},
+				{Key: "type", Value: "collection"},
+			},
+			size: namespace.Size(),
+			docs: namespace.Documents.List,
+		})
+	}
+
+	return namespaces, nil
+}
+
+// restoreNamespaces will restore the namespaces in a single transaction.
+func restoreNamespaces(ctx context.Context, engine *Engine, namespaces []*dumpNamespace, drop bool) (map[Handle]int, error) {
+	// begin transaction
+	txn, err := engine.Begin(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// ensure abortion
+	defer engine.Abort(txn)
+
+	// restore namespaces
+	counts := map[Handle]int{}
+	for _, ns := range namespaces {
+		err = restoreNamespace(txn, ns, drop)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ns.handle.String(), err)
+		}
+		counts[ns.handle] = len(ns.docs)
+	}
+
+	// commit transaction
+	err = engine.Commit(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func restoreNamespace(txn *Transaction, ns *dumpNamespace, drop bool) error {
+	// check type
+	if kind, _ := bsonkit.Get(&ns.metadata, "type").(string); kind != "" && kind != "collection" {
+		return fmt.Errorf("unsupported collection type %q", kind)
+	}
+
+	// drop namespace
+	if drop {
+		err := txn.Drop(ns.handle)
+		if err != nil {
+			return err
+		}
+	}
+
+	// create namespace
+	err := txn.Create(ns.handle)
+	if err != nil {
+		return err
+	}
+
+	// create indexes except the default index
+	indexes, _ := bsonkit.Get(&ns.metadata, "indexes").(bson.A)
+	for _, item := range indexes {
+		spec, ok := item.(bson.D)
+		if !ok {
+			return fmt.Errorf("invalid index specification")
+		}
+		name, config, err := parseIndex(&spec)
+		if err != nil {
+			return err
+		} else if name == "_id_" {
+			continue
+		}
+		_, err = txn.CreateIndex(ns.handle, name, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// insert documents
+	if len(ns.docs) > 0 {
+		res, err := txn.Insert(ns.handle, ns.docs, true)
+		if err != nil {
+			return err
+		} else if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	return nil
+}
+
+// decodeMetadata will decode the Extended JSON metadata of a collection.
+func decodeMetadata(buf []byte) (bson.D, error) {
+	doc, err := bsonkit.UnmarshalExtJSON(buf)
+	if err != nil {
+		return nil, err
+	}
+	return *doc, nil
+}
+
+// writeDumpFile will create the file and call the function with a writer that
+// optionally compresses the written data.
+func writeDumpFile(path string, compress bool, fn func(io.Writer) error) error {
+	// adjust path
+	if compress {
+		path += ".gz"
+	}
+
+	// create file
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// prepare writer
+	bw := bufio.NewWriter(file)
+	out := io.Writer(bw)
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(bw)
+		out = zw
+	}
+
+	// write data
+	err = fn(out)
+	if err != nil {
+		return err
+	}
+
+	// close compressor
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// flush writer
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// readDumpFile will read the file and decompress it if it has a ".gz"
+// extension.
+func readDumpFile(path string) ([]byte, error) {
+	// read file
+	buf, err := os.ReadFile(path)
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return buf, err
+	}
+
+	// decompress data
+	zr, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	buf, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return buf, nil
+}
+
+// writeValue will write the value as a BSON document.
+func writeValue(w io.Writer, value interface{}) error {
+	// encode value
+	buf, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	// write document
+	_, err = w.Write(buf)
+
+	return err
+}
+
+// writeDocuments will write the documents and add them to the optional
+// checksum.
+func writeDocuments(w io.Writer, docs bsonkit.List, checksum hash.Hash64) error {
+	for _, doc := range docs {
+		// encode document
+		buf, err := bson.Marshal(*doc)
+		if err != nil {
+			return err
+		}
+
+		// write document
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+
+		// update checksum
+		if checksum != nil {
+			_, _ = checksum.Write(buf)
+		}
+	}
+
+	return nil
+}
+
+// errTerminator is returned when reading a terminator instead of a document.
+var errTerminator = errors.New("unexpected terminator")
+
+// readValue will read a BSON document and decode it into the value.
+func readValue(r io.Reader, value interface{}) error {
+	// read document
+	buf, err := readDocument(r)
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(buf, value)
+}
+
+// readDocuments will read BSON documents until the end of the reader.
+func readDocuments(r io.Reader) (bsonkit.List, error) {
+	var list bsonkit.List
+	for {
+		// read document
+		buf, err := readDocument(r)
+		if errors.Is(err, io.EOF) {
+			return list, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		// decode document
+		doc, err := decodeDocument(buf)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, doc)
+	}
+}
+
+// readDocument will read a raw BSON document. It returns io.EOF if the reader
+// ends before the document and errTerminator if a terminator has been read.
+func readDocument(r io.Reader) ([]byte, error) {
+	// read length
+	var head [4]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// check terminator
+	if bytes.Equal(head[:], archiveTerminator) {
+		return nil, errTerminator
+	}
+
+	// check length
+	length := binary.LittleEndian.Uint32(head[:])
+	if length < 5 || length > 64*1024*1024 {
+		return nil, fmt.Errorf("invalid document length %d", length)
+	}
+
+	// read document
+	buf := make([]byte, length)
+	copy(buf, head[:])
+	_, err = io.ReadFull(r, buf[4:])
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// decodeDocument will decode a raw BSON document.
+func decodeDocument(buf []byte) (bsonkit.Doc, error) {
+	var doc bson.D
+	err := bson.Unmarshal(buf, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
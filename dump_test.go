@@ -0,0 +1,225 @@
+package lungo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func dumpEngine(t *testing.T) *Engine {
+	client, engine, err := Open(nil, Options{Store: NewMemoryStore()})
+	assert.NoError(t, err)
+
+	users := client.Database("app").Collection("users")
+	_, err = users.InsertMany(nil, []interface{}{
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "a"}, {Key: "age", Value: int64(31)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "name", Value: "b"}, {Key: "score", Value: 2.5}},
+	})
+	assert.NoError(t, err)
+
+	_, err = users.Indexes().CreateMany(nil, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "name", Value: int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "age", Value: int32(-1)}},
+			Options: options.Index().SetPartialFilterExpression(bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(30)}}}}),
+		},
+		{
+			Keys:    bson.D{{Key: "created", Value: int32(1)}},
+			Options: options.Index().SetExpireAfterSeconds(3600),
+		},
+	})
+	assert.NoError(t, err)
+
+	_, err = client.Database("app").Collection("empty").InsertOne(nil, bson.D{})
+	assert.NoError(t, err)
+	_, err = client.Database("app").Collection("empty").DeleteMany(nil, bson.D{})
+	assert.NoError(t, err)
+
+	_, err = client.Database("other").Collection("items").InsertOne(nil, bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "at", Value: primitive.NewDateTimeFromTime(time.Now())},
+	})
+	assert.NoError(t, err)
+
+	return engine
+}
+
+func assertRestored(t *testing.T, source, target *Engine, handles ...Handle) {
+	sourceTxn := NewTransaction(source.Catalog())
+	targetTxn := NewTransaction(target.Catalog())
+
+	for _, handle := range handles {
+		assert.NotNil(t, target.Catalog().Namespaces[handle], handle.String())
+		assert.Equal(t,
+			append(bsonkit.List{}, source.Catalog().Namespaces[handle].Documents.List...),
+			append(bsonkit.List{}, target.Catalog().Namespaces[handle].Documents.List...),
+		)
+
+		sourceIndexes, err := sourceTxn.ListIndexes(handle)
+		assert.NoError(t, err)
+		targetIndexes, err := targetTxn.ListIndexes(handle)
+		assert.NoError(t, err)
+		assert.Equal(t, sourceIndexes, targetIndexes)
+	}
+}
+
+func TestDumpDirectory(t *testing.T) {
+	source := dumpEngine(t)
+	defer source.Close()
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+
+		counts, err := DumpDirectory(source.Catalog(), dir, DumpOptions{Gzip: compress})
+		assert.NoError(t, err)
+		assert.Equal(t, map[Handle]int{
+			{"app", "empty"}:   0,
+			{"app", "users"}:   2,
+			{"other", "items"}: 1,
+		}, counts)
+
+		ext := ""
+		if compress {
+			ext = ".gz"
+		}
+		assert.FileExists(t, filepath.Join(dir, "app", "users.bson"+ext))
+		assert.FileExists(t, filepath.Join(dir, "app", "users.metadata.json"+ext))
+		assert.NoDirExists(t, filepath.Join(dir, Local))
+
+		if !compress {
+			metadata, err := os.ReadFile(filepath.Join(dir, "app", "empty.metadata.json"))
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{
+				"options": {},
+				"indexes": [{"v": {"$numberInt": "2"}, "key": {"_id": {"$numberInt": "1"}}, "name": "_id_"}],
+				"collectionName": "empty",
+				"type": "collection"
+			}`, string(metadata))
+		}
+
+		target, err := CreateEngine(Options{Store: NewMemoryStore()})
+		assert.NoError(t, err)
+
+		counts, err = RestoreDirectory(nil, target, dir, RestoreOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, counts, 3)
+		assertRestored(t, source, target, Handle{"app", "users"}, Handle{"app", "empty"}, Handle{"other", "items"})
+
+		_, err = RestoreDirectory(nil, target, dir, RestoreOptions{})
+		assert.Error(t, err)
+		assert.True(t, IsUniquenessError(err))
+
+		counts, err = RestoreDirectory(nil, target, dir, RestoreOptions{Database: "app", Drop: true})
+		assert.NoError(t, err)
+		assert.Len(t, counts, 2)
+		assertRestored(t, source, target, Handle{"app", "users"})
+
+		target.Close()
+	}
+
+	target, err := CreateEngine(Options{Store: NewMemoryStore()})
+	assert.NoError(t, err)
+	defer target.Close()
+
+	_, err = RestoreDirectory(nil, target, t.TempDir(), RestoreOptions{})
+	assert.Error(t, err)
+}
+
+func TestDumpArchive(t *testing.T) {
+	source := dumpEngine(t)
+	defer source.Close()
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		counts, err := DumpArchive(source.Catalog(), &buf, DumpOptions{Gzip: compress})
+		assert.NoError(t, err)
+		assert.Len(t, counts, 3)
+
+		if compress {
+			assert.Equal(t, []byte{0x1f, 0x8b}, buf.Bytes()[:2])
+		} else {
+			assert.Equal(t, []byte{0x6d, 0xe2, 0x99, 0x81}, buf.Bytes()[:4])
+		}
+
+		target, err := CreateEngine(Options{Store: NewMemoryStore()})
+		assert.NoError(t, err)
+
+		counts, err = RestoreArchive(nil, target, bytes.NewReader(buf.Bytes()), RestoreOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, map[Handle]int{
+			{"app", "empty"}:   0,
+			{"app", "users"}:   2,
+			{"other", "items"}: 1,
+		}, counts)
+		assertRestored(t, source, target, Handle{"app", "users"}, Handle{"app", "empty"}, Handle{"other", "items"})
+
+		counts, err = RestoreArchive(nil, target, bytes.NewReader(buf.Bytes()), RestoreOptions{Database: "other", Drop: true})
+		assert.NoError(t, err)
+		assert.Equal(t, map[Handle]int{{"other", "items"}: 1}, counts)
+
+		target.Close()
+	}
+}
+
+func TestDumpArchiveErrors(t *testing.T) {
+	source := dumpEngine(t)
+	defer source.Close()
+
+	var buf bytes.Buffer
+	_, err := DumpArchive(source.Catalog(), &buf, DumpOptions{Database: "app"})
+	assert.NoError(t, err)
+	archive := buf.Bytes()
+
+	target, err := CreateEngine(Options{Store: NewMemoryStore()})
+	assert.NoError(t, err)
+	defer target.Close()
+
+	_, err = RestoreArchive(nil, target, bytes.NewReader(nil), RestoreOptions{})
+	assert.EqualError(t, err, "not a mongodump archive")
+
+	_, err = RestoreArchive(nil, target, bytes.NewReader(archive[:len(archive)-20]), RestoreOptions{})
+	assert.Error(t, err)
+
+	corrupt := bytes.Replace(archive, []byte("name\x00\x02\x00\x00\x00a"), []byte("name\x00\x02\x00\x00\x00x"), 1)
+	assert.NotEqual(t, archive, corrupt)
+	_, err = RestoreArchive(nil, target, bytes.NewReader(corrupt), RestoreOptions{})
+	assert.EqualError(t, err, "app.users: checksum mismatch")
+
+	assert.Nil(t, target.Catalog().Namespaces[Handle{"app", "users"}])
+}
+
+func TestRestoreNamespaceType(t *testing.T) {
+	engine, err := CreateEngine(Options{Store: NewMemoryStore()})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	_, err = restoreNamespaces(nil, engine, []*dumpNamespace{
+		{
+			handle:   Handle{"app", "view"},
+			metadata: bson.D{{Key: "type", Value: "view"}},
+		},
+	}, false)
+	assert.EqualError(t, err, `app.view: unsupported collection type "view"`)
+
+	counts, err := restoreNamespaces(nil, engine, []*dumpNamespace{
+		{
+			handle: Handle{"app", "docs"},
+			docs:   bsonkit.List{bsonkit.MustConvert(bson.M{"_id": int32(1)})},
+		},
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[Handle]int{{"app", "docs"}: 1}, counts)
+}
@@ -4,16 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gopkg.in/tomb.v2"
 
 	"github.com/256dpi/lungo/bsonkit"
 	"github.com/256dpi/lungo/dbkit"
+	"github.com/256dpi/lungo/mongokit"
 )
 
+// the server version reported by default
+const defaultVersion = "7.0.0"
+
+// the interval at which transactions, sessions and cursors are reaped
+const reapInterval = time.Second
+
 // ErrEngineClosed is returned if the engine has been closed.
 var ErrEngineClosed = errors.New("engine closed")
 
@@ -41,20 +51,81 @@ type Options struct {
 	// Default: 5m, 1h.
 	MinOplogAge time.Duration
 	MaxOplogAge time.Duration
+
+	// The server version reported by the hello and buildInfo commands.
+	//
+	// Default: 7.0.0.
+	Version string
+
+	// The source of randomness used by the $sample aggregation stage. A seeded
+	// source makes sampling deterministic e.g. in tests. The engine serializes
+	// the access to the source.
+	//
+	// Default: The global source.
+	Random rand.Source
+
+	// The maximum lifetime of transactions started by sessions. Transactions
+	// that run longer are aborted to release the write lock. A negative value
+	// disables the limit.
+	//
+	// Default: 60s.
+	TransactionLifetime time.Duration
+
+	// The duration after which idle sessions are ended and their active
+	// transactions aborted. A negative value disables the timeout.
+	//
+	// Default: 30m.
+	SessionTimeout time.Duration
+
+	// The duration after which idle command cursors are removed. A negative
+	// value disables the timeout.
+	//
+	// Default: 10m.
+	CursorTimeout time.Duration
 }
 
 // Engine manages the catalog loaded from a store and provides access to it
 // through transactions. Additionally, it also manages streams that subscribe
 // to catalog changes.
 type Engine struct {
-	opts    Options
-	store   Store
-	catalog *Catalog
-	streams map[*Stream]struct{}
-	token   *dbkit.Semaphore
-	txn     *Transaction
-	tomb    tomb.Tomb
-	mutex   sync.Mutex
+	opts     Options
+	store    Store
+	catalog  *Catalog
+	streams  map[*Stream]struct{}
+	sessions map[*Session]struct{}
+	latency  map[Handle]*latencyStats
+	ops      map[string]int64
+	txns     txnCounters
+	cursors  map[int64]*commandCursor
+	cursorID int64
+	token    *dbkit.Semaphore
+	random   *rand.Rand
+	txn      *Transaction
+	txnID    int64
+	txnStart time.Time
+	started  time.Time
+	process  primitive.ObjectID
+	tomb     tomb.Tomb
+	mutex    sync.Mutex
+}
+
+// txnCounters holds the number of started, committed and aborted transactions.
+type txnCounters struct {
+	started   int64
+	committed int64
+	aborted   int64
+}
+
+// latencyStats holds the accumulated latency of the operations on a namespace.
+type latencyStats struct {
+	reads  latencyCounter
+	writes latencyCounter
+}
+
+// latencyCounter holds the number and total duration of operations.
+type latencyCounter struct {
+	ops    int64
+	micros int64
 }
 
 // CreateEngine will create and return an engine with a loaded catalog from the
@@ -81,6 +152,27 @@ func CreateEngine(opts Options) (*Engine, error) {
 		opts.MaxOplogAge = time.Hour
 	}
 
+	// set default lifetime and timeouts
+	if opts.TransactionLifetime == 0 {
+		opts.TransactionLifetime = 60 * time.Second
+	}
+	if opts.SessionTimeout == 0 {
+		opts.SessionTimeout = 30 * time.Minute
+	}
+	if opts.CursorTimeout == 0 {
+		opts.CursorTimeout = 10 * time.Minute
+	}
+
+	// set default version
+	if opts.Version == "" {
+		opts.Version = defaultVersion
+	}
+
+	// validate version
+	if _, ok := parseVersion(opts.Version); !ok {
+		return nil, fmt.Errorf("invalid version: %s", opts.Version)
+	}
+
 	// validate oplog ages
 	const maxAge = 21 * 24 * time.Hour
 	if opts.MinOplogAge < 0 || opts.MinOplogAge > maxAge {
@@ -91,10 +183,21 @@ func CreateEngine(opts Options) (*Engine, error) {
 
 	// create engine
 	e := &Engine{
-		opts:    opts,
-		store:   opts.Store,
-		streams: map[*Stream]struct{}{},
-		token:   dbkit.NewSemaphore(1),
+		opts:     opts,
+		store:    opts.Store,
+		streams:  map[*Stream]struct{}{},
+		sessions: map[*Session]struct{}{},
+		latency:  map[Handle]*latencyStats{},
+		ops:      map[string]int64{},
+		cursors:  map[int64]*commandCursor{},
+		token:    dbkit.NewSemaphore(1),
+		started:  time.Now(),
+		process:  primitive.NewObjectID(),
+	}
+
+	// prepare random
+	if opts.Random != nil {
+		e.random = rand.New(&lockedSource{source: opts.Random})
 	}
 
 	// load catalog
@@ -106,12 +209,26 @@ func CreateEngine(opts Options) (*Engine, error) {
 	// set catalog
 	e.catalog = data
 
+	// order new events after the stored events
+	if oplog := data.Namespaces[Oplog]; oplog != nil && len(oplog.Documents.List) > 0 {
+		last := oplog.Documents.List[len(oplog.Documents.List)-1]
+		if ts, ok := bsonkit.Get(last, "_id.ts").(primitive.Timestamp); ok {
+			bsonkit.Advance(ts)
+		}
+	}
+
 	// run expiry
 	e.tomb.Go(func() error {
 		e.expire(opts.ExpireInterval, opts.ExpireErrors)
 		return nil
 	})
 
+	// run reaper
+	e.tomb.Go(func() error {
+		e.reaper(reapInterval)
+		return nil
+	})
+
 	return e, nil
 }
 
@@ -141,7 +258,9 @@ func (e *Engine) Begin(ctx context.Context, lock bool) (*Transaction, error) {
 
 	// non lock transactions do not need to be managed
 	if !lock {
-		return NewTransaction(e.catalog), nil
+		txn := NewTransaction(e.catalog)
+		txn.engine = e
+		return txn, nil
 	}
 
 	// ensure context
@@ -185,6 +304,10 @@ func (e *Engine) Begin(ctx context.Context, lock bool) (*Transaction, error) {
 
 	// create transaction
 	e.txn = NewTransaction(e.catalog)
+	e.txn.engine = e
+	e.txnID++
+	e.txnStart = time.Now()
+	e.txns.started++
 
 	return e.txn, nil
 }
@@ -218,6 +341,7 @@ func (e *Engine) Commit(txn *Transaction) error {
 
 	// check if dirty
 	if !txn.Dirty() {
+		e.txns.committed++
 		return nil
 	}
 
@@ -227,9 +351,13 @@ func (e *Engine) Commit(txn *Transaction) error {
 	// write catalog
 	err := e.store.Store(txn.Catalog())
 	if err != nil {
+		e.txns.aborted++
 		return err
 	}
 
+	// count commit
+	e.txns.committed++
+
 	// set new catalog
 	e.catalog = txn.Catalog()
 
@@ -264,11 +392,175 @@ func (e *Engine) Abort(txn *Transaction) {
 
 	// unset transaction
 	e.txn = nil
+	e.txns.aborted++
 
 	// release token
 	e.token.Release()
 }
 
+// count will record the specified number of operations of the provided type
+// (insert, query, update, delete, getmore or command).
+func (e *Engine) count(op string, n int) {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// update counter
+	e.ops[op] += int64(n)
+}
+
+// track will record the latency of a read or write operation on the namespace.
+func (e *Engine) track(handle Handle, write bool, latency time.Duration) {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// get stats
+	stats := e.latency[handle]
+	if stats == nil {
+		stats = &latencyStats{}
+		e.latency[handle] = stats
+	}
+
+	// update counter
+	counter := &stats.reads
+	if write {
+		counter = &stats.writes
+	}
+	counter.ops++
+	counter.micros += latency.Microseconds()
+}
+
+// latencyStats will return the latency statistics of the namespace.
+func (e *Engine) latencyStats(handle Handle) bsonkit.Doc {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// get stats
+	stats := e.latency[handle]
+	if stats == nil {
+		stats = &latencyStats{}
+	}
+
+	// prepare document
+	doc := bson.D{}
+	for _, item := range []struct {
+		name    string
+		counter latencyCounter
+	}{
+		{"reads", stats.reads},
+		{"writes", stats.writes},
+		{"commands", latencyCounter{}},
+		{"transactions", latencyCounter{}},
+	} {
+		doc = append(doc, bson.E{Key: item.name, Value: bson.D{
+			{Key: "latency", Value: item.counter.micros},
+			{Key: "ops", Value: item.counter.ops},
+		}})
+	}
+
+	return &doc
+}
+
+// register will add the session to the list of active sessions.
+func (e *Engine) register(session *Session) {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// add session
+	e.sessions[session] = struct{}{}
+}
+
+// unregister will remove the session from the list of active sessions.
+func (e *Engine) unregister(session *Session) {
+	// acquire lock
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// remove session
+	delete(e.sessions, session)
+}
+
+// currentOps will return a document for the active transaction if any.
+func (e *Engine) currentOps() bsonkit.List {
+	// get transaction and sessions
+	e.mutex.Lock()
+	txn, id, start := e.txn, e.txnID, e.txnStart
+	sessions := e.activeSessions()
+	e.mutex.Unlock()
+
+	// check transaction
+	if txn == nil {
+		return bsonkit.List{}
+	}
+
+	// prepare document
+	running := time.Since(start)
+	doc := bson.D{
+		{Key: "type", Value: "op"},
+		{Key: "desc", Value: "transaction"},
+		{Key: "active", Value: true},
+		{Key: "currentOpTime", Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		{Key: "opid", Value: id},
+		{Key: "secs_running", Value: int64(running / time.Second)},
+		{Key: "microsecs_running", Value: running.Microseconds()},
+		{Key: "op", Value: "command"},
+	}
+
+	// add session (checked without the engine lock as sessions call into the
+	// engine while holding their own lock)
+	for _, session := range sessions {
+		if session.Transaction() == txn {
+			doc = append(doc, bson.E{Key: "lsid", Value: bson.D{
+				{Key: "id", Value: session.id},
+			}})
+			break
+		}
+	}
+
+	return bsonkit.List{&doc}
+}
+
+// localSessions will return a document for every active session.
+func (e *Engine) localSessions() bsonkit.List {
+	// get sessions
+	e.mutex.Lock()
+	sessions := e.activeSessions()
+	e.mutex.Unlock()
+
+	// prepare documents
+	list := make(bsonkit.List, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, &bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "id", Value: session.id},
+			}},
+			{Key: "lastUse", Value: primitive.NewDateTimeFromTime(session.lastUsed())},
+		})
+	}
+
+	return list
+}
+
+// activeSessions will return the active sessions ordered by their creation.
+// The engine must be locked.
+func (e *Engine) activeSessions() []*Session {
+	// collect sessions
+	sessions := make([]*Session, 0, len(e.sessions))
+	for session := range e.sessions {
+		sessions = append(sessions, session)
+	}
+
+	// sort sessions
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].created.Before(sessions[j].created)
+	})
+
+	return sessions
+}
+
 // Watch will return a stream that is able to consume events from the oplog.
 func (e *Engine) Watch(handle Handle, pipeline bsonkit.List, resumeAfter, startAfter bsonkit.Doc, startAt *primitive.Timestamp) (*Stream, error) {
 	// acquire lock
@@ -280,6 +572,15 @@ func (e *Engine) Watch(handle Handle, pipeline bsonkit.List, resumeAfter, startA
 		return nil, ErrEngineClosed
 	}
 
+	// check pipeline
+	for _, stage := range pipeline {
+		if len(*stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage specification object must contain exactly one field")
+		} else if !changeStreamStages[(*stage)[0].Key] {
+			return nil, fmt.Errorf("%s is not permitted in a $changeStream pipeline", (*stage)[0].Key)
+		}
+	}
+
 	// get oplog
 	oplog := e.catalog.Namespaces[Oplog].Documents
 
@@ -368,6 +669,88 @@ func (e *Engine) Watch(handle Handle, pipeline bsonkit.List, resumeAfter, startA
 	return stream, nil
 }
 
+// Validate will verify the consistency of the specified namespace and its
+// indexes and return a report in the format of the "validate" command. If
+// full is true, the documents, index keys and sizes are verified as well. The
+// ordering of the events is additionally verified for the oplog.
+func (e *Engine) Validate(handle Handle, full bool) (bsonkit.Doc, error) {
+	// validate handle
+	err := handle.Validate(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// get namespace
+	namespace := e.Catalog().Namespaces[handle]
+	if namespace == nil {
+		return nil, mongokit.NamespaceNotFound.Errorf("ns not found: %s", handle.String())
+	}
+
+	// validate namespace
+	val := namespace.Validate(full)
+
+	return validationReport(handle, namespace, val), nil
+}
+
+// validationReport will check the oplog ordering if needed and return the
+// validation in the format of the "validate" command.
+func validationReport(handle Handle, namespace *mongokit.Collection, val *mongokit.Validation) bsonkit.Doc {
+	// check oplog ordering
+	if handle == Oplog {
+		var last interface{}
+		for i, event := range namespace.Documents.List {
+			ts := bsonkit.Get(event, "clusterTime")
+			if i > 0 && bsonkit.Compare(last, ts) >= 0 {
+				val.Errors = append(val.Errors, fmt.Sprintf("oplog: event %d is not ordered after event %d", i, i-1))
+				break
+			}
+			last = ts
+		}
+	}
+
+	// sort indexes
+	names := make([]string, 0, len(val.Keys))
+	for name := range val.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// prepare keys and details
+	keys := bson.D{}
+	details := bson.D{}
+	for _, name := range names {
+		valid := true
+		for _, invalid := range val.InvalidIndexes {
+			if invalid == name {
+				valid = false
+			}
+		}
+		keys = append(keys, bson.E{Key: name, Value: val.Keys[name]})
+		details = append(details, bson.E{Key: name, Value: bson.D{
+			{Key: "valid", Value: valid},
+		}})
+	}
+
+	// prepare errors
+	errs := bson.A{}
+	for _, err := range val.Errors {
+		errs = append(errs, err)
+	}
+
+	return &bson.D{
+		{Key: "ns", Value: handle.String()},
+		{Key: "nInvalidDocuments", Value: val.InvalidDocuments},
+		{Key: "nrecords", Value: val.Records},
+		{Key: "nIndexes", Value: int64(len(val.Keys))},
+		{Key: "keysPerIndex", Value: keys},
+		{Key: "indexDetails", Value: details},
+		{Key: "valid", Value: len(errs) == 0},
+		{Key: "repaired", Value: false},
+		{Key: "warnings", Value: bson.A{}},
+		{Key: "errors", Value: errs},
+	}
+}
+
 // Close will close the engine.
 func (e *Engine) Close() {
 	// acquire lock
@@ -450,3 +833,78 @@ func (e *Engine) expire(interval time.Duration, reporter func(error)) {
 		}
 	}
 }
+
+func (e *Engine) reaper(interval time.Duration) {
+	// prepare ticker
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// await next interval
+		select {
+		case <-e.tomb.Dying():
+			return
+		case <-ticker.C:
+		}
+
+		// reap transactions, sessions and cursors
+		e.reap(time.Now())
+	}
+}
+
+// reap will abort session transactions that exceeded their lifetime, end idle
+// sessions and remove idle cursors.
+func (e *Engine) reap(now time.Time) {
+	// get expired transaction and sessions
+	e.mutex.Lock()
+	txn := e.txn
+	if txn != nil && (e.opts.TransactionLifetime < 0 || now.Sub(e.txnStart) < e.opts.TransactionLifetime) {
+		txn = nil
+	}
+	sessions := e.activeSessions()
+
+	// remove idle cursors
+	var streams []*Stream
+	for id, cursor := range e.cursors {
+		if e.opts.CursorTimeout >= 0 && now.Sub(cursor.used) >= e.opts.CursorTimeout {
+			delete(e.cursors, id)
+			if cursor.stream != nil {
+				streams = append(streams, cursor.stream)
+			}
+		}
+	}
+	e.mutex.Unlock()
+
+	// close streams (without the engine lock as the stream acquires it)
+	for _, stream := range streams {
+		_ = stream.Close(nil)
+	}
+
+	// end idle sessions and abort the expired transaction (without the engine
+	// lock as sessions call into the engine while holding their own lock)
+	var since time.Time
+	if e.opts.SessionTimeout >= 0 {
+		since = now.Add(-e.opts.SessionTimeout)
+	}
+	for _, session := range sessions {
+		session.expire(since, txn)
+	}
+}
+
+// lockedSource is a random source that is safe for concurrent use.
+type lockedSource struct {
+	source rand.Source
+	mutex  sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.source.Seed(seed)
+}
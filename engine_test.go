@@ -1,10 +1,15 @@
 package lungo
 
 import (
+	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
 )
 
 func TestEngineCloseUnblocksBlockedBegin(t *testing.T) {
@@ -67,3 +72,233 @@ func TestStreamCloseAfterEngineClose(t *testing.T) {
 	// idempotent
 	assert.NoError(t, stream.Close(nil))
 }
+
+func TestEngineValidate(t *testing.T) {
+	engine, err := CreateEngine(Options{Store: NewMemoryStore()})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	handle := Handle{"db", "coll"}
+
+	_, err = engine.Validate(handle, true)
+	assert.Error(t, err)
+
+	txn, err := engine.Begin(nil, true)
+	assert.NoError(t, err)
+	_, err = txn.Insert(handle, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+		bsonkit.MustConvert(bson.M{"_id": int32(2)}),
+	}, true)
+	assert.NoError(t, err)
+	err = engine.Commit(txn)
+	assert.NoError(t, err)
+
+	res, err := engine.Validate(handle, true)
+	assert.NoError(t, err)
+	assert.Equal(t, true, bsonkit.Get(res, "valid"))
+	assert.Equal(t, int64(2), bsonkit.Get(res, "nrecords"))
+	assert.Equal(t, int64(2), bsonkit.Get(res, "keysPerIndex._id_"))
+
+	res, err = engine.Validate(Oplog, true)
+	assert.NoError(t, err)
+	assert.Equal(t, true, bsonkit.Get(res, "valid"))
+
+	// reorder oplog
+	oplog := engine.Catalog().Namespaces[Oplog].Documents
+	oplog.List[0], oplog.List[1] = oplog.List[1], oplog.List[0]
+	oplog.Index[oplog.List[0]], oplog.Index[oplog.List[1]] = 0, 1
+
+	res, err = engine.Validate(Oplog, false)
+	assert.NoError(t, err)
+	assert.Equal(t, false, bsonkit.Get(res, "valid"))
+	assert.Len(t, bsonkit.Get(res, "errors"), 1)
+}
+
+func TestEngineOplogOrderAfterLoad(t *testing.T) {
+	store := NewMemoryStore()
+	handle := Handle{"db", "coll"}
+
+	engine, err := CreateEngine(Options{Store: store})
+	assert.NoError(t, err)
+
+	txn, err := engine.Begin(nil, true)
+	assert.NoError(t, err)
+	_, err = txn.Insert(handle, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+	}, true)
+	assert.NoError(t, err)
+	err = engine.Commit(txn)
+	assert.NoError(t, err)
+	engine.Close()
+
+	// move stored event into the future
+	oplog := store.catalog.Namespaces[Oplog].Documents.List
+	ts := bsonkit.Now()
+	ts.I += 100
+	*oplog[0] = bson.D{{Key: "_id", Value: bson.D{{Key: "ts", Value: ts}}}, {Key: "clusterTime", Value: ts}}
+
+	engine, err = CreateEngine(Options{Store: store})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	txn, err = engine.Begin(nil, true)
+	assert.NoError(t, err)
+	_, err = txn.Insert(handle, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(2)}),
+	}, true)
+	assert.NoError(t, err)
+	err = engine.Commit(txn)
+	assert.NoError(t, err)
+
+	res, err := engine.Validate(Oplog, false)
+	assert.NoError(t, err)
+	assert.Equal(t, true, bsonkit.Get(res, "valid"))
+}
+
+func TestEngineRandom(t *testing.T) {
+	sample := func() []bson.M {
+		client, engine, err := Open(nil, Options{
+			Store:  NewMemoryStore(),
+			Random: rand.NewSource(42),
+		})
+		assert.NoError(t, err)
+		defer engine.Close()
+
+		coll := client.Database("test").Collection("foo")
+		for i := 0; i < 10; i++ {
+			_, err = coll.InsertOne(nil, bson.M{"_id": int32(i)})
+			assert.NoError(t, err)
+		}
+
+		csr, err := coll.Aggregate(nil, bson.A{
+			bson.M{"$sample": bson.M{"size": int32(3)}},
+		})
+		assert.NoError(t, err)
+
+		return readAll(csr)
+	}
+
+	first := sample()
+	assert.Len(t, first, 3)
+	assert.Equal(t, first, sample())
+}
+
+func TestEngineReap(t *testing.T) {
+	client, engine, err := Open(nil, Options{
+		Store: NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	coll := client.Database("test").Collection("foo")
+	_, err = coll.InsertMany(nil, []interface{}{
+		bson.M{"_id": int32(1)},
+		bson.M{"_id": int32(2)},
+		bson.M{"_id": int32(3)},
+		bson.M{"_id": int32(4)},
+		bson.M{"_id": int32(5)},
+	})
+	assert.NoError(t, err)
+
+	// transaction lifetime
+	sess, err := client.StartSession()
+	assert.NoError(t, err)
+	err = sess.StartTransaction()
+	assert.NoError(t, err)
+	err = WithSession(nil, sess, func(sc ISessionContext) error {
+		_, err := coll.InsertOne(sc, bson.M{"_id": int32(6)})
+		return err
+	})
+	assert.NoError(t, err)
+
+	engine.reap(time.Now().Add(30 * time.Second))
+	assert.NotNil(t, sess.(*Session).Transaction())
+
+	engine.reap(time.Now().Add(time.Minute))
+	assert.Nil(t, sess.(*Session).Transaction())
+	assert.False(t, sess.(*Session).Ended())
+	assert.True(t, sess.(*Session).Expired())
+	assert.Equal(t, ErrTransactionExpired, sess.CommitTransaction(nil))
+
+	n, err := coll.CountDocuments(nil, bson.M{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	txn, err := engine.Begin(nil, true)
+	assert.NoError(t, err)
+	engine.Abort(txn)
+
+	// session timeout
+	assert.Len(t, engine.localSessions(), 1)
+	engine.reap(time.Now().Add(30 * time.Minute))
+	assert.True(t, sess.(*Session).Ended())
+	assert.Len(t, engine.localSessions(), 0)
+
+	// cursor timeout
+	reply, err := engine.RunCommand(nil, "test", &bson.D{
+		{Key: "find", Value: "foo"},
+		{Key: "batchSize", Value: int32(1)},
+	})
+	assert.NoError(t, err)
+	id := bsonkit.Get(reply, "cursor.id").(int64)
+	assert.NotZero(t, id)
+
+	getMore := bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "foo"},
+		{Key: "batchSize", Value: int32(1)},
+	}
+	_, err = engine.RunCommand(nil, "test", &getMore)
+	assert.NoError(t, err)
+
+	engine.reap(time.Now().Add(5 * time.Minute))
+	_, err = engine.RunCommand(nil, "test", &getMore)
+	assert.NoError(t, err)
+
+	engine.reap(time.Now().Add(10 * time.Minute))
+	_, err = engine.RunCommand(nil, "test", &getMore)
+	assert.Equal(t, mongokit.CursorNotFound, mongokit.GetErrorCode(err))
+}
+
+func TestEngineReapDisabled(t *testing.T) {
+	client, engine, err := Open(nil, Options{
+		Store:               NewMemoryStore(),
+		TransactionLifetime: -1,
+		SessionTimeout:      -1,
+		CursorTimeout:       -1,
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	coll := client.Database("test").Collection("foo")
+	_, err = coll.InsertMany(nil, []interface{}{
+		bson.M{"_id": int32(1)},
+		bson.M{"_id": int32(2)},
+	})
+	assert.NoError(t, err)
+
+	sess, err := client.StartSession()
+	assert.NoError(t, err)
+	err = sess.StartTransaction()
+	assert.NoError(t, err)
+
+	reply, err := engine.RunCommand(nil, "test", &bson.D{
+		{Key: "find", Value: "foo"},
+		{Key: "batchSize", Value: int32(1)},
+	})
+	assert.NoError(t, err)
+	id := bsonkit.Get(reply, "cursor.id").(int64)
+	assert.NotZero(t, id)
+
+	engine.reap(time.Now())
+	engine.reap(time.Now().Add(24 * time.Hour))
+	assert.NotNil(t, sess.(*Session).Transaction())
+	assert.False(t, sess.(*Session).Ended())
+	assert.NoError(t, sess.CommitTransaction(nil))
+
+	_, err = engine.RunCommand(nil, "test", &bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "foo"},
+	})
+	assert.NoError(t, err)
+}
@@ -2,6 +2,7 @@ package lungo
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -83,6 +84,7 @@ func (f *File) BuildCatalog() (*Catalog, error) {
 
 		// add documents
 		namespace.Documents = bsonkit.NewSet(ns.Documents)
+		namespace.ComputeSize()
 
 		// add indexes
 		for name, idx := range ns.Indexes {
@@ -115,3 +117,92 @@ func (f *File) BuildCatalog() (*Catalog, error) {
 
 	return catalog, nil
 }
+
+// Validate will verify the consistency of the specified namespace as stored in
+// the file and return a report in the format of the "validate" command. Unlike
+// BuildCatalog, the unique constraints of the indexes are not enforced while
+// loading the namespace. Instead, every violation is reported. This allows
+// validating files that cannot be loaded anymore e.g. after a manual edit.
+func (f *File) Validate(handle Handle, full bool) (bsonkit.Doc, error) {
+	// validate handle
+	err := handle.Validate(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// get namespace
+	ns, ok := f.Namespaces[handle.String()]
+	if !ok {
+		return nil, fmt.Errorf("ns not found: %s", handle.String())
+	}
+
+	// create namespace
+	namespace := mongokit.NewCollection(false)
+
+	// add documents
+	namespace.Documents = bsonkit.NewSet(ns.Documents)
+	namespace.ComputeSize()
+
+	// sort indexes
+	names := make([]string, 0, len(ns.Indexes))
+	for name := range ns.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// add indexes
+	var errs []string
+	invalid := map[string]bool{}
+	for _, name := range names {
+		// get index
+		idx := ns.Indexes[name]
+
+		// create index
+		index, err := mongokit.CreateIndex(mongokit.IndexConfig{
+			Key:     idx.Key,
+			Unique:  idx.Unique,
+			Partial: idx.Partial,
+			Expiry:  idx.Expiry,
+		})
+		if err != nil {
+			invalid[name] = true
+			errs = append(errs, fmt.Sprintf("index %q: %s", name, err.Error()))
+			continue
+		}
+
+		// add documents and report violations
+		for _, doc := range ns.Documents {
+			ok, err := index.Add(doc)
+			if err != nil {
+				invalid[name] = true
+				errs = append(errs, fmt.Sprintf("index %q: document %v: %s", name, bsonkit.Get(doc, "_id"), err.Error()))
+			} else if !ok {
+				invalid[name] = true
+				errs = append(errs, fmt.Sprintf("index %q: duplicate key for document %v", name, bsonkit.Get(doc, "_id")))
+			}
+		}
+
+		// add index
+		namespace.Indexes[name] = index
+	}
+
+	// validate namespace
+	val := namespace.Validate(full)
+
+	// merge errors
+	val.Errors = append(errs, val.Errors...)
+	for _, name := range val.InvalidIndexes {
+		invalid[name] = true
+	}
+	val.InvalidIndexes = nil
+	for _, name := range names {
+		if invalid[name] {
+			val.InvalidIndexes = append(val.InvalidIndexes, name)
+			if _, ok := val.Keys[name]; !ok {
+				val.Keys[name] = 0
+			}
+		}
+	}
+
+	return validationReport(handle, namespace, val), nil
+}
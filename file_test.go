@@ -4,7 +4,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 
+	"github.com/256dpi/lungo/bsonkit"
 	"github.com/256dpi/lungo/mongokit"
 )
 
@@ -21,4 +23,72 @@ func TestFile(t *testing.T) {
 	catalog2, err := file.BuildCatalog()
 	assert.Nil(t, err)
 	assert.NotNil(t, catalog2)
+
+	file.Namespaces["test.baz"] = FileNamespace{
+		Documents: bsonkit.List{
+			bsonkit.MustConvert(bson.M{"foo": "bar"}),
+		},
+		Indexes: map[string]FileIndex{
+			"foo_1": {Key: bsonkit.MustConvert(bson.M{"foo": int32(1)}), Unique: true},
+		},
+	}
+
+	catalog3, err := file.BuildCatalog()
+	assert.NoError(t, err)
+	namespace := catalog3.Namespaces[Handle{"test", "baz"}]
+	assert.Equal(t, bsonkit.Missing, bsonkit.Get(namespace.Documents.List[0], "_id"))
+	assert.Equal(t, int64(18), namespace.Size())
+	assert.Equal(t, int64(1), namespace.Validate(true).Keys["foo_1"])
+	assert.True(t, namespace.Validate(true).Valid())
+
+	ns := file.Namespaces["test.baz"]
+	ns.Documents = append(ns.Documents, bsonkit.MustConvert(bson.M{"foo": "bar"}))
+	file.Namespaces["test.baz"] = ns
+	_, err = file.BuildCatalog()
+	assert.EqualError(t, err, `duplicate document for index "foo_1"`)
+}
+
+func TestFileValidate(t *testing.T) {
+	file := &File{
+		Namespaces: map[string]FileNamespace{
+			"test.foo": {
+				Documents: bsonkit.List{
+					bsonkit.MustConvert(bson.M{"_id": int32(1), "foo": "bar"}),
+					bsonkit.MustConvert(bson.M{"_id": int32(1), "foo": "baz"}),
+					bsonkit.MustConvert(bson.M{"_id": int32(2), "foo": "baz"}),
+				},
+				Indexes: map[string]FileIndex{
+					"_id_":  {Key: bsonkit.MustConvert(bson.M{"_id": int32(1)}), Unique: true},
+					"foo_1": {Key: bsonkit.MustConvert(bson.M{"foo": int32(1)}), Unique: true},
+					"bar_1": {Key: bsonkit.MustConvert(bson.M{"bar": "x"})},
+				},
+			},
+		},
+	}
+
+	_, err := file.BuildCatalog()
+	assert.Error(t, err)
+
+	res, err := file.Validate(Handle{"test", "foo"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, false, bsonkit.Get(res, "valid"))
+	assert.Equal(t, int64(3), bsonkit.Get(res, "nrecords"))
+	assert.Equal(t, bson.D{
+		{Key: "_id_", Value: int64(2)},
+		{Key: "bar_1", Value: int64(0)},
+		{Key: "foo_1", Value: int64(2)},
+	}, bsonkit.Get(res, "keysPerIndex"))
+	assert.Equal(t, false, bsonkit.Get(res, "indexDetails._id_.valid"))
+	assert.Equal(t, false, bsonkit.Get(res, "indexDetails.bar_1.valid"))
+	assert.Equal(t, false, bsonkit.Get(res, "indexDetails.foo_1.valid"))
+	assert.Equal(t, bson.A{
+		`index "_id_": duplicate key for document 1`,
+		`index "bar_1": expected number as direction`,
+		`index "foo_1": duplicate key for document 2`,
+		`index "_id_": index contains 2 documents but 3 are expected`,
+		`index "foo_1": index contains 2 documents but 3 are expected`,
+	}, bsonkit.Get(res, "errors"))
+
+	_, err = file.Validate(Handle{"test", "bar"}, true)
+	assert.EqualError(t, err, "ns not found: test.bar")
 }
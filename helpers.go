@@ -2,6 +2,8 @@ package lungo
 
 import (
 	"strings"
+
+	"github.com/256dpi/lungo/mongokit"
 )
 
 // IsUniquenessError returns true if the provided error is generated due to a
@@ -24,3 +26,16 @@ func IsUniquenessError(err error) bool {
 
 	return false
 }
+
+// ErrorCode returns the code and name of the MongoDB error that is equivalent
+// to the provided error. Errors without an equivalent are reported as
+// UnknownError (8).
+func ErrorCode(err error) (int32, string) {
+	// get code
+	code := mongokit.GetErrorCode(err)
+	if code == mongokit.UnknownError && IsUniquenessError(err) {
+		code = mongokit.DuplicateKey
+	}
+
+	return int32(code), code.Name()
+}
@@ -0,0 +1,666 @@
+package lungo
+
+import (
+	"bufio"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// ImportFormat defines the format of imported data.
+type ImportFormat string
+
+// The available import formats.
+const (
+	// ImportJSON reads Extended JSON documents that are either given one per
+	// line or as a single array.
+	ImportJSON ImportFormat = "json"
+
+	// ImportCSV reads comma separated values.
+	ImportCSV ImportFormat = "csv"
+
+	// ImportTSV reads tab separated values.
+	ImportTSV ImportFormat = "tsv"
+)
+
+// ImportMode defines how imported documents are written.
+type ImportMode string
+
+// The available import modes.
+const (
+	// ImportInsert inserts the documents.
+	ImportInsert ImportMode = "insert"
+
+	// ImportUpsert replaces the documents that match the upsert fields or
+	// inserts them.
+	ImportUpsert ImportMode = "upsert"
+
+	// ImportMerge sets the fields of the documents that match the upsert
+	// fields or inserts them.
+	ImportMerge ImportMode = "merge"
+
+	// ImportDelete deletes the documents that match the upsert fields.
+	ImportDelete ImportMode = "delete"
+)
+
+// ImportOptions is used to configure an import.
+type ImportOptions struct {
+	// The format of the data.
+	//
+	// Default: ImportJSON.
+	Format ImportFormat
+
+	// The fields of CSV and TSV data. If empty, the fields are read from the
+	// header row.
+	Fields []string
+
+	// Whether the fields specify the type of their values in the form
+	// "name.type(arg)" e.g. "age.int32()" or "created.date(2006-01-02)".
+	// Supported types are auto, string, int32, int64, double, decimal,
+	// boolean, date (with a Go layout) and binary (base64, base32 or hex).
+	// Without types, numbers are inferred and other values are strings.
+	ColumnsHaveTypes bool
+
+	// Whether empty CSV and TSV values should be omitted.
+	IgnoreBlanks bool
+
+	// The mode used to write the documents.
+	//
+	// Default: ImportInsert.
+	Mode ImportMode
+
+	// The fields used to match existing documents in the upsert, merge and
+	// delete modes.
+	//
+	// Default: ["_id"].
+	UpsertFields []string
+
+	// The number of documents written per batch.
+	//
+	// Default: 1000.
+	BatchSize int
+
+	// Whether the import should stop at the first failed line.
+	StopOnError bool
+}
+
+// ImportError is the error of a single line of an import.
+type ImportError struct {
+	Line int
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ImportResult is returned by Import.
+type ImportResult struct {
+	Inserted int64
+	Matched  int64
+	Modified int64
+	Upserted int64
+	Deleted  int64
+	Errors   []*ImportError
+}
+
+// Import will read the documents from the reader and write them to the
+// collection in batches. Lines that fail to parse, convert or write are
+// recorded in the result and skipped unless StopOnError is set. An error is
+// returned if the data cannot be read any further (e.g. a broken JSON array)
+// or the import has been stopped. The documents read before are still written
+// and the result is always returned with the changes made so far.
+func Import(ctx context.Context, coll ICollection, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	// set defaults
+	if opts.Format == "" {
+		opts.Format = ImportJSON
+	}
+	if opts.Mode == "" {
+		opts.Mode = ImportInsert
+	}
+	if len(opts.UpsertFields) == 0 {
+		opts.UpsertFields = []string{"_id"}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	// prepare importer
+	imp := &importer{
+		ctx:    ctx,
+		coll:   coll,
+		opts:   opts,
+		result: &ImportResult{},
+	}
+
+	// check mode
+	switch opts.Mode {
+	case ImportInsert, ImportUpsert, ImportMerge, ImportDelete:
+	default:
+		return imp.result, fmt.Errorf("unsupported import mode %q", opts.Mode)
+	}
+
+	// read documents
+	var err error
+	switch opts.Format {
+	case ImportJSON:
+		err = imp.readJSON(r)
+	case ImportCSV, ImportTSV:
+		err = imp.readTable(r)
+	default:
+		return imp.result, fmt.Errorf("unsupported import format %q", opts.Format)
+	}
+
+	// write remaining documents
+	flushErr := imp.flush()
+	if err != nil {
+		return imp.result, err
+	} else if flushErr != nil {
+		return imp.result, flushErr
+	}
+
+	return imp.result, nil
+}
+
+// importItem is a document queued for writing.
+type importItem struct {
+	line  int
+	doc   bsonkit.Doc
+	model mongo.WriteModel
+}
+
+type importer struct {
+	ctx    context.Context
+	coll   ICollection
+	opts   ImportOptions
+	result *ImportResult
+	batch  []importItem
+}
+
+func (i *importer) readJSON(r io.Reader) error {
+	// read documents
+	reader := bsonkit.NewExtJSONReader(r)
+	for {
+		doc, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		// record invalid lines unless they cannot be skipped
+		var jsonErr *bsonkit.ExtJSONError
+		if errors.As(err, &jsonErr) && reader.Skip() {
+			err = i.fail(jsonErr.Line, jsonErr.Err)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// add document
+		err = i.add(reader.Line(), doc)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (i *importer) readTable(r io.Reader) error {
+	// prepare reader
+	var next func() ([]string, int, error)
+	if i.opts.Format == ImportTSV {
+		next = i.readTSV(r)
+	} else {
+		next = i.readCSV(r)
+	}
+
+	// get field specifications
+	specs := i.opts.Fields
+	var line int
+	if len(specs) == 0 {
+		var err error
+		specs, line, err = next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if specs == nil {
+			return fmt.Errorf("line %d: invalid header row", line)
+		}
+	}
+
+	// parse fields
+	fields := make([]importField, 0, len(specs))
+	for _, spec := range specs {
+		field, err := parseImportField(strings.TrimSpace(spec), i.opts.ColumnsHaveTypes)
+		if err != nil && line > 0 {
+			return fmt.Errorf("line %d: %w", line, err)
+		} else if err != nil {
+			return err
+		}
+		fields = append(fields, field)
+	}
+
+	for {
+		// read record
+		record, line, err := next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if record == nil {
+			continue
+		}
+
+		// build document
+		doc, err := i.build(fields, record)
+		if err != nil {
+			err = i.fail(line, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// add document
+		err = i.add(line, doc)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCSV returns a function that reads the next record and its line. Records
+// that fail to parse are recorded and returned as nil.
+func (i *importer) readCSV(r io.Reader) func() ([]string, int, error) {
+	// prepare reader
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	return func() ([]string, int, error) {
+		// read record
+		record, err := reader.Read()
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, parseErr.StartLine, i.fail(parseErr.StartLine, parseErr.Err)
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		// get line
+		line, _ := reader.FieldPos(0)
+
+		return record, line, nil
+	}
+}
+
+// readTSV returns a function that reads the next non-empty line and its
+// number.
+func (i *importer) readTSV(r io.Reader) func() ([]string, int, error) {
+	// prepare scanner
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	var line int
+	return func() ([]string, int, error) {
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSuffix(scanner.Text(), "\r")
+			if text != "" {
+				return strings.Split(text, "\t"), line, nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, io.EOF
+	}
+}
+
+// build will build a document from the record. Values without a field get
+// the names "field<N>".
+func (i *importer) build(fields []importField, record []string) (bsonkit.Doc, error) {
+	doc := bsonkit.NewDoc()
+	for n, str := range record {
+		// skip blanks
+		if str == "" && i.opts.IgnoreBlanks {
+			continue
+		}
+
+		// get field
+		field := importField{name: fmt.Sprintf("field%d", n), kind: "auto"}
+		if n < len(fields) {
+			field = fields[n]
+		}
+
+		// parse value
+		value, err := field.parse(str)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field.name, err)
+		}
+
+		// set value
+		_, err = bsonkit.Put(doc, field.name, value, false)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field.name, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// add will queue the document and write the batch if it is full.
+func (i *importer) add(line int, doc bsonkit.Doc) error {
+	// prepare item
+	item := importItem{
+		line: line,
+		doc:  doc,
+	}
+
+	// prepare model
+	if i.opts.Mode != ImportInsert {
+		model, err := i.model(doc)
+		if err != nil {
+			return i.fail(line, err)
+		}
+		item.model = model
+	}
+
+	// queue item
+	i.batch = append(i.batch, item)
+	if len(i.batch) < i.opts.BatchSize {
+		return nil
+	}
+
+	return i.flush()
+}
+
+// model will return the write model for the document.
+func (i *importer) model(doc bsonkit.Doc) (mongo.WriteModel, error) {
+	// build filter
+	filter := bson.D{}
+	for _, field := range i.opts.UpsertFields {
+		value := bsonkit.Get(doc, field)
+		if value == bsonkit.Missing {
+			if i.opts.Mode == ImportDelete {
+				return nil, fmt.Errorf("missing upsert field %q", field)
+			}
+			return mongo.NewInsertOneModel().SetDocument(doc), nil
+		}
+		filter = append(filter, bson.E{Key: field, Value: value})
+	}
+
+	switch i.opts.Mode {
+	case ImportUpsert:
+		return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true), nil
+	case ImportMerge:
+		// prepare update
+		set := bson.D{}
+		update := bson.D{}
+		for _, field := range *doc {
+			if field.Key == "_id" {
+				update = append(update, bson.E{Key: "$setOnInsert", Value: bson.D{field}})
+			} else {
+				set = append(set, field)
+			}
+		}
+		if len(set) > 0 {
+			update = append(bson.D{{Key: "$set", Value: set}}, update...)
+		} else if len(update) == 0 {
+			return mongo.NewInsertOneModel().SetDocument(doc), nil
+		}
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true), nil
+	default:
+		return mongo.NewDeleteOneModel().SetFilter(filter), nil
+	}
+}
+
+// flush will write the queued documents. Failed documents are recorded and
+// the remaining documents are written again.
+func (i *importer) flush() error {
+	// get batch
+	batch := i.batch
+	i.batch = nil
+
+	for len(batch) > 0 {
+		// write batch
+		index, err := i.write(batch)
+		if err == nil {
+			return nil
+		} else if index < 0 {
+			return err
+		}
+
+		// record failure
+		err = i.fail(batch[index].line, err)
+		if err != nil {
+			return err
+		}
+
+		// continue after failed document
+		batch = batch[index+1:]
+	}
+
+	return nil
+}
+
+// write will write the batch in order and return the index of the failed
+// document if any.
+func (i *importer) write(batch []importItem) (int, error) {
+	// insert documents
+	if i.opts.Mode == ImportInsert {
+		// prepare documents
+		docs := make([]interface{}, 0, len(batch))
+		for _, item := range batch {
+			docs = append(docs, item.doc)
+		}
+
+		// insert documents
+		res, err := i.coll.InsertMany(i.ctx, docs, options.InsertMany().SetOrdered(true))
+		if err == nil {
+			i.result.Inserted += int64(len(batch))
+			return -1, nil
+		}
+
+		// get failed document
+		index, err := writeErrorIndex(err)
+		if index < 0 && res != nil && len(res.InsertedIDs) < len(batch) {
+			index = len(res.InsertedIDs)
+		}
+		if index >= 0 {
+			i.result.Inserted += int64(index)
+		}
+
+		return index, err
+	}
+
+	// prepare models
+	models := make([]mongo.WriteModel, 0, len(batch))
+	for _, item := range batch {
+		models = append(models, item.model)
+	}
+
+	// write models
+	res, err := i.coll.BulkWrite(i.ctx, models, options.BulkWrite().SetOrdered(true))
+	if res != nil {
+		i.result.Inserted += res.InsertedCount
+		i.result.Matched += res.MatchedCount
+		i.result.Modified += res.ModifiedCount
+		i.result.Upserted += res.UpsertedCount
+		i.result.Deleted += res.DeletedCount
+	}
+	if err != nil {
+		return writeErrorIndex(err)
+	}
+
+	return -1, nil
+}
+
+// fail will record the failed line and return an error if the import should
+// stop.
+func (i *importer) fail(line int, err error) error {
+	// record error
+	importErr := &ImportError{Line: line, Err: err}
+	i.result.Errors = append(i.result.Errors, importErr)
+
+	// check stop
+	if i.opts.StopOnError {
+		return importErr
+	}
+
+	return nil
+}
+
+// writeErrorIndex will return the index and error of the first write error.
+func writeErrorIndex(err error) (int, error) {
+	// check bulk write exception
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+		return bulkErr.WriteErrors[0].Index, bulkErr.WriteErrors[0]
+	}
+
+	// check write errors
+	var writeErrs mongo.WriteErrors
+	if errors.As(err, &writeErrs) && len(writeErrs) > 0 {
+		return writeErrs[0].Index, writeErrs[0]
+	}
+
+	return -1, err
+}
+
+// the pattern of typed field specifications
+var importFieldPattern = regexp.MustCompile(`^(.+)\.(\w+)\((.*)\)$`)
+
+// importField is a typed CSV or TSV field.
+type importField struct {
+	name string
+	kind string
+	arg  string
+}
+
+func parseImportField(spec string, typed bool) (importField, error) {
+	// handle untyped
+	if !typed {
+		return importField{name: spec, kind: "auto"}, nil
+	}
+
+	// parse specification
+	match := importFieldPattern.FindStringSubmatch(spec)
+	if match == nil {
+		return importField{}, fmt.Errorf("invalid typed field %q", spec)
+	}
+	field := importField{name: match[1], kind: match[2], arg: match[3]}
+
+	// check type and argument
+	switch field.kind {
+	case "auto", "string", "int32", "int64", "double", "decimal", "boolean":
+	case "date", "date_go":
+		if field.arg == "" {
+			return importField{}, fmt.Errorf("missing date layout for field %q", field.name)
+		}
+	case "binary":
+		switch field.arg {
+		case "":
+			field.arg = "base64"
+		case "base64", "base32", "hex":
+		default:
+			return importField{}, fmt.Errorf("unsupported binary encoding %q for field %q", field.arg, field.name)
+		}
+	default:
+		return importField{}, fmt.Errorf("unsupported type %q for field %q", field.kind, field.name)
+	}
+
+	return field, nil
+}
+
+func (f importField) parse(str string) (interface{}, error) {
+	// parse value
+	var value interface{}
+	var err error
+	switch f.kind {
+	case "string":
+		return str, nil
+	case "int32":
+		var n int64
+		n, err = strconv.ParseInt(str, 10, 32)
+		value = int32(n)
+	case "int64":
+		value, err = strconv.ParseInt(str, 10, 64)
+	case "double":
+		value, err = strconv.ParseFloat(str, 64)
+	case "decimal":
+		value, err = primitive.ParseDecimal128(str)
+	case "boolean":
+		value, err = strconv.ParseBool(str)
+	case "date", "date_go":
+		var t time.Time
+		t, err = time.Parse(f.arg, str)
+		value = primitive.NewDateTimeFromTime(t)
+	case "binary":
+		var data []byte
+		switch f.arg {
+		case "base64":
+			data, err = base64.StdEncoding.DecodeString(str)
+		case "base32":
+			data, err = base32.StdEncoding.DecodeString(str)
+		case "hex":
+			data, err = hex.DecodeString(str)
+		}
+		value = primitive.Binary{Data: data}
+	default:
+		return inferValue(str), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q as %s", str, f.kind)
+	}
+
+	return value, nil
+}
+
+// inferValue will return an int32, int64 or float64 if the string is a
+// decimal number and the string otherwise.
+func inferValue(str string) interface{} {
+	// check characters
+	if str == "" || strings.Trim(str, "0123456789+-.eE") != "" {
+		return str
+	}
+
+	// parse integer
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int32(n)
+		}
+		return n
+	}
+
+	// parse float
+	if f, err := strconv.ParseFloat(str, 64); err == nil {
+		return f
+	}
+
+	return str
+}
@@ -0,0 +1,244 @@
+package lungo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func importLines(errs []*ImportError) []int {
+	lines := make([]int, 0, len(errs))
+	for _, err := range errs {
+		lines = append(lines, err.Line)
+	}
+	return lines
+}
+
+func TestImportJSON(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		res, err := Import(nil, c, strings.NewReader(strings.Join([]string{
+			`{"_id": 1, "name": "a", "n": {"$numberLong": "2"}}`,
+			``,
+			`{"_id": 2, "name": "b"}`,
+			`{"_id": 1, "name": "c"}`,
+			`{"_id": 3,`,
+			` "name": "d"}`,
+			`{"_id": 2}`,
+		}, "\n")), ImportOptions{
+			BatchSize: 2,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), res.Inserted)
+		assert.Equal(t, []int{4, 7}, importLines(res.Errors))
+		assert.True(t, IsUniquenessError(res.Errors[0]))
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "name": "a", "n": int64(2)},
+			{"_id": int32(2), "name": "b"},
+			{"_id": int32(3), "name": "d"},
+		}, dumpCollection(c, false))
+
+		res, err = Import(nil, c, strings.NewReader(`[
+			{"_id": 4},
+			{"_id": 1},
+			{"_id": 5}
+		]`), ImportOptions{
+			StopOnError: true,
+		})
+		assert.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "line 3: "))
+		assert.Equal(t, int64(1), res.Inserted)
+		assert.Equal(t, []int{3}, importLines(res.Errors))
+
+		res, err = Import(nil, c, strings.NewReader(strings.Join([]string{
+			`{"_id": 6}`,
+			`{"_id": x}`,
+			`foo {"_id": 9}`,
+			`{"_id": 7, "name": "e"`,
+			`{"_id": 8}`,
+			`{"_id": 10`,
+		}, "\n")), ImportOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), res.Inserted)
+		assert.Equal(t, []int{2, 3, 4, 6}, importLines(res.Errors))
+		assert.Equal(t, "line 6: unexpected end of input", res.Errors[3].Error())
+		assert.Len(t, dumpCollection(c, false), 6)
+
+		res, err = Import(nil, c, strings.NewReader(`{"_id": 11}`+"\n"+`{"_id": x}`+"\n"+`{"_id": 12}`), ImportOptions{
+			StopOnError: true,
+		})
+		assert.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "line 2: "))
+		assert.Equal(t, int64(1), res.Inserted)
+
+		res, err = Import(nil, c, strings.NewReader("[\n{\"_id\": 13},\n{\"_id\": x}\n]"), ImportOptions{})
+		assert.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "line 3: "))
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, int64(1), res.Inserted)
+	})
+}
+
+func TestImportCSV(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		res, err := Import(nil, c, strings.NewReader(strings.Join([]string{
+			`_id,name,age,score,address.city,extra`,
+			`1,"Doe, J.",31,1.5,Zürich,`,
+			`2,007,3000000000,-2e3,,x,y`,
+			``,
+			`3,"multi`,
+			`line",+4,.5,Bern`,
+		}, "\n")), ImportOptions{
+			Format: ImportCSV,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), res.Inserted)
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "name": "Doe, J.", "age": int32(31), "score": 1.5, "address": bson.M{"city": "Zürich"}, "extra": ""},
+			{"_id": int32(2), "name": int32(7), "age": int64(3000000000), "score": -2000.0, "address": bson.M{"city": ""}, "extra": "x", "field6": "y"},
+			{"_id": int32(3), "name": "multi\nline", "age": int32(4), "score": 0.5, "address": bson.M{"city": "Bern"}},
+		}, dumpCollection(c, false))
+	})
+
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		res, err := Import(nil, c, strings.NewReader(strings.Join([]string{
+			`1,42,2020-01-02,true,aGk=,1.25,007`,
+			`2,x,2020-01-02,true,aGk=,1.25,007`,
+			`3,1,01/02/2020,false,,,`,
+		}, "\n")), ImportOptions{
+			Format:           ImportCSV,
+			Fields:           []string{"_id.int64()", "age.int32()", "created.date(2006-01-02)", "active.boolean()", "data.binary(base64)", "price.decimal()", "code.string()"},
+			ColumnsHaveTypes: true,
+			IgnoreBlanks:     true,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res.Inserted)
+		assert.Len(t, res.Errors, 2)
+		assert.Equal(t, `line 2: field "age": cannot parse "x" as int32`, res.Errors[0].Error())
+		assert.Equal(t, `line 3: field "created": cannot parse "01/02/2020" as date`, res.Errors[1].Error())
+
+		price, err := primitive.ParseDecimal128("1.25")
+		assert.NoError(t, err)
+		assert.Equal(t, []bson.M{
+			{
+				"_id":     int64(1),
+				"age":     int32(42),
+				"created": primitive.NewDateTimeFromTime(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)),
+				"active":  true,
+				"data":    primitive.Binary{Data: []byte("hi")},
+				"price":   price,
+				"code":    "007",
+			},
+		}, dumpCollection(c, false))
+	})
+
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := Import(nil, c, strings.NewReader("name.int32(),age\n"), ImportOptions{
+			Format:           ImportCSV,
+			ColumnsHaveTypes: true,
+		})
+		assert.EqualError(t, err, `line 1: invalid typed field "age"`)
+
+		_, err = Import(nil, c, strings.NewReader("1\n"), ImportOptions{
+			Format:           ImportCSV,
+			Fields:           []string{"created.date_ms()"},
+			ColumnsHaveTypes: true,
+		})
+		assert.EqualError(t, err, `unsupported type "date_ms" for field "created"`)
+
+		res, err := Import(nil, c, strings.NewReader("_id,name\n1,\"a\"b\"\n2,c\n"), ImportOptions{
+			Format: ImportCSV,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res.Inserted)
+		assert.Equal(t, []int{2}, importLines(res.Errors))
+	})
+}
+
+func TestImportTSV(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		res, err := Import(nil, c, strings.NewReader("_id\tname\r\n1\ta \"b\"\r\n\n2\tc,d\n"), ImportOptions{
+			Format: ImportTSV,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), res.Inserted)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "name": `a "b"`},
+			{"_id": int32(2), "name": "c,d"},
+		}, dumpCollection(c, false))
+	})
+}
+
+func TestImportModes(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := c.InsertMany(nil, []interface{}{
+			bson.M{"_id": int32(1), "email": "a@example.com", "name": "a", "age": int32(30)},
+			bson.M{"_id": int32(2), "email": "b@example.com", "name": "b", "age": int32(40)},
+		})
+		assert.NoError(t, err)
+
+		res, err := Import(nil, c, strings.NewReader(strings.Join([]string{
+			`{"email": "a@example.com", "name": "A"}`,
+			`{"_id": 3, "email": "c@example.com", "name": "c"}`,
+		}, "\n")), ImportOptions{
+			Mode:         ImportMerge,
+			UpsertFields: []string{"email"},
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, int64(1), res.Matched)
+		assert.Equal(t, int64(1), res.Modified)
+		assert.Equal(t, int64(1), res.Upserted)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(1), "email": "a@example.com", "name": "A", "age": int32(30)},
+			{"_id": int32(2), "email": "b@example.com", "name": "b", "age": int32(40)},
+			{"_id": int32(3), "email": "c@example.com", "name": "c"},
+		}, dumpCollection(c, false))
+
+		res, err = Import(nil, c, strings.NewReader(strings.Join([]string{
+			`{"_id": 2, "name": "B"}`,
+			`{"_id": 4, "name": "d"}`,
+			`{"name": "e"}`,
+		}, "\n")), ImportOptions{
+			Mode: ImportUpsert,
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, int64(1), res.Matched)
+		assert.Equal(t, int64(1), res.Upserted)
+		assert.Equal(t, int64(1), res.Inserted)
+		assert.Len(t, dumpCollection(c, false), 5)
+		assert.Equal(t, []bson.M{
+			{"_id": int32(2), "name": "B"},
+		}, readAll(mustFind(t, c, bson.M{"_id": int32(2)})))
+
+		res, err = Import(nil, c, strings.NewReader("_id\n1\n3\n9\n\n"), ImportOptions{
+			Format: ImportCSV,
+			Mode:   ImportDelete,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), res.Deleted)
+		assert.Len(t, dumpCollection(c, false), 3)
+
+		res, err = Import(nil, c, strings.NewReader(`{"name": "x"}`), ImportOptions{
+			Mode: ImportDelete,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, `line 1: missing upsert field "_id"`, res.Errors[0].Error())
+
+		_, err = Import(nil, c, strings.NewReader(""), ImportOptions{
+			Mode: "foo",
+		})
+		assert.EqualError(t, err, `unsupported import mode "foo"`)
+	})
+}
+
+func mustFind(t *testing.T, c ICollection, filter interface{}) ICursor {
+	csr, err := c.Find(nil, filter)
+	assert.NoError(t, err)
+	return csr
+}
@@ -0,0 +1,528 @@
+package mongokit
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// Accumulator computes a single value from a group of documents.
+type Accumulator func(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error)
+
+// GroupAccumulators defines the available accumulators that may be used by
+// stages like $group, $bucket and $bucketAuto.
+var GroupAccumulators = map[string]Accumulator{}
+
+func init() {
+	// register value accumulators
+	GroupAccumulators["$sum"] = accumulateSum
+	GroupAccumulators["$avg"] = accumulateAvg
+	GroupAccumulators["$min"] = accumulateMinMax
+	GroupAccumulators["$max"] = accumulateMinMax
+	GroupAccumulators["$stdDevPop"] = accumulateStdDev
+	GroupAccumulators["$stdDevSamp"] = accumulateStdDev
+	GroupAccumulators["$count"] = accumulateCount
+
+	// register collection accumulators
+	GroupAccumulators["$first"] = accumulateFirstLast
+	GroupAccumulators["$last"] = accumulateFirstLast
+	GroupAccumulators["$push"] = accumulatePush
+	GroupAccumulators["$addToSet"] = accumulateAddToSet
+	GroupAccumulators["$mergeObjects"] = accumulateMergeObjects
+	GroupAccumulators["$firstN"] = accumulateFirstLastN
+	GroupAccumulators["$lastN"] = accumulateFirstLastN
+	GroupAccumulators["$minN"] = accumulateMinMaxN
+	GroupAccumulators["$maxN"] = accumulateMinMaxN
+	GroupAccumulators["$top"] = accumulateTopBottom
+	GroupAccumulators["$bottom"] = accumulateTopBottom
+	GroupAccumulators["$topN"] = accumulateTopBottom
+	GroupAccumulators["$bottomN"] = accumulateTopBottom
+
+	// register accumulator expressions
+	AggregationExpressionOperators["$sum"] = evalAccumulator
+	AggregationExpressionOperators["$avg"] = evalAccumulator
+	AggregationExpressionOperators["$min"] = evalAccumulator
+	AggregationExpressionOperators["$max"] = evalAccumulator
+	AggregationExpressionOperators["$stdDevPop"] = evalAccumulator
+	AggregationExpressionOperators["$stdDevSamp"] = evalAccumulator
+}
+
+// Accumulate will compute the specified accumulator fields for the provided
+// group of documents. Every field value must be a document with a single
+// accumulator.
+func Accumulate(agg *Aggregation, list bsonkit.List, name string, fields bson.D) (bson.D, error) {
+	// compute fields
+	result := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		// get accumulator
+		acc, ok := field.Value.(bson.D)
+		if !ok || len(acc) != 1 {
+			return nil, fmt.Errorf("%s: the field '%s' must be an accumulator object", name, field.Key)
+		}
+		fn := GroupAccumulators[acc[0].Key]
+		if fn == nil {
+			return nil, fmt.Errorf("%s: unknown group operator '%s'", name, acc[0].Key)
+		}
+
+		// compute value
+		value, err := fn(agg, list, acc[0].Key, acc[0].Value)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, bson.E{Key: field.Key, Value: value})
+	}
+
+	return result, nil
+}
+
+// validateAccumulators checks the output field names of an accumulator
+// specification.
+func validateAccumulators(name string, fields bson.D) error {
+	for _, field := range fields {
+		if field.Key == "" || strings.HasPrefix(field.Key, "$") || strings.Contains(field.Key, ".") {
+			return fmt.Errorf("%s: the field name '%s' cannot be an operator name or contain a '.'", name, field.Key)
+		}
+	}
+	return nil
+}
+
+// accumulateValues evaluates the expression for every document in the list.
+// The returned values may include bsonkit.Missing.
+func accumulateValues(agg *Aggregation, list bsonkit.List, expr interface{}) (bson.A, error) {
+	values := make(bson.A, 0, len(list))
+	for _, doc := range list {
+		value, err := agg.Evaluation(doc).Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// accumulateN evaluates the "n" argument of the N accumulators.
+func accumulateN(agg *Aggregation, name string, expr interface{}) (int, error) {
+	// evaluate value
+	value, err := agg.Evaluation(nil).Evaluate(expr)
+	if err != nil {
+		return 0, err
+	}
+
+	// check value
+	n, ok := toInt64(value)
+	if !ok || n <= 0 {
+		return 0, fmt.Errorf("%s: 'n' must be a positive integer", name)
+	}
+
+	return int(n), nil
+}
+
+func accumulateSum(agg *Aggregation, list bsonkit.List, _ string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return sumValues(values), nil
+}
+
+func accumulateAvg(agg *Aggregation, list bsonkit.List, _ string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return avgValues(values), nil
+}
+
+func accumulateMinMax(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return minMaxValues(values, name == "$max"), nil
+}
+
+func accumulateStdDev(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return stdDevValues(values, name == "$stdDevSamp"), nil
+}
+
+func accumulateCount(_ *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// check arguments
+	if doc, ok := args.(bson.D); !ok || len(doc) != 0 {
+		return nil, fmt.Errorf("%s: expected empty document", name)
+	}
+
+	return narrowInt(int64(len(list)), true), nil
+}
+
+func accumulateFirstLast(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// handle empty list
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	// get document
+	doc := list[0]
+	if name == "$last" {
+		doc = list[len(list)-1]
+	}
+
+	// evaluate value
+	value, err := agg.Evaluation(doc).Evaluate(args)
+	if err != nil {
+		return nil, err
+	} else if value == bsonkit.Missing {
+		return nil, nil
+	}
+
+	return value, nil
+}
+
+func accumulatePush(agg *Aggregation, list bsonkit.List, _ string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect present values
+	result := make(bson.A, 0, len(values))
+	for _, value := range values {
+		if value != bsonkit.Missing {
+			result = append(result, value)
+		}
+	}
+
+	return result, nil
+}
+
+func accumulateAddToSet(agg *Aggregation, list bsonkit.List, _ string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect distinct present values
+	result := make(bson.A, 0, len(values))
+	for _, value := range values {
+		if value != bsonkit.Missing && !containsValue(result, value) {
+			result = append(result, value)
+		}
+	}
+
+	return result, nil
+}
+
+func accumulateMergeObjects(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// evaluate values
+	values, err := accumulateValues(agg, list, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// merge documents
+	result := bson.D{}
+	for _, value := range values {
+		if isNullish(value) {
+			continue
+		}
+		doc, ok := value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: requires object inputs, but input %v is of type %s", name, value, typeName(value))
+		}
+		for _, el := range doc {
+			result = setField(result, el.Key, el.Value)
+		}
+	}
+
+	return result, nil
+}
+
+func accumulateFirstLastN(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "n"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get count
+	n, err := accumulateN(agg, name, fields["n"])
+	if err != nil {
+		return nil, err
+	}
+
+	// select documents
+	if n < len(list) {
+		if name == "$firstN" {
+			list = list[:n]
+		} else {
+			list = list[len(list)-n:]
+		}
+	}
+
+	// evaluate values
+	values, err := accumulateValues(agg, list, fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// replace missing values
+	for i, value := range values {
+		if value == bsonkit.Missing {
+			values[i] = nil
+		}
+	}
+
+	return values, nil
+}
+
+func accumulateMinMaxN(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "n"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get count
+	n, err := accumulateN(agg, name, fields["n"])
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate values
+	values, err := accumulateValues(agg, list, fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// collect non-null values
+	result := make(bson.A, 0, len(values))
+	for _, value := range values {
+		if !isNullish(value) {
+			result = append(result, value)
+		}
+	}
+
+	// sort values
+	sort.SliceStable(result, func(i, j int) bool {
+		if name == "$maxN" {
+			return bsonkit.Compare(result[i], result[j]) > 0
+		}
+		return bsonkit.Compare(result[i], result[j]) < 0
+	})
+
+	// limit values
+	if n < len(result) {
+		result = result[:n]
+	}
+
+	return result, nil
+}
+
+func accumulateTopBottom(agg *Aggregation, list bsonkit.List, name string, args interface{}) (interface{}, error) {
+	// get fields
+	multi := name == "$topN" || name == "$bottomN"
+	var fields map[string]interface{}
+	var err error
+	if multi {
+		fields, err = evalObject(name, args, []string{"sortBy", "output", "n"})
+	} else {
+		fields, err = evalObject(name, args, []string{"sortBy", "output"})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// get sort
+	sortBy, ok := fields["sortBy"].(bson.D)
+	if !ok || len(sortBy) == 0 {
+		return nil, fmt.Errorf("%s: 'sortBy' must be a non-empty document", name)
+	}
+
+	// get count
+	n := 1
+	if multi {
+		n, err = accumulateN(agg, name, fields["n"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// sort documents
+	sorted, err := Sort(list, &sortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// select documents
+	if n < len(sorted) {
+		if name == "$top" || name == "$topN" {
+			sorted = sorted[:n]
+		} else {
+			sorted = sorted[len(sorted)-n:]
+		}
+	}
+
+	// evaluate outputs
+	values, err := accumulateValues(agg, sorted, fields["output"])
+	if err != nil {
+		return nil, err
+	}
+
+	// replace missing values
+	for i, value := range values {
+		if value == bsonkit.Missing {
+			values[i] = nil
+		}
+	}
+
+	// handle single value
+	if !multi {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	}
+
+	return values, nil
+}
+
+func evalAccumulator(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 1, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single array argument provides the values
+	if len(values) == 1 {
+		if array, ok := values[0].(bson.A); ok {
+			values = array
+		}
+	}
+
+	switch name {
+	case "$sum":
+		return sumValues(values), nil
+	case "$avg":
+		return avgValues(values), nil
+	case "$min", "$max":
+		return minMaxValues(values, name == "$max"), nil
+	case "$stdDevPop", "$stdDevSamp":
+		return stdDevValues(values, name == "$stdDevSamp"), nil
+	default:
+		return nil, fmt.Errorf("unknown accumulator %q", name)
+	}
+}
+
+// sumValues returns the sum of the numeric values.
+func sumValues(values bson.A) interface{} {
+	var sum interface{} = int32(0)
+	for _, value := range values {
+		if isNumeric(value) {
+			sum = addNumbers(sum, value)
+		}
+	}
+	return sum
+}
+
+// avgValues returns the average of the numeric values or null if there are no
+// numeric values.
+func avgValues(values bson.A) interface{} {
+	// sum values
+	var sum interface{} = int32(0)
+	var count int64
+	for _, value := range values {
+		if isNumeric(value) {
+			sum = addNumbers(sum, value)
+			count++
+		}
+	}
+
+	// handle no values
+	if count == 0 {
+		return nil
+	}
+
+	// handle decimals
+	if isDecimal(sum) {
+		d, ok := toDecimal(sum)
+		if !ok {
+			return sum
+		}
+		return fromDecimal(d.Div(decimal.NewFromInt(count)))
+	}
+
+	f, _ := toFloat(sum)
+
+	return f / float64(count)
+}
+
+// minMaxValues returns the minimum or maximum of the non-null values or null if
+// there are no such values.
+func minMaxValues(values bson.A, max bool) interface{} {
+	var result interface{}
+	for _, value := range values {
+		if isNullish(value) {
+			continue
+		}
+		if result == nil {
+			result = value
+			continue
+		}
+		res := bsonkit.Compare(value, result)
+		if (max && res > 0) || (!max && res < 0) {
+			result = value
+		}
+	}
+	return result
+}
+
+// stdDevValues returns the population or sample standard deviation of the
+// numeric values or null if there are not enough values.
+func stdDevValues(values bson.A, sample bool) interface{} {
+	// compute mean and squared deviations (Welford)
+	var count, mean, m2 float64
+	for _, value := range values {
+		if !isNumeric(value) {
+			continue
+		}
+		f, _ := toFloat(value)
+		count++
+		delta := f - mean
+		mean += delta / count
+		m2 += delta * (f - mean)
+	}
+
+	// compute deviation
+	if sample {
+		if count < 2 {
+			return nil
+		}
+		return math.Sqrt(m2 / (count - 1))
+	}
+	if count == 0 {
+		return nil
+	}
+
+	return math.Sqrt(m2 / count)
+}
@@ -0,0 +1,1037 @@
+package mongokit
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// Stage is an aggregation pipeline stage that transforms a list of documents.
+// Stages must not modify the documents in the provided list.
+type Stage func(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error)
+
+// AggregationStages defines the available aggregation pipeline stages.
+var AggregationStages = map[string]Stage{}
+
+func init() {
+	// register basic stages
+	AggregationStages["$match"] = stageMatch
+	AggregationStages["$project"] = stageProject
+	AggregationStages["$addFields"] = stageAddFields
+	AggregationStages["$set"] = stageAddFields
+	AggregationStages["$unset"] = stageUnset
+	AggregationStages["$replaceRoot"] = stageReplaceRoot
+	AggregationStages["$replaceWith"] = stageReplaceRoot
+	AggregationStages["$sort"] = stageSort
+	AggregationStages["$skip"] = stageSkip
+	AggregationStages["$limit"] = stageLimit
+	AggregationStages["$count"] = stageCount
+	AggregationStages["$unwind"] = stageUnwind
+	AggregationStages["$facet"] = stageFacet
+	AggregationStages["$sample"] = stageSample
+	AggregationStages["$redact"] = stageRedact
+
+	// register join stages
+	AggregationStages["$lookup"] = stageLookup
+	AggregationStages["$graphLookup"] = stageGraphLookup
+	AggregationStages["$unionWith"] = stageUnionWith
+}
+
+// Aggregation describes the environment in which an aggregation pipeline is
+// run.
+type Aggregation struct {
+	// The variables available to stage expressions.
+	Variables map[string]interface{}
+
+	// The function used to resolve other collections referenced by stages like
+	// $lookup. An empty database refers to the database of the aggregated
+	// collection. A nil collection should be returned for missing collections.
+	Lookup func(db, coll string) (*Collection, error)
+
+	// The function used by the $out and $merge stages to obtain a writable
+	// collection. An empty database refers to the database of the aggregated
+	// collection. Missing collections should be created. Writing stages are
+	// not supported if unset.
+	Output func(db, coll string) (*Collection, error)
+
+	// The optional function called by the $out and $merge stages for every
+	// inserted, replaced, updated or deleted document.
+	Record func(db, coll, op string, doc bsonkit.Doc, changes *Changes) error
+
+	// The source of randomness used by the $sample stage. The global source is
+	// used if unset.
+	Random *rand.Rand
+
+	// The namespace and collection that is aggregated. They are reported by
+	// the $collStats and $indexStats stages.
+	Namespace  string
+	Collection *Collection
+
+	// The optional function that returns the latency statistics reported by
+	// the $collStats stage.
+	Latency func() bsonkit.Doc
+
+	// The optional functions that return the documents reported by the
+	// $currentOp and $listLocalSessions stages. The stages are not supported
+	// if unset.
+	Operations func() (bsonkit.List, error)
+	Sessions   func() (bsonkit.List, error)
+}
+
+// Aggregate will run the aggregation pipeline on the list of documents and
+// return the resulting list of documents. The aggregation may be nil.
+func Aggregate(list bsonkit.List, pipeline bsonkit.List, agg *Aggregation) (bsonkit.List, error) {
+	// ensure aggregation
+	if agg == nil {
+		agg = &Aggregation{}
+	}
+
+	// fix time variables for the whole pipeline
+	agg = agg.With(NewEvaluation(nil, agg.Variables).Variables)
+
+	return agg.Run(list, pipeline)
+}
+
+// With will return a derived aggregation that additionally provides the
+// specified variables.
+func (a *Aggregation) With(variables map[string]interface{}) *Aggregation {
+	// copy variables
+	vars := make(map[string]interface{}, len(a.Variables)+len(variables))
+	for name, value := range a.Variables {
+		vars[name] = value
+	}
+	for name, value := range variables {
+		vars[name] = value
+	}
+
+	return &Aggregation{
+		Variables:  vars,
+		Lookup:     a.Lookup,
+		Output:     a.Output,
+		Record:     a.Record,
+		Random:     a.Random,
+		Namespace:  a.Namespace,
+		Collection: a.Collection,
+		Latency:    a.Latency,
+		Operations: a.Operations,
+		Sessions:   a.Sessions,
+	}
+}
+
+// Run will run the aggregation pipeline on the list of documents and return
+// the resulting list of documents.
+func (a *Aggregation) Run(list bsonkit.List, pipeline bsonkit.List) (bsonkit.List, error) {
+	for i, stage := range pipeline {
+		// check stage
+		if len(*stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage specification must contain exactly one field")
+		}
+
+		// get name and specification
+		name := (*stage)[0].Key
+		spec := (*stage)[0].Value
+
+		// check position
+		if outputStages[name] && i != len(pipeline)-1 {
+			return nil, fmt.Errorf("%s can only be the final stage in the pipeline", name)
+		} else if sourceStages[name] && i != 0 {
+			return nil, fmt.Errorf("%s is only valid as the first stage in a pipeline", name)
+		}
+
+		// lookup stage
+		fn := AggregationStages[name]
+		if fn == nil {
+			return nil, fmt.Errorf("unrecognized pipeline stage name %q", name)
+		}
+
+		// run stage
+		var err error
+		list, err = fn(a, list, name, spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// Evaluation returns an evaluation for the specified document that provides
+// the aggregation variables.
+func (a *Aggregation) Evaluation(doc bsonkit.Doc) *Evaluation {
+	return NewEvaluation(doc, a.Variables)
+}
+
+// collection resolves the collection referenced by the "from" argument of a
+// stage which may be a collection name or a document with a db and coll field.
+func (a *Aggregation) collection(name string, from interface{}) (*Collection, error) {
+	// get database and collection
+	var db, coll string
+	switch value := from.(type) {
+	case string:
+		coll = value
+	case bson.D:
+		fields, err := evalObject(name, value, []string{"db", "coll"})
+		if err != nil {
+			return nil, err
+		}
+		db, _ = fields["db"].(string)
+		coll, _ = fields["coll"].(string)
+	}
+
+	// check name
+	if coll == "" {
+		return nil, fmt.Errorf("%s: 'from' must be a collection name or a document with a db and coll field", name)
+	}
+
+	// check lookup
+	if a.Lookup == nil {
+		return nil, nil
+	}
+
+	return a.Lookup(db, coll)
+}
+
+// Reference describes a collection that is read or written by a stage. An
+// empty database refers to the database the pipeline is run against.
+type Reference struct {
+	DB    string
+	Coll  string
+	Write bool
+}
+
+// References returns the collections referenced by the $lookup, $graphLookup,
+// $unionWith, $out and $merge stages of the pipeline, including the stages of
+// nested pipelines. Invalid stages are ignored as they fail when run.
+func References(pipeline bsonkit.List) []Reference {
+	// collect references
+	var list []Reference
+	for _, stage := range pipeline {
+		// get stage
+		if len(*stage) == 0 {
+			continue
+		}
+		name := (*stage)[0].Key
+		spec, _ := (*stage)[0].Value.(bson.D)
+
+		// get target and nested pipelines
+		var target interface{}
+		var write bool
+		var nested []interface{}
+		switch name {
+		case "$lookup", "$graphLookup":
+			target = bsonkit.Get(&spec, "from")
+			nested = append(nested, bsonkit.Get(&spec, "pipeline"))
+		case "$unionWith":
+			if coll, ok := (*stage)[0].Value.(string); ok {
+				target = coll
+			} else {
+				target = bsonkit.Get(&spec, "coll")
+				nested = append(nested, bsonkit.Get(&spec, "pipeline"))
+			}
+		case "$facet":
+			for _, facet := range spec {
+				nested = append(nested, facet.Value)
+			}
+		case "$out":
+			target, write = (*stage)[0].Value, true
+		case "$merge":
+			target, write = (*stage)[0].Value, true
+			if spec != nil {
+				target = bsonkit.Get(&spec, "into")
+			}
+		}
+
+		// add target
+		switch value := target.(type) {
+		case string:
+			list = append(list, Reference{Coll: value, Write: write})
+		case bson.D:
+			db, _ := bsonkit.Get(&value, "db").(string)
+			coll, _ := bsonkit.Get(&value, "coll").(string)
+			list = append(list, Reference{DB: db, Coll: coll, Write: write})
+		}
+
+		// add nested pipelines
+		for _, value := range nested {
+			sub, err := toPipeline(name, value)
+			if err == nil {
+				list = append(list, References(sub)...)
+			}
+		}
+	}
+
+	return list
+}
+
+// toPipeline converts an array of stage documents to a list.
+func toPipeline(name string, v interface{}) (bsonkit.List, error) {
+	// check array
+	array, ok := v.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: 'pipeline' must be an array", name)
+	}
+
+	// convert stages
+	list := make(bsonkit.List, 0, len(array))
+	for _, item := range array {
+		stage, ok := item.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'pipeline' must be an array of documents", name)
+		}
+		list = append(list, &stage)
+	}
+
+	return list, nil
+}
+
+// toFieldPath checks and returns a field path argument.
+func toFieldPath(name, what string, v interface{}) (string, error) {
+	path, ok := v.(string)
+	if !ok || path == "" || strings.HasPrefix(path, "$") {
+		return "", fmt.Errorf("%s: '%s' must be a valid field path", name, what)
+	}
+	return path, nil
+}
+
+func stageMatch(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	query, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected document", name)
+	}
+
+	// filter documents
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		ok, err := MatchWith(doc, &query, agg.Variables)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			result = append(result, doc)
+		}
+	}
+
+	return result, nil
+}
+
+func stageProject(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	projection, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected document", name)
+	} else if len(projection) == 0 {
+		return nil, fmt.Errorf("%s: requires at least one output field", name)
+	}
+
+	// project documents
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		res, err := ProjectStage(doc, &projection, agg.Variables)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, res)
+	}
+
+	return result, nil
+}
+
+func stageAddFields(agg *Aggregation, list bsonkit.List, _ string, spec interface{}) (bsonkit.List, error) {
+	// add fields
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		res, err := AddFields(doc, spec, agg.Variables)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, res)
+	}
+
+	return result, nil
+}
+
+func stageUnset(_ *Aggregation, list bsonkit.List, _ string, spec interface{}) (bsonkit.List, error) {
+	// unset fields
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		res, err := UnsetFields(doc, spec)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, res)
+	}
+
+	return result, nil
+}
+
+func stageReplaceRoot(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// replace roots
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		res, err := ReplaceRoot(doc, name, spec, agg.Variables)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, res)
+	}
+
+	return result, nil
+}
+
+func stageSort(_ *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	sort, ok := spec.(bson.D)
+	if !ok || len(sort) == 0 {
+		return nil, fmt.Errorf("%s: the sort key specification must be a non-empty document", name)
+	}
+
+	return Sort(list, &sort)
+}
+
+func stageSkip(_ *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get skip
+	skip, ok := toInt64(spec)
+	if !ok || skip < 0 {
+		return nil, fmt.Errorf("%s: the skip must be a non-negative integer", name)
+	}
+
+	// apply skip
+	if skip >= int64(len(list)) {
+		return bsonkit.List{}, nil
+	}
+
+	return list[skip:], nil
+}
+
+func stageLimit(_ *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get limit
+	limit, ok := toInt64(spec)
+	if !ok || limit <= 0 {
+		return nil, fmt.Errorf("%s: the limit must be positive", name)
+	}
+
+	// apply limit
+	if limit < int64(len(list)) {
+		return list[:limit], nil
+	}
+
+	return list, nil
+}
+
+func stageCount(_ *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get field
+	field, ok := spec.(string)
+	if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") || field == "_id" {
+		return nil, fmt.Errorf("%s: the count field must be a non-empty string that does not start with '$', contain '.' or equal '_id'", name)
+	}
+
+	// handle empty list
+	if len(list) == 0 {
+		return bsonkit.List{}, nil
+	}
+
+	return bsonkit.List{
+		&bson.D{{Key: field, Value: int32(len(list))}},
+	}, nil
+}
+
+func stageSample(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"size"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get size
+	size, ok := toExactInt64(fields["size"])
+	if !ok || size < 0 {
+		return nil, fmt.Errorf("%s: size argument must be a non-negative integer", name)
+	}
+
+	// get permutation
+	var perm []int
+	if agg.Random != nil {
+		perm = agg.Random.Perm(len(list))
+	} else {
+		perm = rand.Perm(len(list))
+	}
+
+	// select documents
+	if int64(len(perm)) > size {
+		perm = perm[:size]
+	}
+	result := make(bsonkit.List, 0, len(perm))
+	for _, i := range perm {
+		result = append(result, list[i])
+	}
+
+	return result, nil
+}
+
+func stageRedact(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// prepare aggregation
+	agg = agg.With(map[string]interface{}{
+		"DESCEND": "descend",
+		"PRUNE":   "prune",
+		"KEEP":    "keep",
+	})
+
+	// redact documents
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		res, err := redactDocument(agg.Evaluation(doc), name, *doc, spec)
+		if err != nil {
+			return nil, err
+		}
+		if res != nil {
+			result = append(result, res)
+		}
+	}
+
+	return result, nil
+}
+
+// redactDocument evaluates the redact expression for the document and its
+// embedded documents. It returns nil if the document has been pruned.
+func redactDocument(ev *Evaluation, name string, doc bson.D, expr interface{}) (bsonkit.Doc, error) {
+	// evaluate expression
+	ev.Current = doc
+	res, err := ev.Evaluate(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle result
+	switch res {
+	case "keep":
+		return &doc, nil
+	case "prune":
+		return nil, nil
+	case "descend":
+	default:
+		return nil, fmt.Errorf("%s: the expression should not return anything aside from the variables $$KEEP, $$DESCEND, and $$PRUNE, but returned %s", name, typeName(res))
+	}
+
+	// descend into fields
+	out := make(bson.D, 0, len(doc))
+	for _, field := range doc {
+		value, keep, err := redactValue(ev, name, field.Value, expr)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			out = append(out, bson.E{Key: field.Key, Value: value})
+		}
+	}
+
+	return &out, nil
+}
+
+// redactValue redacts embedded documents of the value. It returns false if
+// the value has been pruned.
+func redactValue(ev *Evaluation, name string, value, expr interface{}) (interface{}, bool, error) {
+	switch value := value.(type) {
+	case bson.D:
+		res, err := redactDocument(ev, name, value, expr)
+		if err != nil || res == nil {
+			return nil, false, err
+		}
+		return *res, true, nil
+	case bson.A:
+		array := make(bson.A, 0, len(value))
+		for _, item := range value {
+			res, keep, err := redactValue(ev, name, item, expr)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				array = append(array, res)
+			}
+		}
+		return array, true, nil
+	default:
+		return value, true, nil
+	}
+}
+
+func stageUnwind(_ *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get path and options
+	var path, indexField string
+	var preserve bool
+	switch value := spec.(type) {
+	case string:
+		path = value
+	case bson.D:
+		fields, err := evalObject(name, value, []string{"path"}, "includeArrayIndex", "preserveNullAndEmptyArrays")
+		if err != nil {
+			return nil, err
+		}
+		path, _ = fields["path"].(string)
+		if field, ok := fields["includeArrayIndex"]; ok {
+			indexField, err = toFieldPath(name, "includeArrayIndex", field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if flag, ok := fields["preserveNullAndEmptyArrays"]; ok {
+			preserve, ok = flag.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s: 'preserveNullAndEmptyArrays' must be a boolean", name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s: expected string or document", name)
+	}
+
+	// check path
+	if !strings.HasPrefix(path, "$") || len(path) < 2 || strings.HasPrefix(path, "$$") {
+		return nil, fmt.Errorf("%s: path option must be prefixed with a '$'", name)
+	}
+	path = path[1:]
+
+	// unwind documents
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		// get value
+		value := bsonkit.Get(doc, path)
+
+		// handle non-arrays
+		array, ok := value.(bson.A)
+		if !ok {
+			if isNullish(value) && !preserve {
+				continue
+			}
+			res := doc
+			if indexField != "" {
+				res = bsonkit.Clone(doc)
+				_, err := bsonkit.Put(res, indexField, nil, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+			result = append(result, res)
+			continue
+		}
+
+		// handle empty arrays
+		if len(array) == 0 {
+			if !preserve {
+				continue
+			}
+			res := bsonkit.Clone(doc)
+			bsonkit.Unset(res, path)
+			if indexField != "" {
+				_, err := bsonkit.Put(res, indexField, nil, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+			result = append(result, res)
+			continue
+		}
+
+		// add a document per element
+		for i, item := range array {
+			res := bsonkit.Clone(doc)
+			_, err := bsonkit.Put(res, path, item, false)
+			if err != nil {
+				return nil, err
+			}
+			if indexField != "" {
+				_, err = bsonkit.Put(res, indexField, int64(i), false)
+				if err != nil {
+					return nil, err
+				}
+			}
+			result = append(result, res)
+		}
+	}
+
+	return result, nil
+}
+
+// the stages that may not be used within a $facet sub-pipeline
+var facetExcludedStages = map[string]bool{
+	"$facet":             true,
+	"$out":               true,
+	"$merge":             true,
+	"$collStats":         true,
+	"$indexStats":        true,
+	"$changeStream":      true,
+	"$documents":         true,
+	"$currentOp":         true,
+	"$listLocalSessions": true,
+}
+
+func stageFacet(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	facets, ok := spec.(bson.D)
+	if !ok || len(facets) == 0 {
+		return nil, fmt.Errorf("%s: the specification must be a non-empty document", name)
+	}
+
+	// run facets
+	result := make(bson.D, 0, len(facets))
+	for _, facet := range facets {
+		// check name
+		if facet.Key == "" || strings.HasPrefix(facet.Key, "$") || strings.Contains(facet.Key, ".") {
+			return nil, fmt.Errorf("%s: the facet name '%s' cannot start with a '$' or contain a '.'", name, facet.Key)
+		}
+
+		// get pipeline
+		pipeline, err := toPipeline(name, facet.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range pipeline {
+			if len(*stage) > 0 && facetExcludedStages[(*stage)[0].Key] {
+				return nil, fmt.Errorf("%s: %s is not allowed to be used within a $facet stage", name, (*stage)[0].Key)
+			}
+		}
+
+		// run pipeline
+		docs, err := agg.Run(list, pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		// collect documents
+		array := make(bson.A, 0, len(docs))
+		for _, doc := range docs {
+			array = append(array, *bsonkit.Clone(doc))
+		}
+
+		result = append(result, bson.E{Key: facet.Key, Value: array})
+	}
+
+	return bsonkit.List{&result}, nil
+}
+
+// lookupValues returns the values used to look up foreign documents. Arrays
+// are flattened and missing values are treated as null.
+func lookupValues(value interface{}) bson.A {
+	switch value := value.(type) {
+	case bson.A:
+		return value
+	case bsonkit.MissingType:
+		return bson.A{nil}
+	default:
+		return bson.A{value}
+	}
+}
+
+func stageLookup(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"as"}, "from", "localField", "foreignField", "let", "pipeline")
+	if err != nil {
+		return nil, err
+	}
+
+	// get output field
+	as, err := toFieldPath(name, "as", fields["as"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get local and foreign field
+	var localField, foreignField string
+	_, hasLocal := fields["localField"]
+	_, hasForeign := fields["foreignField"]
+	if hasLocal != hasForeign {
+		return nil, fmt.Errorf("%s: 'localField' and 'foreignField' must be specified together", name)
+	} else if hasLocal {
+		localField, err = toFieldPath(name, "localField", fields["localField"])
+		if err != nil {
+			return nil, err
+		}
+		foreignField, err = toFieldPath(name, "foreignField", fields["foreignField"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get pipeline
+	var pipeline bsonkit.List
+	_, hasPipeline := fields["pipeline"]
+	if hasPipeline {
+		pipeline, err = toPipeline(name, fields["pipeline"])
+		if err != nil {
+			return nil, err
+		}
+		if HasOutputStage(pipeline) {
+			return nil, fmt.Errorf("%s: the pipeline may not contain a $out or $merge stage", name)
+		}
+	} else if !hasLocal {
+		return nil, fmt.Errorf("%s: either 'pipeline' or 'localField' and 'foreignField' must be specified", name)
+	}
+
+	// get variables
+	var let bson.D
+	if value, ok := fields["let"]; ok {
+		if !hasPipeline {
+			return nil, fmt.Errorf("%s: 'let' requires 'pipeline' to be specified", name)
+		}
+		let, ok = value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'let' must be a document", name)
+		}
+	}
+
+	// get collection
+	var coll *Collection
+	if from, ok := fields["from"]; ok {
+		coll, err = agg.collection(name, from)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s: missing 'from' option", name)
+	}
+
+	// get foreign documents
+	var foreign bsonkit.List
+	if coll != nil {
+		foreign = coll.Documents.List
+	}
+
+	// join documents
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		// match local and foreign field
+		matches := foreign
+		if hasLocal {
+			matches = nil
+			if coll != nil {
+				value, _ := bsonkit.All(doc, localField, true, true)
+				matches, err = coll.Lookup(foreignField, lookupValues(value))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// run pipeline
+		if hasPipeline {
+			// evaluate variables
+			ev := agg.Evaluation(doc)
+			vars := make(map[string]interface{}, len(let))
+			for _, v := range let {
+				err = validateVariable(name, v.Key)
+				if err != nil {
+					return nil, err
+				}
+				vars[v.Key], err = ev.Evaluate(v.Value)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// run pipeline
+			matches, err = agg.With(vars).Run(matches, pipeline)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// collect matches
+		array := make(bson.A, 0, len(matches))
+		for _, match := range matches {
+			array = append(array, *bsonkit.Clone(match))
+		}
+
+		// add matches
+		res := bsonkit.Clone(doc)
+		_, err = bsonkit.Put(res, as, array, false)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, res)
+	}
+
+	return result, nil
+}
+
+func stageGraphLookup(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"from", "startWith", "connectFromField", "connectToField", "as"}, "maxDepth", "depthField", "restrictSearchWithMatch")
+	if err != nil {
+		return nil, err
+	}
+
+	// get paths
+	as, err := toFieldPath(name, "as", fields["as"])
+	if err != nil {
+		return nil, err
+	}
+	connectFrom, err := toFieldPath(name, "connectFromField", fields["connectFromField"])
+	if err != nil {
+		return nil, err
+	}
+	connectTo, err := toFieldPath(name, "connectToField", fields["connectToField"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get max depth
+	maxDepth := int64(-1)
+	if value, ok := fields["maxDepth"]; ok {
+		maxDepth, ok = toInt64(value)
+		if !ok || maxDepth < 0 {
+			return nil, fmt.Errorf("%s: 'maxDepth' must be a non-negative integer", name)
+		}
+	}
+
+	// get depth field
+	var depthField string
+	if value, ok := fields["depthField"]; ok {
+		depthField, err = toFieldPath(name, "depthField", value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get restriction
+	var restrict bsonkit.Doc
+	if value, ok := fields["restrictSearchWithMatch"]; ok {
+		query, ok := value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'restrictSearchWithMatch' must be a document", name)
+		}
+		restrict = &query
+	}
+
+	// get collection
+	coll, err := agg.collection(name, fields["from"])
+	if err != nil {
+		return nil, err
+	}
+
+	// traverse graph for every document
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		// evaluate start
+		start, err := agg.Evaluation(doc).Evaluate(fields["startWith"])
+		if err != nil {
+			return nil, err
+		}
+
+		// search documents breadth first
+		array := bson.A{}
+		visited := map[bsonkit.Doc]bool{}
+		values := lookupValues(start)
+		for depth := int64(0); coll != nil && len(values) > 0 && (maxDepth < 0 || depth <= maxDepth); depth++ {
+			// find matching documents
+			matches, err := coll.Lookup(connectTo, distinctValues(values))
+			if err != nil {
+				return nil, err
+			}
+
+			// collect unvisited documents and the next values
+			values = nil
+			for _, match := range matches {
+				// check visited
+				if visited[match] {
+					continue
+				}
+				visited[match] = true
+
+				// check restriction
+				if restrict != nil {
+					ok, err := MatchWith(match, restrict, agg.Variables)
+					if err != nil {
+						return nil, err
+					} else if !ok {
+						continue
+					}
+				}
+
+				// add document
+				found := bsonkit.Clone(match)
+				if depthField != "" {
+					_, err = bsonkit.Put(found, depthField, depth, false)
+					if err != nil {
+						return nil, err
+					}
+				}
+				array = append(array, *found)
+
+				// add next values
+				value, _ := bsonkit.All(match, connectFrom, true, true)
+				if value != bsonkit.Missing {
+					values = append(values, lookupValues(value)...)
+				}
+			}
+		}
+
+		// add documents
+		res := bsonkit.Clone(doc)
+		_, err = bsonkit.Put(res, as, array, false)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, res)
+	}
+
+	return result, nil
+}
+
+func stageUnionWith(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	var fields map[string]interface{}
+	if coll, ok := spec.(string); ok {
+		fields = map[string]interface{}{"coll": coll}
+	} else {
+		var err error
+		fields, err = evalObject(name, spec, nil, "coll", "pipeline")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get pipeline
+	var pipeline bsonkit.List
+	_, hasPipeline := fields["pipeline"]
+	if hasPipeline {
+		var err error
+		pipeline, err = toPipeline(name, fields["pipeline"])
+		if err != nil {
+			return nil, err
+		}
+		if HasOutputStage(pipeline) {
+			return nil, fmt.Errorf("%s: the pipeline may not contain a $out or $merge stage", name)
+		}
+	}
+
+	// get documents
+	var docs bsonkit.List
+	if coll, ok := fields["coll"]; ok {
+		collection, err := agg.collection(name, coll)
+		if err != nil {
+			return nil, err
+		}
+		if collection != nil {
+			docs = collection.Documents.List
+		}
+	} else if !hasPipeline {
+		return nil, fmt.Errorf("%s: either 'coll' or 'pipeline' must be specified", name)
+	}
+
+	// run pipeline
+	docs, err := agg.Run(docs, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	// append documents
+	result := make(bsonkit.List, 0, len(list)+len(docs))
+	result = append(result, list...)
+	result = append(result, docs...)
+
+	return result, nil
+}
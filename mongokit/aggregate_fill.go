@@ -0,0 +1,357 @@
+package mongokit
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register gap filling stages
+	AggregationStages["$densify"] = stageDensify
+	AggregationStages["$fill"] = stageFill
+}
+
+// partitionFields converts a list of partition fields to a partition
+// expression.
+func partitionFields(name string, v interface{}) (bson.D, []string, error) {
+	// check array
+	array, ok := v.(bson.A)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: 'partitionByFields' must be an array of field paths", name)
+	}
+
+	// build expression
+	expr := make(bson.D, 0, len(array))
+	paths := make([]string, 0, len(array))
+	for _, item := range array {
+		path, err := toFieldPath(name, "partitionByFields", item)
+		if err != nil {
+			return nil, nil, err
+		}
+		expr = append(expr, bson.E{Key: fmt.Sprintf("_%d", len(expr)), Value: "$" + path})
+		paths = append(paths, path)
+	}
+
+	return expr, paths, nil
+}
+
+func stageDensify(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"field", "range"}, "partitionByFields")
+	if err != nil {
+		return nil, err
+	}
+
+	// get field
+	field, err := toFieldPath(name, "field", fields["field"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get partition fields
+	var partitionExpr bson.D
+	var partitionPaths []string
+	if value, ok := fields["partitionByFields"]; ok {
+		partitionExpr, partitionPaths, err = partitionFields(name, value)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range partitionPaths {
+			if path == field {
+				return nil, fmt.Errorf("%s: the 'field' may not be included in 'partitionByFields'", name)
+			}
+		}
+	}
+
+	// get range
+	rng, err := evalObject(name, fields["range"], []string{"step", "bounds"}, "unit")
+	if err != nil {
+		return nil, err
+	}
+
+	// get unit
+	var unit string
+	if value, ok := rng["unit"]; ok {
+		unit, err = getUnit(name, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get step
+	step := rng["step"]
+	if !isNumeric(step) || compareValues(step, int32(0)) <= 0 {
+		return nil, fmt.Errorf("%s: the step must be a positive number", name)
+	} else if _, ok := toExactInt64(step); unit != "" && !ok {
+		return nil, fmt.Errorf("%s: the step must be an integer if a unit is specified", name)
+	}
+
+	// check value
+	checkValue := func(value interface{}) error {
+		if unit != "" {
+			if _, ok := value.(primitive.DateTime); !ok {
+				return fmt.Errorf("%s: the field must be a date if a unit is specified", name)
+			}
+		} else if !isNumeric(value) {
+			return fmt.Errorf("%s: the field must be a number if no unit is specified", name)
+		}
+		return nil
+	}
+
+	// get bounds
+	var lower, upper interface{}
+	mode, _ := rng["bounds"].(string)
+	switch bounds := rng["bounds"].(type) {
+	case string:
+		if mode != "full" && mode != "partition" {
+			return nil, fmt.Errorf("%s: bounds must be 'full', 'partition' or an array of two values", name)
+		}
+	case bson.A:
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("%s: bounds must be 'full', 'partition' or an array of two values", name)
+		}
+		for _, bound := range bounds {
+			err = checkValue(bound)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if compareValues(bounds[0], bounds[1]) > 0 {
+			return nil, fmt.Errorf("%s: the lower bound must not exceed the upper bound", name)
+		}
+		lower, upper = bounds[0], bounds[1]
+	default:
+		return nil, fmt.Errorf("%s: bounds must be 'full', 'partition' or an array of two values", name)
+	}
+
+	// collect documents with values
+	result := make(bsonkit.List, 0, len(list))
+	values := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		value := bsonkit.Get(doc, field)
+		if isNullish(value) {
+			result = append(result, doc)
+			continue
+		}
+		err = checkValue(value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, doc)
+	}
+
+	// sort documents
+	values, err = Sort(values, &bson.D{{Key: field, Value: int32(1)}})
+	if err != nil {
+		return nil, err
+	}
+
+	// get full range
+	if mode == "full" && len(values) > 0 {
+		lower = bsonkit.Get(values[0], field)
+		upper = bsonkit.Get(values[len(values)-1], field)
+	}
+
+	// get partitions
+	partitions := []bsonkit.List{values}
+	if partitionExpr != nil {
+		_, partitions, err = groupList(agg, values, partitionExpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// prepare generator
+	generate := func(start interface{}, k int64) interface{} {
+		if unit != "" {
+			amount, _ := toExactInt64(step)
+			t, _ := toTime(name, start)
+			return fromTime(addDate(t, unit, amount*k))
+		}
+		return addNumbers(start, multiplyNumbers(step, narrowInt(k, true)))
+	}
+
+	// densify partitions
+	for _, partition := range partitions {
+		// get range
+		start, end, inclusive := lower, upper, mode != ""
+		if mode != "" && len(partition) == 0 {
+			continue
+		} else if mode == "partition" {
+			start = bsonkit.Get(partition[0], field)
+			end = bsonkit.Get(partition[len(partition)-1], field)
+		}
+
+		// prepare document template
+		template := bson.D{}
+		for _, path := range partitionPaths {
+			if len(partition) == 0 {
+				break
+			}
+			value := bsonkit.Get(partition[0], path)
+			if value != bsonkit.Missing {
+				_, err = bsonkit.Put(&template, path, value, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// check end
+		beyond := func(value interface{}) bool {
+			res := compareValues(value, end)
+			return res > 0 || (res == 0 && !inclusive)
+		}
+
+		// generate missing values
+		var k int64
+		next := generate(start, 0)
+		for _, doc := range partition {
+			value := bsonkit.Get(doc, field)
+
+			// add missing values before document
+			for compareValues(next, value) < 0 && !beyond(next) {
+				gen := bsonkit.Clone(&template)
+				_, err = bsonkit.Put(gen, field, next, false)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, gen)
+				k++
+				next = generate(start, k)
+			}
+
+			// skip present value
+			for compareValues(next, value) <= 0 {
+				k++
+				next = generate(start, k)
+			}
+
+			result = append(result, doc)
+		}
+
+		// add missing values after documents
+		for !beyond(next) {
+			gen := bsonkit.Clone(&template)
+			_, err = bsonkit.Put(gen, field, next, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, gen)
+			k++
+			next = generate(start, k)
+		}
+	}
+
+	return result, nil
+}
+
+func stageFill(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"output"}, "partitionBy", "partitionByFields", "sortBy")
+	if err != nil {
+		return nil, err
+	}
+
+	// get partition
+	var partitionBy interface{}
+	_, hasPartition := fields["partitionBy"]
+	_, hasPartitionFields := fields["partitionByFields"]
+	if hasPartition && hasPartitionFields {
+		return nil, fmt.Errorf("%s: only one of 'partitionBy' and 'partitionByFields' may be specified", name)
+	} else if hasPartition {
+		partitionBy = fields["partitionBy"]
+	} else if hasPartitionFields {
+		partitionBy, _, err = partitionFields(name, fields["partitionByFields"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get outputs
+	doc, ok := fields["output"].(bson.D)
+	if !ok || len(doc) == 0 {
+		return nil, fmt.Errorf("%s: 'output' must be a non-empty document", name)
+	}
+
+	// prepare window fields
+	output := make(bson.D, 0, len(doc))
+	var values bson.D
+	for _, field := range doc {
+		// get method or value
+		spec, err := evalObject(name, field.Value, nil, "method", "value")
+		if err != nil {
+			return nil, err
+		}
+		method, hasMethod := spec["method"]
+		value, hasValue := spec["value"]
+		if hasMethod == hasValue {
+			return nil, fmt.Errorf("%s: exactly one of 'method' or 'value' must be specified for field '%s'", name, field.Key)
+		}
+
+		// handle value
+		if hasValue {
+			values = append(values, bson.E{Key: field.Key, Value: value})
+			continue
+		}
+
+		// handle method
+		switch method {
+		case "locf":
+			output = append(output, bson.E{Key: field.Key, Value: bson.D{{Key: "$locf", Value: "$" + field.Key}}})
+		case "linear":
+			if fields["sortBy"] == nil {
+				return nil, fmt.Errorf("%s: the 'linear' method requires a sortBy", name)
+			}
+			output = append(output, bson.E{Key: field.Key, Value: bson.D{{Key: "$linearFill", Value: "$" + field.Key}}})
+		default:
+			return nil, fmt.Errorf("%s: method must be either 'locf' or 'linear'", name)
+		}
+	}
+
+	// fill values
+	if len(values) > 0 {
+		result := make(bsonkit.List, 0, len(list))
+		for _, doc := range list {
+			doc = bsonkit.Clone(doc)
+			for _, field := range values {
+				if !isNullish(bsonkit.Get(doc, field.Key)) {
+					continue
+				}
+				value, err := agg.Evaluation(doc).Evaluate(field.Value)
+				if err != nil {
+					return nil, err
+				} else if value == bsonkit.Missing {
+					value = nil
+				}
+				_, err = bsonkit.Put(doc, field.Key, value, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+			result = append(result, doc)
+		}
+		list = result
+	}
+
+	// fill methods
+	if len(output) > 0 {
+		window := bson.D{{Key: "output", Value: output}}
+		if partitionBy != nil {
+			window = append(window, bson.E{Key: "partitionBy", Value: partitionBy})
+		}
+		if sortBy, ok := fields["sortBy"]; ok {
+			window = append(window, bson.E{Key: "sortBy", Value: sortBy})
+		}
+		list, err = stageSetWindowFields(agg, list, name, window)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
@@ -0,0 +1,515 @@
+package mongokit
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register group stages
+	AggregationStages["$group"] = stageGroup
+	AggregationStages["$bucket"] = stageBucket
+	AggregationStages["$bucketAuto"] = stageBucketAuto
+	AggregationStages["$sortByCount"] = stageSortByCount
+}
+
+// the preferred number series supported by $bucketAuto
+var granularitySeries = map[string][]float64{
+	"R5":    {1.0, 1.6, 2.5, 4.0, 6.3, 10.0},
+	"R10":   {1.0, 1.25, 1.6, 2.0, 2.5, 3.15, 4.0, 5.0, 6.3, 8.0, 10.0},
+	"R20":   {1.0, 1.12, 1.25, 1.4, 1.6, 1.8, 2.0, 2.24, 2.5, 2.8, 3.15, 3.55, 4.0, 4.5, 5.0, 5.6, 6.3, 7.1, 8.0, 9.0, 10.0},
+	"R40":   {1.0, 1.06, 1.12, 1.18, 1.25, 1.32, 1.4, 1.5, 1.6, 1.7, 1.8, 1.9, 2.0, 2.12, 2.24, 2.36, 2.5, 2.65, 2.8, 3.0, 3.15, 3.35, 3.55, 3.75, 4.0, 4.25, 4.5, 4.75, 5.0, 5.3, 5.6, 6.0, 6.3, 6.7, 7.1, 7.5, 8.0, 8.5, 9.0, 9.5, 10.0},
+	"R80":   {1.0, 1.03, 1.06, 1.09, 1.12, 1.15, 1.18, 1.22, 1.25, 1.28, 1.32, 1.36, 1.4, 1.45, 1.5, 1.55, 1.6, 1.65, 1.7, 1.75, 1.8, 1.85, 1.9, 1.95, 2.0, 2.06, 2.12, 2.18, 2.24, 2.3, 2.36, 2.43, 2.5, 2.58, 2.65, 2.72, 2.8, 2.9, 3.0, 3.07, 3.15, 3.25, 3.35, 3.45, 3.55, 3.65, 3.75, 3.87, 4.0, 4.12, 4.25, 4.37, 4.5, 4.62, 4.75, 4.87, 5.0, 5.15, 5.3, 5.45, 5.6, 5.8, 6.0, 6.15, 6.3, 6.5, 6.7, 6.9, 7.1, 7.3, 7.5, 7.75, 8.0, 8.25, 8.5, 8.75, 9.0, 9.25, 9.5, 9.75, 10.0},
+	"1-2-5": {1.0, 2.0, 5.0, 10.0},
+	"E6":    {1.0, 1.5, 2.2, 3.3, 4.7, 6.8, 10.0},
+	"E12":   {1.0, 1.2, 1.5, 1.8, 2.2, 2.7, 3.3, 3.9, 4.7, 5.6, 6.8, 8.2, 10.0},
+	"E24":   {1.0, 1.1, 1.2, 1.3, 1.5, 1.6, 1.8, 2.0, 2.2, 2.4, 2.7, 3.0, 3.3, 3.6, 3.9, 4.3, 4.7, 5.1, 5.6, 6.2, 6.8, 7.5, 8.2, 9.1, 10.0},
+	"E48":   {1.0, 1.05, 1.1, 1.15, 1.21, 1.27, 1.33, 1.4, 1.47, 1.54, 1.62, 1.69, 1.78, 1.87, 1.96, 2.05, 2.15, 2.26, 2.37, 2.49, 2.61, 2.74, 2.87, 3.01, 3.16, 3.32, 3.48, 3.65, 3.83, 4.02, 4.22, 4.42, 4.64, 4.87, 5.11, 5.36, 5.62, 5.9, 6.19, 6.49, 6.81, 7.15, 7.5, 7.87, 8.25, 8.66, 9.09, 9.53, 10.0},
+	"E96":   {1.0, 1.02, 1.05, 1.07, 1.1, 1.13, 1.15, 1.18, 1.21, 1.24, 1.27, 1.3, 1.33, 1.37, 1.4, 1.43, 1.47, 1.5, 1.54, 1.58, 1.62, 1.65, 1.69, 1.74, 1.78, 1.82, 1.87, 1.91, 1.96, 2.0, 2.05, 2.1, 2.15, 2.21, 2.26, 2.32, 2.37, 2.43, 2.49, 2.55, 2.61, 2.67, 2.74, 2.8, 2.87, 2.94, 3.01, 3.09, 3.16, 3.24, 3.32, 3.4, 3.48, 3.57, 3.65, 3.74, 3.83, 3.92, 4.02, 4.12, 4.22, 4.32, 4.42, 4.53, 4.64, 4.75, 4.87, 4.99, 5.11, 5.23, 5.36, 5.49, 5.62, 5.76, 5.9, 6.04, 6.19, 6.34, 6.49, 6.65, 6.81, 6.98, 7.15, 7.32, 7.5, 7.68, 7.87, 8.06, 8.25, 8.45, 8.66, 8.87, 9.09, 9.31, 9.53, 9.76, 10.0},
+	"E192":  {1.0, 1.01, 1.02, 1.04, 1.05, 1.06, 1.07, 1.09, 1.1, 1.11, 1.13, 1.14, 1.15, 1.17, 1.18, 1.2, 1.21, 1.23, 1.24, 1.26, 1.27, 1.29, 1.3, 1.32, 1.33, 1.35, 1.37, 1.38, 1.4, 1.42, 1.43, 1.45, 1.47, 1.49, 1.5, 1.52, 1.54, 1.56, 1.58, 1.6, 1.62, 1.64, 1.65, 1.67, 1.69, 1.72, 1.74, 1.76, 1.78, 1.8, 1.82, 1.84, 1.87, 1.89, 1.91, 1.93, 1.96, 1.98, 2.0, 2.03, 2.05, 2.08, 2.1, 2.13, 2.15, 2.18, 2.21, 2.23, 2.26, 2.29, 2.32, 2.34, 2.37, 2.4, 2.43, 2.46, 2.49, 2.52, 2.55, 2.58, 2.61, 2.64, 2.67, 2.71, 2.74, 2.77, 2.8, 2.84, 2.87, 2.91, 2.94, 2.98, 3.01, 3.05, 3.09, 3.12, 3.16, 3.2, 3.24, 3.28, 3.32, 3.36, 3.4, 3.44, 3.48, 3.52, 3.57, 3.61, 3.65, 3.7, 3.74, 3.79, 3.83, 3.88, 3.92, 3.97, 4.02, 4.07, 4.12, 4.17, 4.22, 4.27, 4.32, 4.37, 4.42, 4.48, 4.53, 4.59, 4.64, 4.7, 4.75, 4.81, 4.87, 4.93, 4.99, 5.05, 5.11, 5.17, 5.23, 5.3, 5.36, 5.42, 5.49, 5.56, 5.62, 5.69, 5.76, 5.83, 5.9, 5.97, 6.04, 6.12, 6.19, 6.26, 6.34, 6.42, 6.49, 6.57, 6.65, 6.73, 6.81, 6.9, 6.98, 7.06, 7.15, 7.23, 7.32, 7.41, 7.5, 7.59, 7.68, 7.77, 7.87, 7.96, 8.06, 8.16, 8.25, 8.35, 8.45, 8.56, 8.66, 8.76, 8.87, 8.98, 9.09, 9.2, 9.31, 9.42, 9.53, 9.65, 9.76, 9.88, 10.0},
+}
+
+// groupList groups the documents by the evaluated key expression. The groups
+// are returned ordered by their key and retain the order of the documents.
+func groupList(agg *Aggregation, list bsonkit.List, expr interface{}) ([]interface{}, []bsonkit.List, error) {
+	// evaluate keys
+	keys := make([]interface{}, len(list))
+	for i, doc := range list {
+		key, err := agg.Evaluation(doc).Evaluate(expr)
+		if err != nil {
+			return nil, nil, err
+		} else if key == bsonkit.Missing {
+			key = nil
+		}
+		keys[i] = key
+	}
+
+	// sort documents by key
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return bsonkit.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	// collect groups
+	var groupKeys []interface{}
+	var groups []bsonkit.List
+	for _, i := range order {
+		n := len(groups)
+		if n > 0 && bsonkit.Compare(groupKeys[n-1], keys[i]) == 0 {
+			groups[n-1] = append(groups[n-1], list[i])
+			continue
+		}
+		groupKeys = append(groupKeys, keys[i])
+		groups = append(groups, bsonkit.List{list[i]})
+	}
+
+	return groupKeys, groups, nil
+}
+
+// isGroupExpression returns whether the value is a field path or expression
+// object as required by the groupBy argument of the bucket stages.
+func isGroupExpression(v interface{}) bool {
+	switch value := v.(type) {
+	case string:
+		return strings.HasPrefix(value, "$")
+	case bson.D:
+		return len(value) > 0 && strings.HasPrefix(value[0].Key, "$")
+	default:
+		return false
+	}
+}
+
+// bucketOutput returns the checked output argument of the bucket stages.
+func bucketOutput(name string, fields map[string]interface{}) (bson.D, error) {
+	// get output
+	value, ok := fields["output"]
+	if !ok {
+		return bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}, nil
+	}
+
+	// check output
+	output, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: 'output' must be a document", name)
+	}
+	err := validateAccumulators(name, output)
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func stageGroup(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	fields, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected document", name)
+	}
+
+	// get key and accumulators
+	var key interface{}
+	var hasKey bool
+	accumulators := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		if field.Key == "_id" {
+			key = field.Value
+			hasKey = true
+		} else {
+			accumulators = append(accumulators, field)
+		}
+	}
+	if !hasKey {
+		return nil, fmt.Errorf("%s: a group specification must include an _id", name)
+	}
+
+	// check accumulators
+	err := validateAccumulators(name, accumulators)
+	if err != nil {
+		return nil, err
+	}
+
+	// group documents
+	keys, groups, err := groupList(agg, list, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// accumulate groups
+	result := make(bsonkit.List, 0, len(groups))
+	for i, group := range groups {
+		values, err := Accumulate(agg, group, name, accumulators)
+		if err != nil {
+			return nil, err
+		}
+		doc := append(bson.D{{Key: "_id", Value: keys[i]}}, values...)
+		result = append(result, &doc)
+	}
+
+	return result, nil
+}
+
+func stageBucket(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"groupBy", "boundaries"}, "default", "output")
+	if err != nil {
+		return nil, err
+	}
+
+	// check group by
+	if !isGroupExpression(fields["groupBy"]) {
+		return nil, fmt.Errorf("%s: the 'groupBy' field must be a path or an expression object", name)
+	}
+
+	// check boundaries
+	boundaries, ok := fields["boundaries"].(bson.A)
+	if !ok || len(boundaries) < 2 {
+		return nil, fmt.Errorf("%s: the 'boundaries' field must be an array of at least two values", name)
+	}
+	for i := 1; i < len(boundaries); i++ {
+		prevClass, _ := bsonkit.Inspect(boundaries[i-1])
+		class, _ := bsonkit.Inspect(boundaries[i])
+		if prevClass != class {
+			return nil, fmt.Errorf("%s: all values in 'boundaries' must have the same type", name)
+		} else if bsonkit.Compare(boundaries[i-1], boundaries[i]) >= 0 {
+			return nil, fmt.Errorf("%s: the 'boundaries' field must be sorted in ascending order", name)
+		}
+	}
+
+	// check default
+	def, hasDefault := fields["default"]
+	if hasDefault {
+		defClass, _ := bsonkit.Inspect(def)
+		class, _ := bsonkit.Inspect(boundaries[0])
+		if defClass == class && bsonkit.Compare(def, boundaries[0]) >= 0 && bsonkit.Compare(def, boundaries[len(boundaries)-1]) < 0 {
+			return nil, fmt.Errorf("%s: the 'default' field must be less than the lowest boundary or greater than or equal to the highest boundary", name)
+		}
+	}
+
+	// get output
+	output, err := bucketOutput(name, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// assign documents to buckets
+	buckets := make([]bsonkit.List, len(boundaries)-1)
+	var rest bsonkit.List
+	for _, doc := range list {
+		// evaluate value
+		value, err := agg.Evaluation(doc).Evaluate(fields["groupBy"])
+		if err != nil {
+			return nil, err
+		} else if value == bsonkit.Missing {
+			value = nil
+		}
+
+		// check range
+		if bsonkit.Compare(value, boundaries[0]) < 0 || bsonkit.Compare(value, boundaries[len(boundaries)-1]) >= 0 {
+			if !hasDefault {
+				return nil, fmt.Errorf("%s: the 'groupBy' value does not fall into any of the 'boundaries' and no 'default' is specified", name)
+			}
+			rest = append(rest, doc)
+			continue
+		}
+
+		// find bucket
+		i := sort.Search(len(boundaries), func(i int) bool {
+			return bsonkit.Compare(boundaries[i], value) > 0
+		})
+		buckets[i-1] = append(buckets[i-1], doc)
+	}
+
+	// accumulate buckets
+	result := make(bsonkit.List, 0, len(buckets)+1)
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		values, err := Accumulate(agg, bucket, name, output)
+		if err != nil {
+			return nil, err
+		}
+		doc := append(bson.D{{Key: "_id", Value: boundaries[i]}}, values...)
+		result = append(result, &doc)
+	}
+
+	// accumulate default bucket
+	if len(rest) > 0 {
+		values, err := Accumulate(agg, rest, name, output)
+		if err != nil {
+			return nil, err
+		}
+		doc := append(bson.D{{Key: "_id", Value: def}}, values...)
+		result = append(result, &doc)
+	}
+
+	return result, nil
+}
+
+func stageBucketAuto(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"groupBy", "buckets"}, "output", "granularity")
+	if err != nil {
+		return nil, err
+	}
+
+	// check group by
+	if !isGroupExpression(fields["groupBy"]) {
+		return nil, fmt.Errorf("%s: the 'groupBy' field must be a path or an expression object", name)
+	}
+
+	// get buckets
+	count, ok := toInt64(fields["buckets"])
+	if !ok || count <= 0 || count > math.MaxInt32 {
+		return nil, fmt.Errorf("%s: the 'buckets' field must be a positive 32-bit integer", name)
+	}
+
+	// get granularity
+	var granularity string
+	if value, ok := fields["granularity"]; ok {
+		granularity, _ = value.(string)
+		if _, ok := granularitySeries[granularity]; !ok && granularity != "POWERSOF2" {
+			return nil, fmt.Errorf("%s: unknown rounding granularity '%v'", name, value)
+		}
+	}
+
+	// get output
+	output, err := bucketOutput(name, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate values
+	values, err := accumulateValues(agg, list, fields["groupBy"])
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if value == bsonkit.Missing {
+			values[i] = nil
+		}
+		if granularity != "" {
+			f, ok := toFloat(values[i])
+			if !isNumeric(values[i]) || !ok || math.IsNaN(f) || f < 0 {
+				return nil, fmt.Errorf("%s: a 'granularity' requires all 'groupBy' values to be non-negative numbers, but found %v", name, values[i])
+			}
+		}
+	}
+
+	// sort documents by value
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return bsonkit.Compare(values[order[i]], values[order[j]]) < 0
+	})
+
+	// determine bucket size
+	size := int(math.Round(float64(len(list)) / float64(count)))
+	if size < 1 {
+		size = 1
+	}
+
+	// fill buckets
+	type bucket struct {
+		min, max interface{}
+		docs     bsonkit.List
+	}
+	var buckets []*bucket
+	pos := 0
+	for i := int64(0); i < count && pos < len(order); i++ {
+		// start bucket
+		first := order[pos]
+		b := &bucket{min: values[first], max: values[first]}
+		if granularity != "" {
+			if len(buckets) > 0 {
+				b.min = buckets[len(buckets)-1].max
+			} else {
+				b.min = roundGranularity(granularity, values[first], false)
+			}
+		}
+
+		// add documents
+		last := i == count-1
+		for n := 0; pos < len(order) && (last || n < size); n++ {
+			b.docs = append(b.docs, list[order[pos]])
+			b.max = values[order[pos]]
+			pos++
+		}
+
+		// absorb following documents
+		if granularity != "" {
+			boundary := roundGranularity(granularity, b.max, true)
+			for pos < len(order) && bsonkit.Compare(values[order[pos]], boundary) < 0 {
+				b.docs = append(b.docs, list[order[pos]])
+				pos++
+			}
+			b.max = boundary
+		} else {
+			for pos < len(order) && bsonkit.Compare(values[order[pos]], b.max) == 0 {
+				b.docs = append(b.docs, list[order[pos]])
+				pos++
+			}
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	// align boundaries
+	if granularity == "" {
+		for i := 0; i < len(buckets)-1; i++ {
+			buckets[i].max = buckets[i+1].min
+		}
+	}
+
+	// accumulate buckets
+	result := make(bsonkit.List, 0, len(buckets))
+	for _, b := range buckets {
+		values, err := Accumulate(agg, b.docs, name, output)
+		if err != nil {
+			return nil, err
+		}
+		doc := append(bson.D{{Key: "_id", Value: bson.D{
+			{Key: "min", Value: b.min},
+			{Key: "max", Value: b.max},
+		}}}, values...)
+		result = append(result, &doc)
+	}
+
+	return result, nil
+}
+
+// roundGranularity rounds the non-negative number up or down to the next value
+// of the granularity series. Values on the series are always moved to the
+// adjacent value.
+func roundGranularity(granularity string, value interface{}, up bool) interface{} {
+	// handle powers of two
+	if granularity == "POWERSOF2" {
+		return roundPowerOfTwo(value, up)
+	}
+
+	// get number
+	number, _ := toFloat(value)
+	if number == 0 {
+		return 0.0
+	}
+
+	// scale number into series
+	series := granularitySeries[granularity]
+	multiplier := 1.0
+	first, last := series[0], series[len(series)-1]
+	if up {
+		for number < first {
+			number *= 10
+			multiplier /= 10
+		}
+		for number >= last {
+			number /= 10
+			multiplier *= 10
+		}
+	} else {
+		for number <= first {
+			number *= 10
+			multiplier /= 10
+		}
+		for number > last {
+			number /= 10
+			multiplier *= 10
+		}
+	}
+
+	// find adjacent value
+	if up {
+		i := sort.Search(len(series), func(i int) bool {
+			return series[i] > number
+		})
+		return series[i] * multiplier
+	}
+	i := sort.Search(len(series), func(i int) bool {
+		return series[i] >= number
+	})
+
+	return series[i-1] * multiplier
+}
+
+// roundPowerOfTwo rounds the non-negative number up or down to the next power
+// of two. Like MongoDB, the result is computed as 2 raised to an integer
+// exponent and is therefore an integer unless the exponent is negative.
+func roundPowerOfTwo(value interface{}, up bool) interface{} {
+	// handle zero
+	f, _ := toFloat(value)
+	if f == 0 {
+		return value
+	}
+
+	// get exponent
+	var exp int
+	if n, ok := toExactInt64(value); ok {
+		exp = bits.Len64(uint64(n)) - 1
+		if up {
+			exp++
+		} else if n&(n-1) == 0 {
+			exp--
+		}
+	} else {
+		frac, e := math.Frexp(f)
+		exp = e - 1
+		if up {
+			exp++
+		} else if frac == 0.5 {
+			exp--
+		}
+	}
+
+	// compute power
+	if exp < 0 || exp >= 63 {
+		return math.Ldexp(1, exp)
+	}
+
+	return narrowInt(int64(1)<<uint(exp), true)
+}
+
+func stageSortByCount(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	if !isGroupExpression(spec) {
+		return nil, fmt.Errorf("%s: the argument must be a field path or an expression object", name)
+	}
+
+	// group documents
+	keys, groups, err := groupList(agg, list, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// sort groups by count
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(groups[order[i]]) > len(groups[order[j]])
+	})
+
+	// count groups
+	result := make(bsonkit.List, 0, len(groups))
+	for _, i := range order {
+		result = append(result, &bson.D{
+			{Key: "_id", Value: keys[i]},
+			{Key: "count", Value: narrowInt(int64(len(groups[i])), true)},
+		})
+	}
+
+	return result, nil
+}
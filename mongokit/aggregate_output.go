@@ -0,0 +1,358 @@
+package mongokit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register output stages
+	AggregationStages["$out"] = stageOut
+	AggregationStages["$merge"] = stageMerge
+}
+
+// the stages that write to collections and must be the final stage
+var outputStages = map[string]bool{
+	"$out":   true,
+	"$merge": true,
+}
+
+// HasOutputStage returns whether the pipeline ends with a stage that writes to
+// a collection (i.e. $out or $merge).
+func HasOutputStage(pipeline bsonkit.List) bool {
+	// check length
+	if len(pipeline) == 0 {
+		return false
+	}
+
+	// check last stage
+	last := *pipeline[len(pipeline)-1]
+	if len(last) == 0 {
+		return false
+	}
+
+	return outputStages[last[0].Key]
+}
+
+// target resolves the collection that is written by an output stage. The
+// target may be a collection name or a document with a db and coll field.
+func (a *Aggregation) target(name string, target interface{}) (string, string, *Collection, error) {
+	// check support
+	if a.Output == nil {
+		return "", "", nil, fmt.Errorf("%s: writing to collections is not supported in this context", name)
+	}
+
+	// get database and collection
+	var db, coll string
+	switch value := target.(type) {
+	case string:
+		coll = value
+	case bson.D:
+		fields, err := evalObject(name, value, []string{"coll"}, "db")
+		if err != nil {
+			return "", "", nil, err
+		}
+		db, _ = fields["db"].(string)
+		coll, _ = fields["coll"].(string)
+	}
+
+	// check name
+	if coll == "" {
+		return "", "", nil, fmt.Errorf("%s: the target must be a collection name or a document with a db and coll field", name)
+	}
+
+	// get collection
+	collection, err := a.Output(db, coll)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return db, coll, collection, nil
+}
+
+// record reports a change of an output stage.
+func (a *Aggregation) record(db, coll, op string, doc bsonkit.Doc, changes *Changes) error {
+	// check function
+	if a.Record == nil {
+		return nil
+	}
+
+	return a.Record(db, coll, op, doc, changes)
+}
+
+func stageOut(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get target
+	db, coll, target, err := agg.target(name, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove existing documents
+	res, err := target.Delete(&bson.D{}, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range res.Matched {
+		err = agg.record(db, coll, "delete", doc, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// insert documents
+	for _, doc := range list {
+		doc = bsonkit.Clone(doc)
+		_, err = target.Insert(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		err = agg.record(db, coll, "insert", doc, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bsonkit.List{}, nil
+}
+
+func stageMerge(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	var fields map[string]interface{}
+	if coll, ok := spec.(string); ok {
+		fields = map[string]interface{}{"into": coll}
+	} else {
+		var err error
+		fields, err = evalObject(name, spec, []string{"into"}, "on", "let", "whenMatched", "whenNotMatched")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get on fields
+	on := []string{"_id"}
+	switch value := fields["on"].(type) {
+	case nil:
+	case string:
+		on = []string{value}
+	case bson.A:
+		on = make([]string, 0, len(value))
+		for _, item := range value {
+			field, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: 'on' must be a string or an array of strings", name)
+			}
+			on = append(on, field)
+		}
+		if len(on) == 0 {
+			return nil, fmt.Errorf("%s: 'on' must not be empty", name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: 'on' must be a string or an array of strings", name)
+	}
+
+	// get when matched mode
+	whenMatched := "merge"
+	var pipeline bsonkit.List
+	switch value := fields["whenMatched"].(type) {
+	case nil:
+	case string:
+		switch value {
+		case "replace", "keepExisting", "merge", "fail":
+			whenMatched = value
+		default:
+			return nil, fmt.Errorf("%s: unknown 'whenMatched' mode '%s'", name, value)
+		}
+	case bson.A:
+		var err error
+		pipeline, err = toPipeline(name, value)
+		if err != nil {
+			return nil, err
+		}
+		whenMatched = "pipeline"
+	default:
+		return nil, fmt.Errorf("%s: 'whenMatched' must be a string or a pipeline", name)
+	}
+
+	// get when not matched mode
+	whenNotMatched := "insert"
+	if value, ok := fields["whenNotMatched"]; ok {
+		whenNotMatched, _ = value.(string)
+		switch whenNotMatched {
+		case "insert", "discard", "fail":
+		default:
+			return nil, fmt.Errorf("%s: unknown 'whenNotMatched' mode '%v'", name, value)
+		}
+	}
+
+	// get variables
+	let := bson.D{{Key: "new", Value: "$$ROOT"}}
+	if value, ok := fields["let"]; ok {
+		if whenMatched != "pipeline" {
+			return nil, fmt.Errorf("%s: 'let' may only be used with a 'whenMatched' pipeline", name)
+		}
+		let, ok = value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'let' must be a document", name)
+		}
+	}
+
+	// get target
+	db, coll, target, err := agg.target(name, fields["into"])
+	if err != nil {
+		return nil, err
+	}
+
+	// check unique index for custom on fields
+	if len(on) != 1 || on[0] != "_id" {
+		if !hasUniqueIndex(target, on) {
+			return nil, fmt.Errorf("%s: cannot find a unique index for the 'on' fields", name)
+		}
+	}
+
+	// merge documents
+	for _, doc := range list {
+		doc = bsonkit.Clone(doc)
+
+		// ensure id
+		generated := false
+		if bsonkit.Get(doc, "_id") == bsonkit.Missing {
+			_, err = bsonkit.Put(doc, "_id", primitive.NewObjectID(), true)
+			if err != nil {
+				return nil, err
+			}
+			generated = true
+		}
+
+		// prepare query
+		query := make(bson.D, 0, len(on))
+		for _, field := range on {
+			value := bsonkit.Get(doc, field)
+			if _, ok := value.(bson.A); ok || isNullish(value) {
+				return nil, fmt.Errorf("%s: the 'on' field '%s' cannot be missing, null, undefined or an array", name, field)
+			}
+			query = append(query, bson.E{Key: field, Value: bson.D{{Key: "$eq", Value: value}}})
+		}
+
+		// find match
+		res, err := target.Find(&query, nil, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		// handle missing match
+		if len(res.Matched) == 0 {
+			switch whenNotMatched {
+			case "insert":
+				_, err = target.Insert(doc)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				err = agg.record(db, coll, "insert", doc, nil)
+				if err != nil {
+					return nil, err
+				}
+			case "fail":
+				return nil, fmt.Errorf("%s: could not find a matching document in the target collection", name)
+			}
+			continue
+		}
+
+		// keep existing id if generated
+		if generated {
+			bsonkit.Unset(doc, "_id")
+		}
+
+		// handle match
+		var update interface{}
+		switch whenMatched {
+		case "keepExisting":
+			continue
+		case "fail":
+			return nil, fmt.Errorf("%s: found a matching document in the target collection", name)
+		case "replace":
+			// replace document
+			res, err := target.Replace(&query, doc, nil)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if len(res.Modified) > 0 {
+				err = agg.record(db, coll, "replace", res.Modified[0], nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case "merge":
+			update = &bson.D{{Key: "$set", Value: *doc}}
+		case "pipeline":
+			// evaluate variables
+			ev := agg.Evaluation(doc)
+			vars := make(bson.D, 0, len(let))
+			for _, v := range let {
+				err = validateVariable(name, v.Key)
+				if err != nil {
+					return nil, err
+				}
+				value, err := ev.Evaluate(v.Value)
+				if err != nil {
+					return nil, err
+				}
+				vars = append(vars, bson.E{Key: v.Key, Value: bson.D{{Key: "$literal", Value: value}}})
+			}
+
+			update = &UpdatePipeline{
+				Stages:    pipeline,
+				Variables: &vars,
+			}
+		}
+
+		// update document
+		res, err = target.Update(&query, update, nil, 0, 1, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for i, doc := range res.Modified {
+			err = agg.record(db, coll, "update", doc, res.Changes[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return bsonkit.List{}, nil
+}
+
+// hasUniqueIndex returns whether the collection has a unique index on exactly
+// the specified fields.
+func hasUniqueIndex(coll *Collection, fields []string) bool {
+	// sort fields
+	fields = append([]string{}, fields...)
+	sort.Strings(fields)
+
+	for _, index := range coll.Indexes {
+		// check uniqueness
+		if !index.config.Unique || index.config.Partial != nil || len(index.columns) != len(fields) {
+			continue
+		}
+
+		// collect paths
+		paths := make([]string, 0, len(index.columns))
+		for _, column := range index.columns {
+			paths = append(paths, column.Path)
+		}
+		sort.Strings(paths)
+
+		// compare paths
+		if strings.Join(paths, "\x00") == strings.Join(fields, "\x00") {
+			return true
+		}
+	}
+
+	return false
+}
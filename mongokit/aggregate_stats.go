@@ -0,0 +1,296 @@
+package mongokit
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register source stages
+	AggregationStages["$collStats"] = stageCollStats
+	AggregationStages["$indexStats"] = stageIndexStats
+	AggregationStages["$documents"] = stageDocuments
+	AggregationStages["$currentOp"] = stageCurrentOp
+	AggregationStages["$listLocalSessions"] = stageListLocalSessions
+}
+
+// the stages that produce documents and must be the first stage
+var sourceStages = map[string]bool{
+	"$collStats":         true,
+	"$indexStats":        true,
+	"$documents":         true,
+	"$currentOp":         true,
+	"$listLocalSessions": true,
+}
+
+// IsCollectionless returns whether the pipeline starts with a stage that does
+// not require a collection (i.e. $documents, $currentOp or $listLocalSessions).
+func IsCollectionless(pipeline bsonkit.List) bool {
+	// check length
+	if len(pipeline) == 0 {
+		return false
+	}
+
+	// check first stage
+	first := *pipeline[0]
+	if len(first) == 0 {
+		return false
+	}
+
+	switch first[0].Key {
+	case "$documents", "$currentOp", "$listLocalSessions":
+		return true
+	default:
+		return false
+	}
+}
+
+// hostname returns the host reported by the diagnostic stages.
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return host
+}
+
+func stageCollStats(agg *Aggregation, _ bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, nil, "latencyStats", "storageStats", "count", "queryExecStats")
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare document
+	doc := bson.D{
+		{Key: "ns", Value: agg.Namespace},
+		{Key: "host", Value: hostname()},
+		{Key: "localTime", Value: primitive.NewDateTimeFromTime(time.Now())},
+	}
+
+	// get collection
+	coll := agg.Collection
+	if coll == nil {
+		coll = NewCollection(false)
+	}
+
+	// add latency stats
+	if value, ok := fields["latencyStats"]; ok {
+		_, err = evalObject(name, value, nil, "histograms")
+		if err != nil {
+			return nil, err
+		}
+		var latency bson.D
+		if agg.Latency != nil {
+			latency = *agg.Latency()
+		} else {
+			for _, kind := range []string{"reads", "writes", "commands", "transactions"} {
+				latency = append(latency, bson.E{Key: kind, Value: bson.D{
+					{Key: "latency", Value: int64(0)},
+					{Key: "ops", Value: int64(0)},
+				}})
+			}
+		}
+		doc = append(doc, bson.E{Key: "latencyStats", Value: latency})
+	}
+
+	// add storage stats
+	if value, ok := fields["storageStats"]; ok {
+		opts, err := evalObject(name, value, nil, "scale")
+		if err != nil {
+			return nil, err
+		}
+		scale := int64(1)
+		if value, ok := opts["scale"]; ok {
+			scale, ok = toExactInt64(value)
+			if !ok || scale < 1 {
+				return nil, fmt.Errorf("%s: scale must be a positive integer", name)
+			}
+		}
+		doc = append(doc, bson.E{Key: "storageStats", Value: storageStats(coll, scale)})
+	}
+
+	// add count
+	if value, ok := fields["count"]; ok {
+		_, err = evalObject(name, value, nil)
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.E{Key: "count", Value: int64(len(coll.Documents.List))})
+	}
+
+	// add query exec stats
+	if value, ok := fields["queryExecStats"]; ok {
+		_, err = evalObject(name, value, nil)
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.E{Key: "queryExecStats", Value: bson.D{
+			{Key: "collectionScans", Value: bson.D{
+				{Key: "total", Value: int64(0)},
+				{Key: "nonTailable", Value: int64(0)},
+			}},
+		}})
+	}
+
+	return bsonkit.List{&doc}, nil
+}
+
+// storageStats returns the estimated storage statistics of the collection.
+func storageStats(coll *Collection, scale int64) bson.D {
+	// get sizes
+	count := int64(len(coll.Documents.List))
+	size := coll.Size()
+	var avgObjSize int64
+	if count > 0 {
+		avgObjSize = size / count
+	}
+
+	// get index sizes
+	names := make([]string, 0, len(coll.Indexes))
+	for name := range coll.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var totalIndexSize int64
+	indexSizes := make(bson.D, 0, len(names))
+	for _, name := range names {
+		indexSize := coll.Indexes[name].Size()
+		totalIndexSize += indexSize
+		indexSizes = append(indexSizes, bson.E{Key: name, Value: indexSize / scale})
+	}
+
+	return bson.D{
+		{Key: "size", Value: size / scale},
+		{Key: "count", Value: count},
+		{Key: "avgObjSize", Value: avgObjSize},
+		{Key: "storageSize", Value: size / scale},
+		{Key: "freeStorageSize", Value: int64(0)},
+		{Key: "nindexes", Value: int64(len(names))},
+		{Key: "totalIndexSize", Value: totalIndexSize / scale},
+		{Key: "totalSize", Value: (size + totalIndexSize) / scale},
+		{Key: "indexSizes", Value: indexSizes},
+		{Key: "scaleFactor", Value: scale},
+	}
+}
+
+func stageIndexStats(agg *Aggregation, _ bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	_, err := evalObject(name, spec, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// check collection
+	if agg.Collection == nil {
+		return bsonkit.List{}, nil
+	}
+
+	// sort names
+	names := make([]string, 0, len(agg.Collection.Indexes))
+	for name := range agg.Collection.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// prepare documents
+	host := hostname()
+	list := make(bsonkit.List, 0, len(names))
+	for _, name := range names {
+		// get index
+		index := agg.Collection.Indexes[name]
+		ops, since := index.Accesses()
+
+		// prepare spec
+		spec := bson.D{
+			{Key: "v", Value: int32(2)},
+			{Key: "key", Value: *bsonkit.Clone(index.config.Key)},
+			{Key: "name", Value: name},
+		}
+		if index.config.Unique {
+			spec = append(spec, bson.E{Key: "unique", Value: true})
+		}
+		if index.config.Partial != nil {
+			spec = append(spec, bson.E{Key: "partialFilterExpression", Value: *bsonkit.Clone(index.config.Partial)})
+		}
+		if index.config.Expiry > 0 {
+			spec = append(spec, bson.E{Key: "expireAfterSeconds", Value: int32(index.config.Expiry / time.Second)})
+		}
+
+		list = append(list, &bson.D{
+			{Key: "name", Value: name},
+			{Key: "key", Value: *bsonkit.Clone(index.config.Key)},
+			{Key: "host", Value: host},
+			{Key: "accesses", Value: bson.D{
+				{Key: "ops", Value: ops},
+				{Key: "since", Value: primitive.NewDateTimeFromTime(since)},
+			}},
+			{Key: "spec", Value: spec},
+		})
+	}
+
+	return list, nil
+}
+
+func stageDocuments(agg *Aggregation, _ bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// evaluate expression
+	value, err := agg.Evaluation(nil).Evaluate(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// check array
+	array, ok := value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: the argument must evaluate to an array of documents", name)
+	}
+
+	// collect documents
+	list := make(bsonkit.List, 0, len(array))
+	for _, item := range array {
+		doc, ok := item.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: the argument must evaluate to an array of documents", name)
+		}
+		list = append(list, bsonkit.Clone(&doc))
+	}
+
+	return list, nil
+}
+
+func stageCurrentOp(agg *Aggregation, _ bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	_, err := evalObject(name, spec, nil, "allUsers", "idleConnections", "idleCursors", "idleSessions", "localOps", "backtrace", "targetAllNodes")
+	if err != nil {
+		return nil, err
+	}
+
+	// check support
+	if agg.Operations == nil {
+		return nil, fmt.Errorf("%s: operations are not available in this context", name)
+	}
+
+	return agg.Operations()
+}
+
+func stageListLocalSessions(agg *Aggregation, _ bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// check specification
+	_, err := evalObject(name, spec, nil, "allUsers", "users")
+	if err != nil {
+		return nil, err
+	}
+
+	// check support
+	if agg.Sessions == nil {
+		return nil, fmt.Errorf("%s: sessions are not available in this context", name)
+	}
+
+	return agg.Sessions()
+}
@@ -0,0 +1,1409 @@
+package mongokit
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func normalizeList(list bsonkit.List) bsonkit.List {
+	result := make(bsonkit.List, 0, len(list))
+	for _, doc := range list {
+		bytes, err := bson.Marshal(doc)
+		if err != nil {
+			panic(err)
+		}
+
+		var m bson.M
+		err = bson.Unmarshal(bytes, &m)
+		if err != nil {
+			panic(err)
+		}
+
+		result = append(result, bsonkit.MustConvert(m))
+	}
+
+	return result
+}
+
+func aggregateTest(t *testing.T, docs, foreign []bson.M, fn func(from string, run func(bson.A, interface{}))) {
+	t.Run("Mongo", func(t *testing.T) {
+		coll := testCollection()
+		other := testCollection()
+
+		for _, doc := range docs {
+			_, err := coll.InsertOne(nil, doc)
+			assert.NoError(t, err)
+		}
+
+		for _, doc := range foreign {
+			_, err := other.InsertOne(nil, doc)
+			assert.NoError(t, err)
+		}
+
+		fn(other.Name(), func(pipeline bson.A, result interface{}) {
+			csr, err := coll.Aggregate(nil, pipeline, options.Aggregate())
+			if _, ok := result.(string); ok {
+				assert.Error(t, err, pipeline)
+				return
+			}
+			assert.NoError(t, err)
+
+			var list []bson.M
+			err = csr.All(nil, &list)
+			assert.NoError(t, err)
+
+			assert.Equal(t, result, normalizeList(bsonkit.MustConvertList(list)), pipeline)
+		})
+	})
+
+	t.Run("Lungo", func(t *testing.T) {
+		for _, indexed := range []bool{false, true} {
+			coll := NewCollection(true)
+			other := NewCollection(true)
+
+			for _, doc := range docs {
+				_, err := coll.Insert(bsonkit.MustConvert(doc))
+				assert.NoError(t, err)
+			}
+
+			for _, doc := range foreign {
+				_, err := other.Insert(bsonkit.MustConvert(doc))
+				assert.NoError(t, err)
+			}
+
+			if indexed {
+				_, err := other.CreateIndex("k", IndexConfig{
+					Key: bsonkit.MustConvert(bson.M{"k": int32(1)}),
+				})
+				assert.NoError(t, err)
+			}
+
+			fn("foreign", func(pipeline bson.A, result interface{}) {
+				list, err := Aggregate(coll.Documents.List, bsonkit.MustConvertList(pipeline), &Aggregation{
+					Lookup: func(db, name string) (*Collection, error) {
+						if db == "" && name == "foreign" {
+							return other, nil
+						}
+						return nil, nil
+					},
+				})
+				if str, ok := result.(string); ok {
+					assert.Error(t, err)
+					if err != nil {
+						assert.Equal(t, str, err.Error())
+					}
+					return
+				}
+
+				assert.NoError(t, err)
+				assert.Equal(t, result, normalizeList(list), pipeline)
+			})
+		}
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "a": "x", "n": int32(3)},
+		{"_id": int32(2), "a": "y", "n": int32(1)},
+		{"_id": int32(3), "a": "x", "n": int32(2)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// empty pipeline
+		run(bson.A{}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x", "n": int32(3)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "a": "y", "n": int32(1)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "a": "x", "n": int32(2)}),
+		})
+
+		// unknown stage
+		run(bson.A{
+			bson.M{"$foo": bson.M{}},
+		}, `unrecognized pipeline stage name "$foo"`)
+
+		// match, sort and project
+		run(bson.A{
+			bson.M{"$match": bson.M{"a": "x"}},
+			bson.M{"$sort": bson.M{"n": int32(1)}},
+			bson.M{"$project": bson.M{"_id": int32(0), "m": bson.M{"$multiply": bson.A{"$n", int32(2)}}}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"m": int32(4)}),
+			bsonkit.MustConvert(bson.M{"m": int32(6)}),
+		})
+
+		// match expression
+		run(bson.A{
+			bson.M{"$match": bson.M{"$expr": bson.M{"$gt": bson.A{"$n", int32(1)}}}},
+			bson.M{"$unset": bson.A{"a", "n"}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3)}),
+		})
+
+		// set, replace, skip and limit
+		run(bson.A{
+			bson.M{"$set": bson.M{"d": bson.M{"v": "$n"}}},
+			bson.M{"$replaceWith": "$d"},
+			bson.M{"$skip": int32(1)},
+			bson.M{"$limit": int32(1)},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"v": int32(1)}),
+		})
+
+		// count
+		run(bson.A{
+			bson.M{"$match": bson.M{"a": "x"}},
+			bson.M{"$count": "total"},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"total": int32(2)}),
+		})
+
+		// count nothing
+		run(bson.A{
+			bson.M{"$match": bson.M{"a": "z"}},
+			bson.M{"$count": "total"},
+		}, bsonkit.List{})
+
+		// invalid limit
+		run(bson.A{
+			bson.M{"$limit": int32(0)},
+		}, "$limit: the limit must be positive")
+	})
+}
+
+func TestAggregateLookup(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "k": "a"},
+		{"_id": int32(2), "k": bson.A{"b", "c"}},
+		{"_id": int32(3)},
+	}, []bson.M{
+		{"_id": int32(1), "k": "c", "v": int32(1)},
+		{"_id": int32(2), "k": "a", "v": int32(2)},
+		{"_id": int32(3), "k": "b", "v": int32(3)},
+		{"_id": int32(4), "v": int32(4)},
+		{"_id": int32(5), "k": "a", "v": int32(5)},
+	}, func(from string, run func(bson.A, interface{})) {
+		// equality match
+		run(bson.A{
+			bson.M{"$lookup": bson.M{
+				"from":         from,
+				"localField":   "k",
+				"foreignField": "k",
+				"as":           "r",
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "k": "a", "r": bson.A{
+				bson.M{"_id": int32(2), "k": "a", "v": int32(2)},
+				bson.M{"_id": int32(5), "k": "a", "v": int32(5)},
+			}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "k": bson.A{"b", "c"}, "r": bson.A{
+				bson.M{"_id": int32(1), "k": "c", "v": int32(1)},
+				bson.M{"_id": int32(3), "k": "b", "v": int32(3)},
+			}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "r": bson.A{
+				bson.M{"_id": int32(4), "v": int32(4)},
+			}}),
+		})
+
+		// pipeline with variables
+		run(bson.A{
+			bson.M{"$lookup": bson.M{
+				"from": from,
+				"let":  bson.M{"key": "$k"},
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$k", "$$key"}}}},
+					bson.M{"$project": bson.M{"_id": int32(0), "v": int32(1)}},
+				},
+				"as": "r",
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "k": "a", "r": bson.A{
+				bson.M{"v": int32(2)},
+				bson.M{"v": int32(5)},
+			}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "k": bson.A{"b", "c"}, "r": bson.A{}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "r": bson.A{
+				bson.M{"v": int32(4)},
+			}}),
+		})
+
+		// equality match with pipeline
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": int32(1)}},
+			bson.M{"$lookup": bson.M{
+				"from":         from,
+				"localField":   "k",
+				"foreignField": "k",
+				"pipeline": bson.A{
+					bson.M{"$sort": bson.M{"v": int32(-1)}},
+					bson.M{"$limit": int32(1)},
+				},
+				"as": "r",
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "k": "a", "r": bson.A{
+				bson.M{"_id": int32(5), "k": "a", "v": int32(5)},
+			}}),
+		})
+
+		// missing collection
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": int32(1)}},
+			bson.M{"$lookup": bson.M{
+				"from":         "missing",
+				"localField":   "k",
+				"foreignField": "k",
+				"as":           "r",
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "k": "a", "r": bson.A{}}),
+		})
+	})
+}
+
+func TestAggregateGraphLookup(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "s": "a"},
+		{"_id": int32(2), "s": "d"},
+	}, []bson.M{
+		{"_id": int32(1), "k": "a", "n": "b"},
+		{"_id": int32(2), "k": "b", "n": bson.A{"c", "a"}},
+		{"_id": int32(3), "k": "c", "n": "d", "x": true},
+		{"_id": int32(4), "k": "d"},
+	}, func(from string, run func(bson.A, interface{})) {
+		// full traversal
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": int32(1)}},
+			bson.M{"$graphLookup": bson.M{
+				"from":             from,
+				"startWith":        "$s",
+				"connectFromField": "n",
+				"connectToField":   "k",
+				"depthField":       "d",
+				"as":               "r",
+			}},
+			bson.M{"$project": bson.M{"r": bson.M{"$map": bson.M{
+				"input": "$r",
+				"in":    bson.M{"_id": "$$this._id", "d": "$$this.d"},
+			}}}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "r": bson.A{
+				bson.M{"_id": int32(1), "d": int64(0)},
+				bson.M{"_id": int32(2), "d": int64(1)},
+				bson.M{"_id": int32(3), "d": int64(2)},
+				bson.M{"_id": int32(4), "d": int64(3)},
+			}}),
+		})
+
+		// max depth and restriction
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": int32(1)}},
+			bson.M{"$graphLookup": bson.M{
+				"from":                    from,
+				"startWith":               "$s",
+				"connectFromField":        "n",
+				"connectToField":          "k",
+				"maxDepth":                int32(2),
+				"restrictSearchWithMatch": bson.M{"x": bson.M{"$ne": true}},
+				"as":                      "r",
+			}},
+			bson.M{"$project": bson.M{"r": "$r._id"}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "r": bson.A{int32(1), int32(2)}}),
+		})
+
+		// leaf
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": int32(2)}},
+			bson.M{"$graphLookup": bson.M{
+				"from":             from,
+				"startWith":        "$s",
+				"connectFromField": "n",
+				"connectToField":   "k",
+				"as":               "r",
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "s": "d", "r": bson.A{
+				bson.M{"_id": int32(4), "k": "d"},
+			}}),
+		})
+
+		// invalid max depth
+		run(bson.A{
+			bson.M{"$graphLookup": bson.M{
+				"from":             from,
+				"startWith":        "$s",
+				"connectFromField": "n",
+				"connectToField":   "k",
+				"maxDepth":         int32(-1),
+				"as":               "r",
+			}},
+		}, "$graphLookup: 'maxDepth' must be a non-negative integer")
+	})
+}
+
+func TestAggregateGroup(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "a": "x", "n": int32(3)},
+		{"_id": int32(2), "a": "y", "n": int32(1)},
+		{"_id": int32(3), "a": "x", "n": int32(2)},
+		{"_id": int32(4), "n": int32(4)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// missing id
+		run(bson.A{
+			bson.M{"$group": bson.M{"n": bson.M{"$sum": "$n"}}},
+		}, "$group: a group specification must include an _id")
+
+		// accumulators
+		run(bson.A{
+			bson.M{"$group": bson.D{
+				{Key: "_id", Value: "$a"},
+				{Key: "sum", Value: bson.M{"$sum": "$n"}},
+				{Key: "avg", Value: bson.M{"$avg": "$n"}},
+				{Key: "min", Value: bson.M{"$min": "$n"}},
+				{Key: "max", Value: bson.M{"$max": "$n"}},
+				{Key: "first", Value: bson.M{"$first": "$n"}},
+				{Key: "last", Value: bson.M{"$last": "$n"}},
+				{Key: "push", Value: bson.M{"$push": "$n"}},
+				{Key: "count", Value: bson.M{"$count": bson.M{}}},
+			}},
+			bson.M{"$sort": bson.M{"_id": int32(1)}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": nil, "sum": int32(4), "avg": 4.0, "min": int32(4), "max": int32(4), "first": int32(4), "last": int32(4), "push": bson.A{int32(4)}, "count": int32(1)}),
+			bsonkit.MustConvert(bson.M{"_id": "x", "sum": int32(5), "avg": 2.5, "min": int32(2), "max": int32(3), "first": int32(3), "last": int32(2), "push": bson.A{int32(3), int32(2)}, "count": int32(2)}),
+			bsonkit.MustConvert(bson.M{"_id": "y", "sum": int32(1), "avg": 1.0, "min": int32(1), "max": int32(1), "first": int32(1), "last": int32(1), "push": bson.A{int32(1)}, "count": int32(1)}),
+		})
+
+		// null group
+		run(bson.A{
+			bson.M{"$group": bson.M{
+				"_id":  nil,
+				"set":  bson.M{"$addToSet": "$a"},
+				"top":  bson.M{"$top": bson.M{"sortBy": bson.M{"n": int32(-1)}, "output": "$_id"}},
+				"maxN": bson.M{"$maxN": bson.M{"input": "$n", "n": int32(2)}},
+				"dev":  bson.M{"$stdDevPop": bson.A{}},
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": nil, "set": bson.A{"x", "y"}, "top": int32(4), "maxN": bson.A{int32(4), int32(3)}, "dev": nil}),
+		})
+
+		// sort by count
+		run(bson.A{
+			bson.M{"$sortByCount": "$a"},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": "x", "count": int32(2)}),
+			bsonkit.MustConvert(bson.M{"_id": nil, "count": int32(1)}),
+			bsonkit.MustConvert(bson.M{"_id": "y", "count": int32(1)}),
+		})
+	})
+}
+
+func TestAggregateUnwind(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "a": bson.A{"x", "y"}},
+		{"_id": int32(2), "a": bson.A{}},
+		{"_id": int32(3), "a": nil},
+		{"_id": int32(4)},
+		{"_id": int32(5), "a": "z"},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// short form
+		run(bson.A{
+			bson.M{"$unwind": "$a"},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "y"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(5), "a": "z"}),
+		})
+
+		// options
+		run(bson.A{
+			bson.M{"$unwind": bson.M{
+				"path":                       "$a",
+				"includeArrayIndex":          "i",
+				"preserveNullAndEmptyArrays": true,
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x", "i": int64(0)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "y", "i": int64(1)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "i": nil}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "a": nil, "i": nil}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "i": nil}),
+			bsonkit.MustConvert(bson.M{"_id": int32(5), "a": "z", "i": nil}),
+		})
+
+		// invalid path
+		run(bson.A{
+			bson.M{"$unwind": "a"},
+		}, "$unwind: path option must be prefixed with a '$'")
+	})
+}
+
+func TestAggregateFacet(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "a": "x", "n": int32(3)},
+		{"_id": int32(2), "a": "y", "n": int32(12)},
+		{"_id": int32(3), "a": "x", "n": int32(25)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// facets
+		run(bson.A{
+			bson.M{"$facet": bson.M{
+				"tags": bson.A{
+					bson.M{"$sortByCount": "$a"},
+				},
+				"prices": bson.A{
+					bson.M{"$bucket": bson.M{
+						"groupBy":    "$n",
+						"boundaries": bson.A{int32(0), int32(10), int32(20)},
+						"default":    "other",
+					}},
+				},
+				"total": bson.A{
+					bson.M{"$count": "n"},
+				},
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{
+				"tags": bson.A{
+					bson.M{"_id": "x", "count": int32(2)},
+					bson.M{"_id": "y", "count": int32(1)},
+				},
+				"prices": bson.A{
+					bson.M{"_id": int32(0), "count": int32(1)},
+					bson.M{"_id": int32(10), "count": int32(1)},
+					bson.M{"_id": "other", "count": int32(1)},
+				},
+				"total": bson.A{
+					bson.M{"n": int32(3)},
+				},
+			}),
+		})
+
+		// nested facet
+		run(bson.A{
+			bson.M{"$facet": bson.M{
+				"a": bson.A{
+					bson.M{"$facet": bson.M{"b": bson.A{}}},
+				},
+			}},
+		}, "$facet: $facet is not allowed to be used within a $facet stage")
+	})
+}
+
+func TestAggregateBucket(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "n": int32(1)},
+		{"_id": int32(2), "n": int32(5)},
+		{"_id": int32(3), "n": 7.5},
+		{"_id": int32(4), "n": int32(10)},
+		{"_id": int32(5)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// output
+		run(bson.A{
+			bson.M{"$bucket": bson.M{
+				"groupBy":    "$n",
+				"boundaries": bson.A{int32(0), int32(5), int32(10)},
+				"default":    int32(-1),
+				"output": bson.M{
+					"ids": bson.M{"$push": "$_id"},
+				},
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(0), "ids": bson.A{int32(1)}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(5), "ids": bson.A{int32(2), int32(3)}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(-1), "ids": bson.A{int32(4), int32(5)}}),
+		})
+
+		// missing default
+		run(bson.A{
+			bson.M{"$bucket": bson.M{
+				"groupBy":    "$n",
+				"boundaries": bson.A{int32(0), int32(5)},
+			}},
+		}, "$bucket: the 'groupBy' value does not fall into any of the 'boundaries' and no 'default' is specified")
+
+		// unsorted boundaries
+		run(bson.A{
+			bson.M{"$bucket": bson.M{
+				"groupBy":    "$n",
+				"boundaries": bson.A{int32(5), int32(0)},
+			}},
+		}, "$bucket: the 'boundaries' field must be sorted in ascending order")
+	})
+}
+
+func TestAggregateBucketAuto(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "n": int32(1)},
+		{"_id": int32(2), "n": int32(2)},
+		{"_id": int32(3), "n": int32(2)},
+		{"_id": int32(4), "n": int32(3)},
+		{"_id": int32(5), "n": int32(4)},
+		{"_id": int32(6), "n": int32(13)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// basic
+		run(bson.A{
+			bson.M{"$bucketAuto": bson.M{
+				"groupBy": "$n",
+				"buckets": int32(3),
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": int32(1), "max": int32(3)}, "count": int32(3)}),
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": int32(3), "max": int32(13)}, "count": int32(2)}),
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": int32(13), "max": int32(13)}, "count": int32(1)}),
+		})
+
+		// preferred numbers
+		run(bson.A{
+			bson.M{"$bucketAuto": bson.M{
+				"groupBy":     "$n",
+				"buckets":     int32(2),
+				"granularity": "R5",
+				"output": bson.M{
+					"ids": bson.M{"$push": "$_id"},
+				},
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": 0.63, "max": 2.5}, "ids": bson.A{int32(1), int32(2), int32(3)}}),
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": 2.5, "max": 16.0}, "ids": bson.A{int32(4), int32(5), int32(6)}}),
+		})
+
+		// powers of two
+		run(bson.A{
+			bson.M{"$bucketAuto": bson.M{
+				"groupBy":     "$n",
+				"buckets":     int32(2),
+				"granularity": "POWERSOF2",
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": 0.5, "max": int32(4)}, "count": int32(4)}),
+			bsonkit.MustConvert(bson.M{"_id": bson.M{"min": int32(4), "max": int32(16)}, "count": int32(2)}),
+		})
+
+		// invalid granularity
+		run(bson.A{
+			bson.M{"$bucketAuto": bson.M{
+				"groupBy":     "$n",
+				"buckets":     int32(2),
+				"granularity": "foo",
+			}},
+		}, "$bucketAuto: unknown rounding granularity 'foo'")
+	})
+}
+
+func outputTest(t *testing.T, docs, existing []bson.M, pipeline bson.A) (bsonkit.List, []string, error) {
+	source := NewCollection(true)
+	target := NewCollection(true)
+
+	for _, doc := range docs {
+		_, err := source.Insert(bsonkit.MustConvert(doc))
+		assert.NoError(t, err)
+	}
+
+	for _, doc := range existing {
+		_, err := target.Insert(bsonkit.MustConvert(doc))
+		assert.NoError(t, err)
+	}
+
+	var events []string
+	list, err := Aggregate(source.Documents.List, bsonkit.MustConvertList(pipeline), &Aggregation{
+		Output: func(db, name string) (*Collection, error) {
+			assert.Equal(t, "", db)
+			assert.Equal(t, "target", name)
+			return target, nil
+		},
+		Record: func(db, name, op string, doc bsonkit.Doc, changes *Changes) error {
+			events = append(events, op)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	assert.Empty(t, list)
+
+	return normalizeList(target.Documents.List), events, nil
+}
+
+func TestAggregateOut(t *testing.T) {
+	docs := []bson.M{
+		{"_id": int32(1), "n": int32(1)},
+		{"_id": int32(2), "n": int32(2)},
+	}
+
+	list, events, err := outputTest(t, docs, []bson.M{
+		{"_id": int32(3), "n": int32(3)},
+	}, bson.A{
+		bson.M{"$match": bson.M{"n": bson.M{"$gt": int32(1)}}},
+		bson.M{"$out": "target"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(2), "n": int32(2)}),
+	}, list)
+	assert.Equal(t, []string{"delete", "insert"}, events)
+
+	// not final stage
+	_, _, err = outputTest(t, docs, nil, bson.A{
+		bson.M{"$out": "target"},
+		bson.M{"$match": bson.M{}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$out can only be the final stage in the pipeline", err.Error())
+
+	// unsupported
+	_, err = Aggregate(nil, bsonkit.MustConvertList(bson.A{
+		bson.M{"$out": "target"},
+	}), &Aggregation{})
+	assert.Error(t, err)
+	assert.Equal(t, "$out: writing to collections is not supported in this context", err.Error())
+}
+
+func TestAggregateMerge(t *testing.T) {
+	docs := []bson.M{
+		{"_id": int32(1), "a": "x", "n": int32(1)},
+		{"_id": int32(2), "a": "y", "n": int32(2)},
+	}
+
+	existing := []bson.M{
+		{"_id": int32(1), "a": "z", "m": int32(5)},
+	}
+
+	// default (merge and insert)
+	list, events, err := outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": "target"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x", "m": int32(5), "n": int32(1)}),
+		bsonkit.MustConvert(bson.M{"_id": int32(2), "a": "y", "n": int32(2)}),
+	}, list)
+	assert.Equal(t, []string{"update", "insert"}, events)
+
+	// replace and discard
+	list, events, err = outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": bson.M{
+			"into":           "target",
+			"whenMatched":    "replace",
+			"whenNotMatched": "discard",
+		}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x", "n": int32(1)}),
+	}, list)
+	assert.Equal(t, []string{"replace"}, events)
+
+	// keep existing
+	list, events, err = outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": bson.M{
+			"into":        "target",
+			"whenMatched": "keepExisting",
+		}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "z", "m": int32(5)}),
+		bsonkit.MustConvert(bson.M{"_id": int32(2), "a": "y", "n": int32(2)}),
+	}, list)
+	assert.Equal(t, []string{"insert"}, events)
+
+	// pipeline
+	list, events, err = outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": bson.M{
+			"into": "target",
+			"let":  bson.M{"n": "$n"},
+			"whenMatched": bson.A{
+				bson.M{"$set": bson.M{"m": bson.M{"$add": bson.A{"$m", "$$n"}}}},
+			},
+		}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "z", "m": int32(6)}),
+		bsonkit.MustConvert(bson.M{"_id": int32(2), "a": "y", "n": int32(2)}),
+	}, list)
+	assert.Equal(t, []string{"update", "insert"}, events)
+
+	// fail when matched
+	_, _, err = outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": bson.M{
+			"into":        "target",
+			"whenMatched": "fail",
+		}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$merge: found a matching document in the target collection", err.Error())
+
+	// fail when not matched
+	_, _, err = outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": bson.M{
+			"into":           "target",
+			"whenNotMatched": "fail",
+		}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$merge: could not find a matching document in the target collection", err.Error())
+
+	// missing unique index
+	_, _, err = outputTest(t, docs, existing, bson.A{
+		bson.M{"$merge": bson.M{
+			"into": "target",
+			"on":   "a",
+		}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$merge: cannot find a unique index for the 'on' fields", err.Error())
+}
+
+func TestAggregateSetWindowFields(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "g": "a", "n": int32(1), "v": int32(10)},
+		{"_id": int32(2), "g": "a", "n": int32(2), "v": int32(20)},
+		{"_id": int32(3), "g": "a", "n": int32(2), "v": nil},
+		{"_id": int32(4), "g": "a", "n": int32(4), "v": int32(40)},
+		{"_id": int32(5), "g": "b", "n": int32(1), "v": int32(5)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// partitioned running sum
+		run(bson.A{
+			bson.M{"$setWindowFields": bson.M{
+				"partitionBy": "$g",
+				"sortBy":      bson.M{"_id": 1},
+				"output": bson.M{
+					"sum": bson.M{
+						"$sum":   "$v",
+						"window": bson.M{"documents": bson.A{"unbounded", "current"}},
+					},
+				},
+			}},
+			bson.M{"$project": bson.M{"sum": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "sum": int32(10)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "sum": int32(30)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "sum": int32(30)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "sum": int32(70)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(5), "sum": int32(5)}),
+		})
+
+		// moving average
+		run(bson.A{
+			bson.M{"$match": bson.M{"g": "a"}},
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"_id": 1},
+				"output": bson.M{
+					"avg": bson.M{
+						"$avg":   "$v",
+						"window": bson.M{"documents": bson.A{int32(-1), int32(0)}},
+					},
+				},
+			}},
+			bson.M{"$project": bson.M{"avg": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "avg": 10.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "avg": 15.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "avg": 20.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "avg": 40.0}),
+		})
+
+		// range window
+		run(bson.A{
+			bson.M{"$match": bson.M{"g": "a"}},
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"n": 1},
+				"output": bson.M{
+					"ids": bson.M{
+						"$push":  "$_id",
+						"window": bson.M{"range": bson.A{int32(-1), "current"}},
+					},
+				},
+			}},
+			bson.M{"$project": bson.M{"ids": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "ids": bson.A{int32(1)}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "ids": bson.A{int32(1), int32(2), int32(3)}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "ids": bson.A{int32(1), int32(2), int32(3)}}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "ids": bson.A{int32(4)}}),
+		})
+
+		// ranks
+		run(bson.A{
+			bson.M{"$match": bson.M{"g": "a"}},
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"n": 1},
+				"output": bson.M{
+					"rank":  bson.M{"$rank": bson.M{}},
+					"dense": bson.M{"$denseRank": bson.M{}},
+					"num":   bson.M{"$documentNumber": bson.M{}},
+				},
+			}},
+			bson.M{"$project": bson.M{"rank": 1, "dense": 1, "num": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "rank": int32(1), "dense": int32(1), "num": int32(1)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "rank": int32(2), "dense": int32(2), "num": int32(2)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "rank": int32(2), "dense": int32(2), "num": int32(3)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "rank": int32(4), "dense": int32(3), "num": int32(4)}),
+		})
+
+		// shift and locf
+		run(bson.A{
+			bson.M{"$match": bson.M{"g": "a"}},
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"_id": 1},
+				"output": bson.M{
+					"prev": bson.M{"$shift": bson.M{"output": "$v", "by": int32(-1), "default": "none"}},
+					"locf": bson.M{"$locf": "$v"},
+				},
+			}},
+			bson.M{"$project": bson.M{"prev": 1, "locf": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "prev": "none", "locf": int32(10)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "prev": int32(10), "locf": int32(20)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "prev": int32(20), "locf": int32(20)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "prev": nil, "locf": int32(40)}),
+		})
+
+		// derivative and integral
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": bson.M{"$in": bson.A{int32(1), int32(2), int32(4)}}}},
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"n": 1},
+				"output": bson.M{
+					"rate": bson.M{
+						"$derivative": bson.M{"input": "$v"},
+						"window":      bson.M{"documents": bson.A{int32(-1), "current"}},
+					},
+					"area": bson.M{
+						"$integral": bson.M{"input": "$v"},
+						"window":    bson.M{"documents": bson.A{"unbounded", "current"}},
+					},
+				},
+			}},
+			bson.M{"$project": bson.M{"rate": 1, "area": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "rate": nil, "area": 0.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "rate": 10.0, "area": 15.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "rate": 10.0, "area": 75.0}),
+		})
+
+		// exponential moving average and covariance
+		run(bson.A{
+			bson.M{"$match": bson.M{"_id": bson.M{"$in": bson.A{int32(1), int32(2), int32(4)}}}},
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"n": 1},
+				"output": bson.M{
+					"ema": bson.M{"$expMovingAvg": bson.M{"input": "$v", "alpha": 0.5}},
+					"cov": bson.M{
+						"$covariancePop": bson.A{"$n", "$v"},
+						"window":         bson.M{"documents": bson.A{int32(-1), int32(0)}},
+					},
+				},
+			}},
+			bson.M{"$project": bson.M{"ema": 1, "cov": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "ema": int32(10), "cov": 0.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "ema": 15.0, "cov": 2.5}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "ema": 27.5, "cov": 10.0}),
+		})
+
+		// missing sort
+		run(bson.A{
+			bson.M{"$setWindowFields": bson.M{
+				"output": bson.M{
+					"rank": bson.M{"$rank": bson.M{}},
+				},
+			}},
+		}, "$setWindowFields: $rank requires a sortBy")
+	})
+}
+
+func TestAggregateSetWindowFieldsDates(t *testing.T) {
+	day := func(d int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC))
+	}
+
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "d": day(1), "v": int32(1)},
+		{"_id": int32(2), "d": day(2), "v": int32(2)},
+		{"_id": int32(3), "d": day(5), "v": int32(3)},
+		{"_id": int32(4), "d": day(6), "v": int32(4)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// time range window
+		run(bson.A{
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"d": 1},
+				"output": bson.M{
+					"sum": bson.M{
+						"$sum":   "$v",
+						"window": bson.M{"range": bson.A{int32(-2), "current"}, "unit": "day"},
+					},
+					"rate": bson.M{
+						"$derivative": bson.M{"input": "$v", "unit": "day"},
+						"window":      bson.M{"documents": bson.A{int32(-1), int32(0)}},
+					},
+				},
+			}},
+			bson.M{"$project": bson.M{"sum": 1, "rate": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "sum": int32(1), "rate": nil}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "sum": int32(3), "rate": 1.0}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "sum": int32(3), "rate": 1.0 / 3}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "sum": int32(7), "rate": 1.0}),
+		})
+
+		// invalid unit window
+		run(bson.A{
+			bson.M{"$setWindowFields": bson.M{
+				"sortBy": bson.M{"v": 1},
+				"output": bson.M{
+					"sum": bson.M{
+						"$sum":   "$v",
+						"window": bson.M{"range": bson.A{int32(-2), "current"}, "unit": "day"},
+					},
+				},
+			}},
+		}, "$setWindowFields: invalid range: expected the sortBy field to be a date")
+	})
+}
+
+func TestAggregateUnionWith(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "a": "x"},
+	}, []bson.M{
+		{"_id": int32(2), "k": "y"},
+		{"_id": int32(3), "k": "z"},
+	}, func(from string, run func(bson.A, interface{})) {
+		// collection
+		run(bson.A{
+			bson.M{"$unionWith": from},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "k": "y"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "k": "z"}),
+		})
+
+		// pipeline
+		run(bson.A{
+			bson.M{"$unionWith": bson.M{
+				"coll": from,
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{"k": "z"}},
+					bson.M{"$project": bson.M{"_id": 0}},
+				},
+			}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x"}),
+			bsonkit.MustConvert(bson.M{"k": "z"}),
+		})
+
+		// missing collection
+		run(bson.A{
+			bson.M{"$unionWith": "missing"},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x"}),
+		})
+	})
+}
+
+func TestAggregateSample(t *testing.T) {
+	list := bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+		bsonkit.MustConvert(bson.M{"_id": int32(2)}),
+		bsonkit.MustConvert(bson.M{"_id": int32(3)}),
+	}
+
+	pipeline := bsonkit.MustConvertList(bson.A{
+		bson.M{"$sample": bson.M{"size": int32(2)}},
+	})
+
+	res1, err := Aggregate(list, pipeline, &Aggregation{
+		Random: rand.New(rand.NewSource(1)),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, res1, 2)
+	assert.NotEqual(t, res1[0], res1[1])
+
+	res2, err := Aggregate(list, pipeline, &Aggregation{
+		Random: rand.New(rand.NewSource(1)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, res1, res2)
+
+	res3, err := Aggregate(list, bsonkit.MustConvertList(bson.A{
+		bson.M{"$sample": bson.M{"size": int32(5)}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, list, res3)
+
+	_, err = Aggregate(list, bsonkit.MustConvertList(bson.A{
+		bson.M{"$sample": bson.M{"size": int32(-1)}},
+	}), nil)
+	assert.Error(t, err)
+	assert.Equal(t, "$sample: size argument must be a non-negative integer", err.Error())
+}
+
+func TestAggregateRedact(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "level": int32(1), "a": bson.M{"level": int32(2), "b": "c"}, "l": bson.A{
+			bson.M{"level": int32(1), "d": "e"},
+			bson.M{"level": int32(3), "f": "g"},
+		}},
+		{"_id": int32(2), "level": int32(3)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// descend and prune
+		run(bson.A{
+			bson.M{"$redact": bson.M{"$cond": bson.A{
+				bson.M{"$lte": bson.A{"$level", int32(1)}}, "$$DESCEND", "$$PRUNE",
+			}}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "level": int32(1), "l": bson.A{
+				bson.M{"level": int32(1), "d": "e"},
+			}}),
+		})
+
+		// keep
+		run(bson.A{
+			bson.M{"$redact": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$_id", int32(2)}}, "$$KEEP", "$$PRUNE",
+			}}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "level": int32(3)}),
+		})
+
+		// invalid result
+		run(bson.A{
+			bson.M{"$redact": "$level"},
+		}, "$redact: the expression should not return anything aside from the variables $$KEEP, $$DESCEND, and $$PRUNE, but returned int")
+	})
+}
+
+func TestAggregateDensify(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "g": "a", "n": int32(1)},
+		{"_id": int32(2), "g": "a", "n": int32(4)},
+		{"_id": int32(3), "g": "b", "n": int32(3)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// full
+		run(bson.A{
+			bson.M{"$densify": bson.M{
+				"field": "n",
+				"range": bson.M{"step": int32(1), "bounds": "full"},
+			}},
+			bson.M{"$project": bson.M{"_id": 0}},
+			bson.M{"$sort": bson.M{"n": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"g": "a", "n": int32(1)}),
+			bsonkit.MustConvert(bson.M{"n": int32(2)}),
+			bsonkit.MustConvert(bson.M{"g": "b", "n": int32(3)}),
+			bsonkit.MustConvert(bson.M{"g": "a", "n": int32(4)}),
+		})
+
+		// partitions
+		run(bson.A{
+			bson.M{"$densify": bson.M{
+				"field":             "n",
+				"partitionByFields": bson.A{"g"},
+				"range":             bson.M{"step": int32(2), "bounds": "partition"},
+			}},
+			bson.M{"$project": bson.M{"_id": 0}},
+			bson.M{"$sort": bson.D{{Key: "g", Value: 1}, {Key: "n", Value: 1}}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"g": "a", "n": int32(1)}),
+			bsonkit.MustConvert(bson.M{"g": "a", "n": int32(3)}),
+			bsonkit.MustConvert(bson.M{"g": "a", "n": int32(4)}),
+			bsonkit.MustConvert(bson.M{"g": "b", "n": int32(3)}),
+		})
+
+		// explicit bounds
+		run(bson.A{
+			bson.M{"$match": bson.M{"g": "b"}},
+			bson.M{"$densify": bson.M{
+				"field": "n",
+				"range": bson.M{"step": int32(1), "bounds": bson.A{int32(0), int32(3)}},
+			}},
+			bson.M{"$project": bson.M{"_id": 0}},
+			bson.M{"$sort": bson.M{"n": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"n": int32(0)}),
+			bsonkit.MustConvert(bson.M{"n": int32(1)}),
+			bsonkit.MustConvert(bson.M{"n": int32(2)}),
+			bsonkit.MustConvert(bson.M{"g": "b", "n": int32(3)}),
+		})
+	})
+
+	day := func(d int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC))
+	}
+
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "d": day(1)},
+		{"_id": int32(2), "d": day(4)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// dates
+		run(bson.A{
+			bson.M{"$densify": bson.M{
+				"field": "d",
+				"range": bson.M{"step": int32(1), "unit": "day", "bounds": "full"},
+			}},
+			bson.M{"$sort": bson.M{"d": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "d": day(1)}),
+			bsonkit.MustConvert(bson.M{"d": day(2)}),
+			bsonkit.MustConvert(bson.M{"d": day(3)}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "d": day(4)}),
+		})
+	})
+}
+
+func TestAggregateFill(t *testing.T) {
+	aggregateTest(t, []bson.M{
+		{"_id": int32(1), "g": "a", "n": int32(1), "v": int32(10), "s": "x"},
+		{"_id": int32(2), "g": "a", "n": int32(2), "v": nil},
+		{"_id": int32(3), "g": "a", "n": int32(5), "v": int32(40)},
+		{"_id": int32(4), "g": "b", "n": int32(1)},
+	}, nil, func(_ string, run func(bson.A, interface{})) {
+		// value, locf and linear
+		run(bson.A{
+			bson.M{"$fill": bson.M{
+				"partitionByFields": bson.A{"g"},
+				"sortBy":            bson.M{"n": 1},
+				"output": bson.M{
+					"v": bson.M{"method": "linear"},
+					"s": bson.M{"method": "locf"},
+					"z": bson.M{"value": "none"},
+				},
+			}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		}, bsonkit.List{
+			bsonkit.MustConvert(bson.M{"_id": int32(1), "g": "a", "n": int32(1), "v": int32(10), "s": "x", "z": "none"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(2), "g": "a", "n": int32(2), "v": 17.5, "s": "x", "z": "none"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(3), "g": "a", "n": int32(5), "v": int32(40), "s": "x", "z": "none"}),
+			bsonkit.MustConvert(bson.M{"_id": int32(4), "g": "b", "n": int32(1), "v": nil, "s": nil, "z": "none"}),
+		})
+
+		// invalid method
+		run(bson.A{
+			bson.M{"$fill": bson.M{
+				"output": bson.M{
+					"v": bson.M{"method": "foo"},
+				},
+			}},
+		}, "$fill: method must be either 'locf' or 'linear'")
+	})
+}
+
+func TestAggregateCollStats(t *testing.T) {
+	coll := NewCollection(true)
+	_, err := coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "foo"}))
+	assert.NoError(t, err)
+	_, err = coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(2), "a": "bar"}))
+	assert.NoError(t, err)
+
+	res, err := Aggregate(coll.Documents.List, bsonkit.MustConvertList(bson.A{
+		bson.M{"$collStats": bson.M{
+			"count":        bson.M{},
+			"storageStats": bson.M{},
+		}},
+	}), &Aggregation{
+		Namespace:  "foo.bar",
+		Collection: coll,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+	assert.Equal(t, "foo.bar", bsonkit.Get(res[0], "ns"))
+	assert.Equal(t, int64(2), bsonkit.Get(res[0], "count"))
+	assert.Equal(t, int64(2), bsonkit.Get(res[0], "storageStats.count"))
+	assert.Equal(t, coll.Size(), bsonkit.Get(res[0], "storageStats.size"))
+	assert.Equal(t, int64(1), bsonkit.Get(res[0], "storageStats.nindexes"))
+	assert.Equal(t, coll.Indexes["_id_"].Size(), bsonkit.Get(res[0], "storageStats.indexSizes._id_"))
+	assert.Equal(t, bsonkit.Missing, bsonkit.Get(res[0], "latencyStats"))
+
+	res, err = Aggregate(coll.Documents.List, bsonkit.MustConvertList(bson.A{
+		bson.M{"$collStats": bson.M{
+			"latencyStats": bson.M{},
+		}},
+	}), &Aggregation{
+		Collection: coll,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), bsonkit.Get(res[0], "latencyStats.reads.ops"))
+
+	_, err = Aggregate(coll.Documents.List, bsonkit.MustConvertList(bson.A{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$collStats": bson.M{}},
+	}), &Aggregation{
+		Collection: coll,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$collStats is only valid as the first stage in a pipeline", err.Error())
+
+	_, err = Aggregate(coll.Documents.List, bsonkit.MustConvertList(bson.A{
+		bson.M{"$collStats": bson.M{"storageStats": bson.M{"scale": int32(0)}}},
+	}), &Aggregation{
+		Collection: coll,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$collStats: scale must be a positive integer", err.Error())
+}
+
+func TestAggregateIndexStats(t *testing.T) {
+	coll := NewCollection(true)
+	_, err := coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "foo"}))
+	assert.NoError(t, err)
+
+	_, err = coll.CreateIndex("a_1", IndexConfig{
+		Key:    bsonkit.MustConvert(bson.M{"a": int32(1)}),
+		Unique: true,
+	})
+	assert.NoError(t, err)
+
+	_, err = coll.Lookup("a", bson.A{"foo"})
+	assert.NoError(t, err)
+
+	_, err = coll.Lookup("a", bson.A{"bar"})
+	assert.NoError(t, err)
+
+	res, err := Aggregate(coll.Documents.List, bsonkit.MustConvertList(bson.A{
+		bson.M{"$indexStats": bson.M{}},
+		bson.M{"$project": bson.D{
+			{Key: "name", Value: 1},
+			{Key: "key", Value: 1},
+			{Key: "spec", Value: 1},
+			{Key: "ops", Value: "$accesses.ops"},
+		}},
+	}), &Aggregation{
+		Collection: coll,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		&bson.D{
+			{Key: "name", Value: "_id_"},
+			{Key: "key", Value: bson.D{{Key: "_id", Value: int32(1)}}},
+			{Key: "spec", Value: bson.D{
+				{Key: "v", Value: int32(2)},
+				{Key: "key", Value: bson.D{{Key: "_id", Value: int32(1)}}},
+				{Key: "name", Value: "_id_"},
+				{Key: "unique", Value: true},
+			}},
+			{Key: "ops", Value: int64(0)},
+		},
+		&bson.D{
+			{Key: "name", Value: "a_1"},
+			{Key: "key", Value: bson.D{{Key: "a", Value: int32(1)}}},
+			{Key: "spec", Value: bson.D{
+				{Key: "v", Value: int32(2)},
+				{Key: "key", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				{Key: "name", Value: "a_1"},
+				{Key: "unique", Value: true},
+			}},
+			{Key: "ops", Value: int64(2)},
+		},
+	}, res)
+
+	clone := coll.Clone()
+	_, err = clone.Lookup("a", bson.A{"foo"})
+	assert.NoError(t, err)
+
+	ops, _ := coll.Indexes["a_1"].Accesses()
+	assert.Equal(t, int64(3), ops)
+}
+
+func TestAggregateDocuments(t *testing.T) {
+	res, err := Aggregate(nil, bsonkit.MustConvertList(bson.A{
+		bson.M{"$documents": bson.A{
+			bson.M{"a": int32(1)},
+			bson.M{"a": int32(2)},
+		}},
+		bson.M{"$match": bson.M{"a": bson.M{"$gt": int32(1)}}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"a": int32(2)}),
+	}, res)
+
+	_, err = Aggregate(nil, bsonkit.MustConvertList(bson.A{
+		bson.M{"$documents": "foo"},
+	}), nil)
+	assert.Error(t, err)
+	assert.Equal(t, "$documents: the argument must evaluate to an array of documents", err.Error())
+
+	_, err = Aggregate(nil, bsonkit.MustConvertList(bson.A{
+		bson.M{"$currentOp": bson.M{}},
+	}), nil)
+	assert.Error(t, err)
+	assert.Equal(t, "$currentOp: operations are not available in this context", err.Error())
+
+	assert.True(t, IsCollectionless(bsonkit.MustConvertList(bson.A{
+		bson.M{"$documents": bson.A{}},
+	})))
+	assert.False(t, IsCollectionless(bsonkit.MustConvertList(bson.A{
+		bson.M{"$collStats": bson.M{}},
+	})))
+}
+
+func TestReferences(t *testing.T) {
+	refs := References(bsonkit.MustConvertList(bson.A{
+		bson.M{"$lookup": bson.M{
+			"from": bson.M{"db": "admin", "coll": "system.users"},
+			"as":   "users",
+		}},
+		bson.M{"$graphLookup": bson.M{
+			"from": "graph",
+		}},
+		bson.M{"$unionWith": "union"},
+		bson.M{"$unionWith": bson.M{
+			"coll": "outer",
+			"pipeline": bson.A{
+				bson.M{"$lookup": bson.M{
+					"from": bson.M{"db": "other", "coll": "inner"},
+					"pipeline": bson.A{
+						bson.M{"$unionWith": bson.M{"coll": "deep"}},
+					},
+				}},
+			},
+		}},
+		bson.M{"$facet": bson.M{
+			"a": bson.A{
+				bson.M{"$lookup": bson.M{"from": "faceted"}},
+			},
+		}},
+		bson.M{"$merge": bson.M{"into": bson.M{"db": "secret", "coll": "merged"}}},
+	}))
+	assert.Equal(t, []Reference{
+		{DB: "admin", Coll: "system.users"},
+		{Coll: "graph"},
+		{Coll: "union"},
+		{Coll: "outer"},
+		{DB: "other", Coll: "inner"},
+		{Coll: "deep"},
+		{Coll: "faceted"},
+		{DB: "secret", Coll: "merged", Write: true},
+	}, refs)
+
+	refs = References(bsonkit.MustConvertList(bson.A{
+		bson.M{"$out": "out"},
+	}))
+	assert.Equal(t, []Reference{
+		{Coll: "out", Write: true},
+	}, refs)
+
+	refs = References(bsonkit.MustConvertList(bson.A{
+		bson.M{"$out": bson.M{"db": "secret", "coll": "out"}},
+	}))
+	assert.Equal(t, []Reference{
+		{DB: "secret", Coll: "out", Write: true},
+	}, refs)
+
+	refs = References(bsonkit.MustConvertList(bson.A{
+		bson.M{"$merge": "merged"},
+	}))
+	assert.Equal(t, []Reference{
+		{Coll: "merged", Write: true},
+	}, refs)
+}
@@ -0,0 +1,798 @@
+package mongokit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register window stage
+	AggregationStages["$setWindowFields"] = stageSetWindowFields
+
+	// register window operators
+	windowOperators["$rank"] = windowRank
+	windowOperators["$denseRank"] = windowRank
+	windowOperators["$documentNumber"] = windowRank
+	windowOperators["$shift"] = windowShift
+	windowOperators["$derivative"] = windowDerivativeIntegral
+	windowOperators["$integral"] = windowDerivativeIntegral
+	windowOperators["$expMovingAvg"] = windowExpMovingAvg
+	windowOperators["$covariancePop"] = windowCovariance
+	windowOperators["$covarianceSamp"] = windowCovariance
+	windowOperators["$locf"] = windowLocf
+	windowOperators["$linearFill"] = windowLinearFill
+}
+
+// windowPartition is a sorted partition of documents processed by the
+// $setWindowFields stage.
+type windowPartition struct {
+	agg     *Aggregation
+	list    bsonkit.List
+	columns []bsonkit.Column
+	bounds  [][2]int
+}
+
+// windowOperator computes the values of an output field for all documents of a
+// partition. The bounds of the partition contain the half-open window of every
+// document if the operator supports windows.
+type windowOperator func(p *windowPartition, name string, args interface{}) ([]interface{}, error)
+
+// the window operators in addition to the group accumulators
+var windowOperators = map[string]windowOperator{}
+
+// the operators that do not support windows
+var windowlessOperators = map[string]bool{
+	"$rank":           true,
+	"$denseRank":      true,
+	"$documentNumber": true,
+	"$shift":          true,
+	"$expMovingAvg":   true,
+	"$locf":           true,
+	"$linearFill":     true,
+}
+
+// the operators that require a sortBy field
+var sortedWindowOperators = map[string]bool{
+	"$rank":           true,
+	"$denseRank":      true,
+	"$documentNumber": true,
+	"$shift":          true,
+	"$expMovingAvg":   true,
+	"$derivative":     true,
+	"$integral":       true,
+	"$linearFill":     true,
+}
+
+// windowOutput is a parsed output field of the $setWindowFields stage.
+type windowOutput struct {
+	path   string
+	op     string
+	args   interface{}
+	window bson.D
+}
+
+func stageSetWindowFields(agg *Aggregation, list bsonkit.List, name string, spec interface{}) (bsonkit.List, error) {
+	// get fields
+	fields, err := evalObject(name, spec, []string{"output"}, "partitionBy", "sortBy")
+	if err != nil {
+		return nil, err
+	}
+
+	// get sort
+	var sortBy bsonkit.Doc
+	var columns []bsonkit.Column
+	if value, ok := fields["sortBy"]; ok {
+		doc, ok := value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'sortBy' must be a document", name)
+		}
+		sortBy = &doc
+		columns, err = Columns(sortBy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	// get outputs
+	doc, ok := fields["output"].(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: 'output' must be a document", name)
+	}
+	outputs := make([]windowOutput, 0, len(doc))
+	for _, field := range doc {
+		// check operator
+		spec, ok := field.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: the field '%s' must be an object", name, field.Key)
+		}
+		output := windowOutput{path: field.Key}
+		for _, el := range spec {
+			if el.Key == "window" {
+				output.window, ok = el.Value.(bson.D)
+				if !ok {
+					return nil, fmt.Errorf("%s: 'window' field must be an object", name)
+				}
+			} else if output.op == "" {
+				output.op = el.Key
+				output.args = el.Value
+			} else {
+				return nil, fmt.Errorf("%s: two operators specified for field '%s'", name, field.Key)
+			}
+		}
+
+		// check operator
+		if output.op == "" {
+			return nil, fmt.Errorf("%s: expected a window function for field '%s'", name, field.Key)
+		} else if windowOperators[output.op] == nil && GroupAccumulators[output.op] == nil {
+			return nil, fmt.Errorf("%s: unrecognized window function, %s", name, output.op)
+		} else if windowlessOperators[output.op] && output.window != nil {
+			return nil, fmt.Errorf("%s: %s does not accept a 'window' field", name, output.op)
+		} else if output.op == "$derivative" && output.window == nil {
+			return nil, fmt.Errorf("%s: $derivative requires an explicit window", name)
+		}
+
+		// check sort
+		if sortedWindowOperators[output.op] && len(columns) == 0 {
+			return nil, fmt.Errorf("%s: %s requires a sortBy", name, output.op)
+		} else if (output.op == "$rank" || output.op == "$denseRank" || output.op == "$derivative" || output.op == "$integral" || output.op == "$linearFill") && len(columns) != 1 {
+			return nil, fmt.Errorf("%s: %s requires a sortBy with exactly one field", name, output.op)
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	// get partitions
+	partitions := []bsonkit.List{list}
+	if expr, ok := fields["partitionBy"]; ok {
+		_, partitions, err = groupList(agg, list, expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// process partitions
+	result := make(bsonkit.List, 0, len(list))
+	for _, partition := range partitions {
+		// sort partition
+		if sortBy != nil {
+			partition, err = Sort(partition, sortBy)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// clone documents
+		docs := bsonkit.CloneList(partition)
+
+		// compute outputs
+		for _, output := range outputs {
+			// prepare partition
+			p := &windowPartition{
+				agg:     agg,
+				list:    partition,
+				columns: columns,
+			}
+
+			// compute bounds
+			if !windowlessOperators[output.op] {
+				p.bounds, err = windowBounds(name, p, output.window)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// compute values
+			var values []interface{}
+			if fn := windowOperators[output.op]; fn != nil {
+				values, err = fn(p, output.op, output.args)
+			} else {
+				values, err = p.accumulate(output.op, output.args)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// set values
+			for i, doc := range docs {
+				value := values[i]
+				if value == bsonkit.Missing {
+					value = nil
+				}
+				_, err = bsonkit.Put(doc, output.path, value, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		result = append(result, docs...)
+	}
+
+	return result, nil
+}
+
+// windowBounds computes the half-open window of every document in the
+// partition. Without a window specification the whole partition is used.
+func windowBounds(name string, p *windowPartition, window bson.D) ([][2]int, error) {
+	// prepare bounds
+	n := len(p.list)
+	bounds := make([][2]int, n)
+	for i := range bounds {
+		bounds[i] = [2]int{0, n}
+	}
+
+	// handle default
+	if window == nil {
+		return bounds, nil
+	}
+
+	// get fields
+	fields, err := evalObject(name, window, nil, "documents", "range", "unit")
+	if err != nil {
+		return nil, err
+	}
+
+	// get unit
+	var unit string
+	if value, ok := fields["unit"]; ok {
+		unit, err = getUnit(name, value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fields["range"]; !ok {
+			return nil, fmt.Errorf("%s: 'unit' may only be used with a 'range' window", name)
+		}
+	}
+
+	// get bounds
+	docs, hasDocs := fields["documents"]
+	rng, hasRange := fields["range"]
+	if hasDocs && hasRange {
+		return nil, fmt.Errorf("%s: window bounds can only specify one of 'documents' or 'range'", name)
+	} else if !hasDocs && !hasRange {
+		return nil, fmt.Errorf("%s: window bounds must specify 'documents' or 'range'", name)
+	} else if hasDocs {
+		lower, upper, err := windowBound(name, "documents", docs)
+		if err != nil {
+			return nil, err
+		}
+
+		// convert bounds
+		lo, lok := toExactInt64(lower)
+		if lower == "current" {
+			lo, lok = 0, true
+		}
+		hi, hok := toExactInt64(upper)
+		if upper == "current" {
+			hi, hok = 0, true
+		}
+		if (lower != "unbounded" && !lok) || (upper != "unbounded" && !hok) {
+			return nil, fmt.Errorf("%s: numeric document-based bounds must be an integer", name)
+		} else if lok && hok && lo > hi {
+			return nil, fmt.Errorf("%s: lower bound must not exceed upper bound", name)
+		} else if lower == "unbounded" && upper == "unbounded" {
+			return bounds, nil
+		} else if len(p.columns) == 0 {
+			return nil, fmt.Errorf("%s: document-based bounds require a sortBy", name)
+		}
+
+		// compute bounds
+		for i := range bounds {
+			start, end := 0, n
+			if lower != "unbounded" {
+				start = i + int(lo)
+			}
+			if upper != "unbounded" {
+				end = i + int(hi) + 1
+			}
+			bounds[i] = clampBounds(start, end, n)
+		}
+
+		return bounds, nil
+	}
+
+	// get range
+	lower, upper, err := windowBound(name, "range", rng)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.columns) != 1 {
+		return nil, fmt.Errorf("%s: range-based bounds require a sortBy with exactly one field", name)
+	}
+
+	// check bounds
+	for _, bound := range []interface{}{lower, upper} {
+		if bound == "unbounded" || bound == "current" {
+			continue
+		} else if !isNumeric(bound) {
+			return nil, fmt.Errorf("%s: range-based bounds must be 'unbounded', 'current' or a number", name)
+		} else if _, ok := toExactInt64(bound); unit != "" && !ok {
+			return nil, fmt.Errorf("%s: range-based bounds with a unit must be an integer", name)
+		}
+	}
+	if isNumeric(lower) && isNumeric(upper) && compareValues(lower, upper) > 0 {
+		return nil, fmt.Errorf("%s: lower bound must not exceed upper bound", name)
+	}
+
+	// get sort values
+	column := p.columns[0]
+	values := make([]interface{}, n)
+	for i, doc := range p.list {
+		value := bsonkit.Get(doc, column.Path)
+		if unit != "" {
+			t, err := toTime(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid range: expected the sortBy field to be a date", name)
+			}
+			value = t
+		} else if !isNumeric(value) {
+			return nil, fmt.Errorf("%s: invalid range: expected the sortBy field to be a number", name)
+		}
+		values[i] = value
+	}
+
+	// prepare check
+	direction := 1
+	if column.Reverse {
+		direction = -1
+	}
+	within := func(value, base, bound interface{}, isUpper bool) bool {
+		// handle unbounded
+		if bound == "unbounded" {
+			return true
+		} else if bound == "current" {
+			bound = int32(0)
+		}
+
+		// compute difference
+		var diff int
+		if unit != "" {
+			amount, _ := toExactInt64(bound)
+			limit := addDate(base.(time.Time), unit, amount*int64(direction))
+			diff = compareTimes(value.(time.Time), limit) * direction
+		} else {
+			offset := multiplyNumbers(bound, int32(direction))
+			diff = compareValues(value, addNumbers(base, offset)) * direction
+		}
+		if isUpper {
+			return diff <= 0
+		}
+
+		return diff >= 0
+	}
+
+	// compute bounds (the windows are contiguous in the sorted partition)
+	for i := range bounds {
+		start, end := n, n
+		for j := 0; j < n; j++ {
+			if within(values[j], values[i], lower, false) && within(values[j], values[i], upper, true) {
+				if start == n {
+					start = j
+				}
+				end = j + 1
+			}
+		}
+		bounds[i] = clampBounds(start, end, n)
+	}
+
+	return bounds, nil
+}
+
+// windowBound returns the lower and upper bound of a window specification.
+func windowBound(name, kind string, v interface{}) (interface{}, interface{}, error) {
+	// check array
+	array, ok := v.(bson.A)
+	if !ok || len(array) != 2 {
+		return nil, nil, fmt.Errorf("%s: window bounds must be a 2-element array", name)
+	}
+
+	// check values
+	for _, bound := range array {
+		if str, ok := bound.(string); ok && str != "unbounded" && str != "current" {
+			return nil, nil, fmt.Errorf("%s: %s-based bounds must be 'unbounded', 'current' or a number", name, kind)
+		} else if !ok && !isNumeric(bound) {
+			return nil, nil, fmt.Errorf("%s: %s-based bounds must be 'unbounded', 'current' or a number", name, kind)
+		}
+	}
+
+	return array[0], array[1], nil
+}
+
+// clampBounds limits the half-open bounds to the partition size.
+func clampBounds(start, end, n int) [2]int {
+	if start < 0 {
+		start = 0
+	}
+	if end > n {
+		end = n
+	}
+	if start >= end {
+		return [2]int{0, 0}
+	}
+	return [2]int{start, end}
+}
+
+// compareTimes compares two times.
+func compareTimes(a, b time.Time) int {
+	if a.Before(b) {
+		return -1
+	} else if a.After(b) {
+		return 1
+	}
+	return 0
+}
+
+// window returns the documents in the window of the specified document.
+func (p *windowPartition) window(i int) bsonkit.List {
+	return p.list[p.bounds[i][0]:p.bounds[i][1]]
+}
+
+// accumulate computes the group accumulator for every window.
+func (p *windowPartition) accumulate(name string, args interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(p.list))
+	for i := range p.list {
+		value, err := GroupAccumulators[name](p.agg, p.window(i), name, args)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// evaluate evaluates the expression for every document in the partition.
+func (p *windowPartition) evaluate(expr interface{}) (bson.A, error) {
+	return accumulateValues(p.agg, p.list, expr)
+}
+
+func windowRank(p *windowPartition, name string, args interface{}) ([]interface{}, error) {
+	// check arguments
+	if doc, ok := args.(bson.D); !ok || len(doc) != 0 {
+		return nil, fmt.Errorf("%s: expected an empty object as the argument", name)
+	}
+
+	// compute ranks
+	values := make([]interface{}, len(p.list))
+	var rank, dense int64
+	var last interface{}
+	for i, doc := range p.list {
+		// handle document number
+		if name == "$documentNumber" {
+			values[i] = narrowInt(int64(i+1), true)
+			continue
+		}
+
+		// check sort value
+		value := bsonkit.Get(doc, p.columns[0].Path)
+		if i == 0 || bsonkit.Compare(value, last) != 0 {
+			rank = int64(i + 1)
+			dense++
+			last = value
+		}
+
+		// set rank
+		if name == "$rank" {
+			values[i] = narrowInt(rank, true)
+		} else {
+			values[i] = narrowInt(dense, true)
+		}
+	}
+
+	return values, nil
+}
+
+func windowShift(p *windowPartition, name string, args interface{}) ([]interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"output", "by"}, "default")
+	if err != nil {
+		return nil, err
+	}
+
+	// get offset
+	by, ok := toExactInt64(fields["by"])
+	if !ok {
+		return nil, fmt.Errorf("%s: 'by' field must be an integer", name)
+	}
+
+	// get default
+	def, err := p.agg.Evaluation(nil).Evaluate(fields["default"])
+	if err != nil {
+		return nil, err
+	} else if def == bsonkit.Missing {
+		def = nil
+	}
+
+	// compute values
+	values := make([]interface{}, len(p.list))
+	for i := range p.list {
+		j := i + int(by)
+		if j < 0 || j >= len(p.list) {
+			values[i] = def
+			continue
+		}
+		value, err := p.agg.Evaluation(p.list[j]).Evaluate(fields["output"])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+func windowDerivativeIntegral(p *windowPartition, name string, args interface{}) ([]interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input"}, "unit")
+	if err != nil {
+		return nil, err
+	}
+
+	// get unit
+	var unit time.Duration
+	if value, ok := fields["unit"]; ok {
+		str, err := getUnit(name, value)
+		if err != nil {
+			return nil, err
+		}
+		unit = dateUnits[str]
+		if str == "week" {
+			unit = 7 * 24 * time.Hour
+		} else if str == "day" {
+			unit = 24 * time.Hour
+		} else if unit == 0 {
+			return nil, fmt.Errorf("%s: unit must be 'week' or smaller", name)
+		}
+	}
+
+	// get inputs
+	inputs, err := p.evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get positions
+	positions := make([]float64, len(p.list))
+	for i, doc := range p.list {
+		value := bsonkit.Get(doc, p.columns[0].Path)
+		if unit != 0 {
+			t, err := toTime(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: the sortBy field must be a date if a unit is specified", name)
+			}
+			positions[i] = float64(t.UnixMilli()) / float64(unit.Milliseconds())
+		} else {
+			f, ok := toFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: the sortBy field must be a number if no unit is specified", name)
+			}
+			positions[i] = f
+		}
+	}
+
+	// compute values
+	values := make([]interface{}, len(p.list))
+	for i := range p.list {
+		start, end := p.bounds[i][0], p.bounds[i][1]
+
+		// check inputs
+		for j := start; j < end; j++ {
+			if !isNumeric(inputs[j]) {
+				return nil, fmt.Errorf("%s: the input must evaluate to a number, not %s", name, typeName(inputs[j]))
+			}
+		}
+
+		// handle derivative
+		if name == "$derivative" {
+			if end-start < 2 || positions[end-1] == positions[start] {
+				values[i] = nil
+				continue
+			}
+			y1, _ := toFloat(inputs[start])
+			y2, _ := toFloat(inputs[end-1])
+			values[i] = (y2 - y1) / (positions[end-1] - positions[start])
+			continue
+		}
+
+		// handle integral (trapezoidal rule)
+		if start == end {
+			values[i] = nil
+			continue
+		}
+		var sum float64
+		for j := start + 1; j < end; j++ {
+			y1, _ := toFloat(inputs[j-1])
+			y2, _ := toFloat(inputs[j])
+			sum += (positions[j] - positions[j-1]) * (y1 + y2) / 2
+		}
+		values[i] = sum
+	}
+
+	return values, nil
+}
+
+func windowExpMovingAvg(p *windowPartition, name string, args interface{}) ([]interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input"}, "N", "alpha")
+	if err != nil {
+		return nil, err
+	}
+
+	// get alpha
+	var alpha float64
+	_, hasN := fields["N"]
+	_, hasAlpha := fields["alpha"]
+	if hasN == hasAlpha {
+		return nil, fmt.Errorf("%s: must specify exactly one of 'N' or 'alpha'", name)
+	} else if hasN {
+		n, ok := toExactInt64(fields["N"])
+		if !ok || n <= 0 {
+			return nil, fmt.Errorf("%s: 'N' field must be a positive integer", name)
+		}
+		alpha = 2 / float64(n+1)
+	} else {
+		var ok bool
+		alpha, ok = toFloat(fields["alpha"])
+		if !ok || alpha <= 0 || alpha >= 1 {
+			return nil, fmt.Errorf("%s: 'alpha' must be a number between 0 and 1 (exclusive)", name)
+		}
+	}
+
+	// get inputs
+	inputs, err := p.evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// compute values
+	values := make([]interface{}, len(p.list))
+	var current interface{}
+	for i, input := range inputs {
+		// ignore non-numeric inputs
+		if !isNumeric(input) {
+			values[i] = current
+			continue
+		}
+
+		// update average
+		if current == nil {
+			current = input
+		} else if isDecimal(input) || isDecimal(current) {
+			a := decimal.NewFromFloat(alpha)
+			x, _ := toDecimal(input)
+			c, _ := toDecimal(current)
+			current = fromDecimal(x.Mul(a).Add(c.Mul(decimal.NewFromInt(1).Sub(a))))
+		} else {
+			x, _ := toFloat(input)
+			c, _ := toFloat(current)
+			current = x*alpha + c*(1-alpha)
+		}
+		values[i] = current
+	}
+
+	return values, nil
+}
+
+func windowCovariance(p *windowPartition, name string, args interface{}) ([]interface{}, error) {
+	// check arguments
+	array, ok := args.(bson.A)
+	if !ok || len(array) != 2 {
+		return nil, fmt.Errorf("%s: expected an array of two expressions", name)
+	}
+
+	// get inputs
+	xs, err := p.evaluate(array[0])
+	if err != nil {
+		return nil, err
+	}
+	ys, err := p.evaluate(array[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// compute values
+	values := make([]interface{}, len(p.list))
+	for i := range p.list {
+		// compute co-moment (Welford)
+		var count, meanX, meanY, c float64
+		for j := p.bounds[i][0]; j < p.bounds[i][1]; j++ {
+			if !isNumeric(xs[j]) || !isNumeric(ys[j]) {
+				continue
+			}
+			x, _ := toFloat(xs[j])
+			y, _ := toFloat(ys[j])
+			count++
+			dx := x - meanX
+			meanX += dx / count
+			meanY += (y - meanY) / count
+			c += dx * (y - meanY)
+		}
+
+		// compute covariance
+		if name == "$covarianceSamp" {
+			if count < 2 {
+				values[i] = nil
+			} else {
+				values[i] = c / (count - 1)
+			}
+		} else if count == 0 {
+			values[i] = nil
+		} else {
+			values[i] = c / count
+		}
+	}
+
+	return values, nil
+}
+
+func windowLocf(p *windowPartition, _ string, args interface{}) ([]interface{}, error) {
+	// get inputs
+	inputs, err := p.evaluate(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// carry last observation forward
+	values := make([]interface{}, len(p.list))
+	var last interface{}
+	for i, input := range inputs {
+		if !isNullish(input) {
+			last = input
+		}
+		values[i] = last
+	}
+
+	return values, nil
+}
+
+func windowLinearFill(p *windowPartition, name string, args interface{}) ([]interface{}, error) {
+	// get inputs
+	inputs, err := p.evaluate(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// get positions
+	positions := make([]float64, len(p.list))
+	for i, doc := range p.list {
+		value := bsonkit.Get(doc, p.columns[0].Path)
+		if t, err := toTime(name, value); err == nil {
+			positions[i] = float64(t.UnixMilli())
+		} else if f, ok := toFloat(value); ok {
+			positions[i] = f
+		} else {
+			return nil, fmt.Errorf("%s: the sortBy field must be a number or a date", name)
+		}
+	}
+
+	// interpolate values between observations
+	values := make([]interface{}, len(p.list))
+	last := -1
+	for i, input := range inputs {
+		// skip gaps
+		if isNullish(input) {
+			continue
+		} else if !isNumeric(input) {
+			return nil, fmt.Errorf("%s: the input must evaluate to a number, not %s", name, typeName(input))
+		}
+
+		// set value
+		values[i] = input
+
+		// fill gap
+		if last >= 0 && i-last > 1 && positions[i] != positions[last] {
+			y1, _ := toFloat(inputs[last])
+			y2, _ := toFloat(input)
+			for j := last + 1; j < i; j++ {
+				values[j] = y1 + (y2-y1)*(positions[j]-positions[last])/(positions[i]-positions[last])
+			}
+		}
+		last = i
+	}
+
+	return values, nil
+}
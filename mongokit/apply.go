@@ -56,7 +56,7 @@ func (c *Changes) Record(path string, val interface{}) error {
 	// check if path conflicts with another recorded change
 	node, rest := c.pathTree.Lookup(path)
 	if node.Load() == true || rest == bsonkit.PathEnd {
-		return fmt.Errorf("conflicting key %q", path)
+		return ConflictingUpdateOperators.Errorf("conflicting key %q", path)
 	}
 
 	// add path to tree
@@ -3,6 +3,8 @@ package mongokit
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -43,9 +45,13 @@ type Result struct {
 // collection that offers basic CRUD capabilities. The collection is not safe
 // from concurrent access and does not roll back changes on errors. Therefore,
 // the recommended approach is to clone the collection before making changes.
+//
+// The BSON size of the documents is maintained incrementally. Therefore, the
+// documents should only be modified using the collection methods.
 type Collection struct {
 	Documents *bsonkit.Set
 	Indexes   map[string]*Index
+	size      int64
 }
 
 // NewCollection will create and return a new collection.
@@ -75,6 +81,9 @@ func NewCollection(idIndex bool) *Collection {
 
 // Find will look up the documents that match the specified query.
 func (c *Collection) Find(query, sort bsonkit.Doc, skip, limit int) (*Result, error) {
+	// count index access
+	c.access(query, sort)
+
 	// get documents
 	list := c.Documents.List
 
@@ -110,6 +119,114 @@ func (c *Collection) Find(query, sort bsonkit.Doc, skip, limit int) (*Result, er
 	}, nil
 }
 
+// Lookup will return the documents in which the value at the specified path
+// equals one of the specified values using the semantics of the $in query
+// operator. An index on the path is used if available. The documents are
+// returned in their natural order.
+func (c *Collection) Lookup(path string, values bson.A) (bsonkit.List, error) {
+	// prepare query
+	query := bsonkit.MustConvert(bson.M{
+		path: bson.M{"$in": values},
+	})
+
+	// find usable index
+	var index *Index
+	for _, idx := range c.Indexes {
+		if idx.config.Partial == nil && idx.columns[0].Path == path {
+			index = idx
+			break
+		}
+	}
+
+	// regular expressions and arrays cannot be looked up using an index
+	for _, value := range values {
+		switch value.(type) {
+		case primitive.Regex, bson.A:
+			index = nil
+		}
+	}
+
+	// scan collection if no index is available
+	if index == nil {
+		return Filter(c.Documents.List, query, 0)
+	}
+
+	// count access
+	index.access()
+
+	// collect candidates
+	seen := map[bsonkit.Doc]bool{}
+	var list bsonkit.List
+	for _, value := range values {
+		for _, doc := range index.base.Lookup(value) {
+			if !seen[doc] {
+				seen[doc] = true
+				list = append(list, doc)
+			}
+		}
+	}
+
+	// restore natural order
+	sort.Slice(list, func(i, j int) bool {
+		return c.Documents.Index[list[i]] < c.Documents.Index[list[j]]
+	})
+
+	return Filter(list, query, 0)
+}
+
+// access will count an access of the index that MongoDB would use to run an
+// operation with the specified query and sort. This is the index with the
+// longest key prefix that is constrained by top level conditions of the query
+// or otherwise the index that provides the sort order. The documents are still
+// scanned.
+func (c *Collection) access(query, sort bsonkit.Doc) {
+	// collect query fields
+	fields := map[string]bool{}
+	if query != nil {
+		for _, exp := range *query {
+			if !strings.HasPrefix(exp.Key, "$") {
+				fields[exp.Key] = true
+			}
+		}
+	}
+
+	// find index with the longest constrained prefix
+	var name string
+	var best int
+	for key, index := range c.Indexes {
+		// skip partial indexes
+		if index.config.Partial != nil {
+			continue
+		}
+
+		// count constrained columns
+		var prefix int
+		for _, column := range index.columns {
+			if !fields[column.Path] {
+				break
+			}
+			prefix++
+		}
+		if prefix > best || (prefix > 0 && prefix == best && key < name) {
+			name, best = key, prefix
+		}
+	}
+
+	// otherwise, find index that provides the sort order
+	if name == "" && sort != nil && len(*sort) > 0 {
+		for key, index := range c.Indexes {
+			if index.config.Partial == nil && index.columns[0].Path == (*sort)[0].Key && (name == "" || key < name) {
+				name = key
+			}
+		}
+	}
+
+	// count access
+	if name != "" {
+		c.Indexes[name].access()
+	}
+}
+
 // Insert will add the specified document to the collection.
 func (c *Collection) Insert(doc bsonkit.Doc) (*Result, error) {
 	// ensure object id
@@ -126,7 +243,7 @@ func (c *Collection) Insert(doc bsonkit.Doc) (*Result, error) {
 		if err != nil {
 			return nil, err
 		} else if !ok {
-			return nil, fmt.Errorf("duplicate document for index %q", name)
+			return nil, DuplicateKey.Errorf("duplicate document for index %q", name)
 		}
 	}
 
@@ -135,6 +252,9 @@ func (c *Collection) Insert(doc bsonkit.Doc) (*Result, error) {
 		return nil, fmt.Errorf("unable to add document to collection")
 	}
 
+	// update size
+	c.size += docSize(doc)
+
 	return &Result{
 		Modified: bsonkit.List{doc},
 	}, nil
@@ -143,6 +263,9 @@ func (c *Collection) Insert(doc bsonkit.Doc) (*Result, error) {
 // Replace will look up the first document that matches the query and if found
 // replace it with the specified document.
 func (c *Collection) Replace(query, repl, sort bsonkit.Doc) (*Result, error) {
+	// count index access
+	c.access(query, sort)
+
 	// get documents
 	list := c.Documents.List
 
@@ -174,7 +297,7 @@ func (c *Collection) Replace(query, repl, sort bsonkit.Doc) (*Result, error) {
 			return nil, err
 		}
 	} else if replID != bsonkit.Get(list[0], "_id") {
-		return nil, fmt.Errorf("document _id is immutable")
+		return nil, ImmutableField.Errorf("document _id is immutable")
 	}
 
 	// update indexes
@@ -192,7 +315,7 @@ func (c *Collection) Replace(query, repl, sort bsonkit.Doc) (*Result, error) {
 		if err != nil {
 			return nil, err
 		} else if !ok {
-			return nil, fmt.Errorf("duplicate document for index %q", name)
+			return nil, DuplicateKey.Errorf("duplicate document for index %q", name)
 		}
 	}
 
@@ -201,6 +324,9 @@ func (c *Collection) Replace(query, repl, sort bsonkit.Doc) (*Result, error) {
 		return nil, fmt.Errorf("unable to replace document in collection")
 	}
 
+	// update size
+	c.size += docSize(repl) - docSize(list[0])
+
 	// only count the doc as modified if its BSON bytes actually changed; a
 	// replace with a byte-identical document yields ModifiedCount=0 in MongoDB
 	var modified bsonkit.List
@@ -215,8 +341,11 @@ func (c *Collection) Replace(query, repl, sort bsonkit.Doc) (*Result, error) {
 }
 
 // Update will look up all documents that match the specified query and update
-// them according to the update document.
-func (c *Collection) Update(query, update, sort bsonkit.Doc, skip, limit int, arrayFilters bsonkit.List) (*Result, error) {
+// them according to the update document or update pipeline.
+func (c *Collection) Update(query bsonkit.Doc, update interface{}, sort bsonkit.Doc, skip, limit int, arrayFilters bsonkit.List) (*Result, error) {
+	// count index access
+	c.access(query, sort)
+
 	// get documents
 	list := c.Documents.List
 
@@ -264,7 +393,7 @@ func (c *Collection) Update(query, update, sort bsonkit.Doc, skip, limit int, ar
 	// check ids
 	for i, doc := range newList {
 		if bsonkit.Get(doc, "_id") != bsonkit.Get(list[i], "_id") {
-			return nil, fmt.Errorf("document _id is immutable")
+			return nil, ImmutableField.Errorf("document _id is immutable")
 		}
 	}
 
@@ -287,7 +416,7 @@ func (c *Collection) Update(query, update, sort bsonkit.Doc, skip, limit int, ar
 			if err != nil {
 				return nil, err
 			} else if !ok {
-				return nil, fmt.Errorf("duplicate document for index %q", name)
+				return nil, DuplicateKey.Errorf("duplicate document for index %q", name)
 			}
 		}
 	}
@@ -297,6 +426,9 @@ func (c *Collection) Update(query, update, sort bsonkit.Doc, skip, limit int, ar
 		if !c.Documents.Replace(list[i], doc) {
 			return nil, fmt.Errorf("unable to replace document in collection")
 		}
+
+		// update size
+		c.size += docSize(doc) - docSize(list[i])
 	}
 
 	// only include actually-modified docs in Modified/Changes (matches
@@ -320,8 +452,8 @@ func (c *Collection) Update(query, update, sort bsonkit.Doc, skip, limit int, ar
 }
 
 // Upsert will insert a document based on the specified query and either the
-// replacement document or update document.
-func (c *Collection) Upsert(query, repl, update bsonkit.Doc, arrayFilters bsonkit.List) (*Result, error) {
+// replacement document or update document (or update pipeline).
+func (c *Collection) Upsert(query, repl bsonkit.Doc, update interface{}, arrayFilters bsonkit.List) (*Result, error) {
 	// extract query
 	doc, err := Extract(query)
 	if err != nil {
@@ -365,7 +497,7 @@ func (c *Collection) Upsert(query, repl, update bsonkit.Doc, arrayFilters bsonki
 
 	// apply update if present
 	if update != nil {
-		_, err = Apply(doc, query, update, true, arrayFilters)
+		_, err = applyUpdate(doc, query, update, true, arrayFilters)
 		if err != nil {
 			return nil, err
 		}
@@ -385,7 +517,7 @@ func (c *Collection) Upsert(query, repl, update bsonkit.Doc, arrayFilters bsonki
 		if err != nil {
 			return nil, err
 		} else if !ok {
-			return nil, fmt.Errorf("duplicate document for index %q", name)
+			return nil, DuplicateKey.Errorf("duplicate document for index %q", name)
 		}
 	}
 
@@ -394,6 +526,9 @@ func (c *Collection) Upsert(query, repl, update bsonkit.Doc, arrayFilters bsonki
 		return nil, fmt.Errorf("unable to add document to collection")
 	}
 
+	// update size
+	c.size += docSize(doc)
+
 	return &Result{
 		Upserted: doc,
 	}, nil
@@ -401,6 +536,9 @@ func (c *Collection) Upsert(query, repl, update bsonkit.Doc, arrayFilters bsonki
 
 // Delete will remove all documents that match the specified query.
 func (c *Collection) Delete(query, sort bsonkit.Doc, skip, limit int) (*Result, error) {
+	// count index access
+	c.access(query, sort)
+
 	// get documents
 	list := c.Documents.List
 
@@ -431,14 +569,27 @@ func (c *Collection) Delete(query, sort bsonkit.Doc, skip, limit int) (*Result,
 		list = list[skip:]
 	}
 
+	// remove documents
+	err = c.Remove(list)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Matched: list,
+	}, nil
+}
+
+// Remove will remove the specified documents from the collection.
+func (c *Collection) Remove(list bsonkit.List) error {
 	// update indexes
 	for _, doc := range list {
 		for name, index := range c.Indexes {
 			ok, err := index.Remove(doc)
 			if err != nil {
-				return nil, err
+				return err
 			} else if !ok {
-				return nil, fmt.Errorf("unable to remove document from index %q", name)
+				return fmt.Errorf("unable to remove document from index %q", name)
 			}
 		}
 	}
@@ -446,13 +597,14 @@ func (c *Collection) Delete(query, sort bsonkit.Doc, skip, limit int) (*Result,
 	// remove documents
 	for _, doc := range list {
 		if !c.Documents.Remove(doc) {
-			return nil, fmt.Errorf("unable to remove document from collection")
+			return fmt.Errorf("unable to remove document from collection")
 		}
+
+		// update size
+		c.size -= docSize(doc)
 	}
 
-	return &Result{
-		Matched: list,
-	}, nil
+	return nil
 }
 
 // CreateIndex will create and build an index based on the specified
@@ -480,7 +632,7 @@ func (c *Collection) CreateIndex(name string, config IndexConfig) (string, error
 	// check duplicate
 	for name, index := range c.Indexes {
 		if bsonkit.Compare(*config.Key, *index.Config().Key) == 0 {
-			return "", fmt.Errorf("existing index %q has same key", name)
+			return "", IndexOptionsConflict.Errorf("existing index %q has same key", name)
 		}
 	}
 
@@ -498,7 +650,7 @@ func (c *Collection) CreateIndex(name string, config IndexConfig) (string, error
 	if err != nil {
 		return "", err
 	} else if !ok {
-		return "", fmt.Errorf("duplicate document for index %q", name)
+		return "", DuplicateKey.Errorf("duplicate document for index %q", name)
 	}
 
 	return name, nil
@@ -514,7 +666,7 @@ func (c *Collection) DropIndex(name string) ([]string, error) {
 	if name != "" {
 		// check existence
 		if _, ok := c.Indexes[name]; !ok {
-			return nil, fmt.Errorf("missing index %q", name)
+			return nil, IndexNotFound.Errorf("missing index %q", name)
 		}
 
 		// drop index
@@ -540,12 +692,45 @@ func (c *Collection) DropIndex(name string) ([]string, error) {
 	return dropped, nil
 }
 
+// Size will return the BSON size of the documents in bytes.
+func (c *Collection) Size() int64 {
+	return c.size
+}
+
+// ComputeSize will recompute the BSON size of the documents. It must be called
+// after the documents have been assigned directly.
+func (c *Collection) ComputeSize() {
+	c.size = 0
+	for _, doc := range c.Documents.List {
+		c.size += docSize(doc)
+	}
+}
+
+// IndexSize will return the estimated size of all indexes in bytes.
+func (c *Collection) IndexSize() int64 {
+	var size int64
+	for _, index := range c.Indexes {
+		size += index.Size()
+	}
+	return size
+}
+
+// docSize returns the BSON encoded size of the document.
+func docSize(doc bsonkit.Doc) int64 {
+	bytes, err := bson.Marshal(doc)
+	if err != nil {
+		return 0
+	}
+	return int64(len(bytes))
+}
+
 // Clone will clone the collection.
 func (c *Collection) Clone() *Collection {
 	// create new collection
 	clone := &Collection{
 		Documents: c.Documents.Clone(),
 		Indexes:   map[string]*Index{},
+		size:      c.size,
 	}
 
 	// clone indexes
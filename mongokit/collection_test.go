@@ -0,0 +1,228 @@
+package mongokit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func collectionSize(coll *Collection) int64 {
+	var size int64
+	for _, doc := range coll.Documents.List {
+		size += docSize(doc)
+	}
+	return size
+}
+
+func TestCollectionSize(t *testing.T) {
+	coll := NewCollection(true)
+	assert.Equal(t, int64(0), coll.Size())
+	assert.Equal(t, int64(0), coll.IndexSize())
+
+	// insert
+	for i := 0; i < 3; i++ {
+		_, err := coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(i), "foo": "bar"}))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, collectionSize(coll), coll.Size())
+	assert.Equal(t, int64(3*14), coll.IndexSize())
+
+	// update
+	_, err := coll.Update(bsonkit.MustConvert(bson.M{}), bsonkit.MustConvert(bson.M{
+		"$set": bson.M{"foo": "bar baz qux"},
+	}), nil, 0, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, collectionSize(coll), coll.Size())
+
+	// replace
+	_, err = coll.Replace(bsonkit.MustConvert(bson.M{"_id": int32(1)}), bsonkit.MustConvert(bson.M{
+		"foo": "quz",
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, collectionSize(coll), coll.Size())
+
+	// upsert
+	_, err = coll.Upsert(bsonkit.MustConvert(bson.M{"_id": int32(3)}), nil, bsonkit.MustConvert(bson.M{
+		"$set": bson.M{"foo": "bar"},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, collectionSize(coll), coll.Size())
+	assert.Equal(t, int64(4*14), coll.IndexSize())
+
+	// clone
+	clone := coll.Clone()
+	assert.Equal(t, coll.Size(), clone.Size())
+	assert.Equal(t, coll.IndexSize(), clone.IndexSize())
+
+	// delete
+	_, err = clone.Delete(bsonkit.MustConvert(bson.M{"_id": bson.M{"$gt": int32(1)}}), nil, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, collectionSize(clone), clone.Size())
+	assert.Equal(t, int64(2*14), clone.IndexSize())
+	assert.Equal(t, collectionSize(coll), coll.Size())
+
+	// compute
+	size := coll.Size()
+	coll.Documents = bsonkit.NewSet(coll.Documents.List)
+	coll.ComputeSize()
+	assert.Equal(t, size, coll.Size())
+
+	// remove
+	err = clone.Remove(append(bsonkit.List{}, clone.Documents.List...))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), clone.Size())
+	assert.Equal(t, int64(0), clone.IndexSize())
+}
+
+func TestCollectionValidate(t *testing.T) {
+	coll := NewCollection(true)
+
+	_, err := coll.CreateIndex("", IndexConfig{
+		Key:     bsonkit.MustConvert(bson.M{"foo": int32(1)}),
+		Partial: bsonkit.MustConvert(bson.M{"foo": bson.M{"$exists": true}}),
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(i)}))
+		assert.NoError(t, err)
+	}
+	_, err = coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(3), "foo": "bar"}))
+	assert.NoError(t, err)
+
+	val := coll.Validate(true)
+	assert.True(t, val.Valid())
+	assert.Equal(t, &Validation{
+		Records: 4,
+		Keys: map[string]int64{
+			"_id_":  4,
+			"foo_1": 1,
+		},
+	}, val)
+
+	// missing index entry
+	clone := coll.Clone()
+	clone.Indexes["foo_1"].base.Remove(clone.Documents.List[3])
+	val = clone.Validate(false)
+	assert.False(t, val.Valid())
+	assert.Equal(t, []string{"foo_1"}, val.InvalidIndexes)
+
+	// oversize document
+	clone = coll.Clone()
+	_, err = clone.Insert(&bson.D{
+		{Key: "_id", Value: int32(4)},
+		{Key: "data", Value: strings.Repeat("x", MaxDocumentSize)},
+	})
+	assert.NoError(t, err)
+	val = clone.Validate(true)
+	assert.False(t, val.Valid())
+	assert.Equal(t, int64(1), val.InvalidDocuments)
+
+	// modified document
+	clone = coll.Clone()
+	*clone.Documents.List[0] = bson.D{{Key: "_id", Value: int32(7)}}
+	val = clone.Validate(false)
+	assert.True(t, val.Valid())
+	val = clone.Validate(true)
+	assert.False(t, val.Valid())
+	assert.Equal(t, []string{"_id_"}, val.InvalidIndexes)
+}
+
+func TestCollectionRegex(t *testing.T) {
+	coll := NewCollection(true)
+	for i, name := range []string{"Alice", "bob", "Carol"} {
+		_, err := coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(i), "name": name}))
+		assert.NoError(t, err)
+	}
+
+	// find
+	res, err := coll.Find(bsonkit.MustConvert(bson.M{
+		"name": bson.M{"$regex": "^b", "$options": "i"},
+	}), nil, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1), "name": "bob"}),
+	}, res.Matched)
+
+	res, err = coll.Find(bsonkit.MustConvert(bson.M{
+		"name": bson.M{"$in": bson.A{primitive.Regex{Pattern: "^a", Options: "i"}, "Carol"}},
+	}), nil, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, res.Matched, 2)
+
+	// update
+	res, err = coll.Update(bsonkit.MustConvert(bson.M{
+		"name": primitive.Regex{Pattern: "^[A-Z]"},
+	}), bsonkit.MustConvert(bson.M{
+		"$set": bson.M{"upper": true},
+	}), nil, 0, 0, nil)
+	assert.NoError(t, err)
+	assert.Len(t, res.Modified, 2)
+
+	// delete
+	res, err = coll.Delete(bsonkit.MustConvert(bson.M{
+		"name": bson.M{"$not": primitive.Regex{Pattern: "^[A-Z]"}},
+	}), nil, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1), "name": "bob"}),
+	}, res.Matched)
+	assert.Len(t, coll.Documents.List, 2)
+}
+
+func TestCollectionAccess(t *testing.T) {
+	coll := NewCollection(true)
+	_, err := coll.Insert(bsonkit.MustConvert(bson.M{"_id": int32(1), "a": "x", "b": int32(1)}))
+	assert.NoError(t, err)
+
+	for name, key := range map[string]bson.D{
+		"a_1":     {{Key: "a", Value: int32(1)}},
+		"a_1_b_1": {{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(1)}},
+	} {
+		_, err = coll.CreateIndex(name, IndexConfig{
+			Key: bsonkit.MustConvert(key),
+		})
+		assert.NoError(t, err)
+	}
+
+	accesses := func() map[string]int64 {
+		res := map[string]int64{}
+		for name, index := range coll.Indexes {
+			res[name], _ = index.Accesses()
+		}
+		return res
+	}
+
+	// find
+	_, err = coll.Find(bsonkit.MustConvert(bson.M{"_id": int32(1)}), nil, 0, 0)
+	assert.NoError(t, err)
+	_, err = coll.Find(bsonkit.MustConvert(bson.M{"a": "x", "b": int32(1)}), nil, 0, 0)
+	assert.NoError(t, err)
+	_, err = coll.Find(bsonkit.MustConvert(bson.M{}), nil, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"_id_": 1, "a_1": 0, "a_1_b_1": 1}, accesses())
+
+	// update
+	_, err = coll.Update(bsonkit.MustConvert(bson.M{"a": "x"}), bsonkit.MustConvert(bson.M{
+		"$set": bson.M{"c": int32(1)},
+	}), nil, 0, 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"_id_": 1, "a_1": 1, "a_1_b_1": 1}, accesses())
+
+	// replace
+	_, err = coll.Replace(bsonkit.MustConvert(bson.M{"_id": int32(1)}), bsonkit.MustConvert(bson.M{
+		"a": "y", "b": int32(1),
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"_id_": 2, "a_1": 1, "a_1_b_1": 1}, accesses())
+
+	// delete with sort
+	_, err = coll.Delete(bsonkit.MustConvert(bson.M{"c": int32(1)}), bsonkit.MustConvert(bson.M{"a": int32(-1)}), 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"_id_": 2, "a_1": 2, "a_1_b_1": 1}, accesses())
+}
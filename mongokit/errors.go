@@ -0,0 +1,76 @@
+package mongokit
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is the code of a MongoDB server error.
+type ErrorCode int32
+
+// The error codes used by the package.
+const (
+	UnknownError               ErrorCode = 8
+	IllegalOperation           ErrorCode = 20
+	NamespaceNotFound          ErrorCode = 26
+	IndexNotFound              ErrorCode = 27
+	ConflictingUpdateOperators ErrorCode = 40
+	CursorNotFound             ErrorCode = 43
+	NamespaceExists            ErrorCode = 48
+	ImmutableField             ErrorCode = 66
+	IndexOptionsConflict       ErrorCode = 85
+	DuplicateKey               ErrorCode = 11000
+)
+
+// errorNames holds the names of the error codes.
+var errorNames = map[ErrorCode]string{
+	UnknownError:               "UnknownError",
+	IllegalOperation:           "IllegalOperation",
+	NamespaceNotFound:          "NamespaceNotFound",
+	IndexNotFound:              "IndexNotFound",
+	ConflictingUpdateOperators: "ConflictingUpdateOperators",
+	CursorNotFound:             "CursorNotFound",
+	NamespaceExists:            "NamespaceExists",
+	ImmutableField:             "ImmutableField",
+	IndexOptionsConflict:       "IndexOptionsConflict",
+	DuplicateKey:               "DuplicateKey",
+}
+
+// Name returns the name of the error code.
+func (c ErrorCode) Name() string {
+	return errorNames[c]
+}
+
+// Errorf will return a formatted error with the error code.
+func (c ErrorCode) Errorf(format string, args ...interface{}) error {
+	return &Error{
+		Code: c,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// Error is an error that carries the code of the equivalent MongoDB error.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// GetErrorCode returns the code of the first coded error in the chain of the
+// specified error. If no such error is found, UnknownError is returned.
+func GetErrorCode(err error) ErrorCode {
+	var codeErr *Error
+	if errors.As(err, &codeErr) {
+		return codeErr.Code
+	}
+	return UnknownError
+}
@@ -0,0 +1,20 @@
+package mongokit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	err := ImmutableField.Errorf("field %q is immutable", "_id")
+	assert.Equal(t, `field "_id" is immutable`, err.Error())
+	assert.Equal(t, ImmutableField, GetErrorCode(err))
+	assert.Equal(t, "ImmutableField", GetErrorCode(err).Name())
+
+	err = fmt.Errorf("wrapped: %w", err)
+	assert.Equal(t, ImmutableField, GetErrorCode(err))
+
+	assert.Equal(t, UnknownError, GetErrorCode(fmt.Errorf("foo")))
+}
@@ -0,0 +1,1384 @@
+package mongokit
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// https://github.com/mongodb/mongo/blob/master/src/mongo/db/pipeline/expression.cpp
+
+// Evaluator is an aggregation expression operator. It receives the raw
+// unevaluated arguments of the operator and returns the computed value.
+type Evaluator func(ev *Evaluation, name string, args interface{}) (interface{}, error)
+
+// AggregationExpressionOperators defines the aggregation expression operators.
+var AggregationExpressionOperators = map[string]Evaluator{}
+
+func init() {
+	// register literal and variable operators
+	AggregationExpressionOperators["$literal"] = evalLiteral
+	AggregationExpressionOperators["$let"] = evalLet
+
+	// register conditional operators
+	AggregationExpressionOperators["$cond"] = evalCond
+	AggregationExpressionOperators["$ifNull"] = evalIfNull
+	AggregationExpressionOperators["$switch"] = evalSwitch
+
+	// register boolean operators
+	AggregationExpressionOperators["$and"] = evalAnd
+	AggregationExpressionOperators["$or"] = evalOr
+	AggregationExpressionOperators["$not"] = evalNot
+
+	// register comparison operators
+	AggregationExpressionOperators["$cmp"] = evalCompare
+	AggregationExpressionOperators["$eq"] = evalCompare
+	AggregationExpressionOperators["$ne"] = evalCompare
+	AggregationExpressionOperators["$gt"] = evalCompare
+	AggregationExpressionOperators["$gte"] = evalCompare
+	AggregationExpressionOperators["$lt"] = evalCompare
+	AggregationExpressionOperators["$lte"] = evalCompare
+
+	// register arithmetic operators
+	AggregationExpressionOperators["$abs"] = evalAbs
+	AggregationExpressionOperators["$add"] = evalAdd
+	AggregationExpressionOperators["$ceil"] = evalCeilFloor
+	AggregationExpressionOperators["$divide"] = evalDivide
+	AggregationExpressionOperators["$exp"] = evalFloatFunc
+	AggregationExpressionOperators["$floor"] = evalCeilFloor
+	AggregationExpressionOperators["$ln"] = evalFloatFunc
+	AggregationExpressionOperators["$log"] = evalLog
+	AggregationExpressionOperators["$log10"] = evalFloatFunc
+	AggregationExpressionOperators["$mod"] = evalMod
+	AggregationExpressionOperators["$multiply"] = evalMultiply
+	AggregationExpressionOperators["$pow"] = evalPow
+	AggregationExpressionOperators["$round"] = evalRoundTrunc
+	AggregationExpressionOperators["$sqrt"] = evalFloatFunc
+	AggregationExpressionOperators["$subtract"] = evalSubtract
+	AggregationExpressionOperators["$trunc"] = evalRoundTrunc
+}
+
+// Evaluation holds the state used to evaluate aggregation expressions.
+type Evaluation struct {
+	// The document referenced by $$ROOT.
+	Root bsonkit.Doc
+
+	// The value referenced by $$CURRENT that is used to resolve field paths.
+	Current interface{}
+
+	// The user and system variables available to the expression.
+	Variables map[string]interface{}
+}
+
+// NewEvaluation will create and return a new evaluation for the specified
+// document. The $$NOW and $$CLUSTER_TIME variables are set if missing from the
+// provided variables.
+func NewEvaluation(doc bsonkit.Doc, variables map[string]interface{}) *Evaluation {
+	// copy variables
+	vars := make(map[string]interface{}, len(variables)+2)
+	for name, value := range variables {
+		vars[name] = value
+	}
+
+	// set system variables
+	if _, ok := vars["NOW"]; !ok {
+		vars["NOW"] = primitive.NewDateTimeFromTime(time.Now())
+	}
+	if _, ok := vars["CLUSTER_TIME"]; !ok {
+		vars["CLUSTER_TIME"] = bsonkit.Now()
+	}
+
+	// get current
+	var current interface{} = bsonkit.Missing
+	if doc != nil {
+		current = *doc
+	}
+
+	return &Evaluation{
+		Root:      doc,
+		Current:   current,
+		Variables: vars,
+	}
+}
+
+// Evaluate will evaluate the aggregation expression against the specified
+// document and return the result. The result may be bsonkit.Missing if the
+// expression references a missing field or the $$REMOVE variable.
+func Evaluate(doc bsonkit.Doc, expr interface{}, variables map[string]interface{}) (interface{}, error) {
+	return NewEvaluation(doc, variables).Evaluate(expr)
+}
+
+// With will return a derived evaluation that additionally provides the
+// specified variables.
+func (e *Evaluation) With(variables map[string]interface{}) *Evaluation {
+	// copy variables
+	vars := make(map[string]interface{}, len(e.Variables)+len(variables))
+	for name, value := range e.Variables {
+		vars[name] = value
+	}
+	for name, value := range variables {
+		vars[name] = value
+	}
+
+	return &Evaluation{
+		Root:      e.Root,
+		Current:   e.Current,
+		Variables: vars,
+	}
+}
+
+// Evaluate will evaluate the provided expression.
+func (e *Evaluation) Evaluate(expr interface{}) (interface{}, error) {
+	switch value := expr.(type) {
+	case string:
+		// handle variables and field paths
+		if strings.HasPrefix(value, "$$") {
+			return e.variable(value[2:])
+		} else if strings.HasPrefix(value, "$") {
+			return e.field(e.Current, value[1:])
+		}
+
+		return value, nil
+	case bson.D:
+		// handle operators
+		if len(value) > 0 && strings.HasPrefix(value[0].Key, "$") {
+			// check length
+			if len(value) > 1 {
+				return nil, fmt.Errorf("an expression specification must contain exactly one field, found %d fields", len(value))
+			}
+
+			// lookup operator
+			operator := AggregationExpressionOperators[value[0].Key]
+			if operator == nil {
+				return nil, fmt.Errorf("unknown expression operator %q", value[0].Key)
+			}
+
+			return operator(e, value[0].Key, value[0].Value)
+		}
+
+		// evaluate document
+		doc := make(bson.D, 0, len(value))
+		for _, el := range value {
+			// check key
+			if strings.HasPrefix(el.Key, "$") {
+				return nil, fmt.Errorf("field name %q cannot be an operator name", el.Key)
+			}
+
+			// evaluate field
+			res, err := e.Evaluate(el.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			// omit missing values
+			if res == bsonkit.Missing {
+				continue
+			}
+
+			doc = append(doc, bson.E{Key: el.Key, Value: res})
+		}
+
+		return doc, nil
+	case bson.A:
+		// evaluate array (missing values become null)
+		array := make(bson.A, 0, len(value))
+		for _, item := range value {
+			res, err := e.Evaluate(item)
+			if err != nil {
+				return nil, err
+			}
+			if res == bsonkit.Missing {
+				res = nil
+			}
+			array = append(array, res)
+		}
+
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+func (e *Evaluation) variable(expr string) (interface{}, error) {
+	// split name and path
+	name := bsonkit.PathSegment(expr)
+	path := bsonkit.ReducePath(expr)
+
+	// check name
+	if name == "" {
+		return nil, fmt.Errorf("empty variable name")
+	}
+
+	// get value
+	var value interface{}
+	switch name {
+	case "ROOT":
+		value = bsonkit.Missing
+		if e.Root != nil {
+			value = *e.Root
+		}
+	case "CURRENT":
+		value = e.Current
+	case "REMOVE":
+		value = bsonkit.Missing
+	default:
+		var ok bool
+		value, ok = e.Variables[name]
+		if !ok {
+			return nil, fmt.Errorf("use of undefined variable %q", name)
+		}
+	}
+
+	// resolve path
+	if path != bsonkit.PathEnd {
+		return e.field(value, path)
+	}
+
+	return value, nil
+}
+
+func (e *Evaluation) field(value interface{}, path string) (interface{}, error) {
+	// check path
+	if path == "" {
+		return nil, fmt.Errorf("'$' by itself is not a valid field path")
+	}
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid field path %q", path)
+		}
+	}
+
+	return resolvePath(value, path), nil
+}
+
+func resolvePath(value interface{}, path string) interface{} {
+	// check path
+	if path == bsonkit.PathEnd {
+		return value
+	}
+
+	// get key
+	key := bsonkit.PathSegment(path)
+
+	switch value := value.(type) {
+	case bson.D:
+		// get field
+		for _, el := range value {
+			if el.Key == key {
+				return resolvePath(el.Value, bsonkit.ReducePath(path))
+			}
+		}
+
+		return bsonkit.Missing
+	case bson.A:
+		// collect values from embedded documents and arrays
+		result := make(bson.A, 0, len(value))
+		for _, item := range value {
+			switch item.(type) {
+			case bson.D, bson.A:
+				res := resolvePath(item, path)
+				if res != bsonkit.Missing {
+					result = append(result, res)
+				}
+			}
+		}
+
+		return result
+	default:
+		return bsonkit.Missing
+	}
+}
+
+// evalArgs will evaluate the arguments of an operator. A non-array argument is
+// treated as a single argument. A negative max does not limit the number of
+// arguments.
+func evalArgs(ev *Evaluation, name string, args interface{}, min, max int) (bson.A, error) {
+	// get list
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+
+	// check length
+	if len(list) < min || (max >= 0 && len(list) > max) {
+		if min == max {
+			return nil, fmt.Errorf("%s: expected %d arguments, got %d", name, min, len(list))
+		}
+		return nil, fmt.Errorf("%s: invalid number of arguments: %d", name, len(list))
+	}
+
+	// evaluate arguments
+	values := make(bson.A, 0, len(list))
+	for _, item := range list {
+		value, err := ev.Evaluate(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// evalObject will coerce the operator arguments to a document and check for
+// required and unknown fields.
+func evalObject(name string, args interface{}, required []string, optional ...string) (map[string]interface{}, error) {
+	// coerce document
+	doc, ok := args.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected document", name)
+	}
+
+	// collect fields
+	fields := make(map[string]interface{}, len(doc))
+	for _, el := range doc {
+		known := false
+		for _, key := range append(required, optional...) {
+			if key == el.Key {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("%s: unknown argument %q", name, el.Key)
+		}
+		fields[el.Key] = el.Value
+	}
+
+	// check required fields
+	for _, key := range required {
+		if _, ok := fields[key]; !ok {
+			return nil, fmt.Errorf("%s: missing argument %q", name, key)
+		}
+	}
+
+	return fields, nil
+}
+
+func isNullish(v interface{}) bool {
+	switch v.(type) {
+	case nil, bsonkit.MissingType, primitive.Null, primitive.Undefined:
+		return true
+	default:
+		return false
+	}
+}
+
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case int32, int64, float64, primitive.Decimal128:
+		return true
+	default:
+		return false
+	}
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case bsonkit.MissingType:
+		return "missing"
+	case primitive.Undefined:
+		return "undefined"
+	case primitive.MinKey:
+		return "minKey"
+	case primitive.MaxKey:
+		return "maxKey"
+	case primitive.JavaScript:
+		return "javascript"
+	case primitive.Symbol:
+		return "symbol"
+	}
+
+	_, typ := bsonkit.Inspect(v)
+
+	return bsonkit.Type2Alias[typ]
+}
+
+func truthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil, bsonkit.MissingType, primitive.Null, primitive.Undefined:
+		return false
+	case bool:
+		return value
+	case int32:
+		return value != 0
+	case int64:
+		return value != 0
+	case float64:
+		return value != 0
+	case primitive.Decimal128:
+		return !value.IsZero()
+	default:
+		return true
+	}
+}
+
+// compareValues compares two values like bsonkit.Compare but orders missing
+// values before null values as done by the aggregation framework.
+func compareValues(a, b interface{}) int {
+	// handle missing values
+	am := a == bsonkit.Missing
+	bm := b == bsonkit.Missing
+	if am && bm {
+		return 0
+	} else if am {
+		return -1
+	} else if bm {
+		return 1
+	}
+
+	return bsonkit.Compare(a, b)
+}
+
+func evalLiteral(_ *Evaluation, _ string, args interface{}) (interface{}, error) {
+	return args, nil
+}
+
+func evalLet(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"vars", "in"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get variables
+	vars, ok := fields["vars"].(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: vars must be a document", name)
+	}
+
+	// evaluate variables in outer scope
+	values := make(map[string]interface{}, len(vars))
+	for _, v := range vars {
+		err = validateVariable(name, v.Key)
+		if err != nil {
+			return nil, err
+		}
+		values[v.Key], err = ev.Evaluate(v.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ev.With(values).Evaluate(fields["in"])
+}
+
+func validateVariable(name, variable string) error {
+	// check name
+	if variable == "" {
+		return fmt.Errorf("%s: empty variable name", name)
+	}
+
+	// check first character
+	if c := variable[0]; !(c >= 'a' && c <= 'z') && c < 128 {
+		return fmt.Errorf("%s: variable %q must begin with a lowercase letter", name, variable)
+	}
+
+	// check remaining characters
+	for _, c := range variable {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c > 127) {
+			return fmt.Errorf("%s: variable %q contains invalid characters", name, variable)
+		}
+	}
+
+	return nil
+}
+
+func evalCond(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get clauses
+	var ifExpr, thenExpr, elseExpr interface{}
+	switch value := args.(type) {
+	case bson.A:
+		if len(value) != 3 {
+			return nil, fmt.Errorf("%s: expected 3 arguments, got %d", name, len(value))
+		}
+		ifExpr, thenExpr, elseExpr = value[0], value[1], value[2]
+	case bson.D:
+		fields, err := evalObject(name, value, []string{"if", "then", "else"})
+		if err != nil {
+			return nil, err
+		}
+		ifExpr, thenExpr, elseExpr = fields["if"], fields["then"], fields["else"]
+	default:
+		return nil, fmt.Errorf("%s: expected array or document", name)
+	}
+
+	// evaluate condition
+	cond, err := ev.Evaluate(ifExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate branch
+	if truthy(cond) {
+		return ev.Evaluate(thenExpr)
+	}
+
+	return ev.Evaluate(elseExpr)
+}
+
+func evalIfNull(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get list
+	list, ok := args.(bson.A)
+	if !ok || len(list) < 2 {
+		return nil, fmt.Errorf("%s: expected at least 2 arguments", name)
+	}
+
+	// return first non-null value
+	for i, item := range list {
+		value, err := ev.Evaluate(item)
+		if err != nil {
+			return nil, err
+		}
+		if !isNullish(value) || i == len(list)-1 {
+			return value, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func evalSwitch(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"branches"}, "default")
+	if err != nil {
+		return nil, err
+	}
+
+	// get branches
+	branches, ok := fields["branches"].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: branches must be an array", name)
+	}
+
+	// evaluate branches
+	for _, item := range branches {
+		branch, err := evalObject(name, item, []string{"case", "then"})
+		if err != nil {
+			return nil, err
+		}
+		cond, err := ev.Evaluate(branch["case"])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return ev.Evaluate(branch["then"])
+		}
+	}
+
+	// check default
+	def, ok := fields["default"]
+	if !ok {
+		return nil, fmt.Errorf("%s: could not find a matching branch for an input, and no default was specified", name)
+	}
+
+	return ev.Evaluate(def)
+}
+
+func evalAnd(ev *Evaluation, _ string, args interface{}) (interface{}, error) {
+	// get list
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+
+	// evaluate lazily
+	for _, item := range list {
+		value, err := ev.Evaluate(item)
+		if err != nil {
+			return nil, err
+		}
+		if !truthy(value) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func evalOr(ev *Evaluation, _ string, args interface{}) (interface{}, error) {
+	// get list
+	list, ok := args.(bson.A)
+	if !ok {
+		list = bson.A{args}
+	}
+
+	// evaluate lazily
+	for _, item := range list {
+		value, err := ev.Evaluate(item)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(value) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func evalNot(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return !truthy(values[0]), nil
+}
+
+func evalCompare(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare values
+	res := compareValues(values[0], values[1])
+
+	// check operator
+	switch name {
+	case "$cmp":
+		return int32(res), nil
+	case "$eq":
+		return res == 0, nil
+	case "$ne":
+		return res != 0, nil
+	case "$gt":
+		return res > 0, nil
+	case "$gte":
+		return res >= 0, nil
+	case "$lt":
+		return res < 0, nil
+	case "$lte":
+		return res <= 0, nil
+	default:
+		return nil, fmt.Errorf("unknown comparison operator %q", name)
+	}
+}
+
+func evalAdd(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// sum values
+	var sum interface{} = int32(0)
+	var date *primitive.DateTime
+	var null bool
+	for _, value := range values {
+		switch value := value.(type) {
+		case int32, int64, float64, primitive.Decimal128:
+			sum = addNumbers(sum, value)
+		case primitive.DateTime:
+			if date != nil {
+				return nil, fmt.Errorf("%s: only one date allowed", name)
+			}
+			date = &value
+		default:
+			if !isNullish(value) {
+				return nil, fmt.Errorf("%s: only supports numeric or date types, not %s", name, typeName(value))
+			}
+			null = true
+		}
+	}
+
+	// handle null
+	if null {
+		return nil, nil
+	}
+
+	// handle date
+	if date != nil {
+		ms, ok := roundInt64(sum)
+		if !ok {
+			return nil, fmt.Errorf("%s: date overflow", name)
+		}
+		return *date + primitive.DateTime(ms), nil
+	}
+
+	return sum, nil
+}
+
+func evalSubtract(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// handle dates
+	if date, ok := values[0].(primitive.DateTime); ok {
+		switch value := values[1].(type) {
+		case primitive.DateTime:
+			return int64(date) - int64(value), nil
+		case int32, int64, float64, primitive.Decimal128:
+			ms, ok := roundInt64(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: date overflow", name)
+			}
+			return date - primitive.DateTime(ms), nil
+		default:
+			return nil, fmt.Errorf("%s: cannot subtract %s from a date", name, typeName(value))
+		}
+	}
+
+	// check numbers
+	if !isNumeric(values[0]) || !isNumeric(values[1]) {
+		return nil, fmt.Errorf("%s: only supports numeric or date types, not %s and %s", name, typeName(values[0]), typeName(values[1]))
+	}
+
+	return subtractNumbers(values[0], values[1]), nil
+}
+
+func evalMultiply(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// multiply values
+	var product interface{} = int32(1)
+	var null bool
+	for _, value := range values {
+		if isNumeric(value) {
+			product = multiplyNumbers(product, value)
+		} else if isNullish(value) {
+			null = true
+		} else {
+			return nil, fmt.Errorf("%s: only supports numeric types, not %s", name, typeName(value))
+		}
+	}
+
+	// handle null
+	if null {
+		return nil, nil
+	}
+
+	return product, nil
+}
+
+func evalDivide(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// check numbers
+	if !isNumeric(values[0]) || !isNumeric(values[1]) {
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s and %s", name, typeName(values[0]), typeName(values[1]))
+	}
+
+	// check divisor
+	if isZero(values[1]) {
+		return nil, fmt.Errorf("%s: cannot divide by zero", name)
+	}
+
+	// divide decimals
+	if isDecimal(values[0]) || isDecimal(values[1]) {
+		a, ok1 := toDecimal(values[0])
+		b, ok2 := toDecimal(values[1])
+		if !ok1 || !ok2 {
+			return decimalNaN, nil
+		}
+		return fromDecimal(a.DivRound(b, 34)), nil
+	}
+
+	// divide floats
+	a, _ := toFloat(values[0])
+	b, _ := toFloat(values[1])
+
+	return a / b, nil
+}
+
+func evalMod(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// check numbers
+	if !isNumeric(values[0]) || !isNumeric(values[1]) {
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s and %s", name, typeName(values[0]), typeName(values[1]))
+	}
+
+	// check divisor
+	if isZero(values[1]) {
+		return nil, fmt.Errorf("%s: cannot divide by zero", name)
+	}
+
+	return bsonkit.Mod(values[0], values[1]), nil
+}
+
+func evalAbs(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := values[0].(type) {
+	case int32:
+		if value == math.MinInt32 {
+			return -int64(value), nil
+		} else if value < 0 {
+			return -value, nil
+		}
+		return value, nil
+	case int64:
+		if value == math.MinInt64 {
+			return nil, fmt.Errorf("%s: cannot take absolute value of %d", name, value)
+		} else if value < 0 {
+			return -value, nil
+		}
+		return value, nil
+	case float64:
+		return math.Abs(value), nil
+	case primitive.Decimal128:
+		d, ok := toDecimal(value)
+		if !ok {
+			return value, nil
+		}
+		return fromDecimal(d.Abs()), nil
+	default:
+		if isNullish(value) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s", name, typeName(value))
+	}
+}
+
+func evalCeilFloor(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := values[0].(type) {
+	case int32, int64:
+		return value, nil
+	case float64:
+		if name == "$ceil" {
+			return math.Ceil(value), nil
+		}
+		return math.Floor(value), nil
+	case primitive.Decimal128:
+		d, ok := toDecimal(value)
+		if !ok {
+			return value, nil
+		}
+		if name == "$ceil" {
+			return fromDecimal(d.Ceil()), nil
+		}
+		return fromDecimal(d.Floor()), nil
+	default:
+		if isNullish(value) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s", name, typeName(value))
+	}
+}
+
+func evalRoundTrunc(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// get place
+	var place int64
+	if len(values) == 2 {
+		if isNullish(values[1]) {
+			return nil, nil
+		}
+		var ok bool
+		place, ok = toInt64(values[1])
+		if !ok || place < -20 || place > 100 {
+			return nil, fmt.Errorf("%s: place must be an integer between -20 and 100", name)
+		}
+	}
+
+	// get value
+	value := values[0]
+	if isNullish(value) {
+		return nil, nil
+	} else if !isNumeric(value) {
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s", name, typeName(value))
+	}
+
+	// handle non-finite floats
+	if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return f, nil
+	}
+
+	// get decimal
+	d, ok := toDecimal(value)
+	if !ok {
+		return value, nil
+	}
+
+	// round or truncate
+	p := int32(place)
+	if name == "$round" {
+		d = d.RoundBank(p)
+	} else {
+		d = d.Shift(p).Truncate(0).Shift(-p)
+	}
+
+	// convert back
+	switch value.(type) {
+	case int32:
+		if d.IntPart() >= math.MinInt32 && d.IntPart() <= math.MaxInt32 {
+			return int32(d.IntPart()), nil
+		}
+		return d.IntPart(), nil
+	case int64:
+		return d.IntPart(), nil
+	case float64:
+		f, _ := d.Float64()
+		return f, nil
+	default:
+		return fromDecimal(d), nil
+	}
+}
+
+func evalFloatFunc(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// get value
+	value := values[0]
+	if isNullish(value) {
+		return nil, nil
+	} else if !isNumeric(value) {
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s", name, typeName(value))
+	}
+
+	// compute result
+	f, _ := toFloat(value)
+	var res float64
+	switch name {
+	case "$exp":
+		res = math.Exp(f)
+	case "$ln":
+		if f <= 0 {
+			return nil, fmt.Errorf("%s: argument must be a positive number", name)
+		}
+		res = math.Log(f)
+	case "$log10":
+		if f <= 0 {
+			return nil, fmt.Errorf("%s: argument must be a positive number", name)
+		}
+		res = math.Log10(f)
+	case "$sqrt":
+		if f < 0 {
+			return nil, fmt.Errorf("%s: argument must be greater than or equal to 0", name)
+		}
+		res = math.Sqrt(f)
+	default:
+		return nil, fmt.Errorf("unknown operator %q", name)
+	}
+
+	// keep decimals
+	if isDecimal(value) {
+		return floatToDecimal(res), nil
+	}
+
+	return res, nil
+}
+
+func evalLog(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// check numbers
+	if !isNumeric(values[0]) || !isNumeric(values[1]) {
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s and %s", name, typeName(values[0]), typeName(values[1]))
+	}
+
+	// get values
+	num, _ := toFloat(values[0])
+	base, _ := toFloat(values[1])
+
+	// check values
+	if num <= 0 {
+		return nil, fmt.Errorf("%s: argument must be a positive number", name)
+	} else if base <= 0 || base == 1 {
+		return nil, fmt.Errorf("%s: base must be a positive number not equal to 1", name)
+	}
+
+	// compute result
+	res := math.Log(num) / math.Log(base)
+
+	// keep decimals
+	if isDecimal(values[0]) || isDecimal(values[1]) {
+		return floatToDecimal(res), nil
+	}
+
+	return res, nil
+}
+
+func evalPow(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// check numbers
+	if !isNumeric(values[0]) || !isNumeric(values[1]) {
+		return nil, fmt.Errorf("%s: only supports numeric types, not %s and %s", name, typeName(values[0]), typeName(values[1]))
+	}
+
+	// check zero base with negative exponent
+	if isZero(values[0]) && compareValues(values[1], int32(0)) < 0 {
+		return nil, fmt.Errorf("%s: cannot take a base of 0 and a negative exponent", name)
+	}
+
+	// handle decimals and floats
+	if isDecimal(values[0]) || isDecimal(values[1]) {
+		base, _ := toFloat(values[0])
+		exp, _ := toFloat(values[1])
+		return floatToDecimal(math.Pow(base, exp)), nil
+	}
+	_, baseIsFloat := values[0].(float64)
+	_, expIsFloat := values[1].(float64)
+	if baseIsFloat || expIsFloat {
+		base, _ := toFloat(values[0])
+		exp, _ := toFloat(values[1])
+		return math.Pow(base, exp), nil
+	}
+
+	// get integers
+	base, _ := toInt64(values[0])
+	exp, _ := toInt64(values[1])
+	_, base32 := values[0].(int32)
+	_, exp32 := values[1].(int32)
+
+	// handle negative exponents
+	if exp < 0 {
+		switch base {
+		case 1:
+			return narrowInt(1, base32 && exp32), nil
+		case -1:
+			if exp%2 == 0 {
+				return narrowInt(1, base32 && exp32), nil
+			}
+			return narrowInt(-1, base32 && exp32), nil
+		default:
+			return math.Pow(float64(base), float64(exp)), nil
+		}
+	}
+
+	// compute integer power with overflow detection
+	res := int64(1)
+	for i := int64(0); i < exp; i++ {
+		next, ok := mulInt64(res, base)
+		if !ok {
+			return math.Pow(float64(base), float64(exp)), nil
+		}
+		res = next
+		if res == 0 || res == 1 {
+			break
+		}
+	}
+
+	return narrowInt(res, base32 && exp32), nil
+}
+
+var decimalNaN, _ = primitive.ParseDecimal128("NaN")
+
+func isDecimal(v interface{}) bool {
+	_, ok := v.(primitive.Decimal128)
+	return ok
+}
+
+func isZero(v interface{}) bool {
+	switch value := v.(type) {
+	case int32:
+		return value == 0
+	case int64:
+		return value == 0
+	case float64:
+		return value == 0
+	case primitive.Decimal128:
+		return value.IsZero()
+	default:
+		return false
+	}
+}
+
+func narrowInt(v int64, narrow bool) interface{} {
+	if narrow && v >= math.MinInt32 && v <= math.MaxInt32 {
+		return int32(v)
+	}
+	return v
+}
+
+func addInt64(a, b int64) (int64, bool) {
+	c := a + b
+	if (c > a) != (b > 0) {
+		return 0, false
+	}
+	return c, true
+}
+
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if c/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return c, true
+}
+
+func addNumbers(a, b interface{}) interface{} {
+	// add integers with overflow promotion
+	ai, aInt := a.(int32)
+	bi, bInt := b.(int32)
+	if aInt && bInt {
+		return narrowInt(int64(ai)+int64(bi), true)
+	}
+	al, aOK := toExactInt64(a)
+	bl, bOK := toExactInt64(b)
+	if aOK && bOK {
+		c, ok := addInt64(al, bl)
+		if ok {
+			return c
+		}
+		return float64(al) + float64(bl)
+	}
+
+	return bsonkit.Add(a, b)
+}
+
+func subtractNumbers(a, b interface{}) interface{} {
+	// subtract integers with overflow promotion
+	ai, aInt := a.(int32)
+	bi, bInt := b.(int32)
+	if aInt && bInt {
+		return narrowInt(int64(ai)-int64(bi), true)
+	}
+	al, aOK := toExactInt64(a)
+	bl, bOK := toExactInt64(b)
+	if aOK && bOK {
+		if bl != math.MinInt64 {
+			c, ok := addInt64(al, -bl)
+			if ok {
+				return c
+			}
+		}
+		return float64(al) - float64(bl)
+	}
+
+	// negate subtrahend
+	switch value := b.(type) {
+	case float64:
+		return bsonkit.Add(a, -value)
+	default:
+		return bsonkit.Add(a, bsonkit.Mul(b, int32(-1)))
+	}
+}
+
+func multiplyNumbers(a, b interface{}) interface{} {
+	// multiply integers with overflow promotion
+	ai, aInt := a.(int32)
+	bi, bInt := b.(int32)
+	if aInt && bInt {
+		return narrowInt(int64(ai)*int64(bi), true)
+	}
+	al, aOK := toExactInt64(a)
+	bl, bOK := toExactInt64(b)
+	if aOK && bOK {
+		c, ok := mulInt64(al, bl)
+		if ok {
+			return c
+		}
+		return float64(al) * float64(bl)
+	}
+
+	return bsonkit.Mul(a, b)
+}
+
+// toExactInt64 returns the value of int32 and int64 values.
+func toExactInt64(v interface{}) (int64, bool) {
+	switch value := v.(type) {
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	default:
+		return 0, false
+	}
+}
+
+// toInt64 returns the value of numbers that represent whole integers.
+func toInt64(v interface{}) (int64, bool) {
+	switch value := v.(type) {
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		if value != math.Trunc(value) || value < math.MinInt64 || value >= -math.MinInt64 {
+			return 0, false
+		}
+		return int64(value), true
+	case primitive.Decimal128:
+		d, ok := toDecimal(value)
+		if !ok || !d.Equal(d.Truncate(0)) || !d.IsInteger() {
+			return 0, false
+		}
+		if d.LessThan(decimal.NewFromInt(math.MinInt64)) || d.GreaterThan(decimal.NewFromInt(math.MaxInt64)) {
+			return 0, false
+		}
+		return d.IntPart(), true
+	default:
+		return 0, false
+	}
+}
+
+// roundInt64 rounds numbers to the nearest integer (half away from zero).
+func roundInt64(v interface{}) (int64, bool) {
+	switch value := v.(type) {
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		r := math.Round(value)
+		if math.IsNaN(r) || r < math.MinInt64 || r >= -math.MinInt64 {
+			return 0, false
+		}
+		return int64(r), true
+	case primitive.Decimal128:
+		d, ok := toDecimal(value)
+		if !ok {
+			return 0, false
+		}
+		return toInt64(fromDecimal(d.Round(0)))
+	default:
+		return 0, false
+	}
+}
+
+// toFloat returns the float value of a number.
+func toFloat(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	case primitive.Decimal128:
+		d, ok := toDecimal(value)
+		if ok {
+			f, _ := d.Float64()
+			return f, true
+		}
+		switch value.String() {
+		case "Infinity":
+			return math.Inf(1), true
+		case "-Infinity":
+			return math.Inf(-1), true
+		default:
+			return math.NaN(), true
+		}
+	default:
+		return 0, false
+	}
+}
+
+// toDecimal returns the decimal value of a finite number.
+func toDecimal(v interface{}) (decimal.Decimal, bool) {
+	switch value := v.(type) {
+	case int32:
+		return decimal.NewFromInt(int64(value)), true
+	case int64:
+		return decimal.NewFromInt(value), true
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return decimal.Decimal{}, false
+		}
+		return decimal.NewFromFloat(value), true
+	case primitive.Decimal128:
+		big, exp, err := value.BigInt()
+		if err != nil {
+			return decimal.Decimal{}, false
+		}
+		return decimal.NewFromBigInt(big, int32(exp)), true
+	default:
+		return decimal.Decimal{}, false
+	}
+}
+
+// fromDecimal converts a decimal to a decimal128 value.
+func fromDecimal(d decimal.Decimal) primitive.Decimal128 {
+	dd, ok := primitive.ParseDecimal128FromBigInt(d.Coefficient(), int(d.Exponent()))
+	if !ok {
+		dd, _ = primitive.ParseDecimal128(d.String())
+	}
+	return dd
+}
+
+// floatToDecimal converts a float to a decimal128 value.
+func floatToDecimal(f float64) primitive.Decimal128 {
+	if math.IsNaN(f) {
+		return decimalNaN
+	} else if math.IsInf(f, 1) {
+		d, _ := primitive.ParseDecimal128("Infinity")
+		return d
+	} else if math.IsInf(f, -1) {
+		d, _ := primitive.ParseDecimal128("-Infinity")
+		return d
+	}
+	return fromDecimal(decimal.NewFromFloat(f))
+}
@@ -0,0 +1,1091 @@
+package mongokit
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register higher order operators
+	AggregationExpressionOperators["$map"] = evalMap
+	AggregationExpressionOperators["$filter"] = evalFilter
+	AggregationExpressionOperators["$reduce"] = evalReduce
+
+	// register array operators
+	AggregationExpressionOperators["$zip"] = evalZip
+	AggregationExpressionOperators["$range"] = evalRange
+	AggregationExpressionOperators["$reverseArray"] = evalReverseArray
+	AggregationExpressionOperators["$slice"] = evalSlice
+	AggregationExpressionOperators["$arrayElemAt"] = evalArrayElemAt
+	AggregationExpressionOperators["$first"] = evalFirstLast
+	AggregationExpressionOperators["$last"] = evalFirstLast
+	AggregationExpressionOperators["$concatArrays"] = evalConcatArrays
+	AggregationExpressionOperators["$in"] = evalIn
+	AggregationExpressionOperators["$indexOfArray"] = evalIndexOfArray
+	AggregationExpressionOperators["$isArray"] = evalIsArray
+	AggregationExpressionOperators["$size"] = evalSize
+	AggregationExpressionOperators["$sortArray"] = evalSortArray
+
+	// register object operators
+	AggregationExpressionOperators["$arrayToObject"] = evalArrayToObject
+	AggregationExpressionOperators["$objectToArray"] = evalObjectToArray
+	AggregationExpressionOperators["$mergeObjects"] = evalMergeObjects
+	AggregationExpressionOperators["$getField"] = evalGetField
+	AggregationExpressionOperators["$setField"] = evalSetField
+
+	// register set operators
+	AggregationExpressionOperators["$setUnion"] = evalSetUnion
+	AggregationExpressionOperators["$setIntersection"] = evalSetIntersection
+	AggregationExpressionOperators["$setDifference"] = evalSetDifference
+	AggregationExpressionOperators["$setEquals"] = evalSetEquals
+	AggregationExpressionOperators["$setIsSubset"] = evalSetIsSubset
+	AggregationExpressionOperators["$anyElementTrue"] = evalElementsTrue
+	AggregationExpressionOperators["$allElementsTrue"] = evalElementsTrue
+}
+
+// evalInput evaluates the input argument of a higher order operator and
+// returns the array or whether the input is null.
+func evalInput(ev *Evaluation, name string, expr interface{}) (bson.A, bool, error) {
+	// evaluate input
+	value, err := ev.Evaluate(expr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// handle null
+	if isNullish(value) {
+		return nil, true, nil
+	}
+
+	// check array
+	array, ok := value.(bson.A)
+	if !ok {
+		return nil, false, fmt.Errorf("%s: input must be an array, not %s", name, typeName(value))
+	}
+
+	return array, false, nil
+}
+
+// evalAs returns the variable name specified by the "as" argument.
+func evalAs(name string, fields map[string]interface{}) (string, error) {
+	// check field
+	as, ok := fields["as"]
+	if !ok {
+		return "this", nil
+	}
+
+	// check name
+	str, ok := as.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: 'as' must be a string", name)
+	}
+	err := validateVariable(name, str)
+	if err != nil {
+		return "", err
+	}
+
+	return str, nil
+}
+
+func evalMap(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "in"}, "as")
+	if err != nil {
+		return nil, err
+	}
+
+	// get variable
+	as, err := evalAs(name, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// get input
+	input, null, err := evalInput(ev, name, fields["input"])
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// map items
+	result := make(bson.A, 0, len(input))
+	for _, item := range input {
+		value, err := ev.With(map[string]interface{}{as: item}).Evaluate(fields["in"])
+		if err != nil {
+			return nil, err
+		}
+		if value == bsonkit.Missing {
+			value = nil
+		}
+		result = append(result, value)
+	}
+
+	return result, nil
+}
+
+func evalFilter(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "cond"}, "as", "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	// get variable
+	as, err := evalAs(name, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// get input
+	input, null, err := evalInput(ev, name, fields["input"])
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// get limit
+	limit := int64(math.MaxInt64)
+	if expr, ok := fields["limit"]; ok {
+		value, err := ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if !isNullish(value) {
+			limit, ok = toInt64(value)
+			if !ok || limit <= 0 {
+				return nil, fmt.Errorf("%s: limit must be a positive integer", name)
+			}
+		}
+	}
+
+	// filter items
+	result := make(bson.A, 0, len(input))
+	for _, item := range input {
+		if int64(len(result)) >= limit {
+			break
+		}
+		value, err := ev.With(map[string]interface{}{as: item}).Evaluate(fields["cond"])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(value) {
+			result = append(result, item)
+		}
+	}
+
+	return result, nil
+}
+
+func evalReduce(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "initialValue", "in"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get input
+	input, null, err := evalInput(ev, name, fields["input"])
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// get initial value
+	value, err := ev.Evaluate(fields["initialValue"])
+	if err != nil {
+		return nil, err
+	}
+
+	// reduce items
+	for _, item := range input {
+		value, err = ev.With(map[string]interface{}{
+			"this":  item,
+			"value": value,
+		}).Evaluate(fields["in"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return value, nil
+}
+
+func evalZip(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"inputs"}, "useLongestLength", "defaults")
+	if err != nil {
+		return nil, err
+	}
+
+	// get flag
+	useLongest, ok := fields["useLongestLength"]
+	if !ok {
+		useLongest = false
+	}
+	if _, ok := useLongest.(bool); !ok {
+		return nil, fmt.Errorf("%s: 'useLongestLength' must be a boolean", name)
+	}
+
+	// evaluate inputs
+	value, err := ev.Evaluate(fields["inputs"])
+	if err != nil {
+		return nil, err
+	}
+	inputs, ok := value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: 'inputs' must be an array, not %s", name, typeName(value))
+	}
+
+	// check inputs
+	arrays := make([]bson.A, 0, len(inputs))
+	for _, input := range inputs {
+		if isNullish(input) {
+			return nil, nil
+		}
+		array, ok := input.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'inputs' must evaluate to arrays, found %s", name, typeName(input))
+		}
+		arrays = append(arrays, array)
+	}
+
+	// get defaults
+	defaults := make(bson.A, len(arrays))
+	if expr, ok := fields["defaults"]; ok {
+		if useLongest != true {
+			return nil, fmt.Errorf("%s: cannot specify defaults unless useLongestLength is true", name)
+		}
+		value, err := ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'defaults' must evaluate to an array, found %s", name, typeName(value))
+		} else if len(list) != len(arrays) {
+			return nil, fmt.Errorf("%s: 'defaults' and 'inputs' must have the same length", name)
+		}
+		defaults = list
+	}
+
+	// get length
+	length := 0
+	for i, array := range arrays {
+		if i == 0 || (useLongest == true && len(array) > length) || (useLongest != true && len(array) < length) {
+			length = len(array)
+		}
+	}
+
+	// zip arrays
+	result := make(bson.A, 0, length)
+	for i := 0; i < length; i++ {
+		tuple := make(bson.A, 0, len(arrays))
+		for j, array := range arrays {
+			if i < len(array) {
+				tuple = append(tuple, array[i])
+			} else {
+				tuple = append(tuple, defaults[j])
+			}
+		}
+		result = append(result, tuple)
+	}
+
+	return result, nil
+}
+
+func evalRange(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// get arguments
+	bounds := []int64{0, 0, 1}
+	for i, value := range values {
+		n, ok := toInt64(value)
+		if !ok || n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("%s: arguments must be integral values representable as 32-bit integers, found %s", name, typeName(value))
+		}
+		bounds[i] = n
+	}
+
+	// check step
+	start, end, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return nil, fmt.Errorf("%s: step cannot be zero", name)
+	}
+
+	// build range
+	result := bson.A{}
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		result = append(result, int32(i))
+	}
+
+	return result, nil
+}
+
+// evalArray evaluates the single array argument of an operator and returns the
+// array or whether the argument is null.
+func evalArray(ev *Evaluation, name string, args interface{}) (bson.A, bool, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// handle null
+	if isNullish(values[0]) {
+		return nil, true, nil
+	}
+
+	// check array
+	array, ok := values[0].(bson.A)
+	if !ok {
+		return nil, false, fmt.Errorf("%s: argument must be an array, not %s", name, typeName(values[0]))
+	}
+
+	return array, false, nil
+}
+
+func evalReverseArray(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get array
+	array, null, err := evalArray(ev, name, args)
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// reverse array
+	result := make(bson.A, len(array))
+	for i, item := range array {
+		result[len(array)-1-i] = item
+	}
+
+	return result, nil
+}
+
+func evalSlice(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	for _, value := range values {
+		if isNullish(value) {
+			return nil, nil
+		}
+	}
+
+	// get array
+	array, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: first argument must be an array, not %s", name, typeName(values[0]))
+	}
+
+	// get numbers
+	var nums []int64
+	for _, value := range values[1:] {
+		n, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("%s: arguments must be integral values, found %s", name, typeName(value))
+		}
+		nums = append(nums, n)
+	}
+
+	// compute bounds
+	length := int64(len(array))
+	var start, count int64
+	if len(nums) == 1 {
+		if nums[0] >= 0 {
+			start, count = 0, nums[0]
+		} else {
+			start, count = length+nums[0], -nums[0]
+		}
+	} else {
+		if nums[1] <= 0 {
+			return nil, fmt.Errorf("%s: third argument must be positive", name)
+		}
+		start, count = nums[0], nums[1]
+		if start < 0 {
+			start += length
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > length {
+		start = length
+	}
+	if count > length-start {
+		count = length - start
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	return append(bson.A{}, array[start:start+count]...), nil
+}
+
+func evalArrayElemAt(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// get array
+	array, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: first argument must be an array, not %s", name, typeName(values[0]))
+	}
+
+	// get index
+	index, ok := toInt64(values[1])
+	if !ok {
+		return nil, fmt.Errorf("%s: second argument must be an integral value, not %s", name, typeName(values[1]))
+	}
+	if index < 0 {
+		index += int64(len(array))
+	}
+
+	// check index
+	if index < 0 || index >= int64(len(array)) {
+		return bsonkit.Missing, nil
+	}
+
+	return array[index], nil
+}
+
+func evalFirstLast(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if values[0] == bsonkit.Missing {
+		return bsonkit.Missing, nil
+	} else if isNullish(values[0]) {
+		return nil, nil
+	}
+
+	// get array
+	array, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: argument must be an array, not %s", name, typeName(values[0]))
+	}
+
+	// check length
+	if len(array) == 0 {
+		return bsonkit.Missing, nil
+	}
+
+	// get item
+	if name == "$first" {
+		return array[0], nil
+	}
+
+	return array[len(array)-1], nil
+}
+
+func evalConcatArrays(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// concat arrays
+	result := bson.A{}
+	for _, value := range values {
+		if isNullish(value) {
+			return nil, nil
+		}
+		array, ok := value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("%s: only supports arrays, not %s", name, typeName(value))
+		}
+		result = append(result, array...)
+	}
+
+	return result, nil
+}
+
+func evalIn(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// get array
+	array, ok := values[1].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: requires an array as a second argument, found: %s", name, typeName(values[1]))
+	}
+
+	// find value
+	for _, item := range array {
+		if compareValues(item, values[0]) == 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func evalIndexOfArray(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+
+	// get array
+	array, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: first argument must be an array, not %s", name, typeName(values[0]))
+	}
+
+	// get bounds
+	start, end := 0, len(array)
+	if len(values) > 2 {
+		start, err = toIndex(name, "starting index", values[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(values) > 3 {
+		end, err = toIndex(name, "ending index", values[3])
+		if err != nil {
+			return nil, err
+		}
+		if end > len(array) {
+			end = len(array)
+		}
+	}
+
+	// find value
+	for i := start; i < end; i++ {
+		if compareValues(array[i], values[1]) == 0 {
+			return int32(i), nil
+		}
+	}
+
+	return int32(-1), nil
+}
+
+func evalIsArray(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// check array
+	_, ok := values[0].(bson.A)
+
+	return ok, nil
+}
+
+func evalSize(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// check array
+	array, ok := values[0].(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s: the argument must be an array, not %s", name, typeName(values[0]))
+	}
+
+	return int32(len(array)), nil
+}
+
+func evalSortArray(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "sortBy"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get input
+	input, null, err := evalInput(ev, name, fields["input"])
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// copy input
+	result := append(bson.A{}, input...)
+
+	// sort by value
+	if dir, ok := toInt64(fields["sortBy"]); ok {
+		if dir != 1 && dir != -1 {
+			return nil, fmt.Errorf("%s: sortBy must be either 1, -1 or a document", name)
+		}
+		sort.SliceStable(result, func(i, j int) bool {
+			return bsonkit.Compare(result[i], result[j])*int(dir) < 0
+		})
+		return result, nil
+	}
+
+	// get columns
+	sortBy, ok := fields["sortBy"].(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: sortBy must be either 1, -1 or a document", name)
+	}
+	columns, err := Columns(&sortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// sort by fields
+	docs := make([]bsonkit.Doc, len(result))
+	for i, item := range result {
+		doc, _ := item.(bson.D)
+		docs[i] = &doc
+	}
+	indexes := make([]int, len(result))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return bsonkit.Order(docs[indexes[i]], docs[indexes[j]], columns, false) < 0
+	})
+	sorted := make(bson.A, 0, len(result))
+	for _, i := range indexes {
+		sorted = append(sorted, result[i])
+	}
+
+	return sorted, nil
+}
+
+func evalArrayToObject(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get array
+	array, null, err := evalArray(ev, name, args)
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// build document
+	doc := bson.D{}
+	for _, item := range array {
+		// get key and value
+		var key, value interface{}
+		switch item := item.(type) {
+		case bson.A:
+			if len(item) != 2 {
+				return nil, fmt.Errorf("%s: arrays must have exactly two elements", name)
+			}
+			key, value = item[0], item[1]
+		case bson.D:
+			if len(item) != 2 || lookupField(item, "k") == bsonkit.Missing || lookupField(item, "v") == bsonkit.Missing {
+				return nil, fmt.Errorf("%s: documents must have exactly two fields named 'k' and 'v'", name)
+			}
+			key, value = lookupField(item, "k"), lookupField(item, "v")
+		default:
+			return nil, fmt.Errorf("%s: expected array of arrays or documents, found %s", name, typeName(item))
+		}
+
+		// check key
+		str, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: key must be a string, found %s", name, typeName(key))
+		} else if strings.ContainsRune(str, 0) {
+			return nil, fmt.Errorf("%s: key must not contain an embedded null byte", name)
+		}
+
+		// set field
+		doc = setField(doc, str, value)
+	}
+
+	return doc, nil
+}
+
+func evalObjectToArray(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+
+	// get document
+	doc, ok := values[0].(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: requires a document input, found: %s", name, typeName(values[0]))
+	}
+
+	// build array
+	result := make(bson.A, 0, len(doc))
+	for _, el := range doc {
+		result = append(result, bson.D{
+			{Key: "k", Value: el.Key},
+			{Key: "v", Value: el.Value},
+		})
+	}
+
+	return result, nil
+}
+
+func evalMergeObjects(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// merge documents
+	result := bson.D{}
+	for _, value := range values {
+		if isNullish(value) {
+			continue
+		}
+		doc, ok := value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s: requires object inputs, but input %v is of type %s", name, value, typeName(value))
+		}
+		for _, el := range doc {
+			result = setField(result, el.Key, el.Value)
+		}
+	}
+
+	return result, nil
+}
+
+// setField sets the field in the document, replacing an existing field in
+// place or appending a new field.
+func setField(doc bson.D, key string, value interface{}) bson.D {
+	for i, el := range doc {
+		if el.Key == key {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.E{Key: key, Value: value})
+}
+
+// evalFieldName evaluates the field argument of $getField and $setField.
+func evalFieldName(ev *Evaluation, name string, expr interface{}) (string, error) {
+	// check constant
+	if doc, ok := expr.(bson.D); ok && (len(doc) != 1 || doc[0].Key != "$literal") {
+		return "", fmt.Errorf("%s: 'field' must evaluate to a constant string", name)
+	} else if str, ok := expr.(string); ok && strings.HasPrefix(str, "$") {
+		return "", fmt.Errorf("%s: 'field' must evaluate to a constant string", name)
+	}
+
+	// evaluate field
+	value, err := ev.Evaluate(expr)
+	if err != nil {
+		return "", err
+	}
+	field, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: 'field' must evaluate to a string, found %s", name, typeName(value))
+	}
+
+	return field, nil
+}
+
+func evalGetField(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// handle shorthand
+	fields := map[string]interface{}{
+		"field": args,
+		"input": "$$CURRENT",
+	}
+	if doc, ok := args.(bson.D); ok && lookupField(doc, "field") != bsonkit.Missing {
+		var err error
+		fields, err = evalObject(name, args, []string{"field"}, "input")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fields["input"]; !ok {
+			fields["input"] = "$$CURRENT"
+		}
+	}
+
+	// get field
+	field, err := evalFieldName(ev, name, fields["field"])
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate input
+	input, err := ev.Evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(input) {
+		return nil, nil
+	}
+
+	// get document
+	doc, ok := input.(bson.D)
+	if !ok {
+		return bsonkit.Missing, nil
+	}
+
+	return lookupField(doc, field), nil
+}
+
+func evalSetField(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"field", "input", "value"})
+	if err != nil {
+		return nil, err
+	}
+
+	// get field
+	field, err := evalFieldName(ev, name, fields["field"])
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate input
+	input, err := ev.Evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(input) {
+		return nil, nil
+	}
+
+	// get document
+	doc, ok := input.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: 'input' must evaluate to an object, found %s", name, typeName(input))
+	}
+
+	// evaluate value
+	value, err := ev.Evaluate(fields["value"])
+	if err != nil {
+		return nil, err
+	}
+
+	// remove field
+	result := make(bson.D, 0, len(doc)+1)
+	if value == bsonkit.Missing {
+		for _, el := range doc {
+			if el.Key != field {
+				result = append(result, el)
+			}
+		}
+		return result, nil
+	}
+
+	// set field
+	result = append(result, doc...)
+
+	return setField(result, field, value), nil
+}
+
+// evalSets evaluates the arguments of a set operator and returns the arrays or
+// whether an argument is null.
+func evalSets(ev *Evaluation, name string, args interface{}, min, max int, nullable bool) ([]bson.A, bool, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, min, max)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// check arguments
+	sets := make([]bson.A, 0, len(values))
+	null := false
+	for _, value := range values {
+		if nullable && isNullish(value) {
+			null = true
+			continue
+		}
+		array, ok := value.(bson.A)
+		if !ok {
+			return nil, false, fmt.Errorf("%s: all operands must be arrays, found %s", name, typeName(value))
+		}
+		sets = append(sets, array)
+	}
+
+	return sets, null, nil
+}
+
+// distinctValues returns the distinct values of the array.
+func distinctValues(array bson.A) bson.A {
+	result := make(bson.A, 0, len(array))
+	for _, item := range array {
+		if !containsValue(result, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// containsValue returns whether the array contains the value.
+func containsValue(array bson.A, value interface{}) bool {
+	for _, item := range array {
+		if bsonkit.Compare(item, value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func evalSetUnion(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get sets
+	sets, null, err := evalSets(ev, name, args, 0, -1, true)
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// compute union
+	var result bson.A
+	for _, set := range sets {
+		result = append(result, set...)
+	}
+
+	return distinctValues(result), nil
+}
+
+func evalSetIntersection(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get sets
+	sets, null, err := evalSets(ev, name, args, 0, -1, true)
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// handle empty
+	if len(sets) == 0 {
+		return bson.A{}, nil
+	}
+
+	// compute intersection
+	result := bson.A{}
+	for _, item := range distinctValues(sets[0]) {
+		found := true
+		for _, set := range sets[1:] {
+			if !containsValue(set, item) {
+				found = false
+				break
+			}
+		}
+		if found {
+			result = append(result, item)
+		}
+	}
+
+	return result, nil
+}
+
+func evalSetDifference(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get sets
+	sets, null, err := evalSets(ev, name, args, 2, 2, true)
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// compute difference
+	result := bson.A{}
+	for _, item := range distinctValues(sets[0]) {
+		if !containsValue(sets[1], item) {
+			result = append(result, item)
+		}
+	}
+
+	return result, nil
+}
+
+func evalSetEquals(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get sets
+	sets, _, err := evalSets(ev, name, args, 2, -1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare sets
+	for _, set := range sets[1:] {
+		if !isSubset(sets[0], set) || !isSubset(set, sets[0]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func evalSetIsSubset(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get sets
+	sets, _, err := evalSets(ev, name, args, 2, 2, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return isSubset(sets[0], sets[1]), nil
+}
+
+// isSubset returns whether all values of a are contained in b.
+func isSubset(a, b bson.A) bool {
+	for _, item := range a {
+		if !containsValue(b, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func evalElementsTrue(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get sets
+	sets, _, err := evalSets(ev, name, args, 1, 1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// check elements
+	want := name == "$anyElementTrue"
+	for _, item := range sets[0] {
+		if truthy(item) == want {
+			return want, nil
+		}
+	}
+
+	return !want, nil
+}
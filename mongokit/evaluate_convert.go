@@ -0,0 +1,395 @@
+package mongokit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register conversion operators
+	AggregationExpressionOperators["$convert"] = evalConvert
+	AggregationExpressionOperators["$toString"] = evalConvertTo
+	AggregationExpressionOperators["$toInt"] = evalConvertTo
+	AggregationExpressionOperators["$toLong"] = evalConvertTo
+	AggregationExpressionOperators["$toDouble"] = evalConvertTo
+	AggregationExpressionOperators["$toDecimal"] = evalConvertTo
+	AggregationExpressionOperators["$toBool"] = evalConvertTo
+	AggregationExpressionOperators["$toDate"] = evalConvertTo
+	AggregationExpressionOperators["$toObjectId"] = evalConvertTo
+
+	// register type operators
+	AggregationExpressionOperators["$type"] = evalType
+	AggregationExpressionOperators["$isNumber"] = evalIsNumber
+}
+
+// the target types of the shorthand conversion operators
+var convertShorthands = map[string]bsontype.Type{
+	"$toString":   bsontype.String,
+	"$toInt":      bsontype.Int32,
+	"$toLong":     bsontype.Int64,
+	"$toDouble":   bsontype.Double,
+	"$toDecimal":  bsontype.Decimal128,
+	"$toBool":     bsontype.Boolean,
+	"$toDate":     bsontype.DateTime,
+	"$toObjectId": bsontype.ObjectID,
+}
+
+func evalConvert(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "to"}, "onError", "onNull")
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate input
+	input, err := ev.Evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate target
+	to, err := ev.Evaluate(fields["to"])
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(input) || isNullish(to) {
+		if expr, ok := fields["onNull"]; ok && isNullish(input) {
+			return ev.Evaluate(expr)
+		}
+		return nil, nil
+	}
+
+	// get type
+	var typ bsontype.Type
+	var ok bool
+	switch value := to.(type) {
+	case string:
+		typ, ok = bsonkit.Alias2Type[value]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown type name: %s", name, value)
+		}
+	default:
+		var num int64
+		num, ok = toInt64(value)
+		if ok {
+			typ, ok = bsonkit.Number2Type[byte(num)]
+		}
+		if !ok || num < 0 || num > math.MaxInt8 {
+			return nil, fmt.Errorf("%s: invalid type %v", name, value)
+		}
+	}
+
+	// convert value
+	res, err := convertValue(name, input, typ)
+	if err != nil {
+		if expr, ok := fields["onError"]; ok {
+			return ev.Evaluate(expr)
+		}
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func evalConvertTo(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+
+	return convertValue(name, values[0], convertShorthands[name])
+}
+
+// convertValue converts the non-null value to the specified type following the
+// rules of the $convert operator.
+func convertValue(name string, v interface{}, typ bsontype.Type) (interface{}, error) {
+	// prepare errors
+	unsupported := fmt.Errorf("%s: unsupported conversion from %s to %s", name, typeName(v), bsonkit.Type2Alias[typ])
+	overflow := fmt.Errorf("%s: conversion would overflow target type", name)
+	failed := func(err string) error {
+		return fmt.Errorf("%s: failed to parse %s %q: %s", name, bsonkit.Type2Alias[typ], v, err)
+	}
+
+	switch typ {
+	case bsontype.Boolean:
+		switch value := v.(type) {
+		case bool:
+			return value, nil
+		case int32, int64, float64, primitive.Decimal128:
+			return truthy(value), nil
+		case primitive.MinKey, primitive.MaxKey, primitive.Undefined, primitive.JavaScript, primitive.Symbol:
+			return nil, unsupported
+		default:
+			return true, nil
+		}
+	case bsontype.Int32, bsontype.Int64:
+		// get range
+		min, max := int64(math.MinInt32), int64(math.MaxInt32)
+		if typ == bsontype.Int64 {
+			min, max = math.MinInt64, math.MaxInt64
+		}
+
+		// get integer
+		var n int64
+		switch value := v.(type) {
+		case bool:
+			if value {
+				n = 1
+			}
+		case int32:
+			n = int64(value)
+		case int64:
+			n = value
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("%s: attempt to convert NaN or infinity value to integer type", name)
+			}
+			t := math.Trunc(value)
+			if t < float64(min) || t >= -float64(min) {
+				return nil, overflow
+			}
+			n = int64(t)
+		case primitive.Decimal128:
+			d, ok := toDecimal(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: attempt to convert NaN or infinity value to integer type", name)
+			}
+			d = d.Truncate(0)
+			if d.LessThan(decimal.NewFromInt(min)) || d.GreaterThan(decimal.NewFromInt(max)) {
+				return nil, overflow
+			}
+			n = d.IntPart()
+		case string:
+			var err error
+			n, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+					return nil, overflow
+				}
+				return nil, failed("did not consume whole string")
+			}
+		case primitive.DateTime:
+			if typ == bsontype.Int32 {
+				return nil, unsupported
+			}
+			n = int64(value)
+		default:
+			return nil, unsupported
+		}
+
+		// check range
+		if n < min || n > max {
+			return nil, overflow
+		}
+		if typ == bsontype.Int32 {
+			return int32(n), nil
+		}
+
+		return n, nil
+	case bsontype.Double:
+		switch value := v.(type) {
+		case bool:
+			if value {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		case int32:
+			return float64(value), nil
+		case int64:
+			return float64(value), nil
+		case float64:
+			return value, nil
+		case primitive.Decimal128:
+			f, _ := toFloat(value)
+			if _, ok := toDecimal(value); ok && math.IsInf(f, 0) {
+				return nil, overflow
+			}
+			return f, nil
+		case string:
+			if strings.ContainsAny(value, "xX_") || strings.TrimSpace(value) != value {
+				return nil, failed("did not consume whole string")
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+					return nil, overflow
+				}
+				return nil, failed("did not consume whole string")
+			}
+			return f, nil
+		case primitive.DateTime:
+			return float64(value), nil
+		default:
+			return nil, unsupported
+		}
+	case bsontype.Decimal128:
+		switch value := v.(type) {
+		case bool:
+			if value {
+				return fromDecimal(decimal.NewFromInt(1)), nil
+			}
+			return fromDecimal(decimal.NewFromInt(0)), nil
+		case int32:
+			return fromDecimal(decimal.NewFromInt(int64(value))), nil
+		case int64:
+			return fromDecimal(decimal.NewFromInt(value)), nil
+		case float64:
+			return doubleToDecimal(value), nil
+		case primitive.Decimal128:
+			return value, nil
+		case string:
+			if strings.TrimSpace(value) != value {
+				return nil, failed("did not consume whole string")
+			}
+			d, err := primitive.ParseDecimal128(value)
+			if err != nil {
+				return nil, failed("did not consume whole string")
+			}
+			return d, nil
+		case primitive.DateTime:
+			return fromDecimal(decimal.NewFromInt(int64(value))), nil
+		default:
+			return nil, unsupported
+		}
+	case bsontype.String:
+		switch value := v.(type) {
+		case bool:
+			return strconv.FormatBool(value), nil
+		case int32, int64, float64, primitive.Decimal128, string, primitive.DateTime:
+			return coerceString(name, value)
+		case primitive.ObjectID:
+			return value.Hex(), nil
+		default:
+			return nil, unsupported
+		}
+	case bsontype.DateTime:
+		switch value := v.(type) {
+		case int64:
+			return primitive.DateTime(value), nil
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("%s: attempt to convert NaN or infinity value to date", name)
+			}
+			t := math.Trunc(value)
+			if t < math.MinInt64 || t >= -math.MinInt64 {
+				return nil, overflow
+			}
+			return primitive.DateTime(int64(t)), nil
+		case primitive.Decimal128:
+			d, ok := toDecimal(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: attempt to convert NaN or infinity value to date", name)
+			}
+			d = d.Truncate(0)
+			if d.LessThan(decimal.NewFromInt(math.MinInt64)) || d.GreaterThan(decimal.NewFromInt(math.MaxInt64)) {
+				return nil, overflow
+			}
+			return primitive.DateTime(d.IntPart()), nil
+		case string:
+			t, err := parseDate(name, value, "", time.UTC, false)
+			if err != nil {
+				return nil, err
+			}
+			return fromTime(t), nil
+		case primitive.DateTime, primitive.Timestamp, primitive.ObjectID:
+			t, err := toTime(name, value)
+			if err != nil {
+				return nil, err
+			}
+			return fromTime(t), nil
+		default:
+			return nil, unsupported
+		}
+	case bsontype.ObjectID:
+		switch value := v.(type) {
+		case primitive.ObjectID:
+			return value, nil
+		case string:
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: failed to parse objectId %q: invalid string length for parsing to OID, expected 24 hex characters", name, value)
+			}
+			return id, nil
+		default:
+			return nil, unsupported
+		}
+	default:
+		return nil, unsupported
+	}
+}
+
+// doubleToDecimal converts a double to a decimal128 value rounded to 15
+// significant digits as done by MongoDB.
+func doubleToDecimal(f float64) primitive.Decimal128 {
+	// handle special values
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return floatToDecimal(f)
+	}
+
+	// round to 15 significant digits
+	d, err := primitive.ParseDecimal128(strconv.FormatFloat(f, 'e', 14, 64))
+	if err != nil {
+		return floatToDecimal(f)
+	}
+
+	return d
+}
+
+// formatDouble formats a double as done by MongoDB when converting doubles to
+// strings.
+func formatDouble(f float64) string {
+	// handle special values
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	// use exponential notation for very large and small numbers
+	abs := math.Abs(f)
+	if abs != 0 && (abs >= 1e21 || abs < 1e-6) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func evalType(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return typeName(values[0]), nil
+}
+
+func evalIsNumber(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return isNumeric(values[0]), nil
+}
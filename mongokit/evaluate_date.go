@@ -0,0 +1,1040 @@
+package mongokit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	// embed the time zone database for systems without one
+	_ "time/tzdata"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register date part operators
+	AggregationExpressionOperators["$year"] = evalDatePart
+	AggregationExpressionOperators["$month"] = evalDatePart
+	AggregationExpressionOperators["$dayOfMonth"] = evalDatePart
+	AggregationExpressionOperators["$hour"] = evalDatePart
+	AggregationExpressionOperators["$minute"] = evalDatePart
+	AggregationExpressionOperators["$second"] = evalDatePart
+	AggregationExpressionOperators["$millisecond"] = evalDatePart
+	AggregationExpressionOperators["$dayOfYear"] = evalDatePart
+	AggregationExpressionOperators["$dayOfWeek"] = evalDatePart
+	AggregationExpressionOperators["$week"] = evalDatePart
+	AggregationExpressionOperators["$isoWeek"] = evalDatePart
+	AggregationExpressionOperators["$isoWeekYear"] = evalDatePart
+	AggregationExpressionOperators["$isoDayOfWeek"] = evalDatePart
+
+	// register date operators
+	AggregationExpressionOperators["$dateToString"] = evalDateToString
+	AggregationExpressionOperators["$dateFromString"] = evalDateFromString
+	AggregationExpressionOperators["$dateToParts"] = evalDateToParts
+	AggregationExpressionOperators["$dateFromParts"] = evalDateFromParts
+	AggregationExpressionOperators["$dateAdd"] = evalDateAdd
+	AggregationExpressionOperators["$dateSubtract"] = evalDateAdd
+	AggregationExpressionOperators["$dateDiff"] = evalDateDiff
+	AggregationExpressionOperators["$dateTrunc"] = evalDateTrunc
+}
+
+// the default date format
+const defaultDateFormat = "%Y-%m-%dT%H:%M:%S.%LZ"
+
+// the reference point used to compute date bins
+var dateReference = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// the date units and their duration for fixed size units
+var dateUnits = map[string]time.Duration{
+	"year":        0,
+	"quarter":     0,
+	"month":       0,
+	"week":        0,
+	"day":         0,
+	"hour":        time.Hour,
+	"minute":      time.Minute,
+	"second":      time.Second,
+	"millisecond": time.Millisecond,
+}
+
+// toTime converts a date, timestamp or object id to a time.
+func toTime(name string, v interface{}) (time.Time, error) {
+	switch value := v.(type) {
+	case primitive.DateTime:
+		return time.UnixMilli(int64(value)).UTC(), nil
+	case primitive.Timestamp:
+		return time.Unix(int64(value.T), 0).UTC(), nil
+	case primitive.ObjectID:
+		return value.Timestamp().UTC(), nil
+	default:
+		return time.Time{}, fmt.Errorf("%s: cannot convert from BSON type %s to date", name, typeName(v))
+	}
+}
+
+// fromTime converts a time to a date.
+func fromTime(t time.Time) primitive.DateTime {
+	return primitive.DateTime(t.UnixMilli())
+}
+
+// parseTimezone parses an Olson time zone identifier or UTC offset.
+func parseTimezone(name string, v interface{}) (*time.Location, error) {
+	// check value
+	if isNullish(v) {
+		return time.UTC, nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: timezone must be a string, not %s", name, typeName(v))
+	}
+
+	// handle offsets
+	if strings.HasPrefix(str, "+") || strings.HasPrefix(str, "-") {
+		offset, ok := parseOffset(str)
+		if !ok {
+			return nil, fmt.Errorf("%s: unrecognized time zone identifier: %q", name, str)
+		}
+		return time.FixedZone(str, offset), nil
+	}
+
+	// load location
+	loc, err := time.LoadLocation(str)
+	if err != nil || str == "" || str == "Local" {
+		return nil, fmt.Errorf("%s: unrecognized time zone identifier: %q", name, str)
+	}
+
+	return loc, nil
+}
+
+// parseOffset parses a UTC offset in the form +hh, +hhmm or +hh:mm and returns
+// the offset in seconds.
+func parseOffset(str string) (int, bool) {
+	// get sign
+	sign := 1
+	if str[0] == '-' {
+		sign = -1
+	}
+	str = strings.ReplaceAll(str[1:], ":", "")
+
+	// check length
+	if len(str) != 2 && len(str) != 4 {
+		return 0, false
+	}
+
+	// parse hours and minutes
+	hours, err := strconv.Atoi(str[:2])
+	if err != nil {
+		return 0, false
+	}
+	var minutes int
+	if len(str) == 4 {
+		minutes, err = strconv.Atoi(str[2:])
+		if err != nil || minutes >= 60 {
+			return 0, false
+		}
+	}
+
+	return sign * (hours*3600 + minutes*60), true
+}
+
+// evalDateArgs evaluates the arguments of operators that accept either a date
+// or a document with a date and other fields.
+func evalDateArgs(ev *Evaluation, name string, args interface{}, required []string, optional ...string) (map[string]interface{}, error) {
+	// handle document form
+	if doc, ok := args.(bson.D); ok && len(doc) > 0 && !strings.HasPrefix(doc[0].Key, "$") {
+		fields, err := evalObject(name, doc, required, optional...)
+		if err != nil {
+			return nil, err
+		}
+		for key, expr := range fields {
+			fields[key], err = ev.Evaluate(expr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	}
+
+	// handle single argument form
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"date": values[0],
+	}, nil
+}
+
+// getDate returns the date field in the specified time zone.
+func getDate(name string, fields map[string]interface{}, key string) (time.Time, bool, error) {
+	// check null
+	value := fields[key]
+	if isNullish(value) {
+		return time.Time{}, true, nil
+	}
+
+	// get time zone
+	loc, err := parseTimezone(name, fields["timezone"])
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	// get time
+	t, err := toTime(name, value)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return t.In(loc), false, nil
+}
+
+func evalDatePart(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	fields, err := evalDateArgs(ev, name, args, []string{"date"}, "timezone")
+	if err != nil {
+		return nil, err
+	}
+
+	// check time zone
+	if tz, ok := fields["timezone"]; ok && isNullish(tz) {
+		return nil, nil
+	}
+
+	// get date
+	t, null, err := getDate(name, fields, "date")
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// get part
+	switch name {
+	case "$year":
+		return int32(t.Year()), nil
+	case "$month":
+		return int32(t.Month()), nil
+	case "$dayOfMonth":
+		return int32(t.Day()), nil
+	case "$hour":
+		return int32(t.Hour()), nil
+	case "$minute":
+		return int32(t.Minute()), nil
+	case "$second":
+		return int32(t.Second()), nil
+	case "$millisecond":
+		return int32(t.Nanosecond() / int(time.Millisecond)), nil
+	case "$dayOfYear":
+		return int32(t.YearDay()), nil
+	case "$dayOfWeek":
+		return int32(t.Weekday()) + 1, nil
+	case "$week":
+		return int32((t.YearDay() + 6 - int(t.Weekday())) / 7), nil
+	case "$isoWeek":
+		_, week := t.ISOWeek()
+		return int32(week), nil
+	case "$isoWeekYear":
+		year, _ := t.ISOWeek()
+		return int32(year), nil
+	case "$isoDayOfWeek":
+		return int32((int(t.Weekday())+6)%7) + 1, nil
+	default:
+		return nil, fmt.Errorf("unknown date operator %q", name)
+	}
+}
+
+func evalDateToString(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"date"}, "format", "timezone", "onNull")
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate date
+	date, err := ev.Evaluate(fields["date"])
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(date) {
+		if expr, ok := fields["onNull"]; ok {
+			return ev.Evaluate(expr)
+		}
+		return nil, nil
+	}
+
+	// evaluate format
+	format := defaultDateFormat
+	if expr, ok := fields["format"]; ok {
+		value, err := ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(value) {
+			return nil, nil
+		}
+		format, ok = value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: format must be a string, not %s", name, typeName(value))
+		}
+	}
+
+	// evaluate time zone
+	var timezone interface{}
+	if expr, ok := fields["timezone"]; ok {
+		timezone, err = ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(timezone) {
+			return nil, nil
+		}
+	}
+
+	// get date
+	t, _, err := getDate(name, map[string]interface{}{
+		"date":     date,
+		"timezone": timezone,
+	}, "date")
+	if err != nil {
+		return nil, err
+	}
+
+	return formatDate(name, t, format)
+}
+
+func formatDate(name string, t time.Time, format string) (string, error) {
+	// prepare builder
+	var builder strings.Builder
+
+	// format date
+	for i := 0; i < len(format); i++ {
+		// write plain characters
+		if format[i] != '%' {
+			builder.WriteByte(format[i])
+			continue
+		}
+
+		// check specifier
+		if i+1 >= len(format) {
+			return "", fmt.Errorf("%s: unmatched '%%' at end of format string", name)
+		}
+		i++
+
+		// write specifier
+		isoYear, isoWeek := t.ISOWeek()
+		switch format[i] {
+		case 'd':
+			builder.WriteString(fmt.Sprintf("%02d", t.Day()))
+		case 'G':
+			builder.WriteString(fmt.Sprintf("%04d", isoYear))
+		case 'H':
+			builder.WriteString(fmt.Sprintf("%02d", t.Hour()))
+		case 'j':
+			builder.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'L':
+			builder.WriteString(fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond)))
+		case 'm':
+			builder.WriteString(fmt.Sprintf("%02d", int(t.Month())))
+		case 'M':
+			builder.WriteString(fmt.Sprintf("%02d", t.Minute()))
+		case 'S':
+			builder.WriteString(fmt.Sprintf("%02d", t.Second()))
+		case 'w':
+			builder.WriteString(strconv.Itoa(int(t.Weekday()) + 1))
+		case 'u':
+			builder.WriteString(strconv.Itoa((int(t.Weekday())+6)%7 + 1))
+		case 'U':
+			builder.WriteString(fmt.Sprintf("%02d", (t.YearDay()+6-int(t.Weekday()))/7))
+		case 'V':
+			builder.WriteString(fmt.Sprintf("%02d", isoWeek))
+		case 'Y':
+			builder.WriteString(fmt.Sprintf("%04d", t.Year()))
+		case 'z':
+			_, offset := t.Zone()
+			sign := '+'
+			if offset < 0 {
+				sign = '-'
+				offset = -offset
+			}
+			builder.WriteString(fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset%3600/60))
+		case 'Z':
+			_, offset := t.Zone()
+			builder.WriteString(fmt.Sprintf("%+d", offset/60))
+		case 'b':
+			builder.WriteString(t.Month().String()[:3])
+		case 'B':
+			builder.WriteString(t.Month().String())
+		case '%':
+			builder.WriteByte('%')
+		default:
+			return "", fmt.Errorf("%s: invalid format character '%%%c' in format string", name, format[i])
+		}
+	}
+
+	return builder.String(), nil
+}
+
+func evalDateFromString(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"dateString"}, "format", "timezone", "onError", "onNull")
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate date string
+	value, err := ev.Evaluate(fields["dateString"])
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(value) {
+		if expr, ok := fields["onNull"]; ok {
+			return ev.Evaluate(expr)
+		}
+		return nil, nil
+	}
+
+	// evaluate format
+	var format string
+	if expr, ok := fields["format"]; ok {
+		value, err := ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(value) {
+			return nil, nil
+		}
+		format, ok = value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: format must be a string, not %s", name, typeName(value))
+		}
+	}
+
+	// evaluate time zone
+	loc := time.UTC
+	var hasZone bool
+	if expr, ok := fields["timezone"]; ok {
+		timezone, err := ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(timezone) {
+			return nil, nil
+		}
+		loc, err = parseTimezone(name, timezone)
+		if err != nil {
+			return nil, err
+		}
+		hasZone = true
+	}
+
+	// parse string
+	var t time.Time
+	str, ok := value.(string)
+	if !ok {
+		err = fmt.Errorf("%s: requires dateString to be a string, found %s", name, typeName(value))
+	} else {
+		t, err = parseDate(name, str, format, loc, hasZone)
+	}
+
+	// handle errors
+	if err != nil {
+		if expr, ok := fields["onError"]; ok {
+			return ev.Evaluate(expr)
+		}
+		return nil, err
+	}
+
+	return fromTime(t), nil
+}
+
+// the layouts used to parse dates without a format
+var dateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05.999999999",
+	"2006/01/02",
+	"January 2, 2006 15:04:05",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"Jan 2 2006",
+}
+
+func parseDate(name, str, format string, loc *time.Location, hasZone bool) (time.Time, error) {
+	// parse with format
+	if format != "" {
+		return parseDateFormat(name, str, format, loc, hasZone)
+	}
+
+	// parse with layouts
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, str, loc)
+		if err != nil {
+			continue
+		}
+
+		// check conflicting time zones
+		if hasZone && strings.Contains(layout, "Z07") {
+			return time.Time{}, fmt.Errorf("%s: you cannot pass in a date/time string with time zone information together with a timezone argument", name)
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("%s: error parsing date string %q", name, str)
+}
+
+func parseDateFormat(name, str, format string, loc *time.Location, hasZone bool) (time.Time, error) {
+	// prepare parts
+	year, month, day := 1970, 1, 1
+	var hour, minute, second, milli int
+	var isoYear, isoWeek, isoDay int
+	var offset *int
+
+	// prepare error
+	parseErr := fmt.Errorf("%s: error parsing date string %q with format %q", name, str, format)
+
+	// read number helper
+	pos := 0
+	readNumber := func(min, max int) (int, bool) {
+		start := pos
+		if pos < len(str) && (str[pos] == '+' || str[pos] == '-') && min == 0 {
+			pos++
+		}
+		for pos < len(str) && pos-start < max && str[pos] >= '0' && str[pos] <= '9' {
+			pos++
+		}
+		if pos-start < min || pos == start {
+			return 0, false
+		}
+		n, err := strconv.Atoi(str[start:pos])
+		return n, err == nil
+	}
+
+	// parse string
+	for i := 0; i < len(format); i++ {
+		// match plain characters
+		if format[i] != '%' {
+			if pos >= len(str) || str[pos] != format[i] {
+				return time.Time{}, parseErr
+			}
+			pos++
+			continue
+		}
+
+		// check specifier
+		if i+1 >= len(format) {
+			return time.Time{}, fmt.Errorf("%s: unmatched '%%' at end of format string", name)
+		}
+		i++
+
+		// parse specifier
+		var ok = true
+		switch format[i] {
+		case 'Y':
+			year, ok = readNumber(4, 4)
+		case 'm':
+			month, ok = readNumber(1, 2)
+		case 'd':
+			day, ok = readNumber(1, 2)
+		case 'H':
+			hour, ok = readNumber(1, 2)
+		case 'M':
+			minute, ok = readNumber(1, 2)
+		case 'S':
+			second, ok = readNumber(1, 2)
+		case 'L':
+			start := pos
+			milli, ok = readNumber(1, 3)
+			for n := pos - start; ok && n < 3; n++ {
+				milli *= 10
+			}
+		case 'j':
+			var yday int
+			yday, ok = readNumber(1, 3)
+			month, day = 1, yday
+		case 'G':
+			isoYear, ok = readNumber(4, 4)
+		case 'V':
+			isoWeek, ok = readNumber(1, 2)
+		case 'u':
+			isoDay, ok = readNumber(1, 1)
+		case 'z':
+			end := pos + 1
+			for end < len(str) && (str[end] >= '0' && str[end] <= '9' || str[end] == ':') {
+				end++
+			}
+			var off int
+			if pos < len(str) && str[pos] == 'Z' {
+				end = pos + 1
+			} else if pos >= len(str) {
+				ok = false
+				break
+			} else {
+				off, ok = parseOffset(str[pos:end])
+			}
+			offset = &off
+			pos = end
+		case 'Z':
+			var minutes int
+			minutes, ok = readNumber(0, 5)
+			off := minutes * 60
+			offset = &off
+		case '%':
+			ok = pos < len(str) && str[pos] == '%'
+			pos++
+		default:
+			return time.Time{}, fmt.Errorf("%s: invalid format character '%%%c' in format string", name, format[i])
+		}
+		if !ok {
+			return time.Time{}, parseErr
+		}
+	}
+
+	// check remainder
+	if pos != len(str) {
+		return time.Time{}, parseErr
+	}
+
+	// check conflicting time zones
+	if offset != nil {
+		if hasZone {
+			return time.Time{}, fmt.Errorf("%s: you cannot pass in a date/time string with time zone information together with a timezone argument", name)
+		}
+		loc = time.FixedZone("", *offset)
+	}
+
+	// build ISO date
+	if isoYear != 0 {
+		if isoWeek == 0 {
+			isoWeek = 1
+		}
+		if isoDay == 0 {
+			isoDay = 1
+		}
+		t := isoDate(isoYear, isoWeek, isoDay, loc)
+		return time.Date(t.Year(), t.Month(), t.Day(), hour, minute, second, milli*int(time.Millisecond), loc), nil
+	}
+
+	// check ranges
+	if month < 1 || month > 12 || day < 1 || (day > 31 && month != 1) || hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, parseErr
+	}
+
+	return time.Date(year, time.Month(month), day, hour, minute, second, milli*int(time.Millisecond), loc), nil
+}
+
+// isoDate returns the date of the specified ISO week date.
+func isoDate(year, week, day int, loc *time.Location) time.Time {
+	// get monday of the first week (the week with january 4th)
+	jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, loc)
+	monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+
+	return monday.AddDate(0, 0, (week-1)*7+(day-1))
+}
+
+func evalDateToParts(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalDateArgs(ev, name, args, []string{"date"}, "timezone", "iso8601")
+	if err != nil {
+		return nil, err
+	}
+
+	// get date
+	t, null, err := getDate(name, fields, "date")
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	}
+
+	// get iso
+	iso, ok := fields["iso8601"]
+	if ok && !isNullish(iso) {
+		if _, ok := iso.(bool); !ok {
+			return nil, fmt.Errorf("%s: iso8601 must be a boolean, not %s", name, typeName(iso))
+		}
+	}
+
+	// get time parts
+	timeParts := bson.D{
+		{Key: "hour", Value: int32(t.Hour())},
+		{Key: "minute", Value: int32(t.Minute())},
+		{Key: "second", Value: int32(t.Second())},
+		{Key: "millisecond", Value: int32(t.Nanosecond() / int(time.Millisecond))},
+	}
+
+	// handle iso
+	if iso == true {
+		year, week := t.ISOWeek()
+		return append(bson.D{
+			{Key: "isoWeekYear", Value: int32(year)},
+			{Key: "isoWeek", Value: int32(week)},
+			{Key: "isoDayOfWeek", Value: int32((int(t.Weekday())+6)%7) + 1},
+		}, timeParts...), nil
+	}
+
+	return append(bson.D{
+		{Key: "year", Value: int32(t.Year())},
+		{Key: "month", Value: int32(t.Month())},
+		{Key: "day", Value: int32(t.Day())},
+	}, timeParts...), nil
+}
+
+func evalDateFromParts(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// check form
+	doc, ok := args.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected document", name)
+	}
+	iso := lookupField(doc, "isoWeekYear") != bsonkit.Missing
+
+	// get fields
+	var fields map[string]interface{}
+	var err error
+	if iso {
+		fields, err = evalDateArgs(ev, name, args, []string{"isoWeekYear"}, "isoWeek", "isoDayOfWeek", "hour", "minute", "second", "millisecond", "timezone")
+	} else {
+		fields, err = evalDateArgs(ev, name, args, []string{"year"}, "month", "day", "hour", "minute", "second", "millisecond", "timezone")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// get parts
+	parts := map[string]int{}
+	for key, value := range fields {
+		// skip time zone
+		if key == "timezone" {
+			continue
+		}
+
+		// handle null
+		if isNullish(value) {
+			return nil, nil
+		}
+
+		// check value
+		n, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("%s: '%s' must evaluate to an integer, found %s", name, key, typeName(value))
+		}
+
+		// check range
+		if key == "year" || key == "isoWeekYear" {
+			if n < 1 || n > 9999 {
+				return nil, fmt.Errorf("%s: '%s' must evaluate to an integer in the range 1 to 9999, found %d", name, key, n)
+			}
+		} else if n < -32768 || n > 32767 {
+			return nil, fmt.Errorf("%s: '%s' must evaluate to a value in the range [-32768, 32767], found %d", name, key, n)
+		}
+
+		parts[key] = int(n)
+	}
+
+	// handle null time zone
+	if tz, ok := fields["timezone"]; ok && isNullish(tz) {
+		return nil, nil
+	}
+
+	// get time zone
+	loc, err := parseTimezone(name, fields["timezone"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get optional part
+	get := func(key string, def int) int {
+		if n, ok := parts[key]; ok {
+			return n
+		}
+		return def
+	}
+
+	// get time
+	nsec := get("millisecond", 0) * int(time.Millisecond)
+	if iso {
+		t := isoDate(parts["isoWeekYear"], get("isoWeek", 1), get("isoDayOfWeek", 1), loc)
+		return fromTime(time.Date(t.Year(), t.Month(), t.Day(), get("hour", 0), get("minute", 0), get("second", 0), nsec, loc)), nil
+	}
+
+	return fromTime(time.Date(parts["year"], time.Month(get("month", 1)), get("day", 1), get("hour", 0), get("minute", 0), get("second", 0), nsec, loc)), nil
+}
+
+// getUnit returns the unit field.
+func getUnit(name string, v interface{}) (string, error) {
+	unit, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: unit must be a string, not %s", name, typeName(v))
+	} else if _, ok := dateUnits[unit]; !ok {
+		return "", fmt.Errorf("%s: unknown time unit value: %s", name, unit)
+	}
+	return unit, nil
+}
+
+// getStartOfWeek returns the start of week field.
+func getStartOfWeek(name string, v interface{}) (time.Weekday, error) {
+	// handle default
+	if v == nil {
+		return time.Sunday, nil
+	}
+
+	// get day
+	day, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("%s: startOfWeek must be a string, not %s", name, typeName(v))
+	}
+
+	// parse day
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		full := strings.ToLower(d.String())
+		if strings.ToLower(day) == full || strings.ToLower(day) == full[:3] {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s: unknown day of week value: %s", name, day)
+}
+
+// addDate adds the amount of units to the time.
+func addDate(t time.Time, unit string, amount int64) time.Time {
+	// add months clamping the day to the last day of the month
+	addMonths := func(months int64) time.Time {
+		first := time.Date(t.Year(), t.Month(), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+		first = first.AddDate(0, int(months), 0)
+		last := first.AddDate(0, 1, -1).Day()
+		day := t.Day()
+		if day > last {
+			day = last
+		}
+		return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	}
+
+	switch unit {
+	case "year":
+		return addMonths(amount * 12)
+	case "quarter":
+		return addMonths(amount * 3)
+	case "month":
+		return addMonths(amount)
+	case "week":
+		return t.AddDate(0, 0, int(amount)*7)
+	case "day":
+		return t.AddDate(0, 0, int(amount))
+	default:
+		return t.Add(time.Duration(amount) * dateUnits[unit])
+	}
+}
+
+func evalDateAdd(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalDateArgs(ev, name, args, []string{"startDate", "unit", "amount"}, "timezone")
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	for _, value := range fields {
+		if isNullish(value) {
+			return nil, nil
+		}
+	}
+
+	// get date
+	t, _, err := getDate(name, fields, "startDate")
+	if err != nil {
+		return nil, err
+	}
+
+	// get unit
+	unit, err := getUnit(name, fields["unit"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get amount
+	amount, ok := toInt64(fields["amount"])
+	if !ok {
+		return nil, fmt.Errorf("%s: amount must be an integer, found %s", name, typeName(fields["amount"]))
+	}
+	if name == "$dateSubtract" {
+		amount = -amount
+	}
+
+	return fromTime(addDate(t, unit, amount)), nil
+}
+
+// localMillis returns the milliseconds since the epoch in the local time zone.
+func localMillis(t time.Time) int64 {
+	_, offset := t.Zone()
+	return t.UnixMilli() + int64(offset)*1000
+}
+
+// civilDays returns the number of days since the epoch of the local date.
+func civilDays(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+func evalDateDiff(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalDateArgs(ev, name, args, []string{"startDate", "endDate", "unit"}, "timezone", "startOfWeek")
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	for _, value := range fields {
+		if isNullish(value) {
+			return nil, nil
+		}
+	}
+
+	// get dates
+	start, _, err := getDate(name, fields, "startDate")
+	if err != nil {
+		return nil, err
+	}
+	end, _, err := getDate(name, fields, "endDate")
+	if err != nil {
+		return nil, err
+	}
+
+	// get unit
+	unit, err := getUnit(name, fields["unit"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get start of week
+	startOfWeek, err := getStartOfWeek(name, fields["startOfWeek"])
+	if err != nil {
+		return nil, err
+	}
+
+	// compute difference
+	switch unit {
+	case "year":
+		return int64(end.Year() - start.Year()), nil
+	case "quarter":
+		q := func(t time.Time) int64 { return int64(t.Year())*4 + int64(t.Month()-1)/3 }
+		return q(end) - q(start), nil
+	case "month":
+		m := func(t time.Time) int64 { return int64(t.Year())*12 + int64(t.Month()-1) }
+		return m(end) - m(start), nil
+	case "week":
+		w := func(t time.Time) int64 {
+			days := civilDays(t)
+			// the epoch was a thursday
+			shift := (int64(time.Thursday) - int64(startOfWeek) + 7) % 7
+			return floorDiv(days+shift, 7)
+		}
+		return w(end) - w(start), nil
+	case "day":
+		return civilDays(end) - civilDays(start), nil
+	default:
+		ms := dateUnits[unit].Milliseconds()
+		return floorDiv(localMillis(end), ms) - floorDiv(localMillis(start), ms), nil
+	}
+}
+
+func evalDateTrunc(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalDateArgs(ev, name, args, []string{"date", "unit"}, "binSize", "timezone", "startOfWeek")
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	for _, value := range fields {
+		if isNullish(value) {
+			return nil, nil
+		}
+	}
+
+	// get date
+	t, _, err := getDate(name, fields, "date")
+	if err != nil {
+		return nil, err
+	}
+
+	// get unit
+	unit, err := getUnit(name, fields["unit"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get bin size
+	binSize := int64(1)
+	if value, ok := fields["binSize"]; ok {
+		binSize, ok = toInt64(value)
+		if !ok || binSize <= 0 {
+			return nil, fmt.Errorf("%s: binSize must be a positive integer", name)
+		}
+	}
+
+	// get start of week
+	startOfWeek, err := getStartOfWeek(name, fields["startOfWeek"])
+	if err != nil {
+		return nil, err
+	}
+
+	// get location
+	loc := t.Location()
+
+	// truncate date
+	var res time.Time
+	switch unit {
+	case "year", "quarter", "month":
+		months := map[string]int64{"year": 12, "quarter": 3, "month": 1}[unit] * binSize
+		n := int64(t.Year()-2000)*12 + int64(t.Month()-1)
+		n = floorDiv(n, months) * months
+		res = time.Date(2000+int(floorDiv(n, 12)), time.Month(n-floorDiv(n, 12)*12+1), 1, 0, 0, 0, 0, loc)
+	case "week", "day":
+		days := binSize
+		ref := civilDays(dateReference)
+		if unit == "week" {
+			days *= 7
+			ref += (int64(startOfWeek) - int64(dateReference.Weekday()) + 7) % 7
+		}
+		n := ref + floorDiv(civilDays(t)-ref, days)*days
+		d := time.Unix(n*86400, 0).UTC()
+		res = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc)
+	default:
+		ms := dateUnits[unit].Milliseconds() * binSize
+		ref := dateReference.UnixMilli()
+		n := ref + floorDiv(localMillis(t)-ref, ms)*ms
+		d := time.UnixMilli(n).UTC()
+		res = time.Date(d.Year(), d.Month(), d.Day(), d.Hour(), d.Minute(), d.Second(), d.Nanosecond(), loc)
+	}
+
+	// check range
+	if res.UnixMilli() < math.MinInt64/2 {
+		return nil, fmt.Errorf("%s: date overflow", name)
+	}
+
+	return fromTime(res), nil
+}
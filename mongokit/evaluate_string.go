@@ -0,0 +1,655 @@
+package mongokit
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func init() {
+	// register string operators
+	AggregationExpressionOperators["$concat"] = evalConcat
+	AggregationExpressionOperators["$substr"] = evalSubstrBytes
+	AggregationExpressionOperators["$substrBytes"] = evalSubstrBytes
+	AggregationExpressionOperators["$substrCP"] = evalSubstrCP
+	AggregationExpressionOperators["$toLower"] = evalToCase
+	AggregationExpressionOperators["$toUpper"] = evalToCase
+	AggregationExpressionOperators["$trim"] = evalTrim
+	AggregationExpressionOperators["$ltrim"] = evalTrim
+	AggregationExpressionOperators["$rtrim"] = evalTrim
+	AggregationExpressionOperators["$split"] = evalSplit
+	AggregationExpressionOperators["$strLenBytes"] = evalStrLen
+	AggregationExpressionOperators["$strLenCP"] = evalStrLen
+	AggregationExpressionOperators["$indexOfBytes"] = evalIndexOf
+	AggregationExpressionOperators["$indexOfCP"] = evalIndexOf
+	AggregationExpressionOperators["$strcasecmp"] = evalStrcasecmp
+	AggregationExpressionOperators["$replaceOne"] = evalReplace
+	AggregationExpressionOperators["$replaceAll"] = evalReplace
+	AggregationExpressionOperators["$regexMatch"] = evalRegex
+	AggregationExpressionOperators["$regexFind"] = evalRegex
+	AggregationExpressionOperators["$regexFindAll"] = evalRegex
+}
+
+// the code points trimmed by default
+const trimWhitespace = "\u0000\u0020\u0009\u000A\u000B\u000C\u000D\u00A0\u1680" +
+	"\u2000\u2001\u2002\u2003\u2004\u2005\u2006\u2007\u2008\u2009\u200A" +
+	"\u2028\u2029\u202F\u205F\u3000"
+
+// coerceString converts a value to a string as done by the string operators
+// that accept non-string arguments. Null and missing values become an empty
+// string.
+func coerceString(name string, v interface{}) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case int32:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return formatDouble(value), nil
+	case primitive.Decimal128:
+		return value.String(), nil
+	case primitive.DateTime:
+		return value.Time().UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	case primitive.Timestamp:
+		return fmt.Sprintf("Timestamp(%d, %d)", value.T, value.I), nil
+	case primitive.Symbol:
+		return string(value), nil
+	default:
+		if isNullish(value) {
+			return "", nil
+		}
+		return "", fmt.Errorf("%s: cannot convert from BSON type %s to string", name, typeName(value))
+	}
+}
+
+// toIndex returns the value of a non-negative integral number.
+func toIndex(name, what string, v interface{}) (int, error) {
+	n, ok := toInt64(v)
+	if !ok || n < 0 || int64(int(n)) != n {
+		return 0, fmt.Errorf("%s: %s must be a nonnegative integer", name, what)
+	}
+	return int(n), nil
+}
+
+func evalConcat(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// concatenate strings
+	var null bool
+	var builder strings.Builder
+	for _, value := range values {
+		switch value := value.(type) {
+		case string:
+			builder.WriteString(value)
+		default:
+			if !isNullish(value) {
+				return nil, fmt.Errorf("%s: only supports strings, not %s", name, typeName(value))
+			}
+			null = true
+		}
+	}
+
+	// handle null
+	if null {
+		return nil, nil
+	}
+
+	return builder.String(), nil
+}
+
+func evalSubstrBytes(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 3, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// get string
+	str, err := coerceString(name, values[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// get start
+	if !isNumeric(values[1]) {
+		return nil, fmt.Errorf("%s: starting index must be a numeric type, not %s", name, typeName(values[1]))
+	}
+	start, ok := roundInt64(values[1])
+	if !ok || start < 0 {
+		return "", nil
+	}
+
+	// get length
+	if !isNumeric(values[2]) {
+		return nil, fmt.Errorf("%s: length must be a numeric type, not %s", name, typeName(values[2]))
+	}
+	length, ok := roundInt64(values[2])
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid length", name)
+	}
+
+	// handle start beyond string
+	if start >= int64(len(str)) {
+		return "", nil
+	}
+
+	// check start
+	if !utf8.RuneStart(str[start]) {
+		return nil, fmt.Errorf("%s: invalid range, starting index is a UTF-8 continuation byte", name)
+	}
+
+	// get end
+	end := int64(len(str))
+	if length >= 0 && start+length < end {
+		end = start + length
+	}
+
+	// check end
+	if end < int64(len(str)) && !utf8.RuneStart(str[end]) {
+		return nil, fmt.Errorf("%s: invalid range, ending index is in the middle of a UTF-8 character", name)
+	}
+
+	return str[start:end], nil
+}
+
+func evalSubstrCP(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 3, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// get string
+	str, err := coerceString(name, values[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// get start and length
+	start, err := toIndex(name, "starting index", values[1])
+	if err != nil {
+		return nil, err
+	}
+	length, err := toIndex(name, "length", values[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// get code points
+	runes := []rune(str)
+	if start >= len(runes) {
+		return "", nil
+	}
+	end := len(runes)
+	if start+length < end {
+		end = start + length
+	}
+
+	return string(runes[start:end]), nil
+}
+
+func evalToCase(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// get string
+	str, err := coerceString(name, values[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return asciiCase(str, name == "$toUpper"), nil
+}
+
+// asciiCase maps the ASCII characters of the string to upper or lower case.
+func asciiCase(str string, upper bool) string {
+	buf := []byte(str)
+	for i, c := range buf {
+		if !upper && c >= 'A' && c <= 'Z' {
+			buf[i] = c + ('a' - 'A')
+		} else if upper && c >= 'a' && c <= 'z' {
+			buf[i] = c - ('a' - 'A')
+		}
+	}
+
+	return string(buf)
+}
+
+func evalTrim(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input"}, "chars")
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate input
+	input, err := ev.Evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// check input
+	if isNullish(input) {
+		return nil, nil
+	}
+	str, ok := input.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: input must be a string, not %s", name, typeName(input))
+	}
+
+	// get characters
+	chars := trimWhitespace
+	if expr, ok := fields["chars"]; ok {
+		value, err := ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(value) {
+			return nil, nil
+		}
+		chars, ok = value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: chars must be a string, not %s", name, typeName(value))
+		}
+	}
+
+	// trim string
+	switch name {
+	case "$ltrim":
+		return strings.TrimLeft(str, chars), nil
+	case "$rtrim":
+		return strings.TrimRight(str, chars), nil
+	default:
+		return strings.Trim(str, chars), nil
+	}
+}
+
+func evalSplit(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) || isNullish(values[1]) {
+		return nil, nil
+	}
+
+	// check arguments
+	str, ok := values[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: string must be a string, not %s", name, typeName(values[0]))
+	}
+	sep, ok := values[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: separator must be a string, not %s", name, typeName(values[1]))
+	} else if sep == "" {
+		return nil, fmt.Errorf("%s: separator must not be empty", name)
+	}
+
+	// split string
+	parts := strings.Split(str, sep)
+	array := make(bson.A, 0, len(parts))
+	for _, part := range parts {
+		array = append(array, part)
+	}
+
+	return array, nil
+}
+
+func evalStrLen(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate argument
+	values, err := evalArgs(ev, name, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// check argument
+	str, ok := values[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: requires a string argument, found %s", name, typeName(values[0]))
+	}
+
+	// count bytes or code points
+	if name == "$strLenBytes" {
+		return int32(len(str)), nil
+	}
+
+	return int32(utf8.RuneCountInString(str)), nil
+}
+
+func evalIndexOf(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle null
+	if isNullish(values[0]) {
+		return nil, nil
+	}
+
+	// check arguments
+	str, ok := values[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: string must be a string, not %s", name, typeName(values[0]))
+	}
+	sub, ok := values[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: substring must be a string, not %s", name, typeName(values[1]))
+	}
+
+	// get units
+	var units []string
+	if name == "$indexOfCP" {
+		units = make([]string, 0, len(str))
+		for _, r := range str {
+			units = append(units, string(r))
+		}
+	} else {
+		units = make([]string, 0, len(str))
+		for i := 0; i < len(str); i++ {
+			units = append(units, str[i:i+1])
+		}
+	}
+
+	// get start and end
+	start := 0
+	end := len(units)
+	if len(values) > 2 {
+		start, err = toIndex(name, "starting index", values[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(values) > 3 {
+		end, err = toIndex(name, "ending index", values[3])
+		if err != nil {
+			return nil, err
+		}
+		if end > len(units) {
+			end = len(units)
+		}
+	}
+
+	// check range
+	if start > end || start > len(units) {
+		return int32(-1), nil
+	}
+
+	// search substring
+	window := strings.Join(units[start:end], "")
+	idx := strings.Index(window, sub)
+	if idx < 0 {
+		return int32(-1), nil
+	}
+
+	// convert byte offset to code points
+	if name == "$indexOfCP" {
+		idx = utf8.RuneCountInString(window[:idx])
+	}
+
+	return int32(start + idx), nil
+}
+
+func evalStrcasecmp(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// evaluate arguments
+	values, err := evalArgs(ev, name, args, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// get strings
+	a, err := coerceString(name, values[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := coerceString(name, values[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// compare upper case strings
+	return int32(strings.Compare(asciiCase(a, true), asciiCase(b, true))), nil
+}
+
+func evalReplace(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "find", "replacement"})
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate fields
+	var strs [3]string
+	var null bool
+	for i, key := range []string{"input", "find", "replacement"} {
+		value, err := ev.Evaluate(fields[key])
+		if err != nil {
+			return nil, err
+		}
+		if isNullish(value) {
+			null = true
+			continue
+		}
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a string, not %s", name, key, typeName(value))
+		}
+		strs[i] = str
+	}
+
+	// handle null
+	if null {
+		return nil, nil
+	}
+
+	// replace string
+	if name == "$replaceOne" {
+		return strings.Replace(strs[0], strs[1], strs[2], 1), nil
+	}
+
+	return strings.ReplaceAll(strs[0], strs[1], strs[2]), nil
+}
+
+func evalRegex(ev *Evaluation, name string, args interface{}) (interface{}, error) {
+	// get fields
+	fields, err := evalObject(name, args, []string{"input", "regex"}, "options")
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate input
+	input, err := ev.Evaluate(fields["input"])
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate regex
+	regex, err := ev.Evaluate(fields["regex"])
+	if err != nil {
+		return nil, err
+	}
+
+	// evaluate options
+	var options interface{} = bsonkit.Missing
+	if expr, ok := fields["options"]; ok {
+		options, err = ev.Evaluate(expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get pattern and flags
+	var pattern, flags string
+	switch value := regex.(type) {
+	case string:
+		pattern = value
+	case primitive.Regex:
+		pattern = value.Pattern
+		flags = value.Options
+	default:
+		if !isNullish(value) {
+			return nil, fmt.Errorf("%s: regex must be a string or regex, not %s", name, typeName(value))
+		}
+	}
+	switch value := options.(type) {
+	case string:
+		if flags != "" && value != "" {
+			return nil, fmt.Errorf("%s: options cannot be specified both in regex and options", name)
+		}
+		if value != "" {
+			flags = value
+		}
+	default:
+		if !isNullish(value) {
+			return nil, fmt.Errorf("%s: options must be a string, not %s", name, typeName(value))
+		}
+	}
+
+	// check input
+	str, ok := input.(string)
+	if !ok && !isNullish(input) {
+		return nil, fmt.Errorf("%s: input must be a string, not %s", name, typeName(input))
+	}
+
+	// handle null input or regex
+	if !ok || isNullish(regex) {
+		switch name {
+		case "$regexMatch":
+			return false, nil
+		case "$regexFind":
+			return nil, nil
+		default:
+			return bson.A{}, nil
+		}
+	}
+
+	// compile regex
+	re, err := compileRegex(name, pattern, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle match
+	if name == "$regexMatch" {
+		return re.MatchString(str), nil
+	}
+
+	// find matches
+	limit := -1
+	if name == "$regexFind" {
+		limit = 1
+	}
+	matches := re.FindAllStringSubmatchIndex(str, limit)
+
+	// build results
+	results := make(bson.A, 0, len(matches))
+	for _, match := range matches {
+		captures := make(bson.A, 0, len(match)/2-1)
+		for i := 2; i < len(match); i += 2 {
+			if match[i] < 0 {
+				captures = append(captures, nil)
+			} else {
+				captures = append(captures, str[match[i]:match[i+1]])
+			}
+		}
+		results = append(results, bson.D{
+			{Key: "match", Value: str[match[0]:match[1]]},
+			{Key: "idx", Value: int32(utf8.RuneCountInString(str[:match[0]]))},
+			{Key: "captures", Value: captures},
+		})
+	}
+
+	// handle find
+	if name == "$regexFind" {
+		if len(results) == 0 {
+			return nil, nil
+		}
+		return results[0], nil
+	}
+
+	return results, nil
+}
+
+func compileRegex(name, pattern, flags string) (*regexp.Regexp, error) {
+	// prepare flags
+	var prefix string
+	for _, flag := range flags {
+		switch flag {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(prefix, flag) {
+				prefix += string(flag)
+			}
+		case 'x':
+			pattern = stripExtended(pattern)
+		case 'u':
+			// always enabled
+		default:
+			return nil, fmt.Errorf("%s: invalid flag in regex options: %c", name, flag)
+		}
+	}
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+
+	// compile pattern
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid regular expression: %s", name, err.Error())
+	}
+
+	return re, nil
+}
+
+// stripExtended removes unescaped whitespace and comments outside of character
+// classes from an extended regular expression.
+func stripExtended(pattern string) string {
+	var builder strings.Builder
+	var class, comment bool
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case comment:
+			if c == '\n' {
+				comment = false
+			}
+		case c == '\\' && i+1 < len(pattern):
+			builder.WriteByte(c)
+			builder.WriteByte(pattern[i+1])
+			i++
+		case class:
+			if c == ']' {
+				class = false
+			}
+			builder.WriteByte(c)
+		case c == '[':
+			class = true
+			builder.WriteByte(c)
+		case c == '#':
+			comment = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
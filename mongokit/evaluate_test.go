@@ -0,0 +1,757 @@
+package mongokit
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func evaluateTest(t *testing.T, doc bson.M, fn func(fn func(interface{}, interface{}))) {
+	t.Run("Mongo", func(t *testing.T) {
+		coll := testCollection()
+		res, err := coll.InsertOne(nil, doc)
+		assert.NoError(t, err)
+
+		fn(func(expr interface{}, result interface{}) {
+			csr, err := coll.Aggregate(nil, bson.A{
+				bson.M{"$match": bson.M{"_id": res.InsertedID}},
+				bson.M{"$project": bson.M{"_id": 0, "v": expr}},
+			})
+			if err == nil {
+				var out []bson.M
+				err = csr.All(nil, &out)
+				if err == nil {
+					if _, ok := result.(error); ok {
+						t.Errorf("expected error for %v", expr)
+					} else if result == bsonkit.Missing {
+						assert.Equal(t, bson.M{}, out[0], expr)
+					} else {
+						assert.Equal(t, bson.M{"v": result}, out[0], expr)
+					}
+					return
+				}
+			}
+			_, ok := result.(error)
+			assert.True(t, ok, err)
+		})
+	})
+
+	t.Run("Lungo", func(t *testing.T) {
+		fn(func(expr interface{}, result interface{}) {
+			res, err := Evaluate(bsonkit.MustConvert(doc), bsonkit.MustConvertValue(expr), nil)
+			if e, ok := result.(error); ok {
+				assert.Error(t, err)
+				assert.Equal(t, e.Error(), err.Error())
+			} else if result == bsonkit.Missing {
+				assert.NoError(t, err)
+				assert.Equal(t, bsonkit.Missing, res, expr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, bsonkit.MustConvertValue(result), bsonkit.MustConvertValue(unorder(res)), expr)
+			}
+		})
+	})
+}
+
+func unorder(v interface{}) interface{} {
+	switch value := v.(type) {
+	case bson.D:
+		m := bson.M{}
+		for _, e := range value {
+			m[e.Key] = unorder(e.Value)
+		}
+		return m
+	case bson.A:
+		a := make(bson.A, 0, len(value))
+		for _, item := range value {
+			a = append(a, unorder(item))
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+type evalError string
+
+func (e evalError) Error() string {
+	return string(e)
+}
+
+func TestEvaluateBasics(t *testing.T) {
+	evaluateTest(t, bson.M{
+		"foo": "bar",
+		"num": int32(7),
+		"sub": bson.M{
+			"bar": "baz",
+		},
+		"list": bson.A{
+			bson.M{"a": int32(1)},
+			bson.M{"b": int32(2)},
+			bson.M{"a": int32(3)},
+		},
+	}, func(fn func(interface{}, interface{})) {
+		// field paths
+		fn(bson.M{"$literal": "$foo"}, "$foo")
+		fn(bson.M{"$ifNull": bson.A{"$foo", nil}}, "bar")
+		fn(bson.M{"$ifNull": bson.A{"$sub.bar", nil}}, "baz")
+		fn(bson.M{"$ifNull": bson.A{"$list.a", nil}}, bson.A{int32(1), int32(3)})
+		fn(bson.M{"$ifNull": bson.A{"$missing", "$$REMOVE"}}, bsonkit.Missing)
+		fn(bson.M{"$ifNull": bson.A{"$missing", "def"}}, "def")
+
+		// variables
+		fn(bson.M{"$let": bson.M{
+			"vars": bson.M{"x": "$num"},
+			"in":   bson.M{"$add": bson.A{"$$x", int32(1)}},
+		}}, int32(8))
+		fn(bson.M{"$ifNull": bson.A{"$$ROOT.sub.bar", nil}}, "baz")
+		fn(bson.M{"$ifNull": bson.A{"$$CURRENT.foo", nil}}, "bar")
+		fn(bson.M{"$add": bson.A{"$$x", int32(1)}}, evalError(`use of undefined variable "x"`))
+
+		// documents and arrays
+		fn(bson.M{"$ifNull": bson.A{bson.M{"a": "$foo", "b": "$missing"}, nil}}, bson.M{"a": "bar"})
+		fn(bson.M{"$ifNull": bson.A{bson.A{"$foo", "$missing"}, nil}}, bson.A{"bar", nil})
+		fn(bson.M{"$foo": int32(1)}, evalError(`unknown expression operator "$foo"`))
+	})
+}
+
+func TestEvaluateConditional(t *testing.T) {
+	evaluateTest(t, bson.M{
+		"num": int32(7),
+	}, func(fn func(interface{}, interface{})) {
+		// cond
+		fn(bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$num", int32(5)}}, "big", "small"}}, "big")
+		fn(bson.M{"$cond": bson.M{"if": bson.M{"$lt": bson.A{"$num", int32(5)}}, "then": "small", "else": "big"}}, "big")
+		fn(bson.M{"$cond": bson.A{"$missing", int32(1), int32(2)}}, int32(2))
+		fn(bson.M{"$cond": bson.A{"", int32(1), int32(2)}}, int32(1))
+		fn(bson.M{"$cond": bson.A{int32(0), int32(1), int32(2)}}, int32(2))
+
+		// switch
+		fn(bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{"case": bson.M{"$eq": bson.A{"$num", int32(1)}}, "then": "one"},
+				bson.M{"case": bson.M{"$eq": bson.A{"$num", int32(7)}}, "then": "seven"},
+			},
+		}}, "seven")
+		fn(bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{"case": false, "then": "one"},
+			},
+			"default": "none",
+		}}, "none")
+		fn(bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{"case": false, "then": "one"},
+			},
+		}}, evalError("$switch: could not find a matching branch for an input, and no default was specified"))
+
+		// boolean
+		fn(bson.M{"$and": bson.A{true, int32(1), "x"}}, true)
+		fn(bson.M{"$and": bson.A{true, nil}}, false)
+		fn(bson.M{"$or": bson.A{false, "$missing", int32(1)}}, true)
+		fn(bson.M{"$or": bson.A{}}, false)
+		fn(bson.M{"$not": bson.A{int32(0)}}, true)
+	})
+}
+
+func TestEvaluateComparison(t *testing.T) {
+	evaluateTest(t, bson.M{
+		"num": int32(7),
+		"nil": nil,
+	}, func(fn func(interface{}, interface{})) {
+		fn(bson.M{"$eq": bson.A{"$num", 7.0}}, true)
+		fn(bson.M{"$ne": bson.A{"$num", int64(7)}}, false)
+		fn(bson.M{"$gt": bson.A{"$num", int32(5)}}, true)
+		fn(bson.M{"$gte": bson.A{"$num", int32(8)}}, false)
+		fn(bson.M{"$lt": bson.A{"$num", "a"}}, true)
+		fn(bson.M{"$lte": bson.A{"$num", int32(7)}}, true)
+		fn(bson.M{"$cmp": bson.A{"$num", int32(8)}}, int32(-1))
+		fn(bson.M{"$cmp": bson.A{"b", "a"}}, int32(1))
+		fn(bson.M{"$eq": bson.A{"$nil", nil}}, true)
+		fn(bson.M{"$eq": bson.A{"$missing", nil}}, false)
+		fn(bson.M{"$lt": bson.A{"$missing", nil}}, true)
+		fn(bson.M{"$eq": bson.A{"$num"}}, evalError("$eq: expected 2 arguments, got 1"))
+	})
+}
+
+func TestEvaluateArithmetic(t *testing.T) {
+	date := primitive.NewDateTimeFromTime(time.Now())
+
+	evaluateTest(t, bson.M{
+		"i":    int32(7),
+		"l":    int64(10),
+		"d":    2.5,
+		"date": date,
+	}, func(fn func(interface{}, interface{})) {
+		// add
+		fn(bson.M{"$add": bson.A{"$i", int32(3)}}, int32(10))
+		fn(bson.M{"$add": bson.A{"$i", "$l"}}, int64(17))
+		fn(bson.M{"$add": bson.A{"$i", "$d"}}, 9.5)
+		fn(bson.M{"$add": bson.A{int32(math.MaxInt32), int32(1)}}, int64(math.MaxInt32+1))
+		fn(bson.M{"$add": bson.A{"$i", nil}}, nil)
+		fn(bson.M{"$add": bson.A{"$date", int32(1000)}}, date+1000)
+		fn(bson.M{"$add": bson.A{"$i", "x"}}, evalError("$add: only supports numeric or date types, not string"))
+
+		// subtract
+		fn(bson.M{"$subtract": bson.A{"$i", int32(10)}}, int32(-3))
+		fn(bson.M{"$subtract": bson.A{"$date", int32(1000)}}, date-1000)
+		fn(bson.M{"$subtract": bson.A{"$date", "$date"}}, int64(0))
+
+		// multiply
+		fn(bson.M{"$multiply": bson.A{"$i", "$l"}}, int64(70))
+		fn(bson.M{"$multiply": bson.A{"$i", "$d"}}, 17.5)
+
+		// divide
+		fn(bson.M{"$divide": bson.A{"$l", int32(4)}}, 2.5)
+		fn(bson.M{"$divide": bson.A{"$l", int32(0)}}, evalError("$divide: cannot divide by zero"))
+
+		// mod
+		fn(bson.M{"$mod": bson.A{"$i", int32(4)}}, int32(3))
+		fn(bson.M{"$mod": bson.A{"$l", int32(4)}}, int64(2))
+		fn(bson.M{"$mod": bson.A{"$d", int32(2)}}, 0.5)
+
+		// abs, ceil, floor
+		fn(bson.M{"$abs": int32(-3)}, int32(3))
+		fn(bson.M{"$abs": -2.5}, 2.5)
+		fn(bson.M{"$ceil": "$d"}, 3.0)
+		fn(bson.M{"$floor": "$d"}, 2.0)
+		fn(bson.M{"$floor": "$i"}, int32(7))
+
+		// round, trunc
+		fn(bson.M{"$round": "$d"}, 2.0)
+		fn(bson.M{"$round": 3.5}, 4.0)
+		fn(bson.M{"$round": bson.A{1.2345, int32(2)}}, 1.23)
+		fn(bson.M{"$round": bson.A{int32(1234), int32(-2)}}, int32(1200))
+		fn(bson.M{"$trunc": bson.A{-1.789, int32(1)}}, -1.7)
+
+		// powers and logarithms
+		fn(bson.M{"$pow": bson.A{int32(2), int32(10)}}, int32(1024))
+		fn(bson.M{"$pow": bson.A{int32(2), int32(40)}}, int64(1099511627776))
+		fn(bson.M{"$pow": bson.A{int32(2), int32(-1)}}, 0.5)
+		fn(bson.M{"$sqrt": int32(16)}, 4.0)
+		fn(bson.M{"$exp": int32(0)}, 1.0)
+		fn(bson.M{"$ln": int32(1)}, 0.0)
+		fn(bson.M{"$log10": int32(100)}, 2.0)
+		fn(bson.M{"$log": bson.A{int32(8), int32(2)}}, 3.0)
+		fn(bson.M{"$sqrt": int32(-1)}, evalError("$sqrt: argument must be greater than or equal to 0"))
+	})
+}
+
+func TestEvaluateString(t *testing.T) {
+	evaluateTest(t, bson.M{
+		"str": "Hello World",
+		"cp":  "café ☕ bar",
+		"num": int32(42),
+		"ws":  "  \t padded \n ",
+	}, func(fn func(interface{}, interface{})) {
+		// concat
+		fn(bson.M{"$concat": bson.A{"$str", "!", "?"}}, "Hello World!?")
+		fn(bson.M{"$concat": bson.A{"$str", "$missing"}}, nil)
+		fn(bson.M{"$concat": bson.A{"$str", "$num"}}, evalError("$concat: only supports strings, not int"))
+
+		// substr
+		fn(bson.M{"$substr": bson.A{"$str", int32(0), int32(5)}}, "Hello")
+		fn(bson.M{"$substrBytes": bson.A{"$str", int32(6), int32(-1)}}, "World")
+		fn(bson.M{"$substrBytes": bson.A{"$num", int32(1), int32(1)}}, "2")
+		fn(bson.M{"$substrBytes": bson.A{"$cp", int32(4), int32(1)}}, evalError("$substrBytes: invalid range, starting index is a UTF-8 continuation byte"))
+		fn(bson.M{"$substrCP": bson.A{"$cp", int32(3), int32(3)}}, "é ☕")
+		fn(bson.M{"$substrCP": bson.A{"$cp", int32(20), int32(3)}}, "")
+
+		// case
+		fn(bson.M{"$toLower": "$str"}, "hello world")
+		fn(bson.M{"$toUpper": "$str"}, "HELLO WORLD")
+		fn(bson.M{"$toUpper": "$cp"}, "CAFé ☕ BAR")
+		fn(bson.M{"$toUpper": "$missing"}, "")
+
+		// trim
+		fn(bson.M{"$trim": bson.M{"input": "$ws"}}, "padded")
+		fn(bson.M{"$ltrim": bson.M{"input": "$ws"}}, "padded \n ")
+		fn(bson.M{"$rtrim": bson.M{"input": "$ws"}}, "  \t padded")
+		fn(bson.M{"$trim": bson.M{"input": "$str", "chars": "Hd"}}, "ello Worl")
+		fn(bson.M{"$trim": bson.M{"input": "$missing"}}, nil)
+
+		// split
+		fn(bson.M{"$split": bson.A{"$str", " "}}, bson.A{"Hello", "World"})
+		fn(bson.M{"$split": bson.A{"$str", "x"}}, bson.A{"Hello World"})
+		fn(bson.M{"$split": bson.A{"$str", ""}}, evalError("$split: separator must not be empty"))
+
+		// length
+		fn(bson.M{"$strLenBytes": "$cp"}, int32(13))
+		fn(bson.M{"$strLenCP": "$cp"}, int32(10))
+		fn(bson.M{"$strLenCP": "$missing"}, evalError("$strLenCP: requires a string argument, found missing"))
+
+		// index
+		fn(bson.M{"$indexOfBytes": bson.A{"$str", "o"}}, int32(4))
+		fn(bson.M{"$indexOfBytes": bson.A{"$str", "o", int32(5)}}, int32(7))
+		fn(bson.M{"$indexOfBytes": bson.A{"$str", "o", int32(5), int32(6)}}, int32(-1))
+		fn(bson.M{"$indexOfBytes": bson.A{"$cp", "bar"}}, int32(10))
+		fn(bson.M{"$indexOfCP": bson.A{"$cp", "bar"}}, int32(7))
+		fn(bson.M{"$indexOfCP": bson.A{"$missing", "bar"}}, nil)
+
+		// compare
+		fn(bson.M{"$strcasecmp": bson.A{"$str", "hello world"}}, int32(0))
+		fn(bson.M{"$strcasecmp": bson.A{"$str", "hello"}}, int32(1))
+		fn(bson.M{"$strcasecmp": bson.A{"a", "B"}}, int32(-1))
+
+		// replace
+		fn(bson.M{"$replaceOne": bson.M{"input": "$str", "find": "o", "replacement": "0"}}, "Hell0 World")
+		fn(bson.M{"$replaceAll": bson.M{"input": "$str", "find": "o", "replacement": "0"}}, "Hell0 W0rld")
+		fn(bson.M{"$replaceAll": bson.M{"input": "$missing", "find": "o", "replacement": "0"}}, nil)
+
+		// regex
+		fn(bson.M{"$regexMatch": bson.M{"input": "$str", "regex": "^hello", "options": "i"}}, true)
+		fn(bson.M{"$regexMatch": bson.M{"input": "$str", "regex": primitive.Regex{Pattern: "^hello"}}}, false)
+		fn(bson.M{"$regexFind": bson.M{"input": "$cp", "regex": "(b)(x)?ar"}}, bson.M{
+			"match":    "bar",
+			"idx":      int32(7),
+			"captures": bson.A{"b", nil},
+		})
+		fn(bson.M{"$regexFind": bson.M{"input": "$str", "regex": "xyz"}}, nil)
+		fn(bson.M{"$regexFindAll": bson.M{"input": "$str", "regex": "o."}}, bson.A{
+			bson.M{"match": "o ", "idx": int32(4), "captures": bson.A{}},
+			bson.M{"match": "or", "idx": int32(7), "captures": bson.A{}},
+		})
+		fn(bson.M{"$regexFindAll": bson.M{"input": "$missing", "regex": "o."}}, bson.A{})
+	})
+}
+
+func TestEvaluateDate(t *testing.T) {
+	date := time.Date(2021, 3, 14, 1, 30, 15, 250*int(time.Millisecond), time.UTC)
+	id, _ := primitive.ObjectIDFromHex("604d6a670000000000000000")
+
+	evaluateTest(t, bson.M{
+		"date": primitive.NewDateTimeFromTime(date),
+		"ts":   primitive.Timestamp{T: uint32(date.Unix()), I: 1},
+		"id":   id,
+		"str":  "2021-03-14T01:30:15.250Z",
+	}, func(fn func(interface{}, interface{})) {
+		// parts
+		fn(bson.M{"$year": "$date"}, int32(2021))
+		fn(bson.M{"$month": "$date"}, int32(3))
+		fn(bson.M{"$dayOfMonth": "$date"}, int32(14))
+		fn(bson.M{"$hour": "$date"}, int32(1))
+		fn(bson.M{"$minute": "$date"}, int32(30))
+		fn(bson.M{"$second": "$date"}, int32(15))
+		fn(bson.M{"$millisecond": "$date"}, int32(250))
+		fn(bson.M{"$dayOfYear": "$date"}, int32(73))
+		fn(bson.M{"$dayOfWeek": "$date"}, int32(1))
+		fn(bson.M{"$week": "$date"}, int32(11))
+		fn(bson.M{"$isoWeek": "$date"}, int32(10))
+		fn(bson.M{"$isoWeekYear": "$date"}, int32(2021))
+		fn(bson.M{"$isoDayOfWeek": "$date"}, int32(7))
+		fn(bson.M{"$year": bson.A{"$date"}}, int32(2021))
+		fn(bson.M{"$year": "$missing"}, nil)
+		fn(bson.M{"$year": "$str"}, evalError("$year: cannot convert from BSON type string to date"))
+		fn(bson.M{"$second": "$ts"}, int32(15))
+		fn(bson.M{"$dayOfMonth": "$id"}, int32(14))
+
+		// time zones
+		fn(bson.M{"$hour": bson.M{"date": "$date", "timezone": "America/New_York"}}, int32(20))
+		fn(bson.M{"$dayOfMonth": bson.M{"date": "$date", "timezone": "America/New_York"}}, int32(13))
+		fn(bson.M{"$hour": bson.M{"date": "$date", "timezone": "+05:30"}}, int32(7))
+		fn(bson.M{"$minute": bson.M{"date": "$date", "timezone": "-0130"}}, int32(0))
+		fn(bson.M{"$hour": bson.M{"date": "$date", "timezone": "Foo/Bar"}}, evalError(`$hour: unrecognized time zone identifier: "Foo/Bar"`))
+
+		// to string
+		fn(bson.M{"$dateToString": bson.M{"date": "$date"}}, "2021-03-14T01:30:15.250Z")
+		fn(bson.M{"$dateToString": bson.M{
+			"date":     "$date",
+			"format":   "%Y/%m/%d %H:%M:%S %z %Z %j %w %u %U %V %G %%",
+			"timezone": "Europe/Zurich",
+		}}, "2021/03/14 02:30:15 +0100 +60 073 1 7 11 10 2021 %")
+		fn(bson.M{"$dateToString": bson.M{"date": "$missing", "onNull": "none"}}, "none")
+		fn(bson.M{"$dateToString": bson.M{"date": "$date", "format": "%Q"}}, evalError("$dateToString: invalid format character '%Q' in format string"))
+
+		// from string
+		fn(bson.M{"$dateFromString": bson.M{"dateString": "$str"}}, primitive.NewDateTimeFromTime(date))
+		fn(bson.M{"$dateFromString": bson.M{"dateString": "2021-03-14"}}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromString": bson.M{
+			"dateString": "2021-03-14T12:00:00",
+			"timezone":   "Asia/Tokyo",
+		}}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 3, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromString": bson.M{
+			"dateString": "14.03.2021 12:00",
+			"format":     "%d.%m.%Y %H:%M",
+		}}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 12, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromString": bson.M{
+			"dateString": "2021-03-14 12:00 +0200",
+			"format":     "%Y-%m-%d %H:%M %z",
+		}}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 10, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromString": bson.M{"dateString": "foo", "onError": "bad"}}, "bad")
+		fn(bson.M{"$dateFromString": bson.M{"dateString": "$missing", "onNull": "null"}}, "null")
+
+		// to parts
+		fn(bson.M{"$dateToParts": bson.M{"date": "$date"}}, bson.M{
+			"year":        int32(2021),
+			"month":       int32(3),
+			"day":         int32(14),
+			"hour":        int32(1),
+			"minute":      int32(30),
+			"second":      int32(15),
+			"millisecond": int32(250),
+		})
+		fn(bson.M{"$dateToParts": bson.M{"date": "$date", "iso8601": true, "timezone": "America/New_York"}}, bson.M{
+			"isoWeekYear":  int32(2021),
+			"isoWeek":      int32(10),
+			"isoDayOfWeek": int32(6),
+			"hour":         int32(20),
+			"minute":       int32(30),
+			"second":       int32(15),
+			"millisecond":  int32(250),
+		})
+
+		// from parts
+		fn(bson.M{"$dateFromParts": bson.M{
+			"year": int32(2021), "month": int32(3), "day": int32(14),
+			"hour": int32(1), "minute": int32(30), "second": int32(15), "millisecond": int32(250),
+		}}, primitive.NewDateTimeFromTime(date))
+		fn(bson.M{"$dateFromParts": bson.M{
+			"year": int32(2021), "month": int32(14), "day": int32(0),
+		}}, primitive.NewDateTimeFromTime(time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromParts": bson.M{
+			"isoWeekYear": int32(2021), "isoWeek": int32(10), "isoDayOfWeek": int32(7),
+		}}, primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromParts": bson.M{
+			"year": int32(2021), "timezone": "Europe/Zurich",
+		}}, primitive.NewDateTimeFromTime(time.Date(2020, 12, 31, 23, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateFromParts": bson.M{
+			"year": int32(0),
+		}}, evalError("$dateFromParts: 'year' must evaluate to an integer in the range 1 to 9999, found 0"))
+
+		// add and subtract
+		fn(bson.M{"$dateAdd": bson.M{"startDate": "$date", "unit": "hour", "amount": int32(2)}},
+			primitive.NewDateTimeFromTime(date.Add(2*time.Hour)))
+		fn(bson.M{"$dateAdd": bson.M{
+			"startDate": primitive.NewDateTimeFromTime(time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC)),
+			"unit":      "month",
+			"amount":    int32(1),
+		}}, primitive.NewDateTimeFromTime(time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateAdd": bson.M{
+			"startDate": "$date",
+			"unit":      "day",
+			"amount":    int32(1),
+			"timezone":  "America/New_York",
+		}}, primitive.NewDateTimeFromTime(date.Add(23*time.Hour)))
+		fn(bson.M{"$dateSubtract": bson.M{"startDate": "$date", "unit": "week", "amount": int64(1)}},
+			primitive.NewDateTimeFromTime(date.AddDate(0, 0, -7)))
+		fn(bson.M{"$dateAdd": bson.M{"startDate": "$date", "unit": "foo", "amount": int32(1)}},
+			evalError("$dateAdd: unknown time unit value: foo"))
+
+		// diff
+		fn(bson.M{"$dateDiff": bson.M{
+			"startDate": "$date",
+			"endDate":   primitive.NewDateTimeFromTime(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+			"unit":      "year",
+		}}, int64(1))
+		fn(bson.M{"$dateDiff": bson.M{
+			"startDate": "$date",
+			"endDate":   primitive.NewDateTimeFromTime(time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)),
+			"unit":      "day",
+		}}, int64(1))
+		fn(bson.M{"$dateDiff": bson.M{
+			"startDate": "$date",
+			"endDate":   primitive.NewDateTimeFromTime(time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)),
+			"unit":      "day",
+			"timezone":  "America/New_York",
+		}}, int64(1))
+		fn(bson.M{"$dateDiff": bson.M{
+			"startDate": "$date",
+			"endDate":   primitive.NewDateTimeFromTime(time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)),
+			"unit":      "week",
+		}}, int64(0))
+		fn(bson.M{"$dateDiff": bson.M{
+			"startDate":   "$date",
+			"endDate":     primitive.NewDateTimeFromTime(time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)),
+			"unit":        "week",
+			"startOfWeek": "monday",
+		}}, int64(1))
+		fn(bson.M{"$dateDiff": bson.M{
+			"startDate": "$date",
+			"endDate":   primitive.NewDateTimeFromTime(date.Add(-90 * time.Minute)),
+			"unit":      "hour",
+		}}, int64(-1))
+
+		// trunc
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "day"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "day", "timezone": "America/New_York"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 13, 5, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "day", "timezone": "Asia/Kolkata"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 13, 18, 30, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "week"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "week", "startOfWeek": "mon"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "quarter"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "month", "binSize": int32(5)}},
+			primitive.NewDateTimeFromTime(time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "minute", "binSize": int32(15)}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 1, 30, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$date", "unit": "hour", "binSize": int32(6), "timezone": "+05:30"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 3, 14, 0, 30, 0, 0, time.UTC)))
+		fn(bson.M{"$dateTrunc": bson.M{"date": "$ts", "unit": "year"}},
+			primitive.NewDateTimeFromTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)))
+	})
+}
+
+func TestEvaluateArray(t *testing.T) {
+	evaluateTest(t, bson.M{
+		"nums": bson.A{int32(3), int32(1), int32(2)},
+		"strs": bson.A{"a", "b", "c"},
+		"docs": bson.A{
+			bson.M{"n": int32(2), "s": "x"},
+			bson.M{"n": int32(1), "s": "y"},
+		},
+		"obj": bson.M{"a": int32(1)},
+		"num": int32(1),
+	}, func(fn func(interface{}, interface{})) {
+		// map
+		fn(bson.M{"$map": bson.M{
+			"input": "$nums",
+			"in":    bson.M{"$multiply": bson.A{"$$this", int32(2)}},
+		}}, bson.A{int32(6), int32(2), int32(4)})
+		fn(bson.M{"$map": bson.M{
+			"input": "$nums",
+			"as":    "n",
+			"in":    bson.M{"$add": bson.A{"$$n", "$num"}},
+		}}, bson.A{int32(4), int32(2), int32(3)})
+		fn(bson.M{"$map": bson.M{"input": "$missing", "in": "$$this"}}, nil)
+		fn(bson.M{"$map": bson.M{"input": "$num", "in": "$$this"}}, evalError("$map: input must be an array, not int"))
+
+		// filter
+		fn(bson.M{"$filter": bson.M{
+			"input": "$nums",
+			"cond":  bson.M{"$gt": bson.A{"$$this", int32(1)}},
+		}}, bson.A{int32(3), int32(2)})
+		fn(bson.M{"$filter": bson.M{
+			"input": "$nums",
+			"as":    "n",
+			"cond":  bson.M{"$gte": bson.A{"$$n", int32(1)}},
+			"limit": int32(2),
+		}}, bson.A{int32(3), int32(1)})
+
+		// reduce
+		fn(bson.M{"$reduce": bson.M{
+			"input":        "$nums",
+			"initialValue": int32(0),
+			"in":           bson.M{"$add": bson.A{"$$value", "$$this"}},
+		}}, int32(6))
+		fn(bson.M{"$reduce": bson.M{
+			"input":        "$strs",
+			"initialValue": "",
+			"in":           bson.M{"$concat": bson.A{"$$value", "$$this"}},
+		}}, "abc")
+
+		// zip
+		fn(bson.M{"$zip": bson.M{"inputs": bson.A{"$nums", "$strs"}}}, bson.A{
+			bson.A{int32(3), "a"}, bson.A{int32(1), "b"}, bson.A{int32(2), "c"},
+		})
+		fn(bson.M{"$zip": bson.M{
+			"inputs":           bson.A{"$nums", bson.A{"x"}},
+			"useLongestLength": true,
+			"defaults":         bson.A{int32(0), "y"},
+		}}, bson.A{
+			bson.A{int32(3), "x"}, bson.A{int32(1), "y"}, bson.A{int32(2), "y"},
+		})
+		fn(bson.M{"$zip": bson.M{"inputs": bson.A{"$nums", "$missing"}}}, nil)
+
+		// range
+		fn(bson.M{"$range": bson.A{int32(0), int32(5), int32(2)}}, bson.A{int32(0), int32(2), int32(4)})
+		fn(bson.M{"$range": bson.A{int32(3), int32(0), int32(-1)}}, bson.A{int32(3), int32(2), int32(1)})
+		fn(bson.M{"$range": bson.A{int32(0), int32(5), int32(0)}}, evalError("$range: step cannot be zero"))
+
+		// reverse
+		fn(bson.M{"$reverseArray": "$nums"}, bson.A{int32(2), int32(1), int32(3)})
+		fn(bson.M{"$reverseArray": "$missing"}, nil)
+
+		// slice
+		fn(bson.M{"$slice": bson.A{"$nums", int32(2)}}, bson.A{int32(3), int32(1)})
+		fn(bson.M{"$slice": bson.A{"$nums", int32(-2)}}, bson.A{int32(1), int32(2)})
+		fn(bson.M{"$slice": bson.A{"$nums", int32(1), int32(5)}}, bson.A{int32(1), int32(2)})
+		fn(bson.M{"$slice": bson.A{"$nums", int32(-5), int32(2)}}, bson.A{int32(3), int32(1)})
+
+		// element at
+		fn(bson.M{"$arrayElemAt": bson.A{"$nums", int32(1)}}, int32(1))
+		fn(bson.M{"$arrayElemAt": bson.A{"$nums", int32(-1)}}, int32(2))
+		fn(bson.M{"$arrayElemAt": bson.A{"$nums", int32(5)}}, bsonkit.Missing)
+		fn(bson.M{"$first": "$nums"}, int32(3))
+		fn(bson.M{"$last": "$nums"}, int32(2))
+		fn(bson.M{"$first": bson.A{bson.A{}}}, bsonkit.Missing)
+
+		// concat
+		fn(bson.M{"$concatArrays": bson.A{"$nums", "$strs"}}, bson.A{int32(3), int32(1), int32(2), "a", "b", "c"})
+		fn(bson.M{"$concatArrays": bson.A{"$nums", "$missing"}}, nil)
+
+		// in and index
+		fn(bson.M{"$in": bson.A{int32(2), "$nums"}}, true)
+		fn(bson.M{"$in": bson.A{int64(4), "$nums"}}, false)
+		fn(bson.M{"$in": bson.A{int32(2), "$num"}}, evalError("$in: requires an array as a second argument, found: int"))
+		fn(bson.M{"$indexOfArray": bson.A{"$strs", "b"}}, int32(1))
+		fn(bson.M{"$indexOfArray": bson.A{"$strs", "b", int32(2)}}, int32(-1))
+		fn(bson.M{"$indexOfArray": bson.A{"$missing", "b"}}, nil)
+
+		// is array and size
+		fn(bson.M{"$isArray": bson.A{"$nums"}}, true)
+		fn(bson.M{"$isArray": "$num"}, false)
+		fn(bson.M{"$size": "$nums"}, int32(3))
+		fn(bson.M{"$size": "$missing"}, evalError("$size: the argument must be an array, not missing"))
+
+		// sort
+		fn(bson.M{"$sortArray": bson.M{"input": "$nums", "sortBy": int32(1)}}, bson.A{int32(1), int32(2), int32(3)})
+		fn(bson.M{"$sortArray": bson.M{"input": "$nums", "sortBy": int32(-1)}}, bson.A{int32(3), int32(2), int32(1)})
+		fn(bson.M{"$sortArray": bson.M{"input": "$docs", "sortBy": bson.M{"n": int32(1)}}}, bson.A{
+			bson.M{"n": int32(1), "s": "y"},
+			bson.M{"n": int32(2), "s": "x"},
+		})
+
+		// objects
+		fn(bson.M{"$arrayToObject": bson.A{bson.A{bson.A{"a", int32(1)}, bson.A{"b", int32(2)}}}}, bson.M{"a": int32(1), "b": int32(2)})
+		fn(bson.M{"$arrayToObject": bson.A{bson.A{bson.M{"k": "a", "v": int32(1)}}}}, bson.M{"a": int32(1)})
+		fn(bson.M{"$objectToArray": "$obj"}, bson.A{bson.M{"k": "a", "v": int32(1)}})
+		fn(bson.M{"$mergeObjects": bson.A{"$obj", bson.M{"b": int32(2)}, "$missing"}}, bson.M{"a": int32(1), "b": int32(2)})
+		fn(bson.M{"$mergeObjects": bson.A{"$obj", "$num"}}, evalError("$mergeObjects: requires object inputs, but input 1 is of type int"))
+		fn(bson.M{"$getField": "num"}, int32(1))
+		fn(bson.M{"$getField": bson.M{"field": "a", "input": "$obj"}}, int32(1))
+		fn(bson.M{"$getField": bson.M{"field": "b", "input": "$obj"}}, bsonkit.Missing)
+		fn(bson.M{"$setField": bson.M{"field": "b", "input": "$obj", "value": int32(2)}}, bson.M{"a": int32(1), "b": int32(2)})
+		fn(bson.M{"$setField": bson.M{"field": "a", "input": "$obj", "value": "$$REMOVE"}}, bson.M{})
+
+		// sets
+		fn(bson.M{"$setUnion": bson.A{bson.A{int32(1), int32(1)}, bson.A{int32(2)}}}, bson.A{int32(1), int32(2)})
+		fn(bson.M{"$setIntersection": bson.A{"$nums", bson.A{int32(1), int32(2), int32(5)}}}, bson.A{int32(1), int32(2)})
+		fn(bson.M{"$setDifference": bson.A{"$nums", bson.A{int32(1)}}}, bson.A{int32(3), int32(2)})
+		fn(bson.M{"$setEquals": bson.A{"$nums", bson.A{int32(1), int32(2), int32(3), int32(3)}}}, true)
+		fn(bson.M{"$setIsSubset": bson.A{bson.A{int32(1)}, "$nums"}}, true)
+		fn(bson.M{"$setIsSubset": bson.A{bson.A{int32(1)}, "$missing"}}, evalError("$setIsSubset: all operands must be arrays, found missing"))
+		fn(bson.M{"$anyElementTrue": bson.A{bson.A{int32(0), false, "a"}}}, true)
+		fn(bson.M{"$allElementsTrue": bson.A{bson.A{int32(1), false}}}, false)
+	})
+}
+
+func TestEvaluateConvert(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("5ab9cbfa31c2ab715d42129e")
+	date := primitive.NewDateTimeFromTime(time.Date(2018, 3, 27, 4, 8, 58, 0, time.UTC))
+
+	evaluateTest(t, bson.M{
+		"int":    int32(42),
+		"long":   int64(7),
+		"double": 2.5,
+		"str":    "123",
+		"float":  "1.5",
+		"hex":    "5ab9cbfa31c2ab715d42129e",
+		"bad":    "abc",
+		"id":     id,
+		"date":   date,
+	}, func(fn func(interface{}, interface{})) {
+		// convert
+		fn(bson.M{"$convert": bson.M{"input": "$str", "to": "int"}}, int32(123))
+		fn(bson.M{"$convert": bson.M{"input": "$str", "to": int32(18)}}, int64(123))
+		fn(bson.M{"$convert": bson.M{"input": "$bad", "to": "int", "onError": "error"}}, "error")
+		fn(bson.M{"$convert": bson.M{"input": "$missing", "to": "int", "onNull": "null"}}, "null")
+		fn(bson.M{"$convert": bson.M{"input": "$missing", "to": "int"}}, nil)
+		fn(bson.M{"$convert": bson.M{"input": "$bad", "to": "int"}}, evalError(`$convert: failed to parse int "abc": did not consume whole string`))
+		fn(bson.M{"$convert": bson.M{"input": "$str", "to": "foo"}}, evalError("$convert: unknown type name: foo"))
+		fn(bson.M{"$convert": bson.M{"input": "$id", "to": "int"}}, evalError("$convert: unsupported conversion from objectId to int"))
+
+		// to string
+		fn(bson.M{"$toString": "$int"}, "42")
+		fn(bson.M{"$toString": "$double"}, "2.5")
+		fn(bson.M{"$toString": 1e6}, "1000000")
+		fn(bson.M{"$toString": true}, "true")
+		fn(bson.M{"$toString": "$id"}, "5ab9cbfa31c2ab715d42129e")
+		fn(bson.M{"$toString": "$date"}, "2018-03-27T04:08:58.000Z")
+		fn(bson.M{"$toString": "$missing"}, nil)
+
+		// to int and long
+		fn(bson.M{"$toInt": "$double"}, int32(2))
+		fn(bson.M{"$toInt": -2.9}, int32(-2))
+		fn(bson.M{"$toInt": true}, int32(1))
+		fn(bson.M{"$toInt": "$float"}, evalError(`$toInt: failed to parse int "1.5": did not consume whole string`))
+		fn(bson.M{"$toInt": int64(math.MaxInt32 + 1)}, evalError("$toInt: conversion would overflow target type"))
+		fn(bson.M{"$toLong": "$str"}, int64(123))
+		fn(bson.M{"$toLong": "$date"}, int64(1522123738000))
+		fn(bson.M{"$toLong": bson.M{"$toDecimal": "25.7"}}, int64(25))
+
+		// to double
+		fn(bson.M{"$toDouble": "$float"}, 1.5)
+		fn(bson.M{"$toDouble": "$long"}, 7.0)
+		fn(bson.M{"$toDouble": false}, 0.0)
+		fn(bson.M{"$toDouble": "$date"}, 1522123738000.0)
+		fn(bson.M{"$toDouble": " 1"}, evalError(`$toDouble: failed to parse double " 1": did not consume whole string`))
+
+		// to decimal
+		fn(bson.M{"$toDecimal": "$int"}, func() primitive.Decimal128 {
+			d, _ := primitive.ParseDecimal128("42")
+			return d
+		}())
+		fn(bson.M{"$toDecimal": "$double"}, func() primitive.Decimal128 {
+			d, _ := primitive.ParseDecimal128("2.50000000000000")
+			return d
+		}())
+		fn(bson.M{"$toDecimal": "$float"}, func() primitive.Decimal128 {
+			d, _ := primitive.ParseDecimal128("1.5")
+			return d
+		}())
+
+		// to bool
+		fn(bson.M{"$toBool": "$int"}, true)
+		fn(bson.M{"$toBool": int32(0)}, false)
+		fn(bson.M{"$toBool": ""}, true)
+		fn(bson.M{"$toBool": "$date"}, true)
+
+		// to date
+		fn(bson.M{"$toDate": "$long"}, primitive.DateTime(7))
+		fn(bson.M{"$toDate": "2018-03-27T04:08:58Z"}, date)
+		fn(bson.M{"$toDate": "$id"}, primitive.NewDateTimeFromTime(time.Date(2018, 3, 27, 4, 43, 38, 0, time.UTC)))
+		fn(bson.M{"$toDate": "$int"}, evalError("$toDate: unsupported conversion from int to date"))
+
+		// to object id
+		fn(bson.M{"$toObjectId": "$hex"}, id)
+		fn(bson.M{"$toObjectId": "$bad"}, evalError(`$toObjectId: failed to parse objectId "abc": invalid string length for parsing to OID, expected 24 hex characters`))
+
+		// type
+		fn(bson.M{"$type": "$int"}, "int")
+		fn(bson.M{"$type": "$long"}, "long")
+		fn(bson.M{"$type": "$id"}, "objectId")
+		fn(bson.M{"$type": "$missing"}, "missing")
+		fn(bson.M{"$type": bson.A{nil}}, "null")
+		fn(bson.M{"$isNumber": "$double"}, true)
+		fn(bson.M{"$isNumber": "$str"}, false)
+	})
+}
+
+func TestEvaluateAccumulator(t *testing.T) {
+	evaluateTest(t, bson.M{
+		"nums":  bson.A{int32(1), int32(2), 3.0, "x"},
+		"empty": bson.A{},
+	}, func(fn func(interface{}, interface{})) {
+		// sum
+		fn(bson.M{"$sum": "$nums"}, 6.0)
+		fn(bson.M{"$sum": bson.A{int32(1), int64(2)}}, int64(3))
+		fn(bson.M{"$sum": "$empty"}, int32(0))
+		fn(bson.M{"$sum": "$missing"}, int32(0))
+
+		// avg
+		fn(bson.M{"$avg": "$nums"}, 2.0)
+		fn(bson.M{"$avg": bson.A{int32(1), int32(2)}}, 1.5)
+		fn(bson.M{"$avg": "$empty"}, nil)
+
+		// min and max
+		fn(bson.M{"$min": "$nums"}, int32(1))
+		fn(bson.M{"$max": "$nums"}, "x")
+		fn(bson.M{"$max": bson.A{nil, int32(4), "$missing"}}, int32(4))
+		fn(bson.M{"$min": "$empty"}, nil)
+
+		// standard deviation
+		fn(bson.M{"$stdDevPop": bson.A{int32(1), int32(3)}}, 1.0)
+		fn(bson.M{"$stdDevSamp": bson.A{int32(1), int32(3)}}, 1.4142135623730951)
+		fn(bson.M{"$stdDevSamp": bson.A{int32(1)}}, nil)
+	})
+}
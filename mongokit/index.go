@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -91,6 +92,15 @@ type Index struct {
 	config  IndexConfig
 	columns []bsonkit.Column
 	base    *bsonkit.Index
+	usage   *indexUsage
+	size    int64
+}
+
+// indexUsage counts the accesses of an index. It is shared between clones
+// so that the counters survive catalog changes.
+type indexUsage struct {
+	ops   int64
+	since time.Time
 }
 
 // CreateIndex will create and return a new index.
@@ -120,6 +130,7 @@ func CreateIndex(config IndexConfig) (*Index, error) {
 		config:  config,
 		columns: columns,
 		base:    bsonkit.NewIndex(config.Unique, columns),
+		usage:   &indexUsage{since: time.Now()},
 	}
 
 	return index, nil
@@ -155,7 +166,15 @@ func (i *Index) Add(doc bsonkit.Doc) (bool, error) {
 		}
 	}
 
-	return i.base.Add(doc), nil
+	// add document
+	if !i.base.Add(doc) {
+		return false, nil
+	}
+
+	// update size
+	i.size += i.keySize(doc)
+
+	return true, nil
 }
 
 // Has returns whether the specified document has been added to the index.
@@ -186,7 +205,15 @@ func (i *Index) Remove(doc bsonkit.Doc) (bool, error) {
 		}
 	}
 
-	return i.base.Remove(doc), nil
+	// remove document
+	if !i.base.Remove(doc) {
+		return false, nil
+	}
+
+	// update size
+	i.size -= i.keySize(doc)
+
+	return true, nil
 }
 
 // List will return an ascending list of all documents in the index.
@@ -194,6 +221,84 @@ func (i *Index) List() bsonkit.List {
 	return i.base.List()
 }
 
+// Accesses will return the number of operations that used the index and the
+// time since when they have been counted.
+func (i *Index) Accesses() (int64, time.Time) {
+	return atomic.LoadInt64(&i.usage.ops), i.usage.since
+}
+
+// access will count an operation that used the index.
+func (i *Index) access() {
+	atomic.AddInt64(&i.usage.ops, 1)
+}
+
+// Size will return the estimated size of the index keys in bytes. The size is
+// maintained incrementally as documents are added and removed.
+func (i *Index) Size() int64 {
+	return i.size
+}
+
+// keySize returns the BSON encoded size of the document's index key.
+func (i *Index) keySize(doc bsonkit.Doc) int64 {
+	key := make(bson.D, 0, len(i.columns))
+	for _, column := range i.columns {
+		key = append(key, bson.E{Key: column.Path, Value: bsonkit.Get(doc, column.Path)})
+	}
+	return docSize(&key)
+}
+
+// Validate will verify that the index contains exactly the documents from the
+// specified list that match the partial filter. If full is true, the unique
+// constraint, the index keys and the index size are verified as well.
+func (i *Index) Validate(list bsonkit.List, full bool) error {
+	// collect expected documents
+	expected := make(map[bsonkit.Doc]bool, len(list))
+	for _, doc := range list {
+		if i.config.Partial != nil {
+			ok, err := Match(doc, i.config.Partial)
+			if err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+		}
+		expected[doc] = true
+	}
+
+	// check indexed documents
+	indexed := i.base.List()
+	for _, doc := range indexed {
+		if !expected[doc] {
+			return fmt.Errorf("index contains an unexpected document")
+		}
+	}
+	if len(indexed) != len(expected) {
+		return fmt.Errorf("index contains %d documents but %d are expected", len(indexed), len(expected))
+	}
+
+	// check full
+	if !full {
+		return nil
+	}
+
+	// check entries
+	err := i.base.Validate()
+	if err != nil {
+		return err
+	}
+
+	// check size
+	var size int64
+	for _, doc := range indexed {
+		size += i.keySize(doc)
+	}
+	if size != i.size {
+		return fmt.Errorf("index size is %d but should be %d", i.size, size)
+	}
+
+	return nil
+}
+
 // Config will return the index configuration.
 func (i *Index) Config() IndexConfig {
 	return IndexConfig{
@@ -211,5 +316,7 @@ func (i *Index) Clone() *Index {
 		config:  i.config,
 		columns: i.columns,
 		base:    i.base.Clone(),
+		usage:   i.usage,
+		size:    i.size,
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsontype"
@@ -29,6 +30,7 @@ func init() {
 	TopLevelQueryOperators["$or"] = matchOr
 	TopLevelQueryOperators["$nor"] = matchNor
 	TopLevelQueryOperators["$jsonSchema"] = matchJSONSchema
+	TopLevelQueryOperators["$expr"] = matchExpr
 
 	// register expression query operators
 	ExpressionQueryOperators[""] = matchComp
@@ -51,15 +53,24 @@ func init() {
 	ExpressionQueryOperators["$bitsAnyClear"] = matchBits
 	ExpressionQueryOperators["$bitsAnySet"] = matchBits
 	ExpressionQueryOperators["$mod"] = matchMod
+	ExpressionQueryOperators["$regex"] = matchRegex
+	ExpressionQueryOperators["$options"] = matchOptions
 }
 
 // Match will test if the specified document matches the supplied MongoDB query
 // document.
 func Match(doc, query bsonkit.Doc) (bool, error) {
+	return MatchWith(doc, query, nil)
+}
+
+// MatchWith will test if the specified document matches the supplied MongoDB
+// query document. The variables are made available to $expr expressions.
+func MatchWith(doc, query bsonkit.Doc, variables map[string]interface{}) (bool, error) {
 	// match document to query
 	err := Process(Context{
 		TopLevel:   TopLevelQueryOperators,
 		Expression: ExpressionQueryOperators,
+		Value:      variables,
 	}, doc, *query, "", true)
 	if err == ErrNotMatched {
 		return false, nil
@@ -70,6 +81,62 @@ func Match(doc, query bsonkit.Doc) (bool, error) {
 	return true, nil
 }
 
+// BindVariables will return a copy of the query in which every $expr
+// expression is wrapped in a $let expression that provides the specified
+// variables. This allows using "let" variables in queries that are matched
+// without variables.
+func BindVariables(query, variables bsonkit.Doc) (bsonkit.Doc, error) {
+	// check query and variables
+	if query == nil || variables == nil || len(*variables) == 0 {
+		return query, nil
+	}
+
+	// evaluate variables
+	values, err := EvaluateVariables(variables)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare literals
+	vars := make(bson.D, 0, len(*variables))
+	for _, v := range *variables {
+		vars = append(vars, bson.E{Key: v.Key, Value: bson.D{{Key: "$literal", Value: values[v.Key]}}})
+	}
+
+	// bind query
+	bound := bindVariables(*query, vars)
+
+	return &bound, nil
+}
+
+func bindVariables(query bson.D, vars bson.D) bson.D {
+	// bind expressions
+	bound := make(bson.D, 0, len(query))
+	for _, e := range query {
+		switch e.Key {
+		case "$expr":
+			e.Value = bson.D{{Key: "$let", Value: bson.D{
+				{Key: "vars", Value: vars},
+				{Key: "in", Value: e.Value},
+			}}}
+		case "$and", "$or", "$nor":
+			if list, ok := e.Value.(bson.A); ok {
+				items := make(bson.A, 0, len(list))
+				for _, item := range list {
+					if doc, ok := item.(bson.D); ok {
+						item = bindVariables(doc, vars)
+					}
+					items = append(items, item)
+				}
+				e.Value = items
+			}
+		}
+		bound = append(bound, e)
+	}
+
+	return bound
+}
+
 func matchAnd(ctx Context, doc bsonkit.Doc, name, _ string, v interface{}) error {
 	// get array
 	array, ok := v.(bson.A)
@@ -140,7 +207,30 @@ func matchNor(ctx Context, doc bsonkit.Doc, name, path string, v interface{}) er
 	})
 }
 
-func matchComp(_ Context, doc bsonkit.Doc, op, path string, v interface{}) error {
+func matchExpr(ctx Context, doc bsonkit.Doc, _, _ string, v interface{}) error {
+	// get variables
+	vars, _ := ctx.Value.(map[string]interface{})
+
+	// evaluate expression
+	res, err := Evaluate(doc, v, vars)
+	if err != nil {
+		return err
+	}
+
+	// check result
+	if !truthy(res) {
+		return ErrNotMatched
+	}
+
+	return nil
+}
+
+func matchComp(ctx Context, doc bsonkit.Doc, op, path string, v interface{}) error {
+	// handle regular expressions
+	if regex, ok := v.(primitive.Regex); ok && op == "" {
+		return matchRegex(ctx, doc, "$regex", path, regex)
+	}
+
 	return matchUnwind(doc, path, true, false, func(field interface{}) error {
 		// determine if comparable (type bracketing)
 		lc, _ := bsonkit.Inspect(field)
@@ -175,6 +265,13 @@ func matchComp(_ Context, doc bsonkit.Doc, op, path string, v interface{}) error
 }
 
 func matchNot(ctx Context, doc bsonkit.Doc, name, path string, v interface{}) error {
+	// handle regular expressions
+	if regex, ok := v.(primitive.Regex); ok {
+		return matchNegate(func() error {
+			return matchRegex(ctx, doc, name, path, regex)
+		})
+	}
+
 	// coerce item
 	query, ok := v.(bson.D)
 	if !ok {
@@ -187,7 +284,7 @@ func matchNot(ctx Context, doc bsonkit.Doc, name, path string, v interface{}) er
 	}
 
 	// match all expressions
-	for _, exp := range query {
+	for _, exp := range mergeRegex(query) {
 		err := ProcessExpression(ctx, doc, path, exp, false)
 		if err == ErrNotMatched {
 			return nil
@@ -196,8 +293,6 @@ func matchNot(ctx Context, doc bsonkit.Doc, name, path string, v interface{}) er
 		}
 	}
 
-	// TODO: Support regular expressions.
-
 	return ErrNotMatched
 }
 
@@ -211,13 +306,19 @@ func matchIn(_ Context, doc bsonkit.Doc, name, path string, v interface{}) error
 
 		// check if field is in array
 		for _, item := range array {
-			if bsonkit.Compare(field, item) == 0 {
+			if regex, ok := item.(primitive.Regex); ok {
+				re, err := compileRegex(name, regex.Pattern, regex.Options)
+				if err != nil {
+					return err
+				}
+				if matchPattern(re, regex, field) {
+					return nil
+				}
+			} else if bsonkit.Compare(field, item) == 0 {
 				return nil
 			}
 		}
 
-		// TODO: Support regular expressions.
-
 		return ErrNotMatched
 	})
 }
@@ -545,6 +646,93 @@ func matchMod(_ Context, doc bsonkit.Doc, name, path string, v interface{}) erro
 	})
 }
 
+func matchRegex(_ Context, doc bsonkit.Doc, name, path string, v interface{}) error {
+	// get regex
+	var regex primitive.Regex
+	switch value := v.(type) {
+	case string:
+		regex.Pattern = value
+	case primitive.Regex:
+		regex = value
+	default:
+		return fmt.Errorf("%s: expected string or regex", name)
+	}
+
+	// compile regex
+	re, err := compileRegex(name, regex.Pattern, regex.Options)
+	if err != nil {
+		return err
+	}
+
+	return matchUnwind(doc, path, true, false, func(field interface{}) error {
+		if !matchPattern(re, regex, field) {
+			return ErrNotMatched
+		}
+		return nil
+	})
+}
+
+func matchOptions(_ Context, _ bsonkit.Doc, name, _ string, _ interface{}) error {
+	// options are merged into the $regex operator by mergeRegex
+	return fmt.Errorf("%s: needs a $regex", name)
+}
+
+// matchPattern returns whether the field is a string that matches the compiled
+// regex or a regex that equals the specified regex.
+func matchPattern(re *regexp.Regexp, regex primitive.Regex, field interface{}) bool {
+	switch field := field.(type) {
+	case string:
+		return re.MatchString(field)
+	case primitive.Symbol:
+		return re.MatchString(string(field))
+	case primitive.Regex:
+		return field == regex
+	default:
+		return false
+	}
+}
+
+// mergeRegex will merge the $options operator of the expression document into
+// the $regex operator as the options cannot be matched separately.
+func mergeRegex(exps bson.D) bson.D {
+	// find operators
+	regex, options := -1, -1
+	for i, exp := range exps {
+		switch exp.Key {
+		case "$regex":
+			regex = i
+		case "$options":
+			options = i
+		}
+	}
+	if regex < 0 || options < 0 {
+		return exps
+	}
+
+	// get pattern and options
+	pattern, ok := exps[regex].Value.(string)
+	if !ok {
+		return exps
+	}
+	flags, ok := exps[options].Value.(string)
+	if !ok {
+		return exps
+	}
+
+	// merge operators
+	merged := make(bson.D, 0, len(exps)-1)
+	for i, exp := range exps {
+		if i == options {
+			continue
+		} else if i == regex {
+			exp.Value = primitive.Regex{Pattern: pattern, Options: flags}
+		}
+		merged = append(merged, exp)
+	}
+
+	return merged
+}
+
 func modOperandToInt64(name, role string, v interface{}) (int64, error) {
 	switch n := v.(type) {
 	case int32:
@@ -792,6 +792,76 @@ func TestMatchNin(t *testing.T) {
 	})
 }
 
+func TestMatchRegex(t *testing.T) {
+	matchTest(t, bson.M{
+		"foo": "Bar",
+		"bar": bson.A{"baz", "qux"},
+		"baz": primitive.Regex{Pattern: "x", Options: "i"},
+	}, func(fn func(bson.M, interface{})) {
+		// literal
+		fn(bson.M{
+			"foo": primitive.Regex{Pattern: "^b"},
+		}, false)
+		fn(bson.M{
+			"foo": primitive.Regex{Pattern: "^b", Options: "i"},
+		}, true)
+
+		// operator
+		fn(bson.M{
+			"foo": bson.M{"$regex": "^B"},
+		}, true)
+		fn(bson.M{
+			"foo": bson.M{"$regex": "^b", "$options": "i"},
+		}, true)
+		fn(bson.M{
+			"foo": bson.M{"$regex": primitive.Regex{Pattern: "r$", Options: "i"}},
+		}, true)
+
+		// array field
+		fn(bson.M{
+			"bar": primitive.Regex{Pattern: "^q"},
+		}, true)
+
+		// regex field
+		fn(bson.M{
+			"baz": primitive.Regex{Pattern: "x", Options: "i"},
+		}, true)
+		fn(bson.M{
+			"baz": primitive.Regex{Pattern: "x"},
+		}, false)
+
+		// in and not in
+		fn(bson.M{
+			"foo": bson.M{"$in": bson.A{primitive.Regex{Pattern: "^x"}, primitive.Regex{Pattern: "ar$"}}},
+		}, true)
+		fn(bson.M{
+			"foo": bson.M{"$nin": bson.A{primitive.Regex{Pattern: "ar$"}}},
+		}, false)
+
+		// not
+		fn(bson.M{
+			"foo": bson.M{"$not": primitive.Regex{Pattern: "^b"}},
+		}, true)
+		fn(bson.M{
+			"foo": bson.M{"$not": bson.M{"$regex": "^b", "$options": "i"}},
+		}, false)
+
+		// invalid
+		fn(bson.M{
+			"foo": bson.M{"$regex": int32(1)},
+		}, "$regex: expected string or regex")
+		fn(bson.M{
+			"foo": bson.M{"$options": "i"},
+		}, "$options: needs a $regex")
+		fn(bson.M{
+			"foo": bson.M{"$regex": "^b", "$options": "z"},
+		}, "$regex: invalid flag in regex options: z")
+		fn(bson.M{
+			"foo": bson.M{"$regex": "("},
+		}, "$regex: invalid regular expression: error parsing regexp: missing closing ): `(`")
+	})
+}
+
 func TestMatchExists(t *testing.T) {
 	matchTest(t, bson.M{
 		"foo": "bar",
@@ -1619,3 +1689,86 @@ func TestMatchMod(t *testing.T) {
 		}, false)
 	})
 }
+
+func TestMatchExpr(t *testing.T) {
+	matchTest(t, bson.M{
+		"foo": int32(10),
+		"bar": int32(5),
+	}, func(fn func(bson.M, interface{})) {
+		fn(bson.M{
+			"$expr": bson.M{"$gt": bson.A{"$foo", "$bar"}},
+		}, true)
+		fn(bson.M{
+			"$expr": bson.M{"$lt": bson.A{"$foo", "$bar"}},
+		}, false)
+		fn(bson.M{
+			"$expr": "$foo",
+		}, true)
+		fn(bson.M{
+			"$expr": "$baz",
+		}, false)
+		fn(bson.M{
+			"foo": int32(10),
+			"$expr": bson.M{"$eq": bson.A{
+				bson.M{"$add": bson.A{"$bar", "$bar"}},
+				"$foo",
+			}},
+		}, true)
+		fn(bson.M{
+			"$expr": bson.M{"$foo": "$bar"},
+		}, `unknown expression operator "$foo"`)
+	})
+
+	// variables
+	res, err := MatchWith(bsonkit.MustConvert(bson.M{
+		"foo": int32(10),
+	}), bsonkit.MustConvert(bson.M{
+		"$expr": bson.M{"$eq": bson.A{"$foo", "$$x"}},
+	}), map[string]interface{}{
+		"x": int32(10),
+	})
+	assert.NoError(t, err)
+	assert.True(t, res)
+}
+
+func TestBindVariables(t *testing.T) {
+	doc := bsonkit.MustConvert(bson.M{
+		"foo": int32(10),
+		"bar": bson.A{"x"},
+	})
+
+	query, err := BindVariables(bsonkit.MustConvert(bson.M{
+		"$or": bson.A{
+			bson.M{"$expr": bson.M{"$eq": bson.A{"$foo", "$$x"}}},
+			bson.M{"foo": int32(0)},
+		},
+		"$expr": bson.M{"$let": bson.M{
+			"vars": bson.M{"x": "$bar"},
+			"in":   bson.M{"$eq": bson.A{"$$x", bson.A{"$$y"}}},
+		}},
+	}), bsonkit.MustConvert(bson.M{
+		"x": bson.M{"$add": bson.A{int32(5), int32(5)}},
+		"y": "x",
+	}))
+	assert.NoError(t, err)
+
+	res, err := Match(doc, query)
+	assert.NoError(t, err)
+	assert.True(t, res)
+
+	query, err = BindVariables(bsonkit.MustConvert(bson.M{
+		"$expr": bson.M{"$eq": bson.A{"$foo", "$$x"}},
+	}), bsonkit.MustConvert(bson.M{
+		"x": int32(11),
+	}))
+	assert.NoError(t, err)
+
+	res, err = Match(doc, query)
+	assert.NoError(t, err)
+	assert.False(t, res)
+
+	_, err = BindVariables(bsonkit.MustConvert(bson.M{}), bsonkit.MustConvert(bson.M{
+		"X": int32(1),
+	}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,323 @@
+package mongokit
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// UpdatePipeline is an update pipeline that may be used in place of an update
+// document. It supports the $set, $addFields, $unset, $project, $replaceWith
+// and $replaceRoot stages.
+type UpdatePipeline struct {
+	// The pipeline stages.
+	Stages bsonkit.List
+
+	// The variables available to the stage expressions.
+	Variables bsonkit.Doc
+}
+
+// ApplyPipeline will apply an update pipeline on a document. The document is
+// updated in place. The changes to the document are computed and returned.
+func ApplyPipeline(doc bsonkit.Doc, pipeline *UpdatePipeline, upsert bool) (*Changes, error) {
+	// check stages
+	if len(pipeline.Stages) == 0 {
+		return nil, fmt.Errorf("empty update pipeline")
+	}
+
+	// evaluate variables
+	vars, err := EvaluateVariables(pipeline.Variables)
+	if err != nil {
+		return nil, err
+	}
+
+	// run stages
+	result := bsonkit.Clone(doc)
+	for _, stage := range pipeline.Stages {
+		// check stage
+		if len(*stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage specification must contain exactly one field")
+		}
+
+		// get name and specification
+		name := (*stage)[0].Key
+		spec := (*stage)[0].Value
+
+		// run stage
+		switch name {
+		case "$set", "$addFields":
+			result, err = AddFields(result, spec, vars)
+		case "$unset":
+			result, err = UnsetFields(result, spec)
+		case "$project":
+			projection, ok := spec.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("%s: expected document", name)
+			}
+			result, err = ProjectStage(result, &projection, vars)
+		case "$replaceWith", "$replaceRoot":
+			result, err = ReplaceRoot(result, name, spec, vars)
+		default:
+			return nil, fmt.Errorf("%s is not allowed to be used within an update", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// restore id if removed
+	if bsonkit.Get(result, "_id") == bsonkit.Missing {
+		id := bsonkit.Get(doc, "_id")
+		if id != bsonkit.Missing {
+			_, err = bsonkit.Put(result, "_id", id, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// prepare changes
+	changes := &Changes{
+		Upsert:   upsert,
+		Changed:  map[string]interface{}{},
+		pathTree: bsonkit.NewPathNode(),
+	}
+
+	// record differences
+	err = recordDiff(changes, "", *doc, *result)
+	if err != nil {
+		return nil, err
+	}
+
+	// recycle tree
+	changes.pathTree.Recycle()
+	changes.pathTree = nil
+
+	// update document
+	*doc = *result
+
+	return changes, nil
+}
+
+// EvaluateVariables will evaluate the specified variable definitions as used by
+// the "let" option of commands and return the resulting variables.
+func EvaluateVariables(vars bsonkit.Doc) (map[string]interface{}, error) {
+	// check variables
+	if vars == nil {
+		return nil, nil
+	}
+
+	// evaluate variables
+	ev := NewEvaluation(nil, nil)
+	values := make(map[string]interface{}, len(*vars))
+	for _, v := range *vars {
+		err := validateVariable("let", v.Key)
+		if err != nil {
+			return nil, err
+		}
+		values[v.Key], err = ev.Evaluate(v.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// AddFields will return a copy of the document with the fields computed from
+// the specified $addFields (or $set) stage specification.
+func AddFields(doc bsonkit.Doc, spec interface{}, vars map[string]interface{}) (bsonkit.Doc, error) {
+	// check specification
+	fields, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("$addFields: expected document")
+	}
+
+	// compute fields against the original document
+	ev := NewEvaluation(doc, vars)
+	var values bson.D
+	err := addFieldsWalk(ev, doc, fields, "", &values)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply fields
+	result := bsonkit.Clone(doc)
+	for _, value := range values {
+		if value.Value == bsonkit.Missing {
+			bsonkit.Unset(result, value.Key)
+			continue
+		}
+		_, err = bsonkit.Put(result, value.Key, value.Value, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func addFieldsWalk(ev *Evaluation, doc bsonkit.Doc, fields bson.D, prefix string, values *bson.D) error {
+	for _, field := range fields {
+		// check field
+		if field.Key == "" || strings.HasPrefix(field.Key, "$") {
+			return fmt.Errorf("$addFields: invalid field name %q", field.Key)
+		}
+
+		// get path
+		path := field.Key
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		// merge embedded documents into existing documents
+		if sub, ok := field.Value.(bson.D); ok && len(sub) > 0 && !strings.HasPrefix(sub[0].Key, "$") {
+			if _, ok := bsonkit.Get(doc, path).(bson.D); ok {
+				err := addFieldsWalk(ev, doc, sub, path, values)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		// evaluate value
+		value, err := ev.Evaluate(field.Value)
+		if err != nil {
+			return err
+		}
+
+		// add value
+		*values = append(*values, bson.E{Key: path, Value: value})
+	}
+
+	return nil
+}
+
+// UnsetFields will return a copy of the document without the fields specified
+// by the $unset stage specification.
+func UnsetFields(doc bsonkit.Doc, spec interface{}) (bsonkit.Doc, error) {
+	// get paths
+	var paths []string
+	switch value := spec.(type) {
+	case string:
+		paths = append(paths, value)
+	case bson.A:
+		for _, item := range value {
+			path, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("$unset: expected array of strings")
+			}
+			paths = append(paths, path)
+		}
+	default:
+		return nil, fmt.Errorf("$unset: expected string or array of strings")
+	}
+
+	// check paths
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("$unset: expected at least one field")
+	}
+
+	// remove fields
+	result := bsonkit.Clone(doc)
+	for _, path := range paths {
+		if path == "" || strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("$unset: invalid field name %q", path)
+		}
+		bsonkit.Unset(result, path)
+	}
+
+	return result, nil
+}
+
+// ReplaceRoot will return the document computed by the $replaceRoot or
+// $replaceWith stage specification.
+func ReplaceRoot(doc bsonkit.Doc, name string, spec interface{}, vars map[string]interface{}) (bsonkit.Doc, error) {
+	// get expression
+	expr := spec
+	if name == "$replaceRoot" {
+		fields, err := evalObject(name, spec, []string{"newRoot"})
+		if err != nil {
+			return nil, err
+		}
+		expr = fields["newRoot"]
+	}
+
+	// evaluate expression
+	value, err := Evaluate(doc, expr, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// check value
+	root, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s: 'newRoot' expression must evaluate to an object, but resulting value was of type %s", name, typeName(value))
+	}
+
+	return bsonkit.Clone(&root), nil
+}
+
+func recordDiff(changes *Changes, prefix string, before, after bson.D) error {
+	// record removed fields
+	for _, el := range before {
+		if lookupField(after, el.Key) == bsonkit.Missing {
+			err := changes.Record(joinPath(prefix, el.Key), bsonkit.Missing)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// record added and updated fields
+	for _, el := range after {
+		// get old value
+		path := joinPath(prefix, el.Key)
+		old := lookupField(before, el.Key)
+
+		// descend into documents
+		oldDoc, ok1 := old.(bson.D)
+		newDoc, ok2 := el.Value.(bson.D)
+		if ok1 && ok2 && len(newDoc) > 0 {
+			err := recordDiff(changes, path, oldDoc, newDoc)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// record changed value
+		if old == bsonkit.Missing || !valuesEqual(old, el.Value) {
+			err := changes.Record(path, el.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func lookupField(doc bson.D, key string) interface{} {
+	for _, el := range doc {
+		if el.Key == key {
+			return el.Value
+		}
+	}
+	return bsonkit.Missing
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func valuesEqual(a, b interface{}) bool {
+	return docsEqual(&bson.D{{Key: "v", Value: a}}, &bson.D{{Key: "v", Value: b}})
+}
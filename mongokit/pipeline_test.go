@@ -0,0 +1,251 @@
+package mongokit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+func pipelineTest(t *testing.T, doc bson.M, fn func(fn func(bson.A, bson.M, interface{}))) {
+	t.Run("Mongo", func(t *testing.T) {
+		coll := testCollection()
+
+		fn(func(pipeline bson.A, let bson.M, result interface{}) {
+			res, err := coll.InsertOne(nil, doc)
+			assert.NoError(t, err)
+
+			opts := options.Update()
+			if let != nil {
+				opts.SetLet(let)
+			}
+
+			_, err = coll.UpdateOne(nil, bson.M{
+				"_id": res.InsertedID,
+			}, pipeline, opts)
+			if _, ok := result.(string); ok {
+				assert.Error(t, err, pipeline)
+				return
+			}
+
+			assert.NoError(t, err)
+
+			var m bson.M
+			err = coll.FindOne(nil, bson.M{
+				"_id": res.InsertedID,
+			}).Decode(&m)
+			assert.NoError(t, err)
+
+			d := bsonkit.MustConvert(m)
+			bsonkit.Unset(d, "_id")
+
+			assert.Equal(t, result, d, pipeline)
+		})
+	})
+
+	t.Run("Lungo", func(t *testing.T) {
+		fn(func(pipeline bson.A, let bson.M, result interface{}) {
+			d := bsonkit.MustConvert(doc)
+			p := &UpdatePipeline{
+				Stages: bsonkit.MustConvertList(pipeline),
+			}
+			if let != nil {
+				p.Variables = bsonkit.MustConvert(let)
+			}
+			_, err := ApplyPipeline(d, p, false)
+			if str, ok := result.(string); ok {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Equal(t, str, err.Error())
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, result, d, pipeline)
+		})
+	})
+}
+
+func TestApplyPipeline(t *testing.T) {
+	pipelineTest(t, bson.M{
+		"a": int32(1),
+		"b": int32(2),
+		"c": bson.M{
+			"d": "e",
+		},
+	}, func(fn func(bson.A, bson.M, interface{})) {
+		// empty pipeline
+		fn(bson.A{}, nil, "empty update pipeline")
+
+		// invalid stage
+		fn(bson.A{
+			bson.M{"$match": bson.M{}},
+		}, nil, "$match is not allowed to be used within an update")
+
+		// set
+		fn(bson.A{
+			bson.M{"$set": bson.M{
+				"x": bson.M{"$add": bson.A{"$a", "$b"}},
+			}},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"a": int32(1),
+			"b": int32(2),
+			"c": bson.M{
+				"d": "e",
+			},
+			"x": int32(3),
+		}))
+
+		// add fields to embedded document
+		fn(bson.A{
+			bson.M{"$addFields": bson.M{
+				"c": bson.M{
+					"f": "$a",
+				},
+			}},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"a": int32(1),
+			"b": int32(2),
+			"c": bson.M{
+				"d": "e",
+				"f": int32(1),
+			},
+		}))
+
+		// subsequent stages
+		fn(bson.A{
+			bson.M{"$set": bson.M{
+				"a": bson.M{"$multiply": bson.A{"$a", int32(10)}},
+			}},
+			bson.M{"$set": bson.M{
+				"b": bson.M{"$add": bson.A{"$a", "$b"}},
+			}},
+			bson.M{"$unset": "c"},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"a": int32(10),
+			"b": int32(12),
+		}))
+
+		// remove
+		fn(bson.A{
+			bson.M{"$set": bson.M{
+				"a": "$$REMOVE",
+			}},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"b": int32(2),
+			"c": bson.M{
+				"d": "e",
+			},
+		}))
+
+		// project
+		fn(bson.A{
+			bson.M{"$project": bson.M{
+				"b": 1,
+			}},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"b": int32(2),
+		}))
+
+		// replace with
+		fn(bson.A{
+			bson.M{"$replaceWith": "$c"},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"d": "e",
+		}))
+
+		// replace root
+		fn(bson.A{
+			bson.M{"$replaceRoot": bson.M{
+				"newRoot": bson.M{"x": "$a"},
+			}},
+		}, nil, bsonkit.MustConvert(bson.M{
+			"x": int32(1),
+		}))
+
+		// invalid root
+		fn(bson.A{
+			bson.M{"$replaceWith": "$a"},
+		}, nil, "$replaceWith: 'newRoot' expression must evaluate to an object, but resulting value was of type int")
+
+		// variables
+		fn(bson.A{
+			bson.M{"$set": bson.M{
+				"x": "$$foo",
+			}},
+		}, bson.M{
+			"foo": "bar",
+		}, bsonkit.MustConvert(bson.M{
+			"a": int32(1),
+			"b": int32(2),
+			"c": bson.M{
+				"d": "e",
+			},
+			"x": "bar",
+		}))
+	})
+
+	// changes
+	id := primitive.NewObjectID()
+	doc := bsonkit.MustConvert(bson.M{
+		"_id": id,
+		"a":   int32(1),
+		"b": bson.M{
+			"c": int32(2),
+			"d": int32(3),
+		},
+		"e": "f",
+	})
+	changes, err := ApplyPipeline(doc, &UpdatePipeline{
+		Stages: bsonkit.MustConvertList(bson.A{
+			bson.M{"$set": bson.M{
+				"a":   int32(1),
+				"b.c": int32(4),
+				"g":   bson.A{"$a"},
+			}},
+			bson.M{"$unset": bson.A{"b.d", "e"}},
+		}),
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, &Changes{
+		Changed: map[string]interface{}{
+			"b.c": int32(4),
+			"b.d": bsonkit.Missing,
+			"e":   bsonkit.Missing,
+			"g":   bson.A{int32(1)},
+		},
+	}, changes)
+	assert.Equal(t, bsonkit.MustConvert(bson.M{
+		"_id": id,
+		"a":   int32(1),
+		"b": bson.M{
+			"c": int32(4),
+		},
+		"g": bson.A{int32(1)},
+	}), doc)
+
+	// restore id
+	changes, err = ApplyPipeline(doc, &UpdatePipeline{
+		Stages: bsonkit.MustConvertList(bson.A{
+			bson.M{"$replaceWith": bson.M{"x": int32(1)}},
+		}),
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, &Changes{
+		Changed: map[string]interface{}{
+			"a": bsonkit.Missing,
+			"b": bsonkit.Missing,
+			"g": bsonkit.Missing,
+			"x": int32(1),
+		},
+	}, changes)
+	assert.Equal(t, &bson.D{
+		{Key: "_id", Value: id},
+		{Key: "x", Value: int32(1)},
+	}, doc)
+}
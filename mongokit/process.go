@@ -110,6 +110,9 @@ func ProcessExpression(ctx Context, doc bsonkit.Doc, prefix string, pair bson.E,
 	// check for field expressions with a document which may contain either
 	// only expression operators or only simple conditions
 	if exps, ok := pair.Value.(bson.D); ok {
+		// merge regex options
+		exps = mergeRegex(exps)
+
 		// process all expressions (implicit and)
 		for i, exp := range exps {
 			// stop and leave document as a simple condition if the
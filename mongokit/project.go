@@ -2,8 +2,10 @@ package mongokit
 
 import (
 	"fmt"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/256dpi/lungo/bsonkit"
 )
@@ -19,11 +21,15 @@ func init() {
 }
 
 type projectState struct {
-	hideID  bool
-	include []string
-	exclude []string
-	merge   map[string]interface{}
-	skip    map[string]bool
+	hideID    bool
+	includeID bool
+	computed  bool
+	include   []string
+	exclude   []string
+	merge     bson.D
+	skip      map[string]bool
+	tree      bsonkit.PathNode
+	variables map[string]interface{}
 }
 
 // ProjectList will apply the provided projection to the specified list.
@@ -40,19 +46,35 @@ func ProjectList(list bsonkit.List, projection bsonkit.Doc) (bsonkit.List, error
 }
 
 // Project will apply the specified project to the document and return the
-// resulting document.
+// resulting document. Besides inclusions, exclusions and the projection
+// operators, fields may be computed using aggregation expressions.
 func Project(doc, projection bsonkit.Doc) (bsonkit.Doc, error) {
+	return project(doc, projection, ProjectionExpressionOperators, nil)
+}
+
+// ProjectStage will apply the specified $project stage specification to the
+// document and return the resulting document. Unlike Project, all operators
+// are treated as aggregation expressions which may use the provided variables.
+func ProjectStage(doc, projection bsonkit.Doc, variables map[string]interface{}) (bsonkit.Doc, error) {
+	return project(doc, projection, map[string]Operator{
+		"": projectCondition,
+	}, variables)
+}
+
+func project(doc, projection bsonkit.Doc, operators map[string]Operator, variables map[string]interface{}) (bsonkit.Doc, error) {
 	// prepare state
 	state := projectState{
-		merge: map[string]interface{}{},
-		skip:  map[string]bool{},
+		skip:      map[string]bool{},
+		tree:      bsonkit.NewPathNode(),
+		variables: variables,
 	}
+	defer state.tree.Recycle()
 
 	// process projection
-	err := Process(Context{
-		Expression: ProjectionExpressionOperators,
+	err := projectWalk(Context{
+		Expression: operators,
 		Value:      &state,
-	}, doc, *projection, "", true)
+	}, doc, *projection, "")
 	if err != nil {
 		return nil, err
 	}
@@ -60,20 +82,24 @@ func Project(doc, projection bsonkit.Doc) (bsonkit.Doc, error) {
 	// validate
 	if len(state.include) > 0 && len(state.exclude) > 0 {
 		return nil, fmt.Errorf("cannot have a mix of inclusion and exclusion")
+	} else if state.computed && len(state.exclude) > 0 {
+		return nil, fmt.Errorf("cannot use expressions in exclusion projection")
 	}
 
 	// prepare result
 	var res bsonkit.Doc
 
 	// perform inclusion
-	if len(state.include) > 0 {
+	if len(state.include) > 0 || state.computed || (state.includeID && len(state.exclude) == 0) {
 		// set null document
 		res = &bson.D{}
 
-		// copy id
-		_, err := bsonkit.Put(res, "_id", bsonkit.Get(doc, "_id"), false)
-		if err != nil {
-			return nil, err
+		// copy id if present
+		if id := bsonkit.Get(doc, "_id"); id != bsonkit.Missing {
+			_, err := bsonkit.Put(res, "_id", id, false)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// copy included fields
@@ -103,9 +129,9 @@ func Project(doc, projection bsonkit.Doc) (bsonkit.Doc, error) {
 		}
 	}
 
-	// merge fields (overlays from operator expressions)
-	for path, value := range state.merge {
-		_, err := bsonkit.Put(res, path, value, false)
+	// merge fields (overlays from operator and aggregation expressions)
+	for _, field := range state.merge {
+		_, err := bsonkit.Put(res, field.Key, field.Value, false)
 		if err != nil {
 			return nil, err
 		}
@@ -119,27 +145,120 @@ func Project(doc, projection bsonkit.Doc) (bsonkit.Doc, error) {
 	return res, nil
 }
 
-func projectCondition(ctx Context, _ bsonkit.Doc, _, path string, v interface{}) error {
+func projectWalk(ctx Context, doc bsonkit.Doc, projection bson.D, prefix string) error {
 	// get state
 	state := ctx.Value.(*projectState)
 
-	// determine inclusion or exclusion (accept both numeric 0/1 and bool)
+	for _, pair := range projection {
+		// check field
+		if strings.HasPrefix(pair.Key, "$") {
+			if prefix == "" {
+				return fmt.Errorf("unknown top level operator %q", pair.Key)
+			}
+			return fmt.Errorf("unknown expression operator %q", pair.Key)
+		} else if pair.Key == "" {
+			return fmt.Errorf("empty projection field")
+		}
+
+		// get path
+		path := pair.Key
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		// handle operators and embedded projections
+		if exps, ok := pair.Value.(bson.D); ok {
+			// check length
+			if len(exps) == 0 {
+				return fmt.Errorf("empty sub-projection at %q", path)
+			}
+
+			// handle operators
+			if strings.HasPrefix(exps[0].Key, "$") {
+				// record path
+				err := state.record(path)
+				if err != nil {
+					return err
+				}
+
+				// check length
+				if len(exps) > 1 {
+					return fmt.Errorf("expected a single operator at %q", path)
+				}
+
+				// use projection operator if available
+				operator := ctx.Expression[exps[0].Key]
+				if operator == nil {
+					operator = projectExpression
+				}
+
+				// call operator
+				err = operator(ctx, doc, exps[0].Key, path, exps[0].Value)
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			// walk embedded projection
+			err := projectWalk(ctx, doc, exps, path)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// record path
+		err := state.record(path)
+		if err != nil {
+			return err
+		}
+
+		// call default operator
+		err = ctx.Expression[""](ctx, doc, "", path, pair.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *projectState) record(path string) error {
+	// check for collisions with existing or nested paths
+	node, rest := s.tree.Lookup(path)
+	if node.Load() == true || rest == bsonkit.PathEnd {
+		return fmt.Errorf("path collision at %q", path)
+	}
+
+	// store path
+	s.tree.Append(path).Store(true)
+
+	return nil
+}
+
+func projectCondition(ctx Context, doc bsonkit.Doc, _, path string, v interface{}) error {
+	// get state
+	state := ctx.Value.(*projectState)
+
+	// determine inclusion or exclusion (accept bool and any number), other
+	// values are treated as aggregation expressions
 	var include bool
 	switch b := v.(type) {
 	case bool:
 		include = b
+	case int32, int64, float64, primitive.Decimal128:
+		include = !isZero(b)
 	default:
-		if bsonkit.Compare(v, int64(1)) == 0 {
-			include = true
-		} else if bsonkit.Compare(v, int64(0)) == 0 {
-			include = false
-		} else {
-			return fmt.Errorf("invalid projection argument %+v", v)
-		}
+		return projectExpression(ctx, doc, "", path, v)
 	}
 
 	// handle inclusion or exclusion
-	if include {
+	if include && path == "_id" {
+		state.includeID = true
+	} else if include {
 		state.include = append(state.include, path)
 	} else if path == "_id" {
 		state.hideID = true
@@ -150,6 +269,41 @@ func projectCondition(ctx Context, _ bsonkit.Doc, _, path string, v interface{})
 	return nil
 }
 
+func projectExpression(ctx Context, doc bsonkit.Doc, op, path string, v interface{}) error {
+	// get state
+	state := ctx.Value.(*projectState)
+
+	// get expression
+	expr := v
+	if op != "" {
+		expr = bson.D{{Key: op, Value: v}}
+	}
+
+	// evaluate expression
+	value, err := Evaluate(doc, expr, state.variables)
+	if err != nil {
+		return err
+	}
+
+	// mark computed (a computed id does not change the projection mode)
+	if path != "_id" {
+		state.computed = true
+	}
+
+	// a missing value removes the field
+	if value == bsonkit.Missing {
+		if path == "_id" {
+			state.hideID = true
+		}
+		return nil
+	}
+
+	// merge value
+	state.merge = append(state.merge, bson.E{Key: path, Value: value})
+
+	return nil
+}
+
 func projectSlice(ctx Context, doc bsonkit.Doc, _, path string, v interface{}) error {
 	// get state
 	state := ctx.Value.(*projectState)
@@ -212,7 +366,7 @@ func projectSlice(ctx Context, doc bsonkit.Doc, _, path string, v interface{}) e
 		if end > n {
 			end = n
 		}
-		state.merge[path] = append(bson.A{}, array[start:end]...)
+		state.merge = append(state.merge, bson.E{Key: path, Value: append(bson.A{}, array[start:end]...)})
 		return nil
 	}
 
@@ -220,19 +374,19 @@ func projectSlice(ctx Context, doc bsonkit.Doc, _, path string, v interface{}) e
 	switch {
 	case limit > 0:
 		if limit < len(array) {
-			state.merge[path] = array[0:limit]
+			state.merge = append(state.merge, bson.E{Key: path, Value: array[0:limit]})
 		} else {
-			state.merge[path] = array
+			state.merge = append(state.merge, bson.E{Key: path, Value: array})
 		}
 	case limit < 0:
 		n := -limit
 		if n < len(array) {
-			state.merge[path] = array[len(array)-n:]
+			state.merge = append(state.merge, bson.E{Key: path, Value: array[len(array)-n:]})
 		} else {
-			state.merge[path] = array
+			state.merge = append(state.merge, bson.E{Key: path, Value: array})
 		}
 	default:
-		state.merge[path] = bson.A{}
+		state.merge = append(state.merge, bson.E{Key: path, Value: bson.A{}})
 	}
 
 	return nil
@@ -292,7 +446,7 @@ func projectElemMatch(ctx Context, doc bsonkit.Doc, _, path string, v interface{
 		}
 
 		// emit single-element array via merge
-		state.merge[path] = bson.A{item}
+		state.merge = append(state.merge, bson.E{Key: path, Value: bson.A{item}})
 
 		return nil
 	}
@@ -155,7 +155,55 @@ func TestProject(t *testing.T) {
 		})
 	})
 
-	// TODO: Test allowed mixing with _id.
+	// allowed mixing with _id
+	projectTest(t, bson.M{
+		"_id": id,
+		"foo": "bar",
+		"bar": "baz",
+	}, func(fn func(bson.M, interface{})) {
+		fn(bson.M{
+			"_id": 1,
+			"foo": 0,
+		}, bson.M{
+			"_id": id,
+			"bar": "baz",
+		})
+		fn(bson.M{
+			"_id": 1,
+		}, bson.M{
+			"_id": id,
+		})
+	})
+
+	// embedded projection
+	projectTest(t, bson.M{
+		"_id": id,
+		"foo": bson.M{
+			"bar": "baz",
+			"qux": "quz",
+		},
+	}, func(fn func(bson.M, interface{})) {
+		fn(bson.M{
+			"foo": bson.M{
+				"bar": 1,
+			},
+		}, bson.M{
+			"_id": id,
+			"foo": bson.M{
+				"bar": "baz",
+			},
+		})
+		fn(bson.M{
+			"foo": bson.M{
+				"bar": 0,
+			},
+		}, bson.M{
+			"_id": id,
+			"foo": bson.M{
+				"qux": "quz",
+			},
+		})
+	})
 
 	// mixed projection
 	projectTest(t, bson.M{
@@ -461,3 +509,127 @@ func TestProjectElemMatch(t *testing.T) {
 		})
 	})
 }
+
+func TestProjectExpression(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	projectTest(t, bson.M{
+		"_id": id,
+		"foo": "bar",
+		"num": int32(7),
+		"sub": bson.M{
+			"a": int32(1),
+		},
+	}, func(fn func(bson.M, interface{})) {
+		// operator
+		fn(bson.M{
+			"sum": bson.M{"$add": bson.A{"$num", int32(3)}},
+		}, bson.M{
+			"_id": id,
+			"sum": int32(10),
+		})
+
+		// field path
+		fn(bson.M{
+			"_id": 0,
+			"val": "$sub.a",
+		}, bson.M{
+			"val": int32(1),
+		})
+
+		// literal
+		fn(bson.M{
+			"_id": 0,
+			"val": bson.M{"$literal": int32(1)},
+		}, bson.M{
+			"val": int32(1),
+		})
+
+		// mixed with inclusion
+		fn(bson.M{
+			"foo": 1,
+			"val": bson.M{"$multiply": bson.A{"$num", int32(2)}},
+		}, bson.M{
+			"_id": id,
+			"foo": "bar",
+			"val": int32(14),
+		})
+
+		// embedded
+		fn(bson.M{
+			"sub": bson.M{
+				"b": bson.M{"$add": bson.A{"$sub.a", int32(1)}},
+			},
+		}, bson.M{
+			"_id": id,
+			"sub": bson.M{
+				"b": int32(2),
+			},
+		})
+
+		// computed id
+		fn(bson.M{
+			"_id": "$foo",
+		}, bson.M{
+			"_id": "bar",
+			"foo": "bar",
+			"num": int32(7),
+			"sub": bson.M{
+				"a": int32(1),
+			},
+		})
+
+		// remove
+		fn(bson.M{
+			"foo": 1,
+			"num": "$$REMOVE",
+		}, bson.M{
+			"_id": id,
+			"foo": "bar",
+		})
+
+		// mixed with exclusion
+		fn(bson.M{
+			"foo": 0,
+			"val": "$num",
+		}, "cannot use expressions in exclusion projection")
+
+		// invalid expression
+		fn(bson.M{
+			"val": bson.M{"$foo": int32(1)},
+		}, `unknown expression operator "$foo"`)
+
+		// empty sub-projection
+		fn(bson.M{
+			"sub": bson.M{},
+		}, `empty sub-projection at "sub"`)
+	})
+}
+
+func TestProjectPathCollision(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	projectTest(t, bson.M{
+		"_id": id,
+		"foo": bson.M{
+			"bar": "baz",
+		},
+	}, func(fn func(bson.M, interface{})) {
+		fn(bson.M{
+			"foo":     1,
+			"foo.bar": 1,
+		}, `path collision at "foo.bar"`)
+
+		fn(bson.M{
+			"foo.bar": 1,
+			"foo":     bson.M{"$literal": int32(1)},
+		}, `path collision at "foo.bar"`)
+
+		fn(bson.M{
+			"foo": bson.M{
+				"bar": 1,
+			},
+			"foo.bar": "$foo",
+		}, `path collision at "foo.bar"`)
+	})
+}
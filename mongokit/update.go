@@ -1,15 +1,20 @@
 package mongokit
 
-import "github.com/256dpi/lungo/bsonkit"
+import (
+	"fmt"
 
-// Update will apply a MongoDB update document to a list of documents.
-func Update(list bsonkit.List, query, update bsonkit.Doc, upsert bool, arrayFilters bsonkit.List) ([]*Changes, error) {
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// Update will apply a MongoDB update document or update pipeline to a list of
+// documents.
+func Update(list bsonkit.List, query bsonkit.Doc, update interface{}, upsert bool, arrayFilters bsonkit.List) ([]*Changes, error) {
 	// prepare result
 	result := make([]*Changes, 0, len(list))
 
 	// apply update to all documents and collect changes
 	for _, item := range list {
-		changes, err := Apply(item, query, update, upsert, arrayFilters)
+		changes, err := applyUpdate(item, query, update, upsert, arrayFilters)
 		if err != nil {
 			return nil, err
 		}
@@ -18,3 +23,18 @@ func Update(list bsonkit.List, query, update bsonkit.Doc, upsert bool, arrayFilt
 
 	return result, nil
 }
+
+func applyUpdate(doc, query bsonkit.Doc, update interface{}, upsert bool, arrayFilters bsonkit.List) (*Changes, error) {
+	// apply update document or pipeline
+	switch update := update.(type) {
+	case bsonkit.Doc:
+		return Apply(doc, query, update, upsert, arrayFilters)
+	case *UpdatePipeline:
+		if len(arrayFilters) > 0 {
+			return nil, fmt.Errorf("array filters may not be specified for pipeline-style updates")
+		}
+		return ApplyPipeline(doc, update, upsert)
+	default:
+		return nil, fmt.Errorf("unsupported update %T", update)
+	}
+}
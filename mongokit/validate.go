@@ -0,0 +1,115 @@
+package mongokit
+
+import (
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// MaxDocumentSize is the maximum BSON size of a document.
+const MaxDocumentSize = 16 * 1024 * 1024
+
+// Validation is the result of a collection validation.
+type Validation struct {
+	// The number of documents.
+	Records int64
+
+	// The number of invalid documents.
+	InvalidDocuments int64
+
+	// The number of documents per index.
+	Keys map[string]int64
+
+	// The names of the invalid indexes.
+	InvalidIndexes []string
+
+	// The found errors.
+	Errors []string
+}
+
+// Valid returns whether no errors have been found.
+func (v *Validation) Valid() bool {
+	return len(v.Errors) == 0
+}
+
+// Validate will verify the consistency of the collection and its indexes. If
+// full is true, every document is checked to be valid BSON below the maximum
+// document size and the size accounting and index keys are verified.
+func (c *Collection) Validate(full bool) *Validation {
+	// prepare validation
+	val := &Validation{
+		Records: int64(len(c.Documents.List)),
+		Keys:    map[string]int64{},
+	}
+
+	// check set
+	err := c.Documents.Validate()
+	if err != nil {
+		val.Errors = append(val.Errors, fmt.Sprintf("documents: %s", err.Error()))
+	}
+
+	// check documents
+	if full {
+		var size int64
+		for _, doc := range c.Documents.List {
+			// check document
+			n, err := validateDocument(doc)
+			if err != nil {
+				val.InvalidDocuments++
+				val.Errors = append(val.Errors, fmt.Sprintf("document %v: %s", bsonkit.Get(doc, "_id"), err.Error()))
+			}
+			size += n
+		}
+
+		// check size
+		if size != c.size {
+			val.Errors = append(val.Errors, fmt.Sprintf("documents: size is %d but should be %d", c.size, size))
+		}
+	}
+
+	// sort indexes
+	names := make([]string, 0, len(c.Indexes))
+	for name := range c.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// check indexes
+	for _, name := range names {
+		index := c.Indexes[name]
+		val.Keys[name] = int64(len(index.List()))
+		err := index.Validate(c.Documents.List, full)
+		if err != nil {
+			val.InvalidIndexes = append(val.InvalidIndexes, name)
+			val.Errors = append(val.Errors, fmt.Sprintf("index %q: %s", name, err.Error()))
+		}
+	}
+
+	return val
+}
+
+// validateDocument returns the BSON size of the document or an error if the
+// document cannot be encoded, is not valid BSON or exceeds the maximum size.
+func validateDocument(doc bsonkit.Doc) (int64, error) {
+	// encode document
+	bytes, err := bson.Marshal(doc)
+	if err != nil {
+		return 0, err
+	}
+
+	// check bytes
+	err = bson.Raw(bytes).Validate()
+	if err != nil {
+		return 0, err
+	}
+
+	// check size
+	if len(bytes) > MaxDocumentSize {
+		return int64(len(bytes)), fmt.Errorf("size of %d bytes exceeds maximum of %d bytes", len(bytes), MaxDocumentSize)
+	}
+
+	return int64(len(bytes)), nil
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/xdg-go/scram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// the hash functions of the supported mechanisms
+var mechanisms = map[string]scram.HashGeneratorFcn{
+	lungo.ScramSHA1:   scram.SHA1,
+	lungo.ScramSHA256: scram.SHA256,
+}
+
+// conversation holds the state of a SASL conversation.
+type conversation struct {
+	db        string
+	skipEmpty bool
+	conv      *scram.ServerConversation
+}
+
+func authenticationFailed() error {
+	return &commandError{
+		code: 18,
+		name: "AuthenticationFailed",
+		msg:  "Authentication failed.",
+	}
+}
+
+// authenticated returns the authenticated user of the connection, if any.
+// The user is looked up for every command to apply changes immediately.
+func (c *conn) authenticated() (*lungo.User, error) {
+	// check user
+	if c.user == ([2]string{}) {
+		return nil, nil
+	}
+
+	// lookup user
+	user, err := c.server.opts.Engine.User(c.user[0], c.user[1])
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		c.user = [2]string{}
+	}
+
+	return user, nil
+}
+
+// exception returns whether the connection may create the first user.
+func (c *conn) exception(db, name string) (bool, error) {
+	// check command
+	if db != "admin" || name != "createUser" {
+		return false, nil
+	}
+
+	// check address
+	switch addr := c.conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		if !addr.IP.IsLoopback() {
+			return false, nil
+		}
+	case *net.UnixAddr:
+	default:
+		return false, nil
+	}
+
+	// check users
+	users, err := c.server.opts.Engine.ListUsers("")
+	if err != nil {
+		return false, err
+	}
+
+	return len(users) == 0, nil
+}
+
+func (c *conn) saslStart(db string, cmd bson.D) (bson.D, error) {
+	// get mechanism
+	mechanism, _ := bsonkit.Get(&cmd, "mechanism").(string)
+	hash, ok := mechanisms[mechanism]
+	if !ok {
+		return nil, &commandError{
+			code: 334,
+			name: "MechanismUnavailable",
+			msg:  fmt.Sprintf("Received authentication for mechanism %s which is not enabled", mechanism),
+		}
+	}
+
+	// get payload
+	payload, ok := bsonkit.Get(&cmd, "payload").(primitive.Binary)
+	if !ok {
+		return nil, fmt.Errorf("saslStart: payload must be a binary")
+	}
+
+	// prepare server
+	server, err := hash.NewServer(func(name string) (scram.StoredCredentials, error) {
+		// get user
+		user, err := c.server.opts.Engine.User(db, name)
+		if err != nil {
+			return scram.StoredCredentials{}, err
+		} else if user == nil {
+			return scram.StoredCredentials{}, fmt.Errorf("unknown user")
+		}
+
+		// get credential
+		cred := user.Credentials.Get(mechanism)
+		if cred == nil {
+			return scram.StoredCredentials{}, fmt.Errorf("unsupported mechanism")
+		}
+
+		return cred.Stored()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// start conversation
+	skipEmpty, _ := bsonkit.Get(&cmd, "options.skipEmptyExchange").(bool)
+	c.conv = &conversation{
+		db:        db,
+		skipEmpty: skipEmpty,
+		conv:      server.NewConversation(),
+	}
+
+	return c.step(payload.Data)
+}
+
+func (c *conn) saslContinue(cmd bson.D) (bson.D, error) {
+	// check conversation
+	if c.conv == nil {
+		return nil, fmt.Errorf("saslContinue: no conversation in progress")
+	}
+
+	// get payload
+	payload, ok := bsonkit.Get(&cmd, "payload").(primitive.Binary)
+	if !ok {
+		return nil, fmt.Errorf("saslContinue: payload must be a binary")
+	}
+
+	// handle empty exchange
+	if c.conv.conv.Done() && c.conv.conv.Valid() {
+		c.conv = nil
+		return saslReply(true, nil), nil
+	}
+
+	return c.step(payload.Data)
+}
+
+func (c *conn) step(payload []byte) (bson.D, error) {
+	// perform step
+	res, err := c.conv.conv.Step(string(payload))
+	if err != nil {
+		c.conv = nil
+		return nil, authenticationFailed()
+	}
+
+	// handle unfinished conversation
+	if !c.conv.conv.Done() {
+		return saslReply(false, []byte(res)), nil
+	}
+
+	// set user
+	c.user = [2]string{c.conv.db, c.conv.conv.Username()}
+
+	// finish conversation unless an empty exchange is expected
+	done := c.conv.skipEmpty
+	if done {
+		c.conv = nil
+	}
+
+	return saslReply(done, []byte(res)), nil
+}
+
+func saslReply(done bool, payload []byte) bson.D {
+	return bson.D{
+		{Key: "conversationId", Value: int32(1)},
+		{Key: "done", Value: done},
+		{Key: "payload", Value: primitive.Binary{Data: payload}},
+		{Key: "ok", Value: 1.0},
+	}
+}
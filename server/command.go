@@ -0,0 +1,289 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// commandError is an error with a code that is returned to the client.
+type commandError struct {
+	code   int32
+	name   string
+	msg    string
+	labels []string
+}
+
+// Error implements the error interface.
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+// errorReply will return the reply for the specified error.
+func errorReply(err error) bson.D {
+	// get code
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		code, name := lungo.ErrorCode(err)
+		cmdErr = &commandError{
+			code: code,
+			name: name,
+			msg:  err.Error(),
+		}
+		if errors.Is(err, lungo.ErrUnauthorized) {
+			cmdErr.code = 13
+			cmdErr.name = "Unauthorized"
+		}
+	}
+
+	// prepare reply
+	reply := bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: cmdErr.msg},
+		{Key: "code", Value: cmdErr.code},
+		{Key: "codeName", Value: cmdErr.name},
+	}
+
+	// add labels
+	if len(cmdErr.labels) > 0 {
+		labels := bson.A{}
+		for _, label := range cmdErr.labels {
+			labels = append(labels, label)
+		}
+		reply = append(reply, bson.E{Key: "errorLabels", Value: labels})
+	}
+
+	return reply
+}
+
+func unauthorized(name string) error {
+	return &commandError{
+		code: 13,
+		name: "Unauthorized",
+		msg:  fmt.Sprintf("command %s requires authentication", name),
+	}
+}
+
+// run will run the command against the database and return the reply.
+func (c *conn) run(db string, cmd bson.D) bson.D {
+	reply, err := c.execute(db, cmd)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return reply
+}
+
+func (c *conn) execute(db string, cmd bson.D) (bson.D, error) {
+	// check command
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	// get name
+	name := cmd[0].Key
+
+	// get session
+	var id string
+	if lsid := bsonkit.Get(&cmd, "lsid"); lsid != bsonkit.Missing {
+		var err error
+		id, err = sessionID(lsid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get transaction
+	txnNumber, hasTxn := bsonkit.Get(&cmd, "txnNumber").(int64)
+	autocommit, _ := bsonkit.Get(&cmd, "autocommit").(bool)
+	start, _ := bsonkit.Get(&cmd, "startTransaction").(bool)
+	inTxn := id != "" && hasTxn && bsonkit.Get(&cmd, "autocommit") != bsonkit.Missing && !autocommit
+
+	// get user
+	var user *lungo.User
+	authorize := c.server.opts.Auth
+	if authorize {
+		var err error
+		user, err = c.authenticated()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get session owner
+	var owner string
+	if user != nil {
+		owner = user.ID
+	}
+
+	// handle authentication and session commands
+	switch name {
+	case "saslStart":
+		return c.saslStart(db, cmd)
+	case "saslContinue":
+		return c.saslContinue(cmd)
+	case "logout":
+		c.user = [2]string{}
+		return bson.D{{Key: "ok", Value: 1.0}}, nil
+	case "commitTransaction", "abortTransaction":
+		// check authentication
+		if authorize && user == nil {
+			return nil, unauthorized(name)
+		}
+
+		// check transaction
+		if !inTxn {
+			return nil, fmt.Errorf("%s: must be run within a transaction", name)
+		}
+
+		// get session
+		sess := c.server.lookup(id, owner, false)
+		if sess == nil {
+			return nil, noSuchTransaction(txnNumber)
+		}
+
+		// commit or abort transaction
+		var err error
+		if name == "commitTransaction" {
+			err = sess.commit(txnNumber)
+		} else {
+			err = sess.abort(txnNumber)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return bson.D{{Key: "ok", Value: 1.0}}, nil
+	case "endSessions":
+		// check authentication
+		if authorize && user == nil {
+			return nil, unauthorized(name)
+		}
+
+		// get sessions
+		list, ok := cmd[0].Value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("endSessions: sessions must be an array")
+		}
+
+		// end sessions
+		for _, item := range list {
+			id, err := sessionID(item)
+			if err != nil {
+				return nil, err
+			}
+			c.server.remove(id, owner)
+		}
+
+		return bson.D{{Key: "ok", Value: 1.0}}, nil
+	}
+
+	// check command
+	if _, ok := lungo.Commands[name]; !ok {
+		return nil, &commandError{
+			code: 59,
+			name: "CommandNotFound",
+			msg:  fmt.Sprintf("no such command: '%s'", name),
+		}
+	}
+
+	// check localhost exception
+	if authorize && user == nil {
+		ok, err := c.exception(db, name)
+		if err != nil {
+			return nil, err
+		}
+		authorize = !ok
+	}
+
+	// prepare context
+	ctx := &lungo.CommandContext{
+		Context:   c.server.ctx,
+		Engine:    c.server.opts.Engine,
+		Database:  db,
+		Address:   c.address,
+		Authorize: authorize,
+		User:      user,
+	}
+
+	// run command without transaction
+	if !inTxn {
+		reply, err := ctx.Run(&cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		// negotiate compression
+		if name == "hello" || name == "isMaster" || name == "ismaster" {
+			*reply = append(*reply, bson.E{Key: "compression", Value: negotiate(cmd)})
+		}
+
+		return *reply, nil
+	}
+
+	// check authentication
+	if authorize && user == nil {
+		return nil, unauthorized(name)
+	}
+
+	// start or check transaction
+	var sess *session
+	if start {
+		sess = c.server.lookup(id, owner, true)
+		if sess == nil {
+			return nil, &commandError{
+				code: 13,
+				name: "Unauthorized",
+				msg:  "cannot use a session of another user",
+			}
+		}
+		err := sess.start(txnNumber)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sess = c.server.lookup(id, owner, false)
+		if sess == nil {
+			return nil, noSuchTransaction(txnNumber)
+		}
+		err := sess.check(txnNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// run command in transaction
+	var reply bsonkit.Doc
+	err := lungo.WithSession(c.server.ctx, sess.session, func(sc lungo.ISessionContext) error {
+		var err error
+		ctx.Context = sc
+		reply, err = ctx.Run(&cmd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return *reply, nil
+}
+
+// negotiate returns the supported compressors requested by the client.
+func negotiate(cmd bson.D) bson.A {
+	// get requested compressors
+	requested, _ := bsonkit.Get(&cmd, "compression").(bson.A)
+
+	// collect supported compressors
+	list := bson.A{}
+	for _, item := range requested {
+		name, _ := item.(string)
+		if _, ok := compressors[name]; ok {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// the maximum size of a message
+const maxMessageSize = 48000000
+
+// the supported compressors
+var compressors = map[string]wiremessage.CompressorID{
+	"snappy": wiremessage.CompressorSnappy,
+	"zlib":   wiremessage.CompressorZLib,
+	"zstd":   wiremessage.CompressorZstd,
+}
+
+// conn holds the state of a single connection.
+type conn struct {
+	server  *Server
+	conn    net.Conn
+	address string
+	user    [2]string
+	conv    *conversation
+}
+
+func (s *Server) serve(c net.Conn) {
+	// ensure close
+	defer func() {
+		_ = c.Close()
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+	}()
+
+	// get address
+	address := s.opts.Address
+	if address == "" {
+		address = c.LocalAddr().String()
+	}
+
+	// prepare connection
+	cn := &conn{
+		server:  s,
+		conn:    c,
+		address: address,
+	}
+
+	// prepare reader
+	reader := bufio.NewReader(c)
+
+	for {
+		// read message
+		msg, err := readMessage(reader)
+		if err != nil {
+			if !disconnected(err) {
+				s.report(err)
+			}
+			return
+		}
+
+		// handle message
+		reply, err := cn.handle(msg)
+		if err != nil {
+			s.report(err)
+			return
+		}
+
+		// write reply
+		if reply != nil {
+			_, err = c.Write(reply)
+			if err != nil {
+				if !disconnected(err) {
+					s.report(err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// disconnected returns whether the error is caused by a closed connection.
+func disconnected(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// readMessage will read a single message from the reader.
+func readMessage(r io.Reader) ([]byte, error) {
+	// read length
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// check length
+	length := int32(binary.LittleEndian.Uint32(size[:]))
+	if length < 16 || length > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length: %d", length)
+	}
+
+	// read message
+	msg := make([]byte, length)
+	copy(msg, size[:])
+	_, err = io.ReadFull(r, msg[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// handle will handle the message and return the reply, if any.
+func (c *conn) handle(msg []byte) ([]byte, error) {
+	// read header
+	_, requestID, _, opcode, rem, ok := wiremessage.ReadHeader(msg)
+	if !ok {
+		return nil, fmt.Errorf("malformed message header")
+	}
+
+	// decompress message
+	compressor := wiremessage.CompressorNoOp
+	if opcode == wiremessage.OpCompressed {
+		var size int32
+		opcode, rem, ok = wiremessage.ReadCompressedOriginalOpCode(rem)
+		if ok {
+			size, rem, ok = wiremessage.ReadCompressedUncompressedSize(rem)
+		}
+		if ok {
+			compressor, rem, ok = wiremessage.ReadCompressedCompressorID(rem)
+		}
+		if !ok || size < 0 || size > maxMessageSize {
+			return nil, fmt.Errorf("malformed compressed message")
+		}
+		payload, err := driver.DecompressPayload(rem, driver.CompressionOpts{
+			Compressor:       compressor,
+			UncompressedSize: size,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rem = payload
+	}
+
+	// handle message
+	var reply []byte
+	var err error
+	switch opcode {
+	case wiremessage.OpMsg:
+		reply, err = c.handleMsg(requestID, rem)
+	case wiremessage.OpQuery:
+		reply, err = c.handleQuery(requestID, rem)
+	default:
+		return nil, fmt.Errorf("unsupported opcode: %s", opcode)
+	}
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	// compress reply
+	if compressor != wiremessage.CompressorNoOp {
+		reply, err = compress(reply, compressor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+// handleMsg will handle an OP_MSG message.
+func (c *conn) handleMsg(requestID int32, msg []byte) ([]byte, error) {
+	// read flags
+	flags, rem, ok := wiremessage.ReadMsgFlags(msg)
+	if !ok {
+		return nil, fmt.Errorf("malformed message flags")
+	}
+
+	// strip checksum
+	if flags&wiremessage.ChecksumPresent != 0 {
+		if len(rem) < 4 {
+			return nil, fmt.Errorf("malformed message checksum")
+		}
+		rem = rem[:len(rem)-4]
+	}
+
+	// read sections
+	var body bson.D
+	var sequences bson.D
+	var found bool
+	for len(rem) > 0 {
+		var stype wiremessage.SectionType
+		stype, rem, ok = wiremessage.ReadMsgSectionType(rem)
+		if !ok {
+			return nil, fmt.Errorf("malformed message section")
+		}
+
+		switch stype {
+		case wiremessage.SingleDocument:
+			// read document
+			var doc bsoncore.Document
+			doc, rem, ok = wiremessage.ReadMsgSectionSingleDocument(rem)
+			if !ok || found {
+				return nil, fmt.Errorf("malformed message body")
+			}
+			err := bson.Unmarshal(doc, &body)
+			if err != nil {
+				return nil, err
+			}
+			found = true
+		case wiremessage.DocumentSequence:
+			// read documents
+			var identifier string
+			var docs []bsoncore.Document
+			identifier, docs, rem, ok = wiremessage.ReadMsgSectionDocumentSequence(rem)
+			if !ok {
+				return nil, fmt.Errorf("malformed message document sequence")
+			}
+			array := make(bson.A, 0, len(docs))
+			for _, doc := range docs {
+				var item bson.D
+				err := bson.Unmarshal(doc, &item)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, item)
+			}
+			sequences = append(sequences, bson.E{Key: identifier, Value: array})
+		default:
+			return nil, fmt.Errorf("unsupported message section type: %d", stype)
+		}
+	}
+
+	// check body
+	if !found {
+		return nil, fmt.Errorf("missing message body")
+	}
+
+	// merge sequences
+	body = append(body, sequences...)
+
+	// get database
+	db, _ := bsonkit.Get(&body, "$db").(string)
+
+	// run command
+	reply := c.run(db, body)
+
+	// skip reply if not requested
+	if flags&wiremessage.MoreToCome != 0 {
+		return nil, nil
+	}
+
+	// encode reply
+	doc, err := bson.Marshal(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare message
+	idx, out := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), requestID, wiremessage.OpMsg)
+	out = wiremessage.AppendMsgFlags(out, 0)
+	out = wiremessage.AppendMsgSectionType(out, wiremessage.SingleDocument)
+	out = append(out, doc...)
+	out = bsoncore.UpdateLength(out, idx, int32(len(out[idx:])))
+
+	return out, nil
+}
+
+// handleQuery will handle an OP_QUERY message. Only commands are supported,
+// as legacy queries are only used by clients for the initial handshake.
+func (c *conn) handleQuery(requestID int32, msg []byte) ([]byte, error) {
+	// read query
+	_, rem, ok := wiremessage.ReadQueryFlags(msg)
+	var ns string
+	if ok {
+		ns, rem, ok = wiremessage.ReadQueryFullCollectionName(rem)
+	}
+	if ok {
+		_, rem, ok = wiremessage.ReadQueryNumberToSkip(rem)
+	}
+	if ok {
+		_, rem, ok = wiremessage.ReadQueryNumberToReturn(rem)
+	}
+	var query bsoncore.Document
+	if ok {
+		query, _, ok = wiremessage.ReadQueryQuery(rem)
+	}
+	if !ok {
+		return nil, fmt.Errorf("malformed query message")
+	}
+
+	// decode query
+	var cmd bson.D
+	err := bson.Unmarshal(query, &cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// unwrap query
+	if wrapped, ok := bsonkit.Get(&cmd, "$query").(bson.D); ok {
+		cmd = wrapped
+	}
+
+	// run command
+	var reply bson.D
+	if db, ok := strings.CutSuffix(ns, ".$cmd"); ok {
+		reply = c.run(db, cmd)
+	} else {
+		reply = errorReply(fmt.Errorf("legacy queries are not supported"))
+	}
+
+	// encode reply
+	doc, err := bson.Marshal(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare message
+	idx, out := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), requestID, wiremessage.OpReply)
+	out = wiremessage.AppendReplyFlags(out, 0)
+	out = wiremessage.AppendReplyCursorID(out, 0)
+	out = wiremessage.AppendReplyStartingFrom(out, 0)
+	out = wiremessage.AppendReplyNumberReturned(out, 1)
+	out = append(out, doc...)
+	out = bsoncore.UpdateLength(out, idx, int32(len(out[idx:])))
+
+	return out, nil
+}
+
+// compress will wrap the message in an OP_COMPRESSED message.
+func compress(msg []byte, compressor wiremessage.CompressorID) ([]byte, error) {
+	// read header
+	_, requestID, responseTo, opcode, rem, ok := wiremessage.ReadHeader(msg)
+	if !ok {
+		return nil, fmt.Errorf("malformed message header")
+	}
+
+	// compress payload
+	payload, err := driver.CompressPayload(rem, driver.CompressionOpts{
+		Compressor: compressor,
+		ZlibLevel:  wiremessage.DefaultZlibLevel,
+		ZstdLevel:  wiremessage.DefaultZstdLevel,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare message
+	idx, out := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpCompressed)
+	out = wiremessage.AppendCompressedOriginalOpCode(out, opcode)
+	out = wiremessage.AppendCompressedUncompressedSize(out, int32(len(rem)))
+	out = wiremessage.AppendCompressedCompressorID(out, compressor)
+	out = wiremessage.AppendCompressedCompressedMessage(out, payload)
+	out = bsoncore.UpdateLength(out, idx, int32(len(out[idx:])))
+
+	return out, nil
+}
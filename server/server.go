@@ -0,0 +1,165 @@
+// Package server implements a server that speaks the MongoDB wire protocol and
+// runs the received commands against a lungo engine.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/256dpi/lungo"
+)
+
+// ErrServerClosed is returned by Serve if the server has been closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Options is used to configure a server.
+type Options struct {
+	// The engine used to run commands.
+	Engine *lungo.Engine
+
+	// The address reported to clients by the handshake commands.
+	//
+	// Default: The local address of the connection.
+	Address string
+
+	// Whether clients must authenticate using SCRAM and the privileges of
+	// the users are enforced. If no users exist, clients connected via the
+	// loopback interface or a Unix socket may create the first user on the
+	// admin database.
+	Auth bool
+
+	// The function that is called with connection errors.
+	Errors func(error)
+}
+
+// Server accepts connections and serves them using the MongoDB wire protocol.
+type Server struct {
+	opts      Options
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	sessions  map[string]*session
+	closed    bool
+	group     sync.WaitGroup
+	mutex     sync.Mutex
+}
+
+// NewServer will create and return a new server.
+func NewServer(opts Options) *Server {
+	// check engine
+	if opts.Engine == nil {
+		panic("lungo: missing engine")
+	}
+
+	// prepare context
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Server{
+		opts:      opts,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		sessions:  map[string]*session{},
+	}
+}
+
+// Serve will accept and serve connections from the listener until the server
+// is closed. The listener is closed when the method returns.
+func (s *Server) Serve(listener net.Listener) error {
+	// register listener
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mutex.Unlock()
+
+	// ensure removal
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, listener)
+		s.mutex.Unlock()
+		_ = listener.Close()
+	}()
+
+	for {
+		// accept connection
+		conn, err := listener.Accept()
+		if err != nil {
+			// check if closed
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		// register connection
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.group.Add(1)
+		s.mutex.Unlock()
+
+		// serve connection
+		go func() {
+			defer s.group.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+// Close will close all listeners and connections, end all sessions and wait
+// for the connection goroutines to return.
+func (s *Server) Close() {
+	// set flag
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+
+	// close listeners and connections
+	for listener := range s.listeners {
+		_ = listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mutex.Unlock()
+
+	// cancel context
+	s.cancel()
+
+	// await connections
+	s.group.Wait()
+
+	// end sessions
+	s.mutex.Lock()
+	sessions := s.sessions
+	s.sessions = map[string]*session{}
+	s.mutex.Unlock()
+	for _, sess := range sessions {
+		sess.end()
+	}
+}
+
+func (s *Server) report(err error) {
+	if s.opts.Errors != nil {
+		s.opts.Errors(err)
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/256dpi/lungo"
+)
+
+func startServer(t *testing.T, auth bool) (string, func()) {
+	// create engine
+	engine, err := lungo.CreateEngine(lungo.Options{
+		Store: lungo.NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+
+	// create listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// run server
+	server := NewServer(Options{
+		Engine: engine,
+		Auth:   auth,
+		Errors: func(err error) {
+			assert.NoError(t, err)
+		},
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	return listener.Addr().String(), func() {
+		server.Close()
+		assert.Equal(t, ErrServerClosed, <-done)
+		engine.Close()
+	}
+}
+
+func connect(t *testing.T, opts *options.ClientOptions) *mongo.Client {
+	client, err := mongo.Connect(context.Background(), opts.SetServerSelectionTimeout(2*time.Second))
+	assert.NoError(t, err)
+	return client
+}
+
+func serverTest(t *testing.T, compressors []string, fn func(t *testing.T, client *mongo.Client)) {
+	// start server
+	addr, stop := startServer(t, false)
+	defer stop()
+
+	// connect client
+	client := connect(t, options.Client().ApplyURI("mongodb://"+addr).SetCompressors(compressors))
+
+	fn(t, client)
+
+	// disconnect client
+	err := client.Disconnect(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestServerCRUD(t *testing.T) {
+	serverTest(t, nil, func(t *testing.T, client *mongo.Client) {
+		coll := client.Database("test").Collection("crud")
+
+		err := client.Ping(context.Background(), nil)
+		assert.NoError(t, err)
+
+		// insert
+		docs := make([]interface{}, 0, 250)
+		for i := 0; i < 250; i++ {
+			docs = append(docs, bson.M{"_id": int32(i), "even": i%2 == 0})
+		}
+		res1, err := coll.InsertMany(context.Background(), docs)
+		assert.NoError(t, err)
+		assert.Len(t, res1.InsertedIDs, 250)
+
+		// duplicate
+		_, err = coll.InsertOne(context.Background(), bson.M{"_id": int32(1)})
+		assert.True(t, mongo.IsDuplicateKeyError(err))
+
+		// find with multiple batches
+		csr, err := coll.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}).SetBatchSize(50))
+		assert.NoError(t, err)
+		var all []bson.M
+		err = csr.All(context.Background(), &all)
+		assert.NoError(t, err)
+		assert.Len(t, all, 250)
+		assert.Equal(t, int32(249), all[249]["_id"])
+
+		// update
+		res2, err := coll.UpdateMany(context.Background(), bson.M{"even": true}, bson.M{"$set": bson.M{"foo": "bar"}})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(125), res2.ModifiedCount)
+
+		// count
+		num, err := coll.CountDocuments(context.Background(), bson.M{"foo": "bar"})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(125), num)
+
+		// delete
+		res3, err := coll.DeleteMany(context.Background(), bson.M{"even": false})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(125), res3.DeletedCount)
+
+		// find one
+		var doc bson.M
+		err = coll.FindOne(context.Background(), bson.M{"_id": int32(2)}).Decode(&doc)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{"_id": int32(2), "even": true, "foo": "bar"}, doc)
+
+		// indexes
+		name, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+			Keys: bson.M{"foo": 1},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "foo_1", name)
+
+		// list
+		names, err := client.Database("test").ListCollectionNames(context.Background(), bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"crud"}, names)
+
+		// unknown command
+		err = client.Database("test").RunCommand(context.Background(), bson.M{"foo": 1}).Err()
+		var cmdErr mongo.CommandError
+		assert.ErrorAs(t, err, &cmdErr)
+		assert.Equal(t, int32(59), cmdErr.Code)
+	})
+}
+
+func TestServerTransaction(t *testing.T) {
+	serverTest(t, nil, func(t *testing.T, client *mongo.Client) {
+		coll := client.Database("test").Collection("txn")
+
+		// commit
+		sess, err := client.StartSession()
+		assert.NoError(t, err)
+		_, err = sess.WithTransaction(context.Background(), func(sc mongo.SessionContext) (interface{}, error) {
+			_, err := coll.InsertOne(sc, bson.M{"_id": "a"})
+			if err != nil {
+				return nil, err
+			}
+
+			num, err := coll.CountDocuments(sc, bson.M{})
+			assert.Equal(t, int64(1), num)
+
+			return nil, err
+		})
+		assert.NoError(t, err)
+		sess.EndSession(context.Background())
+
+		num, err := coll.CountDocuments(context.Background(), bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), num)
+
+		// abort
+		sess, err = client.StartSession()
+		assert.NoError(t, err)
+		err = mongo.WithSession(context.Background(), sess, func(sc mongo.SessionContext) error {
+			err := sess.StartTransaction()
+			assert.NoError(t, err)
+
+			_, err = coll.InsertOne(sc, bson.M{"_id": "b"})
+			assert.NoError(t, err)
+
+			return sess.AbortTransaction(sc)
+		})
+		assert.NoError(t, err)
+		sess.EndSession(context.Background())
+
+		num, err = coll.CountDocuments(context.Background(), bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), num)
+	})
+}
+
+func TestServerEndedSession(t *testing.T) {
+	engine, err := lungo.CreateEngine(lungo.Options{
+		Store: lungo.NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	server := NewServer(Options{
+		Engine: engine,
+	})
+	defer server.Close()
+
+	sess := server.lookup("a", "", true)
+	assert.NoError(t, sess.start(1))
+	assert.Equal(t, sess, server.lookup("a", "", false))
+
+	// end session like the engine does for idle sessions
+	sess.session.EndSession(nil)
+	assert.Nil(t, server.lookup("a", "", false))
+	assert.Error(t, sess.check(1))
+
+	// ended sessions are replaced and removed
+	other := server.lookup("b", "", true)
+	assert.NotNil(t, other)
+	assert.Len(t, server.sessions, 1)
+
+	sess = server.lookup("a", "", true)
+	assert.NoError(t, sess.start(1))
+	assert.Len(t, server.sessions, 2)
+}
+
+func TestServerSessionOwner(t *testing.T) {
+	engine, err := lungo.CreateEngine(lungo.Options{
+		Store: lungo.NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	server := NewServer(Options{
+		Engine: engine,
+	})
+	defer server.Close()
+
+	sess := server.lookup("a", "test.alice", true)
+	assert.NoError(t, sess.start(1))
+
+	// other users may not use the session
+	assert.Equal(t, sess, server.lookup("a", "test.alice", false))
+	assert.Nil(t, server.lookup("a", "test.bob", false))
+	assert.Nil(t, server.lookup("a", "test.bob", true))
+	assert.Nil(t, server.lookup("a", "", false))
+
+	// other users may not end the session
+	server.remove("a", "test.bob")
+	assert.False(t, sess.session.Ended())
+	assert.NoError(t, sess.check(1))
+
+	server.remove("a", "test.alice")
+	assert.True(t, sess.session.Ended())
+	assert.Nil(t, server.lookup("a", "test.alice", false))
+}
+
+func TestServerExpiredTransaction(t *testing.T) {
+	engine, err := lungo.CreateEngine(lungo.Options{
+		Store:               lungo.NewMemoryStore(),
+		TransactionLifetime: time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	server := NewServer(Options{
+		Engine: engine,
+	})
+	defer server.Close()
+
+	sess := server.lookup("a", "", true)
+	assert.NoError(t, sess.start(1))
+
+	// wait for the engine to abort the transaction
+	assert.Eventually(t, func() bool {
+		return sess.session.Expired()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = sess.commit(1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "lifetime limit")
+}
+
+func TestServerChangeStream(t *testing.T) {
+	serverTest(t, nil, func(t *testing.T, client *mongo.Client) {
+		coll := client.Database("test").Collection("stream")
+
+		stream, err := coll.Watch(context.Background(), bson.A{}, options.ChangeStream().SetMaxAwaitTime(100*time.Millisecond))
+		assert.NoError(t, err)
+
+		_, err = coll.InsertOne(context.Background(), bson.M{"_id": "a"})
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var event bson.M
+		assert.True(t, stream.Next(ctx))
+		assert.NoError(t, stream.Decode(&event))
+		assert.Equal(t, "insert", event["operationType"])
+		assert.Equal(t, bson.M{"_id": "a"}, event["fullDocument"])
+
+		assert.NoError(t, stream.Close(context.Background()))
+	})
+}
+
+func TestServerCompression(t *testing.T) {
+	for _, compressor := range []string{"snappy", "zlib", "zstd"} {
+		t.Run(compressor, func(t *testing.T) {
+			serverTest(t, []string{compressor}, func(t *testing.T, client *mongo.Client) {
+				coll := client.Database("test").Collection("compression")
+
+				_, err := coll.InsertOne(context.Background(), bson.M{"_id": "a", "foo": "bar"})
+				assert.NoError(t, err)
+
+				var doc bson.M
+				err = coll.FindOne(context.Background(), bson.M{"_id": "a"}).Decode(&doc)
+				assert.NoError(t, err)
+				assert.Equal(t, bson.M{"_id": "a", "foo": "bar"}, doc)
+			})
+		})
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	addr, stop := startServer(t, true)
+	defer stop()
+
+	// unauthenticated
+	anon := connect(t, options.Client().ApplyURI("mongodb://"+addr))
+	defer anon.Disconnect(context.Background())
+
+	err := anon.Database("test").Collection("foo").FindOne(context.Background(), bson.M{}).Err()
+	var cmdErr mongo.CommandError
+	assert.ErrorAs(t, err, &cmdErr)
+	assert.Equal(t, int32(13), cmdErr.Code)
+
+	// create first user using the localhost exception
+	err = anon.Database("admin").RunCommand(context.Background(), bson.D{
+		{Key: "createUser", Value: "root"},
+		{Key: "pwd", Value: "secret"},
+		{Key: "roles", Value: bson.A{"root"}},
+	}).Err()
+	assert.NoError(t, err)
+
+	// exception is gone
+	err = anon.Database("admin").RunCommand(context.Background(), bson.D{
+		{Key: "createUser", Value: "other"},
+		{Key: "pwd", Value: "secret"},
+		{Key: "roles", Value: bson.A{"root"}},
+	}).Err()
+	assert.ErrorAs(t, err, &cmdErr)
+	assert.Equal(t, int32(13), cmdErr.Code)
+
+	// ending sessions requires authentication
+	err = anon.Database("admin").RunCommand(context.Background(), bson.D{
+		{Key: "endSessions", Value: bson.A{}},
+	}).Err()
+	assert.ErrorAs(t, err, &cmdErr)
+	assert.Equal(t, int32(13), cmdErr.Code)
+
+	// wrong password
+	client := connect(t, options.Client().ApplyURI("mongodb://"+addr).SetAuth(options.Credential{
+		Username: "root",
+		Password: "wrong",
+	}))
+	err = client.Ping(context.Background(), nil)
+	assert.Error(t, err)
+	_ = client.Disconnect(context.Background())
+
+	for _, mechanism := range []string{"", "SCRAM-SHA-1", "SCRAM-SHA-256"} {
+		// root user
+		root := connect(t, options.Client().ApplyURI("mongodb://"+addr).SetAuth(options.Credential{
+			AuthMechanism: mechanism,
+			Username:      "root",
+			Password:      "secret",
+		}))
+		_, err = root.Database("test").Collection("foo").InsertOne(context.Background(), bson.M{"foo": "bar"})
+		assert.NoError(t, err)
+
+		// create reader
+		_ = root.Database("test").RunCommand(context.Background(), bson.D{{Key: "dropUser", Value: "reader"}}).Err()
+		err = root.Database("test").RunCommand(context.Background(), bson.D{
+			{Key: "createUser", Value: "reader"},
+			{Key: "pwd", Value: "secret"},
+			{Key: "roles", Value: bson.A{"read"}},
+		}).Err()
+		assert.NoError(t, err)
+
+		// read only user
+		reader := connect(t, options.Client().ApplyURI("mongodb://"+addr).SetAuth(options.Credential{
+			AuthMechanism: mechanism,
+			AuthSource:    "test",
+			Username:      "reader",
+			Password:      "secret",
+		}))
+		num, err := reader.Database("test").Collection("foo").CountDocuments(context.Background(), bson.M{})
+		assert.NoError(t, err)
+		assert.True(t, num > 0)
+		_, err = reader.Database("test").Collection("foo").InsertOne(context.Background(), bson.M{"foo": "bar"})
+		assert.ErrorAs(t, err, &cmdErr)
+		assert.Equal(t, int32(13), cmdErr.Code)
+
+		// dropped user
+		err = root.Database("test").RunCommand(context.Background(), bson.D{{Key: "dropUser", Value: "reader"}}).Err()
+		assert.NoError(t, err)
+		_, err = reader.Database("test").Collection("foo").CountDocuments(context.Background(), bson.M{})
+		assert.ErrorAs(t, err, &cmdErr)
+		assert.Equal(t, int32(13), cmdErr.Code)
+
+		assert.NoError(t, reader.Disconnect(context.Background()))
+		assert.NoError(t, root.Disconnect(context.Background()))
+	}
+}
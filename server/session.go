@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo"
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// session maps a client session to an engine session. A session may only be
+// used by the user that created it.
+type session struct {
+	session   *lungo.Session
+	user      string
+	txnNumber int64
+	committed bool
+	mutex     sync.Mutex
+}
+
+// sessionID returns the key of the specified logical session id.
+func sessionID(lsid interface{}) (string, error) {
+	// get id
+	doc, ok := lsid.(bson.D)
+	if !ok {
+		return "", fmt.Errorf("lsid must be an object")
+	}
+	id, ok := bsonkit.Get(&doc, "id").(primitive.Binary)
+	if !ok {
+		return "", fmt.Errorf("lsid.id must be a binary")
+	}
+
+	return string(id.Data), nil
+}
+
+// lookup will return the session with the specified id. If create is set,
+// missing sessions are created for the user. Sessions that have been ended by
+// the engine due to inactivity are treated as missing. Sessions of other users
+// are never returned.
+func (s *Server) lookup(id, user string, create bool) *session {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get session
+	sess, ok := s.sessions[id]
+	if ok && !sess.session.Ended() {
+		if sess.user != user {
+			return nil
+		}
+		return sess
+	} else if !create {
+		return nil
+	}
+
+	// remove ended sessions
+	for key, sess := range s.sessions {
+		if sess.session.Ended() {
+			delete(s.sessions, key)
+		}
+	}
+
+	// start session
+	ses, err := lungo.NewClient(s.opts.Engine).StartSession()
+	if err != nil {
+		panic(err)
+	}
+
+	// store session
+	sess = &session{
+		session: ses.(*lungo.Session),
+		user:    user,
+	}
+	s.sessions[id] = sess
+
+	return sess
+}
+
+// remove will remove and end the session with the specified id if it belongs
+// to the user.
+func (s *Server) remove(id, user string) {
+	// remove session
+	s.mutex.Lock()
+	sess, ok := s.sessions[id]
+	if ok && sess.user == user {
+		delete(s.sessions, id)
+	} else {
+		ok = false
+	}
+	s.mutex.Unlock()
+
+	// end session
+	if ok {
+		sess.end()
+	}
+}
+
+// start will start a transaction with the specified number. An active
+// transaction with a lower number is aborted.
+func (s *session) start(number int64) error {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check number
+	if number <= s.txnNumber {
+		return &commandError{
+			code: 225,
+			name: "TransactionTooOld",
+			msg:  fmt.Sprintf("txnNumber %d is less than or equal to the last txnNumber %d", number, s.txnNumber),
+		}
+	}
+
+	// abort active transaction
+	err := s.session.AbortTransaction(nil)
+	if err != nil {
+		return err
+	}
+
+	// start transaction
+	err = s.session.StartTransaction()
+	if err != nil {
+		return err
+	}
+
+	// set state
+	s.txnNumber = number
+	s.committed = false
+
+	return nil
+}
+
+// check will ensure that the transaction with the specified number is active.
+func (s *session) check(number int64) error {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check transaction
+	if number != s.txnNumber {
+		return noSuchTransaction(number)
+	} else if s.session.Transaction() == nil {
+		return s.missingTransaction(number)
+	}
+
+	return nil
+}
+
+// commit will commit the transaction with the specified number. Committing an
+// already committed transaction succeeds to support retries.
+func (s *session) commit(number int64) error {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check number
+	if number != s.txnNumber {
+		return noSuchTransaction(number)
+	}
+
+	// handle retries
+	if s.committed {
+		return nil
+	}
+
+	// check transaction
+	if s.session.Transaction() == nil {
+		return s.missingTransaction(number)
+	}
+
+	// commit transaction
+	err := s.session.CommitTransaction(nil)
+	if err != nil {
+		return err
+	}
+
+	// set flag
+	s.committed = true
+
+	return nil
+}
+
+// abort will abort the transaction with the specified number.
+func (s *session) abort(number int64) error {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check transaction
+	if number != s.txnNumber {
+		return noSuchTransaction(number)
+	} else if s.session.Transaction() == nil {
+		return s.missingTransaction(number)
+	}
+
+	return s.session.AbortTransaction(nil)
+}
+
+// end will end the session and abort an active transaction.
+func (s *session) end() {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// end session
+	s.session.EndSession(nil)
+}
+
+// missingTransaction will return the error for the current transaction that is
+// no longer active. The session must be locked.
+func (s *session) missingTransaction(number int64) error {
+	// check expiry
+	if s.session.Expired() {
+		return &commandError{
+			code:   251,
+			name:   "NoSuchTransaction",
+			msg:    fmt.Sprintf("transaction %d has been aborted after exceeding the transaction lifetime limit", number),
+			labels: []string{"TransientTransactionError"},
+		}
+	}
+
+	return noSuchTransaction(number)
+}
+
+func noSuchTransaction(number int64) error {
+	return &commandError{
+		code:   251,
+		name:   "NoSuchTransaction",
+		msg:    fmt.Sprintf("transaction %d has been aborted or does not exist", number),
+		labels: []string{"TransientTransactionError"},
+	}
+}
@@ -2,9 +2,11 @@ package lungo
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,6 +18,10 @@ type sessionKey struct{}
 // ErrSessionEnded is returned if the session has been ended.
 var ErrSessionEnded = errors.New("session ended")
 
+// ErrTransactionExpired is returned if the transaction of the session has been
+// aborted because it exceeded the transaction lifetime limit.
+var ErrTransactionExpired = errors.New("transaction aborted after exceeding the transaction lifetime limit")
+
 // SessionContext provides a mongo compatible session context.
 type SessionContext struct {
 	context.Context
@@ -25,15 +31,50 @@ type SessionContext struct {
 // Session provides a mongo compatible way to handle transactions.
 type Session struct {
 	engine   *Engine
+	id       primitive.Binary
+	created  time.Time
+	used     time.Time
 	txn      *Transaction
 	starting bool
+	expired  bool
 	ended    bool
 	mutex    sync.Mutex
 }
 
+// newSession will create and register a new session.
+func newSession(engine *Engine) *Session {
+	// generate random (version 4) UUID
+	uuid := make([]byte, 16)
+	_, err := rand.Read(uuid)
+	if err != nil {
+		panic(err)
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	// create session
+	now := time.Now()
+	session := &Session{
+		engine:  engine,
+		id:      primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: uuid},
+		created: now,
+		used:    now,
+	}
+
+	// register session
+	engine.register(session)
+
+	return session
+}
+
 // ID implements the ISession.ID method.
 func (s *Session) ID() bson.Raw {
-	return nil
+	raw, err := bson.Marshal(bson.D{{Key: "id", Value: s.id}})
+	if err != nil {
+		panic(err)
+	}
+
+	return raw
 }
 
 // AbortTransaction implements the ISession.AbortTransaction method.
@@ -53,6 +94,12 @@ func (s *Session) AbortTransaction(context.Context) error {
 		s.txn = nil
 	}
 
+	// reset flag
+	s.expired = false
+
+	// update usage
+	s.used = time.Now()
+
 	return nil
 }
 
@@ -90,7 +137,9 @@ func (s *Session) CommitTransaction(context.Context) error {
 	}
 
 	// check transaction
-	if s.txn == nil {
+	if s.txn == nil && s.expired {
+		return ErrTransactionExpired
+	} else if s.txn == nil {
 		return fmt.Errorf("missing transaction")
 	}
 
@@ -98,6 +147,9 @@ func (s *Session) CommitTransaction(context.Context) error {
 	txn := s.txn
 	s.txn = nil
 
+	// update usage
+	s.used = time.Now()
+
 	// commit transaction
 	err := s.engine.Commit(txn)
 	if err != nil {
@@ -113,6 +165,13 @@ func (s *Session) EndSession(context.Context) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	// end session
+	s.end()
+}
+
+// end will abort the active transaction and end the session. The session must
+// be locked.
+func (s *Session) end() {
 	// check if ended
 	if s.ended {
 		return
@@ -126,6 +185,9 @@ func (s *Session) EndSession(context.Context) {
 
 	// set flag
 	s.ended = true
+
+	// unregister session
+	s.engine.unregister(s)
 }
 
 // OperationTime implements the ISession.OperationTime method.
@@ -181,6 +243,8 @@ func (s *Session) startTransaction(ctx context.Context, opts ...*options.Transac
 		return ErrSessionEnded
 	}
 	s.txn = txn
+	s.expired = false
+	s.used = time.Now()
 
 	return nil
 }
@@ -230,6 +294,27 @@ func (s *Session) WithTransaction(ctx context.Context, fn func(ISessionContext)
 	return res, nil
 }
 
+// Ended returns whether the session has been ended. Sessions are ended
+// explicitly or by the engine if they have been idle for longer than the
+// session timeout.
+func (s *Session) Ended() bool {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.ended
+}
+
+// Expired will return whether the last transaction has been aborted because it
+// exceeded the transaction lifetime limit.
+func (s *Session) Expired() bool {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.expired
+}
+
 // Transaction will return the active transaction or nil if no transaction has
 // been started.
 func (s *Session) Transaction() *Transaction {
@@ -239,3 +324,45 @@ func (s *Session) Transaction() *Transaction {
 
 	return s.txn
 }
+
+// use will update the usage of the session and return the active transaction.
+func (s *Session) use() *Transaction {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// update usage
+	s.used = time.Now()
+
+	return s.txn
+}
+
+// expire will end the session if it has not been used since the specified
+// time or otherwise abort the specified transaction if it is still active.
+func (s *Session) expire(since time.Time, txn *Transaction) {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// end idle session
+	if s.used.Before(since) {
+		s.end()
+		return
+	}
+
+	// abort transaction
+	if txn != nil && s.txn == txn {
+		s.engine.Abort(s.txn)
+		s.txn = nil
+		s.expired = true
+	}
+}
+
+// lastUsed will return the time the session has last been used.
+func (s *Session) lastUsed() time.Time {
+	// acquire lock
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.used
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
@@ -311,3 +312,96 @@ func TestSessionListOpsHonorTransaction(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestSessionCurrentOpAndLocalSessions(t *testing.T) {
+	d := testLungoClient.Database("admin")
+
+	sess, err := testLungoClient.StartSession()
+	assert.NoError(t, err)
+	defer sess.EndSession(nil)
+
+	id := sess.ID().Lookup("id")
+
+	// local sessions
+	csr, err := d.Aggregate(nil, bson.A{
+		bson.M{"$listLocalSessions": bson.M{}},
+		bson.M{"$match": bson.M{"_id.id": id}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, readAll(csr), 1)
+
+	// no operation
+	csr, err = d.Aggregate(nil, bson.A{
+		bson.M{"$currentOp": bson.M{}},
+		bson.M{"$match": bson.M{"lsid.id": id}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, readAll(csr), 0)
+
+	// active transaction
+	err = sess.StartTransaction()
+	assert.NoError(t, err)
+
+	csr, err = d.Aggregate(nil, bson.A{
+		bson.M{"$currentOp": bson.M{}},
+		bson.M{"$match": bson.M{"lsid.id": id}},
+		bson.M{"$project": bson.M{"_id": 0, "desc": 1, "active": 1}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{
+		{"desc": "transaction", "active": true},
+	}, readAll(csr))
+
+	err = sess.AbortTransaction(nil)
+	assert.NoError(t, err)
+
+	// wrong database
+	_, err = testLungoClient.Database(testDB).Aggregate(nil, bson.A{
+		bson.M{"$currentOp": bson.M{}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "$currentOp must be run against the 'admin' database with {aggregate: 1}", err.Error())
+
+	// ended session
+	sess.EndSession(nil)
+
+	csr, err = d.Aggregate(nil, bson.A{
+		bson.M{"$listLocalSessions": bson.M{}},
+		bson.M{"$match": bson.M{"_id.id": id}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, readAll(csr), 0)
+}
+
+func TestSessionIdleLocalSessions(t *testing.T) {
+	client, engine, err := Open(nil, Options{
+		Store: NewMemoryStore(),
+	})
+	assert.NoError(t, err)
+	defer engine.Close()
+
+	d := client.Database("admin")
+
+	sess, err := client.StartSession()
+	assert.NoError(t, err)
+	err = sess.StartTransaction()
+	assert.NoError(t, err)
+
+	count := func(stage string) int {
+		csr, err := d.Aggregate(nil, bson.A{
+			bson.M{stage: bson.M{}},
+		})
+		assert.NoError(t, err)
+		return len(readAll(csr))
+	}
+
+	assert.Equal(t, 1, count("$listLocalSessions"))
+	assert.Equal(t, 1, count("$currentOp"))
+
+	// idle session
+	engine.reap(time.Now().Add(30 * time.Minute))
+	assert.True(t, sess.(*Session).Ended())
+
+	assert.Equal(t, 0, count("$listLocalSessions"))
+	assert.Equal(t, 0, count("$currentOp"))
+}
@@ -55,10 +55,28 @@ func NewFileStore(path string, mode os.FileMode) *FileStore {
 // Load will read the catalog from disk and return it. If no file exists at the
 // specified location an empty catalog is returned.
 func (s *FileStore) Load() (*Catalog, error) {
+	// read file
+	file, err := s.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	// build catalog from file
+	catalog, err := file.BuildCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	return catalog, nil
+}
+
+// ReadFile will read and decode the file from disk without building a catalog.
+// If no file exists at the specified location an empty file is returned.
+func (s *FileStore) ReadFile() (*File, error) {
 	// load file
 	buf, err := os.ReadFile(s.path)
 	if os.IsNotExist(err) {
-		return NewCatalog(), nil
+		return &File{Namespaces: map[string]FileNamespace{}}, nil
 	} else if err != nil {
 		return nil, err
 	}
@@ -70,13 +88,7 @@ func (s *FileStore) Load() (*Catalog, error) {
 		return nil, err
 	}
 
-	// build catalog from file
-	catalog, err := file.BuildCatalog()
-	if err != nil {
-		return nil, err
-	}
-
-	return catalog, nil
+	return &file, nil
 }
 
 // Store will atomically write the catalog to disk.
@@ -12,6 +12,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
 )
 
 // ErrLostOplogPosition may be returned by a stream when the oplog position has
@@ -19,7 +20,28 @@ import (
 // oplog entries.
 var ErrLostOplogPosition = errors.New("lost oplog position")
 
-// Stream provides a mongo compatible way to read oplog events.
+// ErrModifiedResumeToken is returned by a stream when the pipeline modified the
+// "_id" field of an event that contains the resume token.
+var ErrModifiedResumeToken = errors.New("the pipeline modified the resume token of an event")
+
+// the stages that may be used to filter and transform change stream events
+var changeStreamStages = map[string]bool{
+	"$match":       true,
+	"$project":     true,
+	"$addFields":   true,
+	"$set":         true,
+	"$unset":       true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+	"$redact":      true,
+}
+
+var _ IChangeStream = &Stream{}
+var _ ICursor = &Stream{}
+
+// Stream provides a mongo compatible way to read oplog events. A stream is
+// also returned as a cursor by aggregations that start with a $changeStream
+// stage.
 type Stream struct {
 	handle   Handle
 	last     bsonkit.Doc
@@ -35,6 +57,32 @@ type Stream struct {
 	mutex    sync.Mutex
 }
 
+// All implements the ICursor.All method. It will decode all currently available
+// events and close the stream.
+func (s *Stream) All(ctx context.Context, out interface{}) error {
+	// collect available events
+	var list bsonkit.List
+	for s.next(ctx, false) {
+		s.mutex.Lock()
+		list = append(list, s.event)
+		s.mutex.Unlock()
+	}
+
+	// check error
+	err := s.Err()
+	if err != nil {
+		return err
+	}
+
+	// decode events
+	err = bsonkit.DecodeList(list, out)
+	if err != nil {
+		return err
+	}
+
+	return s.Close(ctx)
+}
+
 // Close implements the IChangeStream.Close method.
 func (s *Stream) Close(context.Context) error {
 	// acquire mutex
@@ -134,6 +182,12 @@ func (s *Stream) ResumeToken() bson.Raw {
 // SetBatchSize implements the IChangeStream.SetBatchSize method.
 func (s *Stream) SetBatchSize(int32) {}
 
+// SetComment implements the ICursor.SetComment method.
+func (s *Stream) SetComment(interface{}) {}
+
+// SetMaxTime implements the ICursor.SetMaxTime method.
+func (s *Stream) SetMaxTime(time.Duration) {}
+
 // TryNext implements the IChangeStream.TryNext method.
 func (s *Stream) TryNext(ctx context.Context) bool {
 	return s.next(ctx, false)
@@ -210,14 +264,47 @@ func (s *Stream) next(ctx context.Context, block bool) bool {
 				continue
 			}
 
-			// check drop and drop database
-			if s.handle[0] != "" && s.handle[1] != "" && opType == "drop" {
+			// check drop, rename and drop database
+			if s.handle[0] != "" && s.handle[1] != "" && (opType == "drop" || opType == "rename") {
 				s.dropped = true
 			} else if s.handle[0] != "" && opType == "dropDatabase" {
 				s.dropped = true
 			}
 
-			// TODO: Filter with pipeline.
+			// filter event
+			if len(s.pipeline) > 0 {
+				res, err := mongokit.Aggregate(bsonkit.List{bsonkit.Clone(event)}, s.pipeline, nil)
+				if err != nil {
+					s.cancel()
+					s.closed = true
+					s.error = err
+					s.mutex.Unlock()
+					return false
+				}
+
+				// skip filtered events
+				if len(res) == 0 {
+					s.last = event
+					s.mutex.Unlock()
+					continue
+				}
+
+				// check token
+				if bsonkit.Compare(bsonkit.Get(res[0], "_id"), token) != 0 {
+					s.cancel()
+					s.closed = true
+					s.error = ErrModifiedResumeToken
+					s.mutex.Unlock()
+					return false
+				}
+
+				// set event and token
+				s.last = event
+				s.event = res[0]
+				s.token = token
+				s.mutex.Unlock()
+				return true
+			}
 
 			// set event and token
 			s.last = event
@@ -263,3 +350,52 @@ func (s *Stream) next(ctx context.Context, block bool) bool {
 		}
 	}
 }
+
+// batch will return up to the specified number of available events. If no
+// events are available, it will wait for new events up to the specified
+// duration. A size of zero returns all available events.
+func (s *Stream) batch(ctx context.Context, size int, wait time.Duration) (bsonkit.List, error) {
+	// get deadline
+	deadline := time.Now().Add(wait)
+
+	for {
+		// collect available events
+		var list bsonkit.List
+		for (size <= 0 || len(list) < size) && s.next(ctx, false) {
+			s.mutex.Lock()
+			list = append(list, s.event)
+			s.mutex.Unlock()
+		}
+
+		// get state
+		s.mutex.Lock()
+		signal := s.signal
+		closed := s.closed
+		err := s.error
+		s.mutex.Unlock()
+
+		// check result
+		remaining := time.Until(deadline)
+		if len(list) > 0 || closed || err != nil || remaining <= 0 {
+			return list, err
+		}
+
+		// await signal
+		timer := time.NewTimer(remaining)
+		select {
+		case <-signal:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+}
+
+// alive returns whether the stream may yield more events.
+func (s *Stream) alive() bool {
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return !s.closed && s.error == nil
+}
@@ -574,6 +574,198 @@ func TestStreamArrayChanges(t *testing.T) {
 	})
 }
 
+func TestStreamPipeline(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		stream, err := c.Watch(nil, bson.A{
+			bson.M{"$match": bson.M{"fullDocument.foo": "bar"}},
+			bson.M{"$project": bson.M{"operationType": 1, "foo": "$fullDocument.foo"}},
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, stream)
+
+		_, err = c.InsertMany(nil, []interface{}{
+			bson.M{"foo": "baz"},
+			bson.M{"foo": "bar"},
+		})
+		assert.NoError(t, err)
+
+		ret := stream.Next(nil)
+		assert.True(t, ret)
+
+		var event bson.M
+		err = stream.Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{
+			"_id":           event["_id"],
+			"operationType": "insert",
+			"foo":           "bar",
+		}, event)
+
+		ret = stream.TryNext(nil)
+		assert.False(t, ret)
+		assert.NoError(t, stream.Err())
+
+		err = stream.Close(nil)
+		assert.NoError(t, err)
+
+		// modified resume token
+		stream, err = c.Watch(nil, bson.A{
+			bson.M{"$project": bson.M{"_id": 0}},
+		})
+		assert.NoError(t, err)
+
+		_, err = c.InsertOne(nil, bson.M{"foo": "bar"})
+		assert.NoError(t, err)
+
+		ret = stream.Next(nil)
+		assert.False(t, ret)
+		assert.Error(t, stream.Err())
+
+		// unsupported stage
+		_, err = c.Watch(nil, bson.A{
+			bson.M{"$group": bson.M{"_id": nil}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestStreamAggregate(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		stream, err := c.Watch(nil, bson.A{})
+		assert.NoError(t, err)
+
+		_, err = c.InsertOne(nil, bson.M{"foo": "bar"})
+		assert.NoError(t, err)
+
+		// first event
+		assert.True(t, stream.Next(nil))
+		token := stream.ResumeToken()
+		assert.NoError(t, stream.Close(nil))
+
+		_, err = c.InsertOne(nil, bson.M{"foo": "baz"})
+		assert.NoError(t, err)
+
+		_, err = c.InsertOne(nil, bson.M{"foo": "qux"})
+		assert.NoError(t, err)
+
+		// collection
+		csr, err := c.Aggregate(nil, bson.A{
+			bson.M{"$changeStream": bson.M{"resumeAfter": token}},
+			bson.M{"$match": bson.M{"fullDocument.foo": "qux"}},
+			bson.M{"$project": bson.M{"operationType": 1, "foo": "$fullDocument.foo"}},
+		})
+		assert.NoError(t, err)
+
+		ret := csr.Next(nil)
+		assert.True(t, ret)
+
+		var event bson.M
+		err = csr.Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{
+			"_id":           event["_id"],
+			"operationType": "insert",
+			"foo":           "qux",
+		}, event)
+
+		ret = csr.TryNext(nil)
+		assert.False(t, ret)
+		assert.NoError(t, csr.Err())
+
+		err = csr.Close(nil)
+		assert.NoError(t, err)
+
+		// database
+		csr, err = c.Database().Aggregate(nil, bson.A{
+			bson.M{"$changeStream": bson.M{"resumeAfter": token}},
+			bson.M{"$match": bson.M{"ns.coll": c.Name()}},
+			bson.M{"$project": bson.M{"foo": "$fullDocument.foo"}},
+		})
+		assert.NoError(t, err)
+
+		var foos []string
+		for i := 0; i < 2 && csr.Next(nil); i++ {
+			err = csr.Decode(&event)
+			assert.NoError(t, err)
+			foos = append(foos, event["foo"].(string))
+		}
+		assert.Equal(t, []string{"baz", "qux"}, foos)
+
+		err = csr.Close(nil)
+		assert.NoError(t, err)
+
+		// cluster
+		csr, err = c.Database().Client().Database("admin").Aggregate(nil, bson.A{
+			bson.M{"$changeStream": bson.M{"allChangesForCluster": true, "resumeAfter": token}},
+			bson.M{"$match": bson.M{"ns.db": c.Database().Name(), "ns.coll": c.Name()}},
+		})
+		assert.NoError(t, err)
+
+		ret = csr.Next(nil)
+		assert.True(t, ret)
+
+		err = csr.Close(nil)
+		assert.NoError(t, err)
+
+		// misplaced stage
+		_, err = c.Aggregate(nil, bson.A{
+			bson.M{"$match": bson.M{}},
+			bson.M{"$changeStream": bson.M{}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestStreamPipelineUpdate(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		id := primitive.NewObjectID()
+
+		_, err := c.InsertOne(nil, bson.M{
+			"_id": id,
+			"foo": bson.M{
+				"bar": int32(1),
+				"baz": int32(2),
+			},
+			"qux": "quz",
+		})
+		assert.NoError(t, err)
+
+		stream, err := c.Watch(nil, bson.A{})
+		assert.NoError(t, err)
+		assert.NotNil(t, stream)
+
+		_, err = c.UpdateOne(nil, bson.M{
+			"_id": id,
+		}, bson.A{
+			bson.M{"$set": bson.M{
+				"foo.bar": bson.M{"$add": bson.A{"$foo.bar", int32(1)}},
+			}},
+			bson.M{"$unset": "qux"},
+		})
+		assert.NoError(t, err)
+
+		ret := stream.Next(nil)
+		assert.True(t, ret)
+
+		var event bson.M
+		err = stream.Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, "update", event["operationType"])
+		assert.Equal(t, bson.M{
+			"updatedFields": bson.M{
+				"foo.bar": int32(2),
+			},
+			"removedFields": bson.A{
+				"qux",
+			},
+			"truncatedArrays": bson.A{},
+		}, event["updateDescription"])
+
+		err = stream.Close(nil)
+		assert.NoError(t, err)
+	})
+}
+
 func TestStreamAsync(t *testing.T) {
 	collectionTest(t, func(t *testing.T, c ICollection) {
 		stream, err := c.Watch(nil, bson.A{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
@@ -899,6 +1091,64 @@ func TestStreamInvalidationCollection(t *testing.T) {
 	})
 }
 
+func TestStreamInvalidationRename(t *testing.T) {
+	collectionTest(t, func(t *testing.T, c ICollection) {
+		_, err := c.InsertOne(nil, bson.M{})
+		assert.NoError(t, err)
+
+		stream, err := c.Watch(nil, bson.A{})
+		assert.NoError(t, err)
+		assert.NotNil(t, stream)
+
+		/* rename */
+
+		target := collectionName()
+		err = c.Database().Client().Database("admin").RunCommand(nil, bson.D{
+			{Key: "renameCollection", Value: c.Database().Name() + "." + c.Name()},
+			{Key: "to", Value: c.Database().Name() + "." + target},
+		}).Err()
+		assert.NoError(t, err)
+
+		ret := stream.Next(nil)
+		assert.True(t, ret)
+
+		var event bson.M
+		err = stream.Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{
+			"_id":         event["_id"],
+			"clusterTime": event["clusterTime"],
+			"wallTime":    event["wallTime"],
+			"ns": bson.M{
+				"db":   c.Database().Name(),
+				"coll": c.Name(),
+			},
+			"to": bson.M{
+				"db":   c.Database().Name(),
+				"coll": target,
+			},
+			"operationType": "rename",
+		}, event)
+
+		/* invalidate */
+
+		ret = stream.Next(nil)
+		assert.True(t, ret)
+
+		event = nil
+		err = stream.Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, "invalidate", event["operationType"])
+
+		ret = stream.Next(nil)
+		assert.False(t, ret)
+		assert.NoError(t, stream.Err())
+
+		err = stream.Close(nil)
+		assert.NoError(t, err)
+	})
+}
+
 // A collection-scoped change stream must invalidate when its containing
 // database is dropped. The dropDatabase oplog event carries only ns.db (no
 // ns.coll), so the stream filter previously rejected it and the stream waited
@@ -50,6 +50,9 @@ type Operation struct {
 	// The insert, update or replacement document.
 	Document bsonkit.Doc
 
+	// The update pipeline used instead of the update document (update).
+	Pipeline *mongokit.UpdatePipeline
+
 	// The sorting to apply (replace, update, delete).
 	Sort bsonkit.Doc
 
@@ -84,6 +87,7 @@ type Result struct {
 // Transaction buffers multiple changes to a catalog.
 type Transaction struct {
 	catalog *Catalog
+	engine  *Engine
 	dirty   bool
 	mutex   sync.RWMutex
 }
@@ -109,7 +113,7 @@ func (t *Transaction) Create(handle Handle) error {
 
 	// check access
 	if handle[0] == Local {
-		return fmt.Errorf("namespace local.* is read only")
+		return mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// check catalog
@@ -155,6 +159,157 @@ func (t *Transaction) Find(handle Handle, query, sort bsonkit.Doc, skip, limit i
 	}, nil
 }
 
+// Aggregate will run the specified aggregation pipeline on the documents of
+// the namespace and return the resulting documents. Other namespaces referenced
+// by the pipeline are read from the same transaction. If the pipeline ends
+// with a $out or $merge stage, the resulting changes are applied to the target
+// namespace and logged to the oplog. A handle without a collection may be used
+// for pipelines that start with a collectionless stage like $documents.
+func (t *Transaction) Aggregate(handle Handle, pipeline bsonkit.List, variables bsonkit.Doc) (bsonkit.List, error) {
+	// acquire write lock if the pipeline writes or read lock otherwise
+	write := mongokit.HasOutputStage(pipeline)
+	if write {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+	} else {
+		t.mutex.RLock()
+		defer t.mutex.RUnlock()
+	}
+
+	// validate handle
+	err := handle.Validate(false)
+	if err != nil {
+		return nil, err
+	}
+
+	// check collectionless pipelines
+	if handle[1] == "" && !mongokit.IsCollectionless(pipeline) {
+		var name string
+		if len(pipeline) > 0 && len(*pipeline[0]) > 0 {
+			name = (*pipeline[0])[0].Key
+		}
+		return nil, fmt.Errorf("{aggregate: 1} is not valid for '%s'; a collection is required", name)
+	}
+
+	// evaluate variables
+	vars, err := mongokit.EvaluateVariables(variables)
+	if err != nil {
+		return nil, err
+	}
+
+	// get documents
+	var list bsonkit.List
+	collection := t.catalog.Namespaces[handle]
+	if collection != nil {
+		list = collection.Documents.List
+	}
+
+	// prepare resolver
+	resolve := func(db, coll string) (Handle, error) {
+		if db == "" {
+			db = handle[0]
+		}
+		other := Handle{db, coll}
+		return other, other.Validate(true)
+	}
+
+	// prepare aggregation
+	agg := &mongokit.Aggregation{
+		Variables: vars,
+		Lookup: func(db, coll string) (*mongokit.Collection, error) {
+			// resolve handle
+			other, err := resolve(db, coll)
+			if err != nil {
+				return nil, err
+			}
+
+			return t.catalog.Namespaces[other], nil
+		},
+		Namespace:  handle.String(),
+		Collection: collection,
+	}
+
+	// provide engine random and diagnostics
+	if t.engine != nil {
+		agg.Random = t.engine.random
+		agg.Latency = func() bsonkit.Doc {
+			return t.engine.latencyStats(handle)
+		}
+		agg.Operations = func() (bsonkit.List, error) {
+			if handle[0] != "admin" || handle[1] != "" {
+				return nil, fmt.Errorf("$currentOp must be run against the 'admin' database with {aggregate: 1}")
+			}
+			return t.engine.currentOps(), nil
+		}
+		agg.Sessions = func() (bsonkit.List, error) {
+			return t.engine.localSessions(), nil
+		}
+	}
+
+	// prepare writing
+	var clone *Catalog
+	written := map[Handle]bool{}
+	if write {
+		// clone catalog
+		clone = t.catalog.Clone()
+
+		// clone oplog
+		oplog := clone.Namespaces[Oplog].Clone()
+		clone.Namespaces[Oplog] = oplog
+
+		// provide writable namespaces
+		agg.Output = func(db, coll string) (*mongokit.Collection, error) {
+			// resolve handle
+			other, err := resolve(db, coll)
+			if err != nil {
+				return nil, err
+			}
+
+			// check access
+			if other[0] == Local {
+				return nil, mongokit.IllegalOperation.Errorf("namespace local.* is read only")
+			}
+
+			// create or clone namespace
+			if !written[other] {
+				if clone.Namespaces[other] == nil {
+					clone.Namespaces[other] = mongokit.NewCollection(true)
+				} else {
+					clone.Namespaces[other] = clone.Namespaces[other].Clone()
+				}
+				written[other] = true
+			}
+
+			return clone.Namespaces[other], nil
+		}
+
+		// log changes
+		agg.Record = func(db, coll, op string, doc bsonkit.Doc, changes *mongokit.Changes) error {
+			// resolve handle
+			other, err := resolve(db, coll)
+			if err != nil {
+				return err
+			}
+
+			return t.append(oplog, other, op, doc, changes)
+		}
+	}
+
+	// run pipeline
+	list, err = mongokit.Aggregate(list, pipeline, agg)
+	if err != nil {
+		return nil, err
+	}
+
+	// set catalog and flag
+	if len(written) > 0 {
+		t.catalog = clone
+		t.dirty = true
+	}
+
+	return list, nil
+}
+
 // Bulk performs the specified operations in one go. If ordered is true the
 // process is aborted on the first error.
 func (t *Transaction) Bulk(handle Handle, ops []Operation, ordered bool) ([]Result, error) {
@@ -170,7 +325,7 @@ func (t *Transaction) Bulk(handle Handle, ops []Operation, ordered bool) ([]Resu
 
 	// check access
 	if handle[0] == Local {
-		return nil, fmt.Errorf("namespace local.* is read only")
+		return nil, mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// clone catalog
@@ -207,7 +362,11 @@ func (t *Transaction) Bulk(handle Handle, ops []Operation, ordered bool) ([]Resu
 		case Replace:
 			res, err = t.replace(handle, oplog, namespace, op.Filter, op.Document, op.Sort, op.Upsert)
 		case Update:
-			res, err = t.update(handle, oplog, namespace, op.Filter, op.Document, op.Sort, op.Upsert, op.Skip, op.Limit, op.ArrayFilters)
+			var update interface{} = op.Document
+			if op.Pipeline != nil {
+				update = op.Pipeline
+			}
+			res, err = t.update(handle, oplog, namespace, op.Filter, update, op.Sort, op.Upsert, op.Skip, op.Limit, op.ArrayFilters)
 		case Delete:
 			res, err = t.delete(handle, oplog, namespace, op.Filter, op.Sort, op.Skip, op.Limit)
 		default:
@@ -272,7 +431,7 @@ func (t *Transaction) Insert(handle Handle, list bsonkit.List, ordered bool) (*R
 
 	// check access
 	if handle[0] == Local {
-		return nil, fmt.Errorf("namespace local.* is read only")
+		return nil, mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// clone list
@@ -366,7 +525,7 @@ func (t *Transaction) Replace(handle Handle, query, sort, repl bsonkit.Doc, upse
 
 	// check access
 	if handle[0] == Local {
-		return nil, fmt.Errorf("namespace local.* is read only")
+		return nil, mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// check namespace
@@ -453,8 +612,9 @@ func (t *Transaction) replace(handle Handle, oplog, namespace *mongokit.Collecti
 // may be supplied to modify the result. If upsert is enabled, it will extract
 // constant parts of the query and apply the update and insert the document if
 // it is missing. The returned result will contain the matched and modified or
-// upserted document.
-func (t *Transaction) Update(handle Handle, query, sort, update bsonkit.Doc, skip, limit int, upsert bool, arrayFilters bsonkit.List) (*Result, error) {
+// upserted document. The update may either be an update document or an
+// update pipeline (*mongokit.UpdatePipeline).
+func (t *Transaction) Update(handle Handle, query, sort bsonkit.Doc, update interface{}, skip, limit int, upsert bool, arrayFilters bsonkit.List) (*Result, error) {
 	// acquire write lock
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
@@ -467,7 +627,7 @@ func (t *Transaction) Update(handle Handle, query, sort, update bsonkit.Doc, ski
 
 	// check access
 	if handle[0] == Local {
-		return nil, fmt.Errorf("namespace local.* is read only")
+		return nil, mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// check namespace
@@ -507,7 +667,7 @@ func (t *Transaction) Update(handle Handle, query, sort, update bsonkit.Doc, ski
 	return res, nil
 }
 
-func (t *Transaction) update(handle Handle, oplog, namespace *mongokit.Collection, query, update, sort bsonkit.Doc, upsert bool, skip, limit int, arrayFilters bsonkit.List) (*Result, error) {
+func (t *Transaction) update(handle Handle, oplog, namespace *mongokit.Collection, query bsonkit.Doc, update interface{}, sort bsonkit.Doc, upsert bool, skip, limit int, arrayFilters bsonkit.List) (*Result, error) {
 	// perform update
 	res, err := namespace.Update(query, update, sort, skip, limit, arrayFilters)
 	if err != nil {
@@ -563,7 +723,7 @@ func (t *Transaction) Delete(handle Handle, query, sort bsonkit.Doc, skip, limit
 
 	// check access
 	if handle[0] == Local {
-		return nil, fmt.Errorf("namespace local.* is read only")
+		return nil, mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// check namespace
@@ -633,7 +793,7 @@ func (t *Transaction) Drop(handle Handle) error {
 
 	// check access
 	if handle[0] == Local {
-		return fmt.Errorf("namespace local.* is read only")
+		return mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// clone catalog
@@ -678,6 +838,82 @@ func (t *Transaction) Drop(handle Handle) error {
 	return nil
 }
 
+// Rename will move the documents and indexes of the source namespace to the
+// target namespace, which may be located in a different database. If the
+// target namespace exists, it is dropped if dropTarget is true. Otherwise, an
+// error is returned.
+func (t *Transaction) Rename(from, to Handle, dropTarget bool) error {
+	// acquire write lock
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// validate handles
+	err := from.Validate(true)
+	if err != nil {
+		return err
+	}
+	err = to.Validate(true)
+	if err != nil {
+		return err
+	}
+
+	// check access
+	if from[0] == Local || to[0] == Local {
+		return mongokit.IllegalOperation.Errorf("namespace local.* is read only")
+	}
+
+	// check handles
+	if from == to {
+		return mongokit.IllegalOperation.Errorf("cannot rename namespace %q to itself", from.String())
+	}
+
+	// check source
+	namespace := t.catalog.Namespaces[from]
+	if namespace == nil {
+		return mongokit.NamespaceNotFound.Errorf("source namespace %q does not exist", from.String())
+	}
+
+	// check target
+	if t.catalog.Namespaces[to] != nil && !dropTarget {
+		return mongokit.NamespaceExists.Errorf("target namespace %q exists", to.String())
+	}
+
+	// clone catalog
+	clone := t.catalog.Clone()
+
+	// clone oplog
+	oplog := clone.Namespaces[Oplog].Clone()
+	clone.Namespaces[Oplog] = oplog
+
+	// drop target
+	if clone.Namespaces[to] != nil {
+		delete(clone.Namespaces, to)
+		err = t.append(oplog, to, "drop", nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// move namespace
+	delete(clone.Namespaces, from)
+	clone.Namespaces[to] = namespace
+
+	// append oplog
+	err = t.append(oplog, from, "rename", &bson.D{
+		bson.E{Key: "db", Value: to[0]},
+		bson.E{Key: "coll", Value: to[1]},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	// set catalog and flag
+	t.catalog = clone
+	t.dirty = true
+
+	return nil
+}
+
 func (t *Transaction) append(oplog *mongokit.Collection, handle Handle, op string, doc bsonkit.Doc, changes *mongokit.Changes) error {
 	// get time
 	now := bsonkit.Now()
@@ -699,8 +935,10 @@ func (t *Transaction) append(oplog *mongokit.Collection, handle Handle, op strin
 		"operationType": op,
 	}
 
-	// add document info
-	if doc != nil {
+	// add target namespace or document info
+	if op == "rename" {
+		event["to"] = *doc
+	} else if doc != nil {
 		// add document key
 		event["documentKey"] = bson.M{
 			"_id": bsonkit.Get(doc, "_id"),
@@ -757,18 +995,20 @@ func (t *Transaction) ListDatabases(query bsonkit.Doc) (bsonkit.List, error) {
 	// prepare list
 	var list bsonkit.List
 	for name, nss := range sort {
-		// check emptiness
+		// check emptiness and sum size
 		empty := true
+		var size int64
 		for _, ns := range nss {
 			if len(ns.Documents.List) > 0 {
 				empty = false
 			}
+			size += ns.Size() + ns.IndexSize()
 		}
 
 		// add specification
 		list = append(list, &bson.D{
 			bson.E{Key: "name", Value: name},
-			bson.E{Key: "sizeOnDisk", Value: 0},
+			bson.E{Key: "sizeOnDisk", Value: size},
 			bson.E{Key: "empty", Value: empty},
 		})
 	}
@@ -931,7 +1171,7 @@ func (t *Transaction) CreateIndex(handle Handle, name string, config mongokit.In
 
 	// check access
 	if handle[0] == Local {
-		return "", fmt.Errorf("namespace local.* is read only")
+		return "", mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// clone catalog
@@ -974,12 +1214,12 @@ func (t *Transaction) DropIndex(handle Handle, name string) error {
 
 	// check access
 	if handle[0] == Local {
-		return fmt.Errorf("namespace local.* is read only")
+		return mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// check namespace
 	if t.catalog.Namespaces[handle] == nil {
-		return fmt.Errorf("missing namespace %q", handle.String())
+		return mongokit.NamespaceNotFound.Errorf("missing namespace %q", handle.String())
 	}
 
 	// clone catalog
@@ -1019,12 +1259,12 @@ func (t *Transaction) DropIndexByKey(handle Handle, key bsonkit.Doc) error {
 
 	// check access
 	if handle[0] == Local {
-		return fmt.Errorf("namespace local.* is read only")
+		return mongokit.IllegalOperation.Errorf("namespace local.* is read only")
 	}
 
 	// check namespace
 	if t.catalog.Namespaces[handle] == nil {
-		return fmt.Errorf("missing namespace %q", handle.String())
+		return mongokit.NamespaceNotFound.Errorf("missing namespace %q", handle.String())
 	}
 
 	// find index by key
@@ -1036,7 +1276,7 @@ func (t *Transaction) DropIndexByKey(handle Handle, key bsonkit.Doc) error {
 		}
 	}
 	if name == "" {
-		return fmt.Errorf("missing index for key")
+		return mongokit.IndexNotFound.Errorf("missing index for key")
 	}
 
 	// clone catalog
@@ -1125,9 +1365,10 @@ func (t *Transaction) Clean(minSize, maxSize int, minAge, maxAge time.Duration)
 		dropped++
 	}
 
-	// remove the prefix in one pass
-	for i := 0; i < dropped; i++ {
-		oplog.Documents.Remove(oplog.Documents.List[0])
+	// remove the prefix (copied as removing mutates the list)
+	err := oplog.Remove(append(bsonkit.List{}, oplog.Documents.List[:dropped]...))
+	if err != nil {
+		panic(err)
 	}
 
 	// set flag
@@ -9,6 +9,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
 )
 
 func TestTransactionOplogCleaningBySize(t *testing.T) {
@@ -140,3 +141,36 @@ func TestTransactionOplogCleaningMultiDrop(t *testing.T) {
 	txn.Clean(0, 1, 0, time.Hour)
 	assert.Len(t, txn.Catalog().Namespaces[Oplog].Documents.List, 1)
 }
+
+func TestTransactionRename(t *testing.T) {
+	txn := NewTransaction(NewCatalog())
+
+	_, err := txn.Insert(Handle{"foo", "bar"}, bsonkit.List{
+		bsonkit.MustConvert(bson.M{"_id": int32(1)}),
+	}, true)
+	assert.NoError(t, err)
+
+	_, err = txn.CreateIndex(Handle{"foo", "bar"}, "", mongokit.IndexConfig{
+		Key: bsonkit.MustConvert(bson.M{"baz": int32(1)}),
+	})
+	assert.NoError(t, err)
+
+	err = txn.Rename(Handle{"foo", "bar"}, Handle{"baz", "qux"}, false)
+	assert.NoError(t, err)
+	assert.Nil(t, txn.Catalog().Namespaces[Handle{"foo", "bar"}])
+	assert.Len(t, txn.Catalog().Namespaces[Handle{"baz", "qux"}].Documents.List, 1)
+	assert.Len(t, txn.Catalog().Namespaces[Handle{"baz", "qux"}].Indexes, 2)
+
+	oplog := txn.Catalog().Namespaces[Oplog].Documents.List
+	event := oplog[len(oplog)-1]
+	assert.Equal(t, "rename", bsonkit.Get(event, "operationType"))
+	assert.Equal(t, "bar", bsonkit.Get(event, "ns.coll"))
+	assert.Equal(t, "baz", bsonkit.Get(event, "to.db"))
+	assert.Equal(t, "qux", bsonkit.Get(event, "to.coll"))
+
+	err = txn.Rename(Handle{"foo", "bar"}, Handle{"baz", "quz"}, false)
+	assert.Error(t, err)
+
+	err = txn.Rename(Handle{"baz", "qux"}, Handle{"local", "qux"}, false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package lungo
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/xdg-go/scram"
+	"github.com/xdg-go/stringprep"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/256dpi/lungo/bsonkit"
+)
+
+// ErrUnauthorized is returned if a command is run without the required roles.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Users is the handle for the namespace that stores the users.
+var Users = Handle{"admin", "system.users"}
+
+// The supported authentication mechanisms.
+const (
+	ScramSHA1   = "SCRAM-SHA-1"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+// the iteration counts and salt lengths used for new credentials
+var scramParams = map[string][2]int{
+	ScramSHA1:   {10000, 16},
+	ScramSHA256: {15000, 28},
+}
+
+// Role is a built-in role granted on a database. The available roles are
+// "read", "readWrite", "dbAdmin" and "root", which may only be granted on the
+// "admin" database and applies to all databases.
+type Role struct {
+	Role string `bson:"role"`
+	DB   string `bson:"db"`
+}
+
+// Credential holds the stored SCRAM credential of a user. The salt and keys
+// are base64 encoded.
+type Credential struct {
+	IterationCount int    `bson:"iterationCount"`
+	Salt           string `bson:"salt"`
+	StoredKey      string `bson:"storedKey"`
+	ServerKey      string `bson:"serverKey"`
+}
+
+// Credentials holds the stored credentials per mechanism.
+type Credentials struct {
+	SHA1   *Credential `bson:"SCRAM-SHA-1,omitempty"`
+	SHA256 *Credential `bson:"SCRAM-SHA-256,omitempty"`
+}
+
+// Get will return the credential for the specified mechanism, if available.
+func (c Credentials) Get(mechanism string) *Credential {
+	switch mechanism {
+	case ScramSHA1:
+		return c.SHA1
+	case ScramSHA256:
+		return c.SHA256
+	default:
+		return nil
+	}
+}
+
+// Mechanisms returns the mechanisms that have credentials.
+func (c Credentials) Mechanisms() []string {
+	var list []string
+	if c.SHA1 != nil {
+		list = append(list, ScramSHA1)
+	}
+	if c.SHA256 != nil {
+		list = append(list, ScramSHA256)
+	}
+	return list
+}
+
+// User is a user stored in the admin.system.users namespace.
+type User struct {
+	ID          string           `bson:"_id"`
+	UserID      primitive.Binary `bson:"userId"`
+	Name        string           `bson:"user"`
+	DB          string           `bson:"db"`
+	Credentials Credentials      `bson:"credentials"`
+	Roles       []Role           `bson:"roles"`
+	CustomData  bson.D           `bson:"customData,omitempty"`
+}
+
+// NewCredential will create a credential for the specified mechanism, user
+// and password using a random salt.
+func NewCredential(mechanism, user, password string) (*Credential, error) {
+	// get parameters
+	params, ok := scramParams[mechanism]
+	if !ok {
+		return nil, fmt.Errorf("unsupported mechanism: %s", mechanism)
+	}
+
+	// generate salt
+	salt := make([]byte, params[1])
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare client
+	var client *scram.Client
+	switch mechanism {
+	case ScramSHA1:
+		// SCRAM-SHA-1 uses the legacy password digest
+		digest := md5.New()
+		_, _ = io.WriteString(digest, user+":mongo:"+password)
+		client, err = scram.SHA1.NewClientUnprepped(user, fmt.Sprintf("%x", digest.Sum(nil)), "")
+	case ScramSHA256:
+		// SCRAM-SHA-256 uses the prepared password
+		password, err = stringprep.SASLprep.Prepare(password)
+		if err != nil {
+			return nil, err
+		}
+		client, err = scram.SHA256.NewClientUnprepped(user, password, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// compute credentials
+	creds := client.GetStoredCredentials(scram.KeyFactors{
+		Salt:  string(salt),
+		Iters: params[0],
+	})
+
+	return &Credential{
+		IterationCount: params[0],
+		Salt:           base64.StdEncoding.EncodeToString(salt),
+		StoredKey:      base64.StdEncoding.EncodeToString(creds.StoredKey),
+		ServerKey:      base64.StdEncoding.EncodeToString(creds.ServerKey),
+	}, nil
+}
+
+// Stored will return the decoded credential.
+func (c *Credential) Stored() (scram.StoredCredentials, error) {
+	// decode salt and keys
+	salt, err := base64.StdEncoding.DecodeString(c.Salt)
+	if err != nil {
+		return scram.StoredCredentials{}, err
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(c.StoredKey)
+	if err != nil {
+		return scram.StoredCredentials{}, err
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(c.ServerKey)
+	if err != nil {
+		return scram.StoredCredentials{}, err
+	}
+
+	return scram.StoredCredentials{
+		KeyFactors: scram.KeyFactors{
+			Salt:  string(salt),
+			Iters: c.IterationCount,
+		},
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+	}, nil
+}
+
+// ListUsers will return the users of the specified database or all users if
+// the database is empty.
+func (e *Engine) ListUsers(db string) ([]User, error) {
+	return listUsers(e.Catalog(), db)
+}
+
+// User will return the specified user or nil if the user does not exist.
+func (e *Engine) User(db, name string) (*User, error) {
+	return findUser(e.Catalog(), db, name)
+}
+
+func listUsers(catalog *Catalog, db string) ([]User, error) {
+	// get namespace
+	namespace := catalog.Namespaces[Users]
+	if namespace == nil {
+		return nil, nil
+	}
+
+	// decode users
+	var users []User
+	for _, doc := range namespace.Documents.List {
+		var user User
+		err := bsonkit.Decode(doc, &user)
+		if err != nil {
+			return nil, err
+		}
+		if db == "" || user.DB == db {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func findUser(catalog *Catalog, db, name string) (*User, error) {
+	// get namespace
+	namespace := catalog.Namespaces[Users]
+	if namespace == nil {
+		return nil, nil
+	}
+
+	// find user
+	res, err := namespace.Find(bsonkit.MustConvert(bson.M{"_id": db + "." + name}), nil, 0, 1)
+	if err != nil || len(res.Matched) == 0 {
+		return nil, err
+	}
+
+	// decode user
+	var user User
+	err = bsonkit.Decode(res.Matched[0], &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -6,7 +6,12 @@ import (
 	"reflect"
 	"strings"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
 	"github.com/256dpi/lungo/bsonkit"
+	"github.com/256dpi/lungo/mongokit"
 )
 
 const (
@@ -45,6 +50,132 @@ func assertOptions(opts interface{}, fields map[string]string) {
 	}
 }
 
+// prepareAggregate checks the aggregate options and transforms the pipeline
+// and variables.
+func prepareAggregate(pipeline interface{}, opts []*options.AggregateOptions) (bsonkit.List, bsonkit.Doc, error) {
+	// merge options
+	opt := options.MergeAggregateOptions(opts...)
+
+	// assert supported options
+	assertOptions(opt, map[string]string{
+		"AllowDiskUse":             ignored,
+		"BatchSize":                ignored,
+		"BypassDocumentValidation": ignored,
+		"Comment":                  ignored,
+		"Hint":                     ignored,
+		"Let":                      supported,
+		"MaxAwaitTime":             ignored,
+		"MaxTime":                  ignored,
+	})
+
+	// check pipeline
+	if pipeline == nil {
+		panic("lungo: missing pipeline")
+	}
+
+	// transform pipeline
+	stages, err := bsonkit.TransformList(pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// transform variables
+	var let bsonkit.Doc
+	if opt.Let != nil {
+		let, err = bsonkit.Transform(opt.Let)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return stages, let, nil
+}
+
+// openChangeStream will open a stream if the pipeline starts with a
+// $changeStream stage. The remaining stages are used to filter the events.
+// Events of system namespaces are omitted unless system is set.
+func openChangeStream(engine *Engine, handle Handle, stages bsonkit.List, system bool) (*Stream, bool, error) {
+	// check stages
+	for i, stage := range stages {
+		if len(*stage) > 0 && (*stage)[0].Key == "$changeStream" && i > 0 {
+			return nil, false, fmt.Errorf("$changeStream is only valid as the first stage in a pipeline")
+		}
+	}
+
+	// check first stage
+	if len(stages) == 0 || len(*stages[0]) == 0 || (*stages[0])[0].Key != "$changeStream" {
+		return nil, false, nil
+	}
+
+	// get specification
+	spec, ok := (*stages[0])[0].Value.(bson.D)
+	if !ok {
+		return nil, false, fmt.Errorf("$changeStream: the stage specification must be an object")
+	}
+
+	// get options
+	var cluster bool
+	var resumeAfter, startAfter bsonkit.Doc
+	var startAt *primitive.Timestamp
+	for _, field := range spec {
+		switch field.Key {
+		case "allChangesForCluster":
+			cluster, ok = field.Value.(bool)
+			if !ok {
+				return nil, false, fmt.Errorf("$changeStream: allChangesForCluster must be a boolean")
+			}
+		case "resumeAfter", "startAfter":
+			doc, ok := field.Value.(bson.D)
+			if !ok {
+				return nil, false, fmt.Errorf("$changeStream: %s must be an object", field.Key)
+			}
+			if field.Key == "resumeAfter" {
+				resumeAfter = &doc
+			} else {
+				startAfter = &doc
+			}
+		case "startAtOperationTime":
+			ts, ok := field.Value.(primitive.Timestamp)
+			if !ok {
+				return nil, false, fmt.Errorf("$changeStream: startAtOperationTime must be a timestamp")
+			}
+			startAt = &ts
+		case "fullDocument", "fullDocumentBeforeChange", "showExpandedEvents":
+			// ignored
+		default:
+			return nil, false, fmt.Errorf("$changeStream: unrecognized option '%s'", field.Key)
+		}
+	}
+
+	// check cluster
+	if cluster {
+		if handle != (Handle{"admin"}) {
+			return nil, false, fmt.Errorf("$changeStream: allChangesForCluster may only be set when running on the 'admin' database with {aggregate: 1}")
+		}
+		handle = Handle{}
+	} else if handle[0] == "admin" {
+		return nil, false, fmt.Errorf("$changeStream may not be opened on the internal admin database")
+	}
+
+	// get filter
+	filter := stages[1:]
+	if !system {
+		notSystem := bson.D{{Key: "$not", Value: primitive.Regex{Pattern: `^system\.`}}}
+		filter = append(bsonkit.List{&bson.D{{Key: "$match", Value: bson.D{
+			{Key: "ns.coll", Value: notSystem},
+			{Key: "to.coll", Value: notSystem},
+		}}}}, filter...)
+	}
+
+	// open stream
+	stream, err := engine.Watch(handle, filter, resumeAfter, startAfter, startAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return stream, true, nil
+}
+
 // validateReplacement rejects replacement documents whose first key begins
 // with '$'. The official mongo-driver enforces this client-side because such
 // documents look like update operators and would otherwise be silently stored
@@ -59,6 +190,65 @@ func validateReplacement(doc bsonkit.Doc) error {
 	return nil
 }
 
+// transformFilter transforms the provided filter and binds the specified "let"
+// variables to its $expr expressions.
+func transformFilter(filter, let interface{}) (bsonkit.Doc, error) {
+	// transform filter
+	query, err := bsonkit.Transform(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// check variables
+	if let == nil {
+		return query, nil
+	}
+
+	// transform variables
+	vars, err := bsonkit.Transform(let)
+	if err != nil {
+		return nil, err
+	}
+
+	return mongokit.BindVariables(query, vars)
+}
+
+// transformUpdate transforms the provided update into either an update document
+// or an update pipeline using the specified "let" variables.
+func transformUpdate(update, let interface{}) (interface{}, error) {
+	// transform value
+	doc, err := bsonkit.Transform(bson.M{"v": update})
+	if err != nil {
+		return nil, err
+	}
+
+	// handle update documents
+	if upd, ok := (*doc)[0].Value.(bson.D); ok {
+		return &upd, nil
+	}
+
+	// transform pipeline
+	stages, err := bsonkit.TransformList(update)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare pipeline
+	pipeline := &mongokit.UpdatePipeline{
+		Stages: stages,
+	}
+
+	// transform variables
+	if let != nil {
+		pipeline.Variables, err = bsonkit.Transform(let)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pipeline, nil
+}
+
 func useTransaction(ctx context.Context, engine *Engine, lock bool, fn func(*Transaction) (interface{}, error)) (interface{}, error) {
 	// ensure context
 	ctx = ensureContext(ctx)
@@ -66,7 +256,7 @@ func useTransaction(ctx context.Context, engine *Engine, lock bool, fn func(*Tra
 	// use active transaction from session in context
 	sess, ok := ctx.Value(sessionKey{}).(*Session)
 	if ok {
-		txn := sess.Transaction()
+		txn := sess.use()
 		if txn != nil {
 			return fn(txn)
 		}